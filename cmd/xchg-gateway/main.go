@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/ipoluianov/xchg/xchg"
+	"github.com/ipoluianov/xchg/xchg_http"
+)
+
+// HTTP to xchg gateway
+//
+//	xchg-gateway -listen :8080 -config gateway.json
+//	curl -X POST --data-binary @param.bin http://localhost:8080/call/{address}/{function}?auth=pass
+
+func main() {
+	listen := flag.String("listen", "", "listen address (overrides the config)")
+	configFile := flag.String("config", "", "config file (JSON)")
+	keyFile := flag.String("key", "", "private key file (PEM), created if it does not exist")
+	peerConfigFile := flag.String("peer-config", "", "peer config file (YAML or JSON), XCHG_* environment variables override it")
+	flag.Parse()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+
+	config := xchg_http.DefaultGatewayConfig()
+	var err error
+	if *configFile != "" {
+		config, err = xchg_http.LoadGatewayConfig(*configFile)
+		if err != nil {
+			logger.Fatalln("config:", err)
+		}
+	}
+	if *listen != "" {
+		config.Listen = *listen
+	}
+
+	privateKey, err := xchg.GenerateRSAKey()
+	if *keyFile != "" {
+		privateKey, err = xchg.LoadOrCreateRSAKey(*keyFile)
+	}
+	if err != nil {
+		logger.Fatalln("key:", err)
+	}
+
+	peerConfig, err := xchg.PeerConfigLoad(*peerConfigFile)
+	if err != nil {
+		logger.Fatalln("peer config:", err)
+	}
+	peer, err := xchg.NewPeerWithConfig(privateKey, xchg.NewDefaultLogger(), peerConfig)
+	if err != nil {
+		logger.Fatalln("peer:", err)
+	}
+	err = peer.Start(false)
+	if err != nil {
+		logger.Fatalln("peer:", err)
+	}
+
+	logger.Println("gateway listens", config.Listen)
+	logger.Fatalln(http.ListenAndServe(config.Listen, xchg_http.NewGateway(peer, config)))
+}
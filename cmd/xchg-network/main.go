@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipoluianov/xchg/xchg"
+)
+
+// Network containers of private networks
+//
+// Signing key (net.key - encrypted private key, net.pub - public key):
+//   xchg-network keygen -out net
+//
+// Network: ranges of address prefixes (hex of sha256 of the address) and their routers
+//   xchg-network build -name MyNet -range 0-7=r1.example.com:8084 -range 8-f=r2.example.com:8084 -initial-point https://example.com/network -out network.json
+//
+// Validity period and the keys of the next containers (rotation, 2 of 3 signatures):
+//   xchg-network build ... -not-after 720h -signing-key a.pub -signing-key b.pub -signing-key c.pub -threshold 2
+//
+// Container (zip, -base64 - the content for the initial points), more signatures - cosign:
+//   xchg-network sign -key net.key -network network.json -out network.zip
+//   xchg-network cosign -key b.key -container network.zip
+//   xchg-network verify -pub net.pub network.zip
+//   xchg-network verify -pub a.pub -pub b.pub -pub c.pub -threshold 2 network.zip
+//   xchg-network inspect network.zip
+//   xchg-network diff old.zip new.zip
+//
+// The password is taken from the environment variable XCHG_NETWORK_PASSWORD or asked on stdin.
+// -password is visible in the process list and in the shell history - avoid it.
+
+const passwordEnv = "XCHG_NETWORK_PASSWORD"
+
+type stringList []string
+
+func (c *stringList) String() string {
+	return strings.Join(*c, ",")
+}
+
+func (c *stringList) Set(value string) error {
+	*c = append(*c, value)
+	return nil
+}
+
+func main() {
+	commands := map[string]func(args []string) error{
+		"keygen":  keygen,
+		"build":   build,
+		"sign":    sign,
+		"cosign":  cosign,
+		"verify":  verify,
+		"inspect": inspect,
+		"diff":    diff,
+	}
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Println("usage: xchg-network keygen|build|sign|cosign|verify|inspect|diff [flags]")
+		os.Exit(2)
+	}
+	err := commands[os.Args[1]](os.Args[2:])
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+}
+
+// -password (warning), the environment variable or the line of stdin
+func readPassword(flagValue string) (password string, err error) {
+	if flagValue != "" {
+		fmt.Fprintln(os.Stderr, "warning: -password is visible to other users of the host, use "+passwordEnv)
+		return flagValue, nil
+	}
+	if password = os.Getenv(passwordEnv); password != "" {
+		return
+	}
+	fmt.Fprint(os.Stderr, "password: ")
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	password = strings.TrimRight(line, "\r\n")
+	if password == "" {
+		err = errors.New("no password")
+	}
+	return
+}
+
+func keygen(args []string) (err error) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("out", "network", "files <out>.key (encrypted private key) and <out>.pub (public key)")
+	password := fs.String("password", "", "password of the private key (insecure, use "+passwordEnv+")")
+	fs.Parse(args)
+
+	if *password, err = readPassword(*password); err != nil {
+		return
+	}
+	for _, fileName := range []string{*out + ".key", *out + ".pub"} {
+		if _, err = os.Stat(fileName); err == nil {
+			return errors.New("file exists: " + fileName)
+		}
+	}
+
+	encryptedPrivateKey, publicKey, err := xchg.NetworkContainerCreateKey(*password)
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(*out+".key", []byte(encryptedPrivateKey), 0600)
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(*out+".pub", []byte(publicKey), 0644)
+	if err != nil {
+		return
+	}
+	fmt.Println("public key:", publicKey)
+	return
+}
+
+func build(args []string) (err error) {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	name := fs.String("name", "MainNet", "name of the network")
+	timestamp := fs.Int64("timestamp", time.Now().Unix(), "timestamp (version) of the network")
+	out := fs.String("out", "network.json", "network file")
+	notBefore := fs.String("not-before", "", "start of the validity period (RFC3339 or duration from now)")
+	notAfter := fs.String("not-after", "", "end of the validity period (RFC3339 or duration from now: 720h)")
+	threshold := fs.Int("threshold", 1, "count of -signing-key that must sign the next containers")
+	var ranges stringList
+	var initialPoints stringList
+	var signingKeys stringList
+	fs.Var(&ranges, "range", "prefix or prefixes (0-7, 00-3f) = routers (host:port,host:port)")
+	fs.Var(&initialPoints, "initial-point", "URL of the container of the network")
+	fs.Var(&signingKeys, "signing-key", "public key file of the next containers (key rotation)")
+	fs.Parse(args)
+
+	if len(ranges) == 0 {
+		return errors.New("no -range")
+	}
+
+	network := xchg.NewNetwork()
+	network.Name = *name
+	network.Timestamp = *timestamp
+	network.InitialPoints = append(network.InitialPoints, initialPoints...)
+	network.NotBefore, err = parseTime(*notBefore)
+	if err != nil {
+		return errors.New("wrong -not-before: " + *notBefore)
+	}
+	network.NotAfter, err = parseTime(*notAfter)
+	if err != nil {
+		return errors.New("wrong -not-after: " + *notAfter)
+	}
+	network.SigningKeys, err = readPublicKeys(signingKeys)
+	if err != nil {
+		return
+	}
+	if len(network.SigningKeys) > 0 {
+		keys, errKeys := xchg.NetworkDistinctPublicKeys(network.SigningKeys)
+		if errKeys != nil || *threshold < 1 || *threshold > len(keys) {
+			return errors.New("wrong -threshold")
+		}
+		network.SigningThreshold = *threshold
+	}
+	for _, r := range ranges {
+		parts := strings.SplitN(r, "=", 2)
+		if len(parts) != 2 {
+			return errors.New("wrong -range: " + r)
+		}
+		var prefixes []string
+		prefixes, err = expandPrefixes(parts[0])
+		if err != nil {
+			return errors.New("wrong -range: " + r)
+		}
+		for _, routerHost := range strings.Split(parts[1], ",") {
+			routerHost = strings.TrimSpace(routerHost)
+			if routerHost == "" {
+				continue
+			}
+			for _, prefix := range prefixes {
+				network.AddHostToRange(prefix, routerHost)
+			}
+		}
+	}
+	return network.SaveToFile(*out)
+}
+
+func sign(args []string) (err error) {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	keyFile := fs.String("key", "network.key", "encrypted private key")
+	password := fs.String("password", "", "password of the private key (insecure, use "+passwordEnv+")")
+	networkFile := fs.String("network", "network.json", "network file")
+	out := fs.String("out", "network.zip", "container file")
+	base64Out := fs.Bool("base64", false, "write the container in base64 (the content for the initial points)")
+	fs.Parse(args)
+
+	if *password, err = readPassword(*password); err != nil {
+		return
+	}
+
+	encryptedPrivateKey, err := os.ReadFile(*keyFile)
+	if err != nil {
+		return
+	}
+	network, err := xchg.NewNetworkFromFile(*networkFile)
+	if err != nil {
+		return
+	}
+	container, err := xchg.NetworkContainerMake(network, strings.TrimSpace(string(encryptedPrivateKey)), *password)
+	if err != nil {
+		return
+	}
+	if *base64Out {
+		container = []byte(base64.StdEncoding.EncodeToString(container))
+	}
+	return os.WriteFile(*out, container, 0644)
+}
+
+func cosign(args []string) (err error) {
+	fs := flag.NewFlagSet("cosign", flag.ExitOnError)
+	keyFile := fs.String("key", "network.key", "encrypted private key")
+	password := fs.String("password", "", "password of the private key (insecure, use "+passwordEnv+")")
+	containerFile := fs.String("container", "network.zip", "container file (zip or base64)")
+	out := fs.String("out", "", "result file (default - the container file)")
+	fs.Parse(args)
+
+	if *password, err = readPassword(*password); err != nil {
+		return
+	}
+
+	encryptedPrivateKey, err := os.ReadFile(*keyFile)
+	if err != nil {
+		return
+	}
+	containerBS, err := os.ReadFile(*containerFile)
+	if err != nil {
+		return
+	}
+	isBase64 := !bytes.HasPrefix(containerBS, []byte("PK"))
+	container, err := readContainer(*containerFile)
+	if err != nil {
+		return
+	}
+	container, err = xchg.NetworkContainerAddSignature(container, strings.TrimSpace(string(encryptedPrivateKey)), *password)
+	if err != nil {
+		return
+	}
+	if isBase64 {
+		container = []byte(base64.StdEncoding.EncodeToString(container))
+	}
+	if *out == "" {
+		*out = *containerFile
+	}
+	return os.WriteFile(*out, container, 0644)
+}
+
+func verify(args []string) (err error) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	threshold := fs.Int("threshold", 1, "count of the keys that must sign the container")
+	var publicKeyFiles stringList
+	fs.Var(&publicKeyFiles, "pub", "public key file (default network.pub)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: xchg-network verify -pub network.pub network.zip")
+	}
+	if len(publicKeyFiles) == 0 {
+		publicKeyFiles = append(publicKeyFiles, "network.pub")
+	}
+
+	publicKeys, err := readPublicKeys(publicKeyFiles)
+	if err != nil {
+		return
+	}
+	container, err := readContainer(fs.Arg(0))
+	if err != nil {
+		return
+	}
+	trust, err := xchg.NewNetworkTrust(publicKeys, *threshold, "")
+	if err != nil {
+		return
+	}
+	network, err := trust.Load(container)
+	if err != nil {
+		return errors.New("verification failed: " + err.Error())
+	}
+	fmt.Println("OK", network.Name, network.Timestamp)
+	return
+}
+
+func inspect(args []string) (err error) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: xchg-network inspect network.zip|network.json")
+	}
+
+	network, err := loadNetwork(fs.Arg(0))
+	if err != nil {
+		return
+	}
+	fmt.Println("name:", network.Name)
+	fmt.Println("timestamp:", formatTimestamp(network.Timestamp))
+	if network.NotBefore != 0 {
+		fmt.Println("not before:", formatTimestamp(network.NotBefore))
+	}
+	if network.NotAfter != 0 {
+		fmt.Println("not after:", formatTimestamp(network.NotAfter))
+	}
+	if err = network.CheckValidity(time.Now()); err != nil {
+		fmt.Println("validity:", err)
+		err = nil
+	}
+	for _, signingKey := range network.SigningKeys {
+		fmt.Println("signing key:", signingKey)
+	}
+	if len(network.SigningKeys) > 0 {
+		fmt.Println("signing threshold:", network.SigningThreshold)
+	}
+	for _, initialPoint := range network.InitialPoints {
+		fmt.Println("initial point:", initialPoint)
+	}
+	ranges := networkRanges(network)
+	for _, prefix := range sortedKeys(ranges) {
+		fmt.Println("range", prefix+":", strings.Join(ranges[prefix], ", "))
+	}
+	return
+}
+
+func diff(args []string) (err error) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("usage: xchg-network diff old.zip new.zip")
+	}
+
+	oldNetwork, err := loadNetwork(fs.Arg(0))
+	if err != nil {
+		return
+	}
+	newNetwork, err := loadNetwork(fs.Arg(1))
+	if err != nil {
+		return
+	}
+
+	if oldNetwork.Name != newNetwork.Name {
+		fmt.Println("name:", oldNetwork.Name, "->", newNetwork.Name)
+	}
+	if oldNetwork.Timestamp != newNetwork.Timestamp {
+		fmt.Println("timestamp:", formatTimestamp(oldNetwork.Timestamp), "->", formatTimestamp(newNetwork.Timestamp))
+		if newNetwork.Timestamp <= oldNetwork.Timestamp {
+			fmt.Println("warning: the new network is not newer, peers will not accept it")
+		}
+	}
+	if oldNetwork.NotBefore != newNetwork.NotBefore {
+		fmt.Println("not before:", formatTimestamp(oldNetwork.NotBefore), "->", formatTimestamp(newNetwork.NotBefore))
+	}
+	if oldNetwork.NotAfter != newNetwork.NotAfter {
+		fmt.Println("not after:", formatTimestamp(oldNetwork.NotAfter), "->", formatTimestamp(newNetwork.NotAfter))
+	}
+	diffLists("signing key", oldNetwork.SigningKeys, newNetwork.SigningKeys)
+	if oldNetwork.SigningThreshold != newNetwork.SigningThreshold {
+		fmt.Println("signing threshold:", oldNetwork.SigningThreshold, "->", newNetwork.SigningThreshold)
+	}
+	diffLists("initial point", oldNetwork.InitialPoints, newNetwork.InitialPoints)
+
+	oldRanges := networkRanges(oldNetwork)
+	newRanges := networkRanges(newNetwork)
+	prefixes := make(map[string][]string)
+	for prefix := range oldRanges {
+		prefixes[prefix] = nil
+	}
+	for prefix := range newRanges {
+		prefixes[prefix] = nil
+	}
+	for _, prefix := range sortedKeys(prefixes) {
+		diffLists("range "+prefix+":", oldRanges[prefix], newRanges[prefix])
+	}
+	return
+}
+
+func diffLists(title string, oldList []string, newList []string) {
+	for _, item := range oldList {
+		if !contains(newList, item) {
+			fmt.Println("-", title, item)
+		}
+	}
+	for _, item := range newList {
+		if !contains(oldList, item) {
+			fmt.Println("+", title, item)
+		}
+	}
+}
+
+// Container (zip or base64) or network JSON, the signature is not verified
+func loadNetwork(fileName string) (network *xchg.Network, err error) {
+	bs, err := os.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(bs), []byte("{")) {
+		return xchg.NewNetworkFromBytes(bs)
+	}
+	container, err := readContainer(fileName)
+	if err != nil {
+		return
+	}
+	return xchg.NetworkContainerLoadUnverified(container)
+}
+
+// Zip or base64 of zip
+func readContainer(fileName string) (container []byte, err error) {
+	container, err = os.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+	if !bytes.HasPrefix(container, []byte("PK")) {
+		container, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(container)))
+	}
+	return
+}
+
+// prefix -> hosts
+func networkRanges(network *xchg.Network) map[string][]string {
+	ranges := make(map[string][]string)
+	for _, r := range network.Ranges {
+		for _, h := range r.Hosts {
+			ranges[r.Prefix] = append(ranges[r.Prefix], h.Address)
+		}
+	}
+	return ranges
+}
+
+// "a" -> [a], "0-3" -> [0 1 2 3], "00-1f" -> [00 01 ... 1f]
+func expandPrefixes(prefixRange string) (prefixes []string, err error) {
+	parts := strings.SplitN(strings.ToLower(strings.TrimSpace(prefixRange)), "-", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+	width := len(parts[0])
+	if width == 0 || width > 4 || len(parts[1]) != width {
+		err = errors.New("wrong prefix range")
+		return
+	}
+	from, err := strconv.ParseUint(parts[0], 16, 16)
+	if err != nil {
+		return
+	}
+	to, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return
+	}
+	if from > to {
+		err = errors.New("wrong prefix range")
+		return
+	}
+	for i := from; i <= to; i++ {
+		prefixes = append(prefixes, fmt.Sprintf("%0*x", width, i))
+	}
+	return
+}
+
+func readPublicKeys(fileNames []string) (publicKeys []string, err error) {
+	for _, fileName := range fileNames {
+		var publicKey []byte
+		publicKey, err = os.ReadFile(fileName)
+		if err != nil {
+			return
+		}
+		publicKeys = append(publicKeys, strings.TrimSpace(string(publicKey)))
+	}
+	return
+}
+
+// RFC3339 or duration from now, empty - 0
+func parseTime(value string) (timestamp int64, err error) {
+	if value == "" {
+		return
+	}
+	if duration, errDuration := time.ParseDuration(value); errDuration == nil {
+		timestamp = time.Now().Add(duration).Unix()
+		return
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return
+	}
+	timestamp = t.Unix()
+	return
+}
+
+func formatTimestamp(timestamp int64) string {
+	if timestamp == 0 {
+		return "0"
+	}
+	return fmt.Sprint(timestamp, " (", time.Unix(timestamp, 0).UTC().Format(time.RFC3339), ")")
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(list []string, item string) bool {
+	for _, i := range list {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
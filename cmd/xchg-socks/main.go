@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/ipoluianov/xchg/socks5"
+	"github.com/ipoluianov/xchg/xchg"
+)
+
+// SOCKS5 proxy for xchg addresses
+//
+//	xchg-socks -listen 127.0.0.1:1080 -auth secret
+//	curl --socks5-hostname 127.0.0.1:1080 http://<address>.xchg:80/
+//	ssh -o ProxyCommand='nc -X 5 -x 127.0.0.1:1080 %h %p' user@<address>.xchg
+//
+// The server of the address must run xchg-tunnel server with -port for the ports (and -auth with the same auth data).
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:1080", "listen address")
+	authData := flag.String("auth", "", "auth data for all addresses")
+	keyFile := flag.String("key", "", "private key file (PEM), created if it does not exist")
+	peerConfigFile := flag.String("peer-config", "", "peer config file (YAML or JSON), XCHG_* environment variables override it")
+	flag.Parse()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+
+	privateKey, err := xchg.GenerateRSAKey()
+	if *keyFile != "" {
+		privateKey, err = xchg.LoadOrCreateRSAKey(*keyFile)
+	}
+	if err != nil {
+		logger.Fatalln("key:", err)
+	}
+
+	peerConfig, err := xchg.PeerConfigLoad(*peerConfigFile)
+	if err != nil {
+		logger.Fatalln("peer config:", err)
+	}
+	peer, err := xchg.NewPeerWithConfig(privateKey, xchg.NewDefaultLogger(), peerConfig)
+	if err != nil {
+		logger.Fatalln("peer:", err)
+	}
+	err = peer.Start(false)
+	if err != nil {
+		logger.Fatalln("peer:", err)
+	}
+
+	var config socks5.Config
+	config.Listen = *listen
+	config.DefaultAuthData = *authData
+	server := socks5.NewServer(peer, config, logger)
+	err = server.Start()
+	if err != nil {
+		logger.Fatalln("listen:", err)
+	}
+	logger.Println("socks5 listens", config.Listen)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	<-stop
+	server.Stop()
+	peer.Stop()
+}
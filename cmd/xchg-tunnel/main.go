@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/ipoluianov/xchg/tunnel"
+	"github.com/ipoluianov/xchg/xchg"
+)
+
+// TCP port forwarding through xchg
+//
+// Server (device): forwards connections to local services
+//   xchg-tunnel server -key server.key -tunnel ssh=127.0.0.1:22 -tunnel modbus=127.0.0.1:502 -auth secret
+//
+// A tunnel or -port without -auth (or an allowlist in the config) is refused, -allow-any-client permits it
+//
+// Client: listens local ports and forwards connections to the server
+//   xchg-tunnel client -forward 127.0.0.1:2222=#address/ssh -auth secret
+//
+// Local ports for SOCKS5 clients (xchg-socks): -port 22 -auth secret
+//
+// Per-tunnel allowlists are available in the config file (-config tunnel.json)
+
+type stringList []string
+
+func (c *stringList) String() string {
+	return strings.Join(*c, ",")
+}
+
+func (c *stringList) Set(value string) error {
+	*c = append(*c, value)
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 || (os.Args[1] != "server" && os.Args[1] != "client") {
+		fmt.Println("usage: xchg-tunnel server|client [flags]")
+		os.Exit(2)
+	}
+	mode := os.Args[1]
+
+	fs := flag.NewFlagSet(mode, flag.ExitOnError)
+	keyFile := fs.String("key", "", "private key file (PEM), created if it does not exist")
+	peerConfigFile := fs.String("peer-config", "", "peer config file (YAML or JSON), XCHG_* environment variables override it")
+	configFile := fs.String("config", "", "config file (JSON)")
+	authData := fs.String("auth", "", "auth data (server: allowed for all -tunnel)")
+	allowAnyClient := fs.Bool("allow-any-client", false, "server: tunnels and ports without -auth are available to any client of the network")
+	var tunnels stringList
+	var forwards stringList
+	fs.Var(&tunnels, "tunnel", "server: name=host:port")
+	fs.Var(&forwards, "forward", "client: listen_host:port=#address/service")
+	var ports stringList
+	fs.Var(&ports, "port", "server: local port available for SOCKS5 clients (<address>.xchg:port)")
+	fs.Parse(os.Args[2:])
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+
+	var config tunnel.Config
+	var err error
+	if *configFile != "" {
+		config, err = tunnel.LoadConfig(*configFile)
+		if err != nil {
+			logger.Fatalln("config:", err)
+		}
+	}
+
+	for _, t := range tunnels {
+		parts := strings.SplitN(t, "=", 2)
+		if len(parts) != 2 {
+			logger.Fatalln("wrong -tunnel:", t)
+		}
+		tunnelConfig := tunnel.TunnelConfig{Name: parts[0], Target: parts[1]}
+		if *authData != "" {
+			tunnelConfig.AllowedAuthData = []string{*authData}
+		}
+		config.Server.Tunnels = append(config.Server.Tunnels, tunnelConfig)
+	}
+
+	if *allowAnyClient {
+		config.Server.AllowAnyClient = true
+	}
+
+	for _, p := range ports {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			logger.Fatalln("wrong -port:", p)
+		}
+		config.Server.AllowedPorts = append(config.Server.AllowedPorts, port)
+	}
+	if len(ports) > 0 && *authData != "" {
+		config.Server.PortsAllowedAuthData = append(config.Server.PortsAllowedAuthData, *authData)
+	}
+
+	for _, f := range forwards {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 {
+			logger.Fatalln("wrong -forward:", f)
+		}
+		forwardConfig := tunnel.ForwardConfig{Listen: parts[0], Address: parts[1], AuthData: *authData}
+		if i := strings.Index(parts[1], "/"); i >= 0 {
+			forwardConfig.Address = parts[1][:i]
+			forwardConfig.Service = parts[1][i+1:]
+		}
+		config.Client.Forwards = append(config.Client.Forwards, forwardConfig)
+	}
+
+	privateKey, err := xchg.GenerateRSAKey()
+	if *keyFile != "" {
+		privateKey, err = xchg.LoadOrCreateRSAKey(*keyFile)
+	}
+	if err != nil {
+		logger.Fatalln("key:", err)
+	}
+
+	peerConfig, err := xchg.PeerConfigLoad(*peerConfigFile)
+	if err != nil {
+		logger.Fatalln("peer config:", err)
+	}
+	peer, err := xchg.NewPeerWithConfig(privateKey, xchg.NewDefaultLogger(), peerConfig)
+	if err != nil {
+		logger.Fatalln("peer:", err)
+	}
+
+	switch mode {
+	case "server":
+		server := tunnel.NewServer(peer, config.Server, logger)
+		err = server.Start()
+		if err != nil {
+			logger.Fatalln("server:", err, "(use -auth or -allow-any-client)")
+		}
+		err = peer.Start(true)
+		if err != nil {
+			logger.Fatalln("peer:", err)
+		}
+		logger.Println("address:", peer.LocalAddress())
+		for _, t := range config.Server.Tunnels {
+			logger.Println("tunnel", t.Name, "->", t.Target)
+		}
+		defer server.Stop()
+	case "client":
+		err = peer.Start(false)
+		if err != nil {
+			logger.Fatalln("peer:", err)
+		}
+		client := tunnel.NewClient(peer, config.Client, logger)
+		err = client.Start()
+		if err != nil {
+			logger.Fatalln("listen:", err)
+		}
+		for _, f := range config.Client.Forwards {
+			logger.Println("forward", f.Listen, "->", f.Address, f.Service)
+		}
+		defer client.Stop()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	<-stop
+	peer.Stop()
+}
@@ -1,3 +1,9 @@
 module github.com/ipoluianov/xchg
 
 go 1.18
+
+require (
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/crypto v0.9.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -68,11 +68,12 @@ func (c *Storage) GetMessage(afterId uint64, maxSize uint64) (data []byte, lastI
 
 	for _, m := range c.messages {
 		if m.id > afterId || sendAll {
-			if len(data)+len(m.data) < int(maxSize) {
-				data = append(data, m.data...)
-				lastId = m.id
-				count++
+			if len(data)+len(m.data) >= int(maxSize) {
+				break
 			}
+			data = append(data, m.data...)
+			lastId = m.id
+			count++
 		}
 	}
 
@@ -0,0 +1,29 @@
+package router
+
+import "sync"
+
+// State of a connection to the router.
+// Addresses are authorized once per connection by a signed block.
+type ConnectionState struct {
+	mtx                 sync.Mutex
+	authorizedAddresses map[string]bool
+}
+
+func NewConnectionState() *ConnectionState {
+	var c ConnectionState
+	c.authorizedAddresses = make(map[string]bool)
+	return &c
+}
+
+func (c *ConnectionState) Authorize(address string) {
+	c.mtx.Lock()
+	c.authorizedAddresses[address] = true
+	c.mtx.Unlock()
+}
+
+func (c *ConnectionState) IsAuthorized(address string) (result bool) {
+	c.mtx.Lock()
+	result = c.authorizedAddresses[address]
+	c.mtx.Unlock()
+	return
+}
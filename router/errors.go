@@ -0,0 +1,29 @@
+package router
+
+const (
+	ERR_XCHG_ROUTER_READ_NOT_AUTHORIZED = "{ERR_XCHG_ROUTER_READ_NOT_AUTHORIZED}"
+	ERR_XCHG_ROUTER_SIGNED_BLOCK_SIZE   = "{ERR_XCHG_ROUTER_SIGNED_BLOCK_SIZE}"
+	ERR_XCHG_ROUTER_WRONG_NONCE         = "{ERR_XCHG_ROUTER_WRONG_NONCE}"
+	ERR_XCHG_ROUTER_WRONG_POW           = "{ERR_XCHG_ROUTER_WRONG_POW}"
+	ERR_XCHG_ROUTER_WRONG_PUBLIC_KEY    = "{ERR_XCHG_ROUTER_WRONG_PUBLIC_KEY}"
+	ERR_XCHG_ROUTER_WRONG_SIGNATURE     = "{ERR_XCHG_ROUTER_WRONG_SIGNATURE}"
+	ERR_XCHG_ROUTER_WRONG_ADDRESS       = "{ERR_XCHG_ROUTER_WRONG_ADDRESS}"
+	ERR_XCHG_ROUTER_WRONG_REQUEST       = "{ERR_XCHG_ROUTER_WRONG_REQUEST}"
+
+	ERR_XCHG_ROUTER_WRONG_ADDRESS_DATA     = "{ERR_XCHG_ROUTER_WRONG_ADDRESS_DATA}"
+	ERR_XCHG_ROUTER_WRONG_CUSTOM_ADDRESS   = "{ERR_XCHG_ROUTER_WRONG_CUSTOM_ADDRESS}"
+	ERR_XCHG_ROUTER_CUSTOM_ADDRESS_IS_BUSY = "{ERR_XCHG_ROUTER_CUSTOM_ADDRESS_IS_BUSY}"
+	ERR_XCHG_ROUTER_CUSTOM_ADDRESS_SIGN    = "{ERR_XCHG_ROUTER_CUSTOM_ADDRESS_SIGN}"
+	ERR_XCHG_ROUTER_NO_ADDRESS_DATA        = "{ERR_XCHG_ROUTER_NO_ADDRESS_DATA}"
+	ERR_XCHG_ROUTER_ADDRESS_DATA_TOO_LARGE = "{ERR_XCHG_ROUTER_ADDRESS_DATA_TOO_LARGE}"
+	ERR_XCHG_ROUTER_ADDRESS_DATA_LIMIT     = "{ERR_XCHG_ROUTER_ADDRESS_DATA_LIMIT}"
+	ERR_XCHG_ROUTER_UNKNOWN_ADDRESS        = "{ERR_XCHG_ROUTER_UNKNOWN_ADDRESS}"
+
+	ERR_XCHG_ROUTER_TCP_WRONG_LENGTH      = "{ERR_XCHG_ROUTER_TCP_WRONG_LENGTH}"
+	ERR_XCHG_ROUTER_TCP_TOO_MANY_REQUESTS = "{ERR_XCHG_ROUTER_TCP_TOO_MANY_REQUESTS}"
+
+	ERR_XCHG_ROUTER_WS_TOO_MANY_REQUESTS = "{ERR_XCHG_ROUTER_WS_TOO_MANY_REQUESTS}"
+	ERR_XCHG_ROUTER_WS_WRONG_FUNCTION    = "{ERR_XCHG_ROUTER_WS_WRONG_FUNCTION}"
+
+	ERR_XCHG_ROUTER_UDP_TOO_LARGE = "{ERR_XCHG_ROUTER_UDP_TOO_LARGE}"
+)
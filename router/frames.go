@@ -0,0 +1,272 @@
+package router
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Frames 0x00 - 0x09 (see protocol.md)
+const (
+	FramePingRequest          = byte(0x00)
+	FramePingResponse         = byte(0x01)
+	FrameNonceRequest         = byte(0x02)
+	FrameNonceResponse        = byte(0x03)
+	FrameDeclareData          = byte(0x04)
+	FrameDeclareDataResponse  = byte(0x05)
+	FrameGetData              = byte(0x06)
+	FrameGetDataResponse      = byte(0x07)
+	FrameResolveAddress       = byte(0x08)
+	FrameResolveAddressResult = byte(0x09)
+
+	FrameHeaderSize = 8
+
+	FrameCodeSuccess = byte(0x00)
+	FrameCodeError   = byte(0x01)
+
+	// The data of an address expires, not more than ADDRESS_DATA_MAX_COUNT addresses
+	ADDRESS_DATA_TIMEOUT   = 10 * time.Minute
+	ADDRESS_DATA_MAXLEN    = 4 * 1024
+	ADDRESS_DATA_MAX_COUNT = 100000
+	CUSTOM_ADDRESS_MAXLEN  = 64
+)
+
+type AddressData struct {
+	Address       string
+	CustomAddress string
+	SignedBlock   []byte
+	DT            time.Time
+}
+
+// The router reads only the custom address and its signature from the declared data
+type addressDataHeader struct {
+	CustomAddress     string `json:"custom_address"`
+	CustomAddressSign []byte `json:"custom_address_sign"`
+}
+
+func (c *Router) ProcessFrame(frame []byte) (response []byte) {
+	if len(frame) < FrameHeaderSize {
+		return
+	}
+
+	switch frame[0] {
+	case FramePingRequest:
+		response = makeFrame(FramePingResponse, FrameCodeSuccess, nil)
+	case FrameNonceRequest:
+		response = makeFrame(FrameNonceResponse, FrameCodeSuccess, c.GetNonce())
+	case FrameDeclareData:
+		err := c.declareAddressData(frame[FrameHeaderSize:])
+		if err != nil {
+			response = makeFrame(FrameDeclareDataResponse, FrameCodeError, []byte(err.Error()))
+			return
+		}
+		response = makeFrame(FrameDeclareDataResponse, FrameCodeSuccess, nil)
+	case FrameGetData:
+		address := normalizeNativeAddress(string(frame[FrameHeaderSize:]))
+		signedBlock, err := c.getAddressData(address)
+		if err != nil {
+			response = makeFrame(FrameGetDataResponse, FrameCodeError, []byte(err.Error()))
+			return
+		}
+		response = makeFrame(FrameGetDataResponse, FrameCodeSuccess, []byte(address+"="+string(signedBlock)))
+	case FrameResolveAddress:
+		address := string(frame[FrameHeaderSize:])
+		nativeAddress, err := c.resolveAddress(address)
+		if err != nil {
+			response = makeFrame(FrameResolveAddressResult, FrameCodeError, []byte(err.Error()))
+			return
+		}
+		response = makeFrame(FrameResolveAddressResult, FrameCodeSuccess, []byte(address+"="+nativeAddress))
+	}
+	return
+}
+
+func makeFrame(frameType byte, code byte, data []byte) []byte {
+	frame := make([]byte, FrameHeaderSize+len(data))
+	frame[0] = frameType
+	frame[1] = code
+	copy(frame[FrameHeaderSize:], data)
+	return frame
+}
+
+func (c *Router) declareAddressData(signedBlock []byte) (err error) {
+	var address string
+	var data []byte
+	address, _, data, err = c.CheckSignedBlock(signedBlock)
+	if err != nil {
+		return
+	}
+	if len(data) > ADDRESS_DATA_MAXLEN {
+		err = errors.New(ERR_XCHG_ROUTER_ADDRESS_DATA_TOO_LARGE)
+		return
+	}
+
+	var header addressDataHeader
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &header)
+		if err != nil {
+			err = errors.New(ERR_XCHG_ROUTER_WRONG_ADDRESS_DATA)
+			return
+		}
+	}
+
+	customAddress := normalizeCustomAddress(header.CustomAddress)
+	if len(header.CustomAddress) > 0 && len(customAddress) == 0 {
+		err = errors.New(ERR_XCHG_ROUTER_WRONG_CUSTOM_ADDRESS)
+		return
+	}
+	if len(customAddress) > 0 && !c.checkCustomAddressSign(customAddress, address, header.CustomAddressSign) {
+		err = errors.New(ERR_XCHG_ROUTER_CUSTOM_ADDRESS_SIGN)
+		return
+	}
+
+	blockCopy := make([]byte, len(signedBlock))
+	copy(blockCopy, signedBlock)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if _, ok := c.addressData[address]; !ok && len(c.addressData) >= ADDRESS_DATA_MAX_COUNT {
+		err = errors.New(ERR_XCHG_ROUTER_ADDRESS_DATA_LIMIT)
+		return
+	}
+
+	if len(customAddress) > 0 {
+		if owner, ok := c.customAddresses[customAddress]; ok && owner != address {
+			if ownerData, ok := c.addressData[owner]; ok && time.Since(ownerData.DT) < ADDRESS_DATA_TIMEOUT {
+				err = errors.New(ERR_XCHG_ROUTER_CUSTOM_ADDRESS_IS_BUSY)
+				return
+			}
+		}
+	}
+
+	if oldData, ok := c.addressData[address]; ok && oldData.CustomAddress != customAddress {
+		if c.customAddresses[oldData.CustomAddress] == address {
+			delete(c.customAddresses, oldData.CustomAddress)
+		}
+	}
+
+	var addressData AddressData
+	addressData.Address = address
+	addressData.CustomAddress = customAddress
+	addressData.SignedBlock = blockCopy
+	addressData.DT = time.Now()
+	c.addressData[address] = &addressData
+	if len(customAddress) > 0 {
+		c.customAddresses[customAddress] = address
+	}
+	return
+}
+
+// Keys of the owner of custom addresses. A custom address is linked to the native address
+// only with the signature of one of the keys (see CustomAddressHash).
+// Without keys custom addresses are not accepted.
+func (c *Router) SetCustomAddressKeys(keys []*rsa.PublicKey) {
+	c.mtx.Lock()
+	c.customAddressKeys = append([]*rsa.PublicKey{}, keys...)
+	c.mtx.Unlock()
+}
+
+func (c *Router) checkCustomAddressSign(customAddress string, nativeAddress string, sign []byte) bool {
+	c.mtx.Lock()
+	keys := c.customAddressKeys
+	c.mtx.Unlock()
+
+	hash := CustomAddressHash(customAddress, nativeAddress)
+	for _, key := range keys {
+		err := rsa.VerifyPSS(key, crypto.SHA256, hash, sign, &rsa.PSSOptions{
+			SaltLength: 32,
+		})
+		if err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// SHA256(custom address + "=" + native address) - signed by the owner of custom addresses
+func CustomAddressHash(customAddress string, nativeAddress string) []byte {
+	hash := sha256.Sum256([]byte(normalizeCustomAddress(customAddress) + "=" + normalizeNativeAddress(nativeAddress)))
+	return hash[:]
+}
+
+func (c *Router) getAddressData(address string) (signedBlock []byte, err error) {
+	c.mtx.Lock()
+	addressData, ok := c.addressData[address]
+	c.mtx.Unlock()
+	// Expired data is not returned before it is cleared
+	if !ok || time.Since(addressData.DT) >= ADDRESS_DATA_TIMEOUT {
+		err = errors.New(ERR_XCHG_ROUTER_NO_ADDRESS_DATA)
+		return
+	}
+	signedBlock = addressData.SignedBlock
+	return
+}
+
+func (c *Router) resolveAddress(address string) (nativeAddress string, err error) {
+	if len(address) < 1 {
+		err = errors.New("empty address")
+		return
+	}
+
+	if address[0] == '#' {
+		nativeAddress = normalizeNativeAddress(address)
+		return
+	}
+
+	customAddress := normalizeCustomAddress(address)
+
+	c.mtx.Lock()
+	nativeAddress, ok := c.customAddresses[customAddress]
+	if ok {
+		ownerData, ownerOk := c.addressData[nativeAddress]
+		ok = ownerOk && time.Since(ownerData.DT) < ADDRESS_DATA_TIMEOUT
+	}
+	c.mtx.Unlock()
+
+	if !ok {
+		nativeAddress = ""
+		err = errors.New(ERR_XCHG_ROUTER_UNKNOWN_ADDRESS)
+	}
+	return
+}
+
+func (c *Router) clearAddressData() {
+	now := time.Now()
+	c.mtx.Lock()
+	for address, addressData := range c.addressData {
+		if now.Sub(addressData.DT) >= ADDRESS_DATA_TIMEOUT {
+			delete(c.addressData, address)
+			if c.customAddresses[addressData.CustomAddress] == address {
+				delete(c.customAddresses, addressData.CustomAddress)
+			}
+		}
+	}
+	c.mtx.Unlock()
+}
+
+func normalizeNativeAddress(address string) string {
+	address = strings.ToLower(strings.TrimSpace(address))
+	if !strings.HasPrefix(address, "#") {
+		address = "#" + address
+	}
+	return address
+}
+
+func normalizeCustomAddress(address string) string {
+	address = strings.ToLower(strings.TrimSpace(address))
+	if len(address) > CUSTOM_ADDRESS_MAXLEN {
+		return ""
+	}
+	for _, ch := range address {
+		if (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') || ch == '-' || ch == '.' || ch == '_' {
+			continue
+		}
+		return ""
+	}
+	return address
+}
@@ -0,0 +1,187 @@
+package router
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Frame 0x04 of the key with the data, the error text for the code 0x01
+func testDeclare(t testing.TB, r *Router, privateKey *rsa.PrivateKey, data []byte) (err string) {
+	signedBlock := testSignedBlock(t, r.GetNonce(), privateKey, data)
+	response := r.ProcessFrame(makeFrame(FrameDeclareData, 0, signedBlock))
+	if len(response) < FrameHeaderSize || response[0] != FrameDeclareDataResponse {
+		t.Fatal("wrong response", response)
+	}
+	if response[1] != FrameCodeSuccess {
+		err = string(response[FrameHeaderSize:])
+	}
+	return
+}
+
+func testCustomAddressData(t testing.TB, customAddress string, nativeAddress string, ownerKey *rsa.PrivateKey) []byte {
+	var header addressDataHeader
+	header.CustomAddress = customAddress
+	if ownerKey != nil {
+		sign, err := rsa.SignPSS(rand.Reader, ownerKey, crypto.SHA256, CustomAddressHash(customAddress, nativeAddress), &rsa.PSSOptions{
+			SaltLength: 32,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		header.CustomAddressSign = sign
+	}
+	data, _ := json.Marshal(header)
+	return data
+}
+
+func TestAddressDataDeclare(t *testing.T) {
+	r := NewRouter()
+	privateKey := testPrivateKey(t)
+	address := AddressForPublicKeyBS(testPublicKeyBS(t, privateKey))
+
+	response := r.ProcessFrame(makeFrame(FrameGetData, 0, []byte(address)))
+	if response[1] != FrameCodeError || string(response[FrameHeaderSize:]) != ERR_XCHG_ROUTER_NO_ADDRESS_DATA {
+		t.Fatal("data of an unknown address", string(response[FrameHeaderSize:]))
+	}
+
+	data := []byte(`{"display_name":"test"}`)
+	if err := testDeclare(t, r, privateKey, data); err != "" {
+		t.Fatal(err)
+	}
+	response = r.ProcessFrame(makeFrame(FrameGetData, 0, []byte(strings.ToUpper(address[1:]))))
+	if response[1] != FrameCodeSuccess {
+		t.Fatal(string(response[FrameHeaderSize:]))
+	}
+	parts := strings.SplitN(string(response[FrameHeaderSize:]), "=", 2)
+	if len(parts) != 2 || parts[0] != address || !strings.HasSuffix(parts[1], string(data)) {
+		t.Fatal("wrong data", parts)
+	}
+
+	// A replayed block is rejected
+	signedBlock := testSignedBlock(t, r.GetNonce(), privateKey, data)
+	r.ProcessFrame(makeFrame(FrameDeclareData, 0, signedBlock))
+	response = r.ProcessFrame(makeFrame(FrameDeclareData, 0, signedBlock))
+	if response[1] != FrameCodeError || string(response[FrameHeaderSize:]) != ERR_XCHG_ROUTER_WRONG_NONCE {
+		t.Fatal("replayed block is accepted", string(response[FrameHeaderSize:]))
+	}
+
+	if err := testDeclare(t, r, privateKey, []byte("not json")); err != ERR_XCHG_ROUTER_WRONG_ADDRESS_DATA {
+		t.Fatal("wrong data is accepted", err)
+	}
+	if err := testDeclare(t, r, privateKey, make([]byte, ADDRESS_DATA_MAXLEN+1)); err != ERR_XCHG_ROUTER_ADDRESS_DATA_TOO_LARGE {
+		t.Fatal("large data is accepted", err)
+	}
+}
+
+func TestAddressDataLimit(t *testing.T) {
+	r := NewRouter()
+	privateKey := testPrivateKey(t)
+	address := AddressForPublicKeyBS(testPublicKeyBS(t, privateKey))
+	if err := testDeclare(t, r, privateKey, nil); err != "" {
+		t.Fatal(err)
+	}
+
+	for i := 0; len(r.addressData) < ADDRESS_DATA_MAX_COUNT; i++ {
+		r.addressData["#other"+strconv.Itoa(i)] = &AddressData{DT: time.Now()}
+	}
+	// The data of the declared address is updated
+	if err := testDeclare(t, r, privateKey, nil); err != "" {
+		t.Fatal(err)
+	}
+	delete(r.addressData, address)
+	r.addressData["#other"] = &AddressData{DT: time.Now()}
+	if err := testDeclare(t, r, privateKey, nil); err != ERR_XCHG_ROUTER_ADDRESS_DATA_LIMIT {
+		t.Fatal("the limit is exceeded", err)
+	}
+}
+
+func TestCustomAddress(t *testing.T) {
+	r := NewRouter()
+	privateKey := testPrivateKey(t)
+	address := AddressForPublicKeyBS(testPublicKeyBS(t, privateKey))
+	ownerKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	otherAddress := AddressForPublicKeyBS(testPublicKeyBS(t, otherKey))
+
+	// Without the keys of the owner custom addresses are not accepted
+	if err := testDeclare(t, r, privateKey, testCustomAddressData(t, "name", address, ownerKey)); err != ERR_XCHG_ROUTER_CUSTOM_ADDRESS_SIGN {
+		t.Fatal("custom address without keys", err)
+	}
+
+	r.SetCustomAddressKeys([]*rsa.PublicKey{&ownerKey.PublicKey})
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"no signature", testCustomAddressData(t, "name", address, nil), ERR_XCHG_ROUTER_CUSTOM_ADDRESS_SIGN},
+		{"other key", testCustomAddressData(t, "name", address, otherKey), ERR_XCHG_ROUTER_CUSTOM_ADDRESS_SIGN},
+		{"other native address", testCustomAddressData(t, "name", otherAddress, ownerKey), ERR_XCHG_ROUTER_CUSTOM_ADDRESS_SIGN},
+		{"wrong custom address", testCustomAddressData(t, "wrong name", address, ownerKey), ERR_XCHG_ROUTER_WRONG_CUSTOM_ADDRESS},
+	}
+	for _, test := range tests {
+		if err := testDeclare(t, r, privateKey, test.data); err != test.err {
+			t.Errorf("%s: %s, expected %s", test.name, err, test.err)
+		}
+	}
+
+	if err := testDeclare(t, r, privateKey, testCustomAddressData(t, "Name", address, ownerKey)); err != "" {
+		t.Fatal(err)
+	}
+	nativeAddress, err := r.resolveAddress("NAME")
+	if err != nil || nativeAddress != address {
+		t.Fatal("custom address is not resolved", nativeAddress, err)
+	}
+	response := r.ProcessFrame(makeFrame(FrameResolveAddress, 0, []byte("name")))
+	if response[1] != FrameCodeSuccess || string(response[FrameHeaderSize:]) != "name="+address {
+		t.Fatal("wrong frame 0x09", string(response[FrameHeaderSize:]))
+	}
+
+	// The custom address is busy while the data of its address is not expired
+	if err := testDeclare(t, r, otherKey, testCustomAddressData(t, "name", otherAddress, ownerKey)); err != ERR_XCHG_ROUTER_CUSTOM_ADDRESS_IS_BUSY {
+		t.Fatal("busy custom address is accepted", err)
+	}
+}
+
+func TestAddressDataExpiry(t *testing.T) {
+	r := NewRouter()
+	privateKey := testPrivateKey(t)
+	address := AddressForPublicKeyBS(testPublicKeyBS(t, privateKey))
+	ownerKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	r.SetCustomAddressKeys([]*rsa.PublicKey{&ownerKey.PublicKey})
+	if err := testDeclare(t, r, privateKey, testCustomAddressData(t, "name", address, ownerKey)); err != "" {
+		t.Fatal(err)
+	}
+
+	r.mtx.Lock()
+	r.addressData[address].DT = time.Now().Add(-ADDRESS_DATA_TIMEOUT)
+	r.mtx.Unlock()
+
+	// Not cleared yet, but expired
+	if _, err := r.getAddressData(address); err == nil || err.Error() != ERR_XCHG_ROUTER_NO_ADDRESS_DATA {
+		t.Fatal("expired data is returned", err)
+	}
+	if nativeAddress, err := r.resolveAddress("name"); err == nil || nativeAddress != "" {
+		t.Fatal("expired custom address is resolved", nativeAddress)
+	}
+
+	r.clearAddressData()
+	r.mtx.Lock()
+	_, dataOk := r.addressData[address]
+	_, customOk := r.customAddresses["name"]
+	r.mtx.Unlock()
+	if dataOk || customOk {
+		t.Fatal("expired data is not cleared")
+	}
+
+	// The native address is resolved without data
+	if nativeAddress, err := r.resolveAddress(strings.ToUpper(address)); err != nil || nativeAddress != address {
+		t.Fatal(nativeAddress, err)
+	}
+}
@@ -3,25 +3,32 @@ package router
 import (
 	"context"
 	"encoding/base64"
-	"encoding/binary"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
 type HttpServer struct {
+	mtx sync.Mutex
 	srv *http.Server
 	//r                    *mux.Router
 	server               *Router
 	longPollingTimeout   time.Duration
 	longPollingTickDelay time.Duration
 	err                  error
+
+	// Origins of browsers allowed to use /api/ws, empty - any
+	wsAllowedOrigins []string
 }
 
+type connectionStateKey struct{}
+
 func CurrentExePath() string {
 	dir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
 	return dir
@@ -34,7 +41,7 @@ func NewHttpServer() *HttpServer {
 	return &c
 }
 
-func (c *HttpServer) Start(server *Router, port int) {
+func (c *HttpServer) Start(server *Router, port int) (err error) {
 	c.server = server
 
 	c.srv = &http.Server{
@@ -42,11 +49,21 @@ func (c *HttpServer) Start(server *Router, port int) {
 	}
 
 	c.srv.Handler = c
-	go c.thListen()
+	c.srv.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+		return context.WithValue(ctx, connectionStateKey{}, NewConnectionState())
+	}
+
+	listener, err := net.Listen("tcp", c.srv.Addr)
+	if err != nil {
+		c.err = err
+		return
+	}
+	go c.thListen(listener)
+	return
 }
 
-func (c *HttpServer) thListen() {
-	c.err = c.srv.ListenAndServe()
+func (c *HttpServer) thListen(listener net.Listener) {
+	c.err = c.srv.Serve(listener)
 }
 
 func (c *HttpServer) Stop() error {
@@ -70,6 +87,18 @@ func (c *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		c.processR(w, r)
 		return
 	}
+	if r.RequestURI == "/api/n" {
+		c.processN(w, r)
+		return
+	}
+	if r.RequestURI == "/api/c" {
+		c.processC(w, r)
+		return
+	}
+	if r.RequestURI == "/api/ws" {
+		c.processWS(w, r)
+		return
+	}
 	if r.RequestURI == "/api/debug" {
 		c.processDebug(w, r)
 		return
@@ -95,8 +124,22 @@ func (c *HttpServer) processStat(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(result)
 }
 
-func (c *HttpServer) processR(w http.ResponseWriter, r *http.Request) {
-	c.server.DeclareHttpRequestR()
+func (c *HttpServer) processN(w http.ResponseWriter, r *http.Request) {
+	c.server.DeclareHttpRequestN()
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Request-Method", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		return
+	}
+
+	resultStr := base64.StdEncoding.EncodeToString(c.server.GetNonce())
+	_, _ = w.Write([]byte(resultStr))
+}
+
+func (c *HttpServer) processC(w http.ResponseWriter, r *http.Request) {
+	c.server.DeclareHttpRequestC()
 
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	if r.Method == "OPTIONS" {
@@ -117,41 +160,80 @@ func (c *HttpServer) processR(w http.ResponseWriter, r *http.Request) {
 	var err error
 	dataBS, err = base64.StdEncoding.DecodeString(data64)
 	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(ERR_XCHG_ROUTER_WRONG_REQUEST))
 		return
 	}
 
-	//addrTemp := base32.StdEncoding.EncodeToString(dataBS[16 : 16+30])
+	resultBS := c.server.ProcessFrame(dataBS)
+	resultStr := base64.StdEncoding.EncodeToString(resultBS)
+	_, _ = w.Write([]byte(resultStr))
+}
 
-	//addrTemp = strings.ToLower(addrTemp)
+func (c *HttpServer) processR(w http.ResponseWriter, r *http.Request) {
+	c.server.DeclareHttpRequestR()
 
-	var resultBS []byte
-	beginLongPollingDT := time.Now()
-	for time.Since(beginLongPollingDT) < c.longPollingTimeout {
-		var count int
-		resultBS, count, err = c.server.GetMessages(dataBS)
-		if count > 0 || err != nil {
-			break
-		}
-		if errors.Is(r.Context().Err(), context.Canceled) {
-			break
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Request-Method", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		return
+	}
+
+	if r.Method == "POST" {
+		if err := r.ParseMultipartForm(1000000); err != nil {
+			fmt.Fprintf(w, "ParseForm() err: %v", err)
+			return
 		}
-		time.Sleep(c.longPollingTickDelay)
 	}
+
+	data64 := r.FormValue("d")
+	var dataBS []byte
+	var err error
+	dataBS, err = base64.StdEncoding.DecodeString(data64)
 	if err != nil {
 		return
 	}
-	resultStr := base64.StdEncoding.EncodeToString(resultBS)
 
-	result := []byte(resultStr)
+	state, ok := r.Context().Value(connectionStateKey{}).(*ConnectionState)
+	if !ok {
+		state = NewConnectionState()
+	}
+
+	resultBS, err := c.getMessagesLongPolling(r.Context(), state, dataBS)
 	if err != nil {
-		w.WriteHeader(500)
+		w.WriteHeader(http.StatusUnauthorized)
 		b := []byte(err.Error())
 		_, _ = w.Write(b)
 		return
 	}
+	resultStr := base64.StdEncoding.EncodeToString(resultBS)
+
+	result := []byte(resultStr)
 	_, _ = w.Write([]byte(result))
 }
 
+// Waits for messages of the address up to longPollingTimeout
+func (c *HttpServer) getMessagesLongPolling(ctx context.Context, state *ConnectionState, dataBS []byte) (resultBS []byte, err error) {
+	beginLongPollingDT := time.Now()
+	for time.Since(beginLongPollingDT) < c.longPollingTimeout {
+		var count int
+		resultBS, count, err = c.server.GetMessages(state, dataBS)
+		if count > 0 || err != nil {
+			break
+		}
+		// The signed block is checked only once
+		if len(dataBS) > 46 {
+			dataBS = dataBS[:46]
+		}
+		if errors.Is(ctx.Err(), context.Canceled) {
+			break
+		}
+		time.Sleep(c.longPollingTickDelay)
+	}
+	return
+}
+
 func (c *HttpServer) processW(w http.ResponseWriter, r *http.Request) {
 	c.server.DeclareHttpRequestW()
 
@@ -177,30 +259,7 @@ func (c *HttpServer) processW(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	offset := 0
-	for offset < len(dataBS) {
-		if offset+128 <= len(dataBS) {
-			frameLen := int(binary.LittleEndian.Uint32(dataBS[offset:]))
-			if offset+frameLen <= len(dataBS) {
-				c.server.Put(dataBS[offset : offset+frameLen])
-				if err != nil {
-					return
-				}
-			} else {
-				break
-			}
-			offset += frameLen
-		} else {
-			break
-		}
-	}
-
-	if err != nil {
-		w.WriteHeader(500)
-		b := []byte(err.Error())
-		_, _ = w.Write(b)
-		return
-	}
+	c.server.PutFrames(dataBS)
 }
 
 func SplitRequest(path string) []string {
@@ -0,0 +1,121 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestHttpServer(r *Router) *HttpServer {
+	server := NewHttpServer()
+	server.server = r
+	server.longPollingTimeout = 50 * time.Millisecond
+	return server
+}
+
+// /api/r of the connection (state), the status and the body
+func testHttpRead(server *HttpServer, state *ConnectionState, request []byte) (status int, body string) {
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	writer.WriteField("d", base64.StdEncoding.EncodeToString(request))
+	writer.Close()
+	httpRequest := httptest.NewRequest("POST", "/api/r", &form)
+	httpRequest.Header.Set("Content-Type", writer.FormDataContentType())
+	httpRequest = httpRequest.WithContext(context.WithValue(httpRequest.Context(), connectionStateKey{}, state))
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httpRequest)
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestHttpReadSignedBlock(t *testing.T) {
+	r := NewRouter()
+	server := newTestHttpServer(r)
+	privateKey := testPrivateKey(t)
+	addressBS := testAddressBS(t, privateKey)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	r.Put(testFrame(addressBS, 1))
+
+	replayedBlock := testSignedBlock(t, r.GetNonce(), privateKey, nil)
+	if status, body := testHttpRead(server, NewConnectionState(), testReadRequest(addressBS, 0, replayedBlock)); status != http.StatusOK {
+		t.Fatal(status, body)
+	}
+
+	reusedNonce := r.GetNonce()
+	if status, body := testHttpRead(server, NewConnectionState(), testReadRequest(addressBS, 0, testSignedBlock(t, reusedNonce, privateKey, nil))); status != http.StatusOK {
+		t.Fatal(status, body)
+	}
+
+	forgedNonce := r.GetNonce()
+	forgedNonce[10] ^= 0xFF
+
+	expiredNonce := r.GetNonce()
+	expiredBlock := testSignedBlock(t, expiredNonce, privateKey, nil)
+	// The ring of nonces wraps: the nonce is replaced by a new one
+	for i := 0; i < NONCE_COUNT; i++ {
+		r.GetNonce()
+	}
+
+	tests := []struct {
+		name    string
+		request []byte
+		err     string
+	}{
+		{"no signed block", testReadRequest(addressBS, 0, nil), ERR_XCHG_ROUTER_READ_NOT_AUTHORIZED},
+		{"replayed block", testReadRequest(addressBS, 0, replayedBlock), ERR_XCHG_ROUTER_WRONG_NONCE},
+		{"reused nonce", testReadRequest(addressBS, 0, testSignedBlock(t, reusedNonce, privateKey, []byte("other"))), ERR_XCHG_ROUTER_WRONG_NONCE},
+		{"forged nonce", testReadRequest(addressBS, 0, testSignedBlock(t, forgedNonce, privateKey, nil)), ERR_XCHG_ROUTER_WRONG_NONCE},
+		{"expired nonce", testReadRequest(addressBS, 0, expiredBlock), ERR_XCHG_ROUTER_WRONG_NONCE},
+		{"wrong key", testReadRequest(addressBS, 0, testSignedBlock(t, r.GetNonce(), otherKey, nil)), ERR_XCHG_ROUTER_WRONG_ADDRESS},
+		{"short block", testReadRequest(addressBS, 0, make([]byte, 100)), ERR_XCHG_ROUTER_SIGNED_BLOCK_SIZE},
+	}
+	for _, test := range tests {
+		status, body := testHttpRead(server, NewConnectionState(), test.request)
+		if status != http.StatusUnauthorized || body != test.err {
+			t.Errorf("%s: %d %s, expected %s", test.name, status, body, test.err)
+		}
+	}
+}
+
+func TestHttpReadAuthorized(t *testing.T) {
+	r := NewRouter()
+	server := newTestHttpServer(r)
+	privateKey := testPrivateKey(t)
+	addressBS := testAddressBS(t, privateKey)
+	r.Put(testFrame(addressBS, 1))
+	r.Put(testFrame(addressBS, 2))
+
+	state := NewConnectionState()
+	status, body := testHttpRead(server, state, testReadRequest(addressBS, 0, testSignedBlock(t, r.GetNonce(), privateKey, nil)))
+	if status != http.StatusOK {
+		t.Fatal(status, body)
+	}
+	response, _ := base64.StdEncoding.DecodeString(body)
+	if len(response) < 8 {
+		t.Fatal("wrong response", body)
+	}
+	if numbers := testFrameNumbers(response[8:]); len(numbers) != 2 || numbers[0] != 1 || numbers[1] != 2 {
+		t.Fatal("wrong frames", numbers)
+	}
+
+	// The connection is authorized: the next reads are without the signed block
+	status, body = testHttpRead(server, state, testReadRequest(addressBS, 1, nil))
+	response, _ = base64.StdEncoding.DecodeString(body)
+	if status != http.StatusOK || len(response) < 8 {
+		t.Fatal(status, body)
+	}
+	if numbers := testFrameNumbers(response[8:]); len(numbers) != 1 || numbers[0] != 2 {
+		t.Fatal("wrong frames after the id", numbers)
+	}
+
+	// Other connections are not
+	if status, body = testHttpRead(server, NewConnectionState(), testReadRequest(addressBS, 0, nil)); status != http.StatusUnauthorized {
+		t.Fatal("other connection is authorized", status, body)
+	}
+}
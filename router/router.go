@@ -26,13 +26,17 @@ type Router struct {
 	stopping bool
 
 	// Data
-	//nonces *Nonces
+	nonces *Nonces
 
 	//network *Network
 	nextId uint64
 
 	addresses map[string]*Storage
 
+	addressData       map[string]*AddressData
+	customAddresses   map[string]string
+	customAddressKeys []*rsa.PublicKey
+
 	// Statistics
 	stat       RouterStatistics
 	statLast   RouterStatistics
@@ -43,6 +47,8 @@ type Router struct {
 	lastStatInfo  []byte
 
 	clearAddressesLastDT time.Time
+
+	putHandlers []func(address string, id uint64, frame []byte)
 }
 
 type RouterStatistics struct {
@@ -59,6 +65,18 @@ type RouterStatistics struct {
 	HttpRequestsD  int `json:"http_requests_d"`
 	HttpRequestsS  int `json:"http_requests_s"`
 	HttpRequestsF  int `json:"http_requests_f"`
+	HttpRequestsC  int `json:"http_requests_c"`
+
+	WsConnections int `json:"ws_connections"`
+	WsRequests    int `json:"ws_requests"`
+
+	UdpEndpoints int `json:"udp_endpoints"`
+	UdpRequests  int `json:"udp_requests"`
+	UdpFramesOut int `json:"udp_frames_out"`
+
+	TcpConnections int `json:"tcp_connections"`
+	TcpRequests    int `json:"tcp_requests"`
+	TcpFramesOut   int `json:"tcp_frames_out"`
 }
 
 type RouterSpeedStatistics struct {
@@ -69,6 +87,12 @@ type RouterSpeedStatistics struct {
 	SpeedHttpRequestsNS int `json:"http_requests_ns"`
 	SpeedHttpRequestsD  int `json:"http_requests_d"`
 	SpeedHttpRequestsF  int `json:"http_requests_f"`
+	SpeedHttpRequestsC  int `json:"http_requests_c"`
+	SpeedWsRequests     int `json:"ws_requests"`
+	SpeedUdpRequests    int `json:"udp_requests"`
+	SpeedUdpFramesOut   int `json:"udp_frames_out"`
+	SpeedTcpRequests    int `json:"tcp_requests"`
+	SpeedTcpFramesOut   int `json:"tcp_frames_out"`
 
 	SpeedFramesIn  int `json:"frames_in"`
 	SpeedFramesOut int `json:"frames_out"`
@@ -85,7 +109,8 @@ type RouterSpeedStatistics struct {
 }
 
 const (
-	NONCE_COUNT       = 1024 * 1024
+	NONCE_COUNT       = 10 * 1024
+	NONCE_COMPLEXITY  = 8
 	INPUT_BUFFER_SIZE = 10 * 1024 * 1024
 	STORING_TIMEOUT   = 60 * time.Second
 )
@@ -93,6 +118,12 @@ const (
 func NewRouter() *Router {
 	var c Router
 	c.addresses = make(map[string]*Storage)
+	c.nonces = NewNonces(NONCE_COUNT, NONCE_COMPLEXITY)
+	c.addressData = make(map[string]*AddressData)
+	c.customAddresses = make(map[string]string)
+
+	// The id 0 means "nothing read" in the read requests (/api/r)
+	c.nextId = 1
 
 	c.statLastDT = time.Now()
 	c.clearAddressesLastDT = time.Now()
@@ -111,6 +142,7 @@ func (c *Router) Start() error {
 		return errors.New("it is stopping")
 	}
 
+	c.started = true
 	go c.thBackgroundOperations()
 
 	return nil
@@ -154,6 +186,11 @@ func (c *Router) thBackgroundOperations() {
 		c.thStatistics()
 		c.thClearAddresses()
 	}
+
+	c.mtx.Lock()
+	c.started = false
+	c.stopping = false
+	c.mtx.Unlock()
 }
 
 func (c *Router) thStatistics() {
@@ -173,6 +210,12 @@ func (c *Router) thStatistics() {
 		stat.HttpRequestsNS = c.stat.HttpRequestsNS - c.statLast.HttpRequestsNS
 		stat.HttpRequestsD = c.stat.HttpRequestsD - c.statLast.HttpRequestsD
 		stat.HttpRequestsF = c.stat.HttpRequestsF - c.statLast.HttpRequestsF
+		stat.HttpRequestsC = c.stat.HttpRequestsC - c.statLast.HttpRequestsC
+		stat.WsRequests = c.stat.WsRequests - c.statLast.WsRequests
+		stat.UdpRequests = c.stat.UdpRequests - c.statLast.UdpRequests
+		stat.UdpFramesOut = c.stat.UdpFramesOut - c.statLast.UdpFramesOut
+		stat.TcpRequests = c.stat.TcpRequests - c.statLast.TcpRequests
+		stat.TcpFramesOut = c.stat.TcpFramesOut - c.statLast.TcpFramesOut
 
 		c.statLast = c.stat
 		c.mtx.Unlock()
@@ -193,6 +236,12 @@ func (c *Router) thStatistics() {
 		c.statSpeed.SpeedHttpRequestsNS = int(float64(stat.HttpRequestsNS) / now.Sub(c.statLastDT).Seconds())
 		c.statSpeed.SpeedHttpRequestsD = int(float64(stat.HttpRequestsD) / now.Sub(c.statLastDT).Seconds())
 		c.statSpeed.SpeedHttpRequestsF = int(float64(stat.HttpRequestsF) / now.Sub(c.statLastDT).Seconds())
+		c.statSpeed.SpeedHttpRequestsC = int(float64(stat.HttpRequestsC) / now.Sub(c.statLastDT).Seconds())
+		c.statSpeed.SpeedWsRequests = int(float64(stat.WsRequests) / now.Sub(c.statLastDT).Seconds())
+		c.statSpeed.SpeedUdpRequests = int(float64(stat.UdpRequests) / now.Sub(c.statLastDT).Seconds())
+		c.statSpeed.SpeedUdpFramesOut = int(float64(stat.UdpFramesOut) / now.Sub(c.statLastDT).Seconds())
+		c.statSpeed.SpeedTcpRequests = int(float64(stat.TcpRequests) / now.Sub(c.statLastDT).Seconds())
+		c.statSpeed.SpeedTcpFramesOut = int(float64(stat.TcpFramesOut) / now.Sub(c.statLastDT).Seconds())
 		c.statSpeed.Version = VERSION
 
 		c.statLastDT = now
@@ -218,6 +267,8 @@ func (c *Router) thClearAddresses() {
 			a.Clear()
 		}
 
+		c.clearAddressData()
+
 		c.clearAddressesLastDT = now
 	}
 }
@@ -243,23 +294,56 @@ func (c *Router) Put(frame []byte) {
 	addressStorage.Put(id, frame)
 	c.stat.FramesIn++
 	c.stat.BytesIn += len(frame)
+
+	c.mtx.Lock()
+	putHandlers := c.putHandlers
+	c.mtx.Unlock()
+	for _, handler := range putHandlers {
+		handler(addressDest, id, frame)
+	}
+}
+
+// Puts the sequence of frames [len 4][frame]...
+func (c *Router) PutFrames(data []byte) {
+	offset := 0
+	for offset+128 <= len(data) {
+		frameLen := int(binary.LittleEndian.Uint32(data[offset:]))
+		if frameLen < 128 || offset+frameLen > len(data) {
+			break
+		}
+		c.Put(data[offset : offset+frameLen])
+		offset += frameLen
+	}
+}
+
+// The handler is called for every stored frame (push of frames to connected peers)
+func (c *Router) AddPutHandler(handler func(address string, id uint64, frame []byte)) {
+	c.mtx.Lock()
+	putHandlers := make([]func(address string, id uint64, frame []byte), 0, len(c.putHandlers)+1)
+	putHandlers = append(putHandlers, c.putHandlers...)
+	c.putHandlers = append(putHandlers, handler)
+	c.mtx.Unlock()
+}
+
+func (c *Router) GetNonce() []byte {
+	nonce := c.nonces.Next()
+	return nonce[:]
 }
 
 // Get message request
-func (c *Router) GetMessages(frame []byte) (response []byte, count int, err error) {
+// [afterId 0:8] [maxSize 8:16] [address 16:46] [signed block 46:] - optional
+// The signed block authorizes the connection to read the address
+func (c *Router) GetMessages(state *ConnectionState, frame []byte) (response []byte, count int, err error) {
 	var ok bool
 	var addressStorage *Storage
 
-	if len(frame) < 46 {
-		err = errors.New("wrong frame size")
+	addressSrc, err := c.AuthorizeRead(state, frame)
+	if err != nil {
 		return
 	}
 
 	afterId := binary.LittleEndian.Uint64(frame[0:])
 	maxSize := binary.LittleEndian.Uint64(frame[8:])
-	addressSrcBS := frame[16 : 16+30]
-
-	addressSrc := "#" + strings.ToLower(base32.StdEncoding.EncodeToString(addressSrcBS))
 
 	c.mtx.Lock()
 	addressStorage, ok = c.addresses[addressSrc]
@@ -285,32 +369,46 @@ func (c *Router) GetMessages(frame []byte) (response []byte, count int, err erro
 	return
 }
 
-func RSAPublicKeyFromDer(publicKeyDer []byte) (publicKey *rsa.PublicKey, err error) {
-	publicKey, err = x509.ParsePKCS1PublicKey(publicKeyDer)
-	return
-}
-
-/*func (c *Router) resolveAddress(address string) (nativeAddress string, err error) {
-	if len(address) < 1 {
-		err = errors.New("empty address")
+// Checks the read request (see GetMessages): the connection must be authorized to read the address.
+// The signed block of the request (if any) is checked and authorizes the connection.
+func (c *Router) AuthorizeRead(state *ConnectionState, frame []byte) (addressSrc string, err error) {
+	if len(frame) < 46 {
+		err = errors.New("wrong frame size")
 		return
 	}
 
-	if address[0] == '#' {
-		nativeAddress = address
-		return
-	}
+	addressSrc = "#" + strings.ToLower(base32.StdEncoding.EncodeToString(frame[16:46]))
 
-	if strings.HasSuffix(address, ".xchg") {
-		if address == "42.xchg" {
-			nativeAddress = "kqfc2fwogggtlsf7vnh46hhgdjmheiqvqycapj2f2xe2d5jz"
+	if len(frame) > 46 {
+		var signedAddress string
+		signedAddress, _, _, err = c.CheckSignedBlock(frame[46:])
+		if err != nil {
+			return
+		}
+		if signedAddress != addressSrc {
+			err = errors.New(ERR_XCHG_ROUTER_WRONG_ADDRESS)
 			return
 		}
+		state.Authorize(addressSrc)
+	}
+
+	if !state.IsAuthorized(addressSrc) {
+		err = errors.New(ERR_XCHG_ROUTER_READ_NOT_AUTHORIZED)
 	}
+	return
+}
 
-	err = errors.New("unknown address")
+func RSAPublicKeyFromDer(publicKeyDer []byte) (publicKey *rsa.PublicKey, err error) {
+	publicKeyAny, err := x509.ParsePKIXPublicKey(publicKeyDer)
+	if err != nil {
+		return
+	}
+	publicKey, ok := publicKeyAny.(*rsa.PublicKey)
+	if !ok {
+		err = errors.New("wrong public key")
+	}
 	return
-}*/
+}
 
 func (c *Router) DebugString() (result []byte) {
 	c.mtx.Lock()
@@ -377,6 +475,61 @@ func (c *Router) DeclareHttpRequestF() {
 	c.mtx.Unlock()
 }
 
+func (c *Router) DeclareHttpRequestC() {
+	c.mtx.Lock()
+	c.stat.HttpRequests++
+	c.stat.HttpRequestsC++
+	c.mtx.Unlock()
+}
+
+func (c *Router) DeclareWsRequest() {
+	c.mtx.Lock()
+	c.stat.WsRequests++
+	c.mtx.Unlock()
+}
+
+func (c *Router) DeclareWsConnection(delta int) {
+	c.mtx.Lock()
+	c.stat.WsConnections += delta
+	c.mtx.Unlock()
+}
+
+func (c *Router) DeclareUdpRequest() {
+	c.mtx.Lock()
+	c.stat.UdpRequests++
+	c.mtx.Unlock()
+}
+
+func (c *Router) DeclareUdpFrameOut() {
+	c.mtx.Lock()
+	c.stat.UdpFramesOut++
+	c.mtx.Unlock()
+}
+
+func (c *Router) DeclareUdpEndpoints(count int) {
+	c.mtx.Lock()
+	c.stat.UdpEndpoints = count
+	c.mtx.Unlock()
+}
+
+func (c *Router) DeclareTcpRequest() {
+	c.mtx.Lock()
+	c.stat.TcpRequests++
+	c.mtx.Unlock()
+}
+
+func (c *Router) DeclareTcpFrameOut() {
+	c.mtx.Lock()
+	c.stat.TcpFramesOut++
+	c.mtx.Unlock()
+}
+
+func (c *Router) DeclareTcpConnection(delta int) {
+	c.mtx.Lock()
+	c.stat.TcpConnections += delta
+	c.mtx.Unlock()
+}
+
 func (c *Router) buildDebugString() {
 	type AddressInfo struct {
 		Address      string `json:"address"`
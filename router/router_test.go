@@ -0,0 +1,122 @@
+package router
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"sync"
+	"testing"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+func testPrivateKey(t testing.TB) *rsa.PrivateKey {
+	testKeyOnce.Do(func() {
+		testKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	})
+	if testKey == nil {
+		t.Fatal("no key")
+	}
+	return testKey
+}
+
+func testPublicKeyBS(t testing.TB, privateKey *rsa.PrivateKey) []byte {
+	publicKeyBS, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publicKeyBS
+}
+
+// Address bytes (30) of the key
+func testAddressBS(t testing.TB, privateKey *rsa.PrivateKey) []byte {
+	hash := sha256.Sum256(testPublicKeyBS(t, privateKey))
+	return hash[:AddressBytesSize]
+}
+
+// Signed block of the nonce (see CheckSignedBlock)
+func testSignedBlock(t testing.TB, nonce []byte, privateKey *rsa.PrivateKey, data []byte) []byte {
+	publicKeyBS := testPublicKeyBS(t, privateKey)
+	block := make([]byte, SignedBlockHeaderSize+len(publicKeyBS)+len(data))
+	copy(block, nonce)
+	for salt := uint64(0); ; salt++ {
+		binary.LittleEndian.PutUint64(block[16:], salt)
+		powHash := sha256.Sum256(block[0:24])
+		if CheckHash(powHash[:], nonce[4]) {
+			break
+		}
+	}
+	hash := sha256.Sum256(append(append([]byte{}, block[0:24]...), data...))
+	signature, err := rsa.SignPSS(rand.Reader, privateKey, crypto.SHA256, hash[:], &rsa.PSSOptions{
+		SaltLength: 32,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(block[24:], signature)
+	binary.LittleEndian.PutUint32(block[280:], uint32(len(publicKeyBS)))
+	copy(block[284:], publicKeyBS)
+	copy(block[284+len(publicKeyBS):], data)
+	return block
+}
+
+// [afterId 0:8] [maxSize 8:16] [address 16:46] [signed block 46:]
+func testReadRequest(addressBS []byte, afterId uint64, signedBlock []byte) []byte {
+	request := make([]byte, 46, 46+len(signedBlock))
+	binary.LittleEndian.PutUint64(request[0:], afterId)
+	binary.LittleEndian.PutUint64(request[8:], INPUT_BUFFER_SIZE)
+	copy(request[16:], addressBS)
+	return append(request, signedBlock...)
+}
+
+// Frame (128 bytes) to the address, the number is at [100:108]
+func testFrame(addressBS []byte, number uint64) []byte {
+	frame := make([]byte, 128)
+	binary.LittleEndian.PutUint32(frame[0:], uint32(len(frame)))
+	copy(frame[70:], addressBS)
+	binary.LittleEndian.PutUint64(frame[100:], number)
+	return frame
+}
+
+// Numbers of the frames [len 4][frame]...
+func testFrameNumbers(data []byte) (numbers []uint64) {
+	for offset := 0; offset+108 <= len(data); {
+		frameLen := int(binary.LittleEndian.Uint32(data[offset:]))
+		if frameLen < 108 || offset+frameLen > len(data) {
+			break
+		}
+		numbers = append(numbers, binary.LittleEndian.Uint64(data[offset+100:]))
+		offset += frameLen
+	}
+	return
+}
+
+func TestRouterStartStop(t *testing.T) {
+	r := NewRouter()
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Start(); err == nil {
+		t.Fatal("started twice")
+	}
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Stop(); err == nil {
+		t.Fatal("stopped twice")
+	}
+
+	// The background goroutine has exited: the router can be started again
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,81 @@
+package router
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Signed block - the body of the 0x04 frame and the authorization of reading:
+// [nonce 0:16] [salt 16:24] [sign 24:280] [pkLen 280:284] [pk 284:284+pkLen] [data 284+pkLen:]
+// PoW:       SHA256(nonce+salt) must match the complexity of the nonce
+// Signature: RSA-PSS(SHA256(nonce+salt+data))
+
+const (
+	SignedBlockNonceSize     = 16
+	SignedBlockSaltSize      = 8
+	SignedBlockSignatureSize = 256
+	SignedBlockHeaderSize    = SignedBlockNonceSize + SignedBlockSaltSize + SignedBlockSignatureSize + 4
+)
+
+func (c *Router) CheckSignedBlock(block []byte) (address string, publicKeyBS []byte, data []byte, err error) {
+	if len(block) < SignedBlockHeaderSize {
+		err = errors.New(ERR_XCHG_ROUTER_SIGNED_BLOCK_SIZE)
+		return
+	}
+
+	nonce := block[0:16]
+	signature := block[24:280]
+	publicKeyLen := int(binary.LittleEndian.Uint32(block[280:]))
+	if len(block) < SignedBlockHeaderSize+publicKeyLen {
+		err = errors.New(ERR_XCHG_ROUTER_SIGNED_BLOCK_SIZE)
+		return
+	}
+	publicKeyBS = block[284 : 284+publicKeyLen]
+	data = block[284+publicKeyLen:]
+
+	// PoW
+	complexity := nonce[4]
+	powHash := sha256.Sum256(block[0:24])
+	if !CheckHash(powHash[:], complexity) {
+		err = errors.New(ERR_XCHG_ROUTER_WRONG_POW)
+		return
+	}
+
+	// Signature
+	var publicKey *rsa.PublicKey
+	publicKey, err = RSAPublicKeyFromDer(publicKeyBS)
+	if err != nil {
+		err = errors.New(ERR_XCHG_ROUTER_WRONG_PUBLIC_KEY)
+		return
+	}
+	signedContent := make([]byte, 24+len(data))
+	copy(signedContent[0:], block[0:24])
+	copy(signedContent[24:], data)
+	hash := sha256.Sum256(signedContent)
+	err = rsa.VerifyPSS(publicKey, crypto.SHA256, hash[:], signature, &rsa.PSSOptions{
+		SaltLength: 32,
+	})
+	if err != nil {
+		err = errors.New(ERR_XCHG_ROUTER_WRONG_SIGNATURE)
+		return
+	}
+
+	// Nonce is used only once
+	if !c.nonces.Check(nonce) {
+		err = errors.New(ERR_XCHG_ROUTER_WRONG_NONCE)
+		return
+	}
+
+	address = AddressForPublicKeyBS(publicKeyBS)
+	return
+}
+
+func AddressForPublicKeyBS(publicKeyBS []byte) string {
+	hash := sha256.Sum256(publicKeyBS)
+	return "#" + strings.ToLower(base32.StdEncoding.EncodeToString(hash[:AddressBytesSize]))
+}
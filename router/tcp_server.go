@@ -0,0 +1,302 @@
+package router
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TCP API of the router - the functions of the HTTP API over a persistent connection.
+// The port is the port of the HTTP API + TcpPortOffset.
+//
+// Message: [length 4][function 1][id 8][status 1][data]
+// The length is the length of the whole message (as in the header of frames).
+//
+// Requests are processed concurrently (up to tcpMaxRequests per connection,
+// the excess is answered with an error), the response has the same function and id.
+// A successful read ("r") subscribes the connection to the address:
+// new frames of the address are pushed to the connection at once (function "f", id - the id of the message).
+// The connection is subscribed before the frames are read: a frame stored during the read
+// is pushed (and may be returned by the read too).
+// Pushed frames wait in the queue of the connection (not more than tcpPushQueueSize frames
+// and tcpPushQueueBytes): the connection that does not read them is closed.
+const (
+	TcpHeaderSize = 14
+	TcpPortOffset = 1000
+	TcpMaxMessage = INPUT_BUFFER_SIZE
+
+	// The connection without requests is closed
+	TcpIdleTimeout = 60 * time.Second
+
+	tcpWriteTimeout = 5 * time.Second
+
+	tcpMaxRequests    = 64
+	tcpPushQueueSize  = 1024
+	tcpPushQueueBytes = 16 * 1024 * 1024
+)
+
+// Functions of the TCP API
+const (
+	TcpFunctionNonce = byte('n')
+	TcpFunctionFrame = byte('c')
+	TcpFunctionWrite = byte('w')
+	TcpFunctionRead  = byte('r')
+	TcpFunctionPush  = byte('f') // router to peer, id - the id of the message
+)
+
+type TcpServer struct {
+	mtx         sync.Mutex
+	listener    net.Listener
+	server      *Router
+	connections map[*tcpConnection]struct{}
+	subscribers map[string]map[*tcpConnection]struct{}
+	stopping    bool
+}
+
+type tcpConnection struct {
+	pushBytes int64 // atomic, the first field - 64-bit aligned
+	mtx       sync.Mutex
+	conn      net.Conn
+	state     *ConnectionState
+	addresses map[string]struct{}
+	requests  chan struct{}
+	pushCh    chan []byte
+	closedCh  chan struct{}
+}
+
+func NewTcpServer() *TcpServer {
+	var c TcpServer
+	c.connections = make(map[*tcpConnection]struct{})
+	c.subscribers = make(map[string]map[*tcpConnection]struct{})
+	return &c
+}
+
+func (c *TcpServer) Start(server *Router, port int) (err error) {
+	c.server = server
+	c.listener, err = net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+	if err != nil {
+		return
+	}
+	server.AddPutHandler(c.push)
+	go c.thAccept()
+	return
+}
+
+func (c *TcpServer) Stop() error {
+	c.mtx.Lock()
+	c.stopping = true
+	listener := c.listener
+	connections := make([]*tcpConnection, 0, len(c.connections))
+	for connection := range c.connections {
+		connections = append(connections, connection)
+	}
+	c.mtx.Unlock()
+	for _, connection := range connections {
+		connection.conn.Close()
+	}
+	if listener == nil {
+		return nil
+	}
+	return listener.Close()
+}
+
+func (c *TcpServer) thAccept() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			c.mtx.Lock()
+			stopping := c.stopping
+			c.mtx.Unlock()
+			if stopping {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		connection := &tcpConnection{}
+		connection.conn = conn
+		connection.state = NewConnectionState()
+		connection.addresses = make(map[string]struct{})
+		connection.requests = make(chan struct{}, tcpMaxRequests)
+		connection.pushCh = make(chan []byte, tcpPushQueueSize)
+		connection.closedCh = make(chan struct{})
+		c.mtx.Lock()
+		c.connections[connection] = struct{}{}
+		c.mtx.Unlock()
+		go c.thReceive(connection)
+		go c.thPush(connection)
+	}
+}
+
+func (c *TcpServer) thReceive(connection *tcpConnection) {
+	c.server.DeclareTcpConnection(1)
+	for {
+		connection.conn.SetReadDeadline(time.Now().Add(TcpIdleTimeout))
+		message, err := TcpReadMessage(connection.conn)
+		if err != nil {
+			break
+		}
+		c.server.DeclareTcpRequest()
+		select {
+		case connection.requests <- struct{}{}:
+			go func() {
+				c.processMessage(connection, message)
+				<-connection.requests
+			}()
+		default:
+			connection.send(message[4], binary.LittleEndian.Uint64(message[5:]), 1, []byte(ERR_XCHG_ROUTER_TCP_TOO_MANY_REQUESTS))
+		}
+	}
+	c.server.DeclareTcpConnection(-1)
+	connection.conn.Close()
+	close(connection.closedCh)
+	c.remove(connection)
+}
+
+// Writes the pushed frames of the queue
+func (c *TcpServer) thPush(connection *tcpConnection) {
+	for {
+		select {
+		case message := <-connection.pushCh:
+			atomic.AddInt64(&connection.pushBytes, -int64(len(message)))
+			if connection.write(message) != nil {
+				connection.conn.Close()
+				return
+			}
+			c.server.DeclareTcpFrameOut()
+		case <-connection.closedCh:
+			return
+		}
+	}
+}
+
+func (c *TcpServer) processMessage(connection *tcpConnection, message []byte) {
+	function := message[4]
+	id := binary.LittleEndian.Uint64(message[5:])
+	data := message[TcpHeaderSize:]
+
+	var result []byte
+	var err error
+	switch function {
+	case TcpFunctionNonce:
+		result = c.server.GetNonce()
+	case TcpFunctionFrame:
+		result = c.server.ProcessFrame(data)
+	case TcpFunctionWrite:
+		c.server.PutFrames(data)
+	case TcpFunctionRead:
+		var address string
+		address, err = c.server.AuthorizeRead(connection.state, data)
+		if err == nil {
+			c.subscribe(connection, address)
+			// The signed block is checked only once
+			result, _, err = c.server.GetMessages(connection.state, data[:46])
+		}
+	default:
+		return
+	}
+
+	status := byte(0)
+	if err != nil {
+		status = 1
+		result = []byte(err.Error())
+	}
+	connection.send(function, id, status, result)
+}
+
+func (c *tcpConnection) send(function byte, id uint64, status byte, data []byte) error {
+	return c.write(TcpMarshal(function, id, status, data))
+}
+
+func (c *tcpConnection) write(message []byte) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	_, err := c.conn.Write(message)
+	return err
+}
+
+// Queues the new frame to the connections subscribed to the address.
+// The connection with the full queue is closed (the peer reads the frames again after reconnecting).
+func (c *TcpServer) push(address string, id uint64, frame []byte) {
+	c.mtx.Lock()
+	connections := make([]*tcpConnection, 0, len(c.subscribers[address]))
+	for connection := range c.subscribers[address] {
+		connections = append(connections, connection)
+	}
+	c.mtx.Unlock()
+	if len(connections) == 0 {
+		return
+	}
+	message := TcpMarshal(TcpFunctionPush, id, 0, frame)
+	for _, connection := range connections {
+		if atomic.AddInt64(&connection.pushBytes, int64(len(message))) > tcpPushQueueBytes {
+			connection.conn.Close()
+			continue
+		}
+		select {
+		case connection.pushCh <- message:
+		default:
+			connection.conn.Close()
+		}
+	}
+}
+
+// The read of the address is authorized
+func (c *TcpServer) subscribe(connection *tcpConnection, address string) {
+	c.mtx.Lock()
+	if _, ok := c.connections[connection]; ok {
+		connection.addresses[address] = struct{}{}
+		subscribers, ok := c.subscribers[address]
+		if !ok {
+			subscribers = make(map[*tcpConnection]struct{})
+			c.subscribers[address] = subscribers
+		}
+		subscribers[connection] = struct{}{}
+	}
+	c.mtx.Unlock()
+}
+
+func (c *TcpServer) remove(connection *tcpConnection) {
+	c.mtx.Lock()
+	delete(c.connections, connection)
+	for address := range connection.addresses {
+		delete(c.subscribers[address], connection)
+		if len(c.subscribers[address]) == 0 {
+			delete(c.subscribers, address)
+		}
+	}
+	c.mtx.Unlock()
+}
+
+func TcpMarshal(function byte, id uint64, status byte, data []byte) (message []byte) {
+	message = make([]byte, TcpHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(message[0:], uint32(len(message)))
+	message[4] = function
+	binary.LittleEndian.PutUint64(message[5:], id)
+	message[13] = status
+	copy(message[TcpHeaderSize:], data)
+	return
+}
+
+// Reads one message [length 4][function 1][id 8][status 1][data]
+func TcpReadMessage(reader io.Reader) (message []byte, err error) {
+	header := make([]byte, 4)
+	_, err = io.ReadFull(reader, header)
+	if err != nil {
+		return
+	}
+	length := int(binary.LittleEndian.Uint32(header))
+	if length < TcpHeaderSize || length > TcpMaxMessage {
+		err = errors.New(ERR_XCHG_ROUTER_TCP_WRONG_LENGTH)
+		return
+	}
+	message = make([]byte, length)
+	copy(message, header)
+	_, err = io.ReadFull(reader, message[4:])
+	return
+}
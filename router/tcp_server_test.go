@@ -0,0 +1,251 @@
+package router
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Client of the TCP API: pushed frames are collected, responses are returned by call
+type testTcpClient struct {
+	mtx       sync.Mutex
+	conn      net.Conn
+	numbers   map[uint64]struct{}
+	responses chan []byte
+	closedCh  chan struct{}
+}
+
+func startTestTcpServer(t testing.TB, r *Router) (server *TcpServer, port int) {
+	server = NewTcpServer()
+	if err := server.Start(r, 0); err != nil {
+		t.Fatal(err)
+	}
+	port = server.listener.Addr().(*net.TCPAddr).Port
+	return
+}
+
+func newTestTcpClient(t testing.TB, port int) *testTcpClient {
+	var c testTcpClient
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.conn = conn
+	c.numbers = make(map[uint64]struct{})
+	c.responses = make(chan []byte, 100)
+	c.closedCh = make(chan struct{})
+	go c.thReceive()
+	return &c
+}
+
+func (c *testTcpClient) thReceive() {
+	defer close(c.closedCh)
+	for {
+		message, err := TcpReadMessage(c.conn)
+		if err != nil {
+			return
+		}
+		if message[4] == TcpFunctionPush {
+			c.add(testFrameNumbers(message[TcpHeaderSize:]))
+			continue
+		}
+		c.responses <- message
+	}
+}
+
+func (c *testTcpClient) call(t testing.TB, function byte, data []byte) (result []byte, status byte) {
+	if _, err := c.conn.Write(TcpMarshal(function, 1, 0, data)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-c.responses:
+		return message[TcpHeaderSize:], message[13]
+	case <-time.After(5 * time.Second):
+		t.Fatal("no response")
+	}
+	return
+}
+
+func (c *testTcpClient) add(numbers []uint64) {
+	c.mtx.Lock()
+	for _, number := range numbers {
+		c.numbers[number] = struct{}{}
+	}
+	c.mtx.Unlock()
+}
+
+// The frames first..last are received
+func (c *testTcpClient) waitFrames(first uint64, last uint64, timeout time.Duration) (missing uint64) {
+	beginDT := time.Now()
+	for {
+		missing = 0
+		c.mtx.Lock()
+		for number := first; number <= last; number++ {
+			if _, ok := c.numbers[number]; !ok {
+				missing++
+			}
+		}
+		c.mtx.Unlock()
+		if missing == 0 || time.Since(beginDT) > timeout {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// The frames stored while the connection reads the address are read or pushed
+func TestTcpReadDuringPut(t *testing.T) {
+	r := NewRouter()
+	server, port := startTestTcpServer(t, r)
+	defer server.Stop()
+	privateKey := testPrivateKey(t)
+	addressBS := testAddressBS(t, privateKey)
+
+	const clientsCount = 30
+	signedBlocks := make([][]byte, clientsCount)
+	for i := range signedBlocks {
+		signedBlocks[i] = testSignedBlock(t, r.GetNonce(), privateKey, nil)
+	}
+
+	// Many stored frames - the read takes time
+	var mtx sync.Mutex
+	lastNumber := uint64(0)
+	for ; lastNumber < 9000; lastNumber++ {
+		r.Put(testFrame(addressBS, lastNumber+1))
+	}
+
+	// Frames are stored all the time of the reads
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go func() {
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			mtx.Lock()
+			lastNumber++
+			number := lastNumber
+			mtx.Unlock()
+			r.Put(testFrame(addressBS, number))
+			time.Sleep(20 * time.Microsecond)
+		}
+	}()
+
+	for i, signedBlock := range signedBlocks {
+		client := newTestTcpClient(t, port)
+		result, status := client.call(t, TcpFunctionRead, testReadRequest(addressBS, 0, signedBlock))
+		if status != 0 {
+			t.Fatal(string(result))
+		}
+		// The storage keeps the last frames only
+		numbers := testFrameNumbers(result[8:])
+		if len(numbers) == 0 {
+			t.Fatal("no frames read")
+		}
+		client.add(numbers)
+		time.Sleep(20 * time.Millisecond)
+		mtx.Lock()
+		number := lastNumber
+		mtx.Unlock()
+		// The last frame may be stored right now
+		if missing := client.waitFrames(numbers[0], number-1, 5*time.Second); missing > 0 {
+			t.Fatal("client", i, "missing frames:", missing)
+		}
+		client.conn.Close()
+	}
+}
+
+func TestTcpReadNotAuthorized(t *testing.T) {
+	r := NewRouter()
+	server, port := startTestTcpServer(t, r)
+	defer server.Stop()
+	addressBS := testAddressBS(t, testPrivateKey(t))
+
+	client := newTestTcpClient(t, port)
+	defer client.conn.Close()
+	result, status := client.call(t, TcpFunctionRead, testReadRequest(addressBS, 0, nil))
+	if status == 0 || string(result) != ERR_XCHG_ROUTER_READ_NOT_AUTHORIZED {
+		t.Fatal("read without the signed block:", status, string(result))
+	}
+	r.Put(testFrame(addressBS, 1))
+	if missing := client.waitFrames(1, 1, 200*time.Millisecond); missing == 0 {
+		t.Fatal("the frame is pushed to the connection without authorization")
+	}
+}
+
+// The subscriber that does not read the pushed frames does not stall the writers and is disconnected
+func TestTcpSlowSubscriber(t *testing.T) {
+	r := NewRouter()
+	server, port := startTestTcpServer(t, r)
+	defer server.Stop()
+	privateKey := testPrivateKey(t)
+	addressBS := testAddressBS(t, privateKey)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := testReadRequest(addressBS, 0, testSignedBlock(t, r.GetNonce(), privateKey, nil))
+	if _, err = conn.Write(TcpMarshal(TcpFunctionRead, 1, 0, request)); err != nil {
+		t.Fatal(err)
+	}
+	response, err := TcpReadMessage(conn)
+	if err != nil || response[13] != 0 {
+		t.Fatal("read:", err)
+	}
+
+	frame := make([]byte, 64*1024)
+	binary.LittleEndian.PutUint32(frame[0:], uint32(len(frame)))
+	copy(frame[70:], addressBS)
+	beginDT := time.Now()
+	for i := 0; i < 2000; i++ {
+		r.Put(frame)
+	}
+	if time.Since(beginDT) > 2*time.Second {
+		t.Fatal("the writer is stalled by the subscriber:", time.Since(beginDT))
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.Copy(io.Discard, conn)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("the subscriber is not disconnected")
+	}
+}
+
+func TestTcpTooManyRequests(t *testing.T) {
+	r := NewRouter()
+	server, port := startTestTcpServer(t, r)
+	defer server.Stop()
+
+	client := newTestTcpClient(t, port)
+	defer client.conn.Close()
+	if _, status := client.call(t, TcpFunctionNonce, nil); status != 0 {
+		t.Fatal("nonce request failed")
+	}
+
+	server.mtx.Lock()
+	var connection *tcpConnection
+	for connection = range server.connections {
+	}
+	server.mtx.Unlock()
+	for i := 0; i < tcpMaxRequests; i++ {
+		connection.requests <- struct{}{}
+	}
+	result, status := client.call(t, TcpFunctionNonce, nil)
+	if status == 0 || string(result) != ERR_XCHG_ROUTER_TCP_TOO_MANY_REQUESTS {
+		t.Fatal("the request over the limit is processed:", status, string(result))
+	}
+	<-connection.requests
+	if _, status = client.call(t, TcpFunctionNonce, nil); status != 0 {
+		t.Fatal("the request under the limit failed")
+	}
+}
@@ -0,0 +1,199 @@
+package router
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// UDP datagram:
+// [function 1][id 8][status 1][fragment index 1][fragments count 1][data]
+//
+// Messages longer than UdpChunkSize are split into fragments,
+// so a datagram fits into the minimal IPv6 MTU (1280) without IP fragmentation.
+// Incomplete messages are kept up to udpAssemblyTimeout, not more than
+// udpMaxPartialMessages (udpMaxPartialPerSource of one source) and udpMaxAssemblyBytes.
+const (
+	UdpHeaderSize   = 12
+	UdpChunkSize    = 1200
+	UdpMaxFragments = 255
+	UdpMaxMessage   = UdpChunkSize * UdpMaxFragments
+	UdpCookieSize   = 16
+
+	udpAssemblyTimeout     = 5 * time.Second
+	udpMaxPartialMessages  = 1024
+	udpMaxPartialPerSource = 16
+	udpMaxAssemblyBytes    = 32 * 1024 * 1024
+)
+
+// Functions of the UDP API
+const (
+	UdpFunctionNonce = byte('n')
+	UdpFunctionFrame = byte('c')
+	UdpFunctionWrite = byte('w')
+	UdpFunctionRead  = byte('r')
+	UdpFunctionPush  = byte('f') // router to peer, id - the id of the message
+
+	// Observed address of the sender (ip:port) - for direct connections of peers
+	UdpFunctionObserve = byte('o')
+
+	// Handshake: [UdpCookieSize zero bytes] -> [cookie], [cookie] -> [] (the endpoint is verified).
+	// The router answers other requests of verified endpoints only.
+	UdpFunctionCookie = byte('k')
+)
+
+// Functions between peers (direct path, id - the session)
+const (
+	UdpFunctionPunchToServer    = byte('p')
+	UdpFunctionPunchToServerAck = byte('P')
+	UdpFunctionPunchToClient    = byte('q')
+	UdpFunctionPunchToClientAck = byte('Q')
+	UdpFunctionDirectFrame      = byte('d')
+
+	// Frames 0x20/0x21 of LAN discovery
+	UdpFunctionLanFrame = byte('l')
+)
+
+type UdpMessage struct {
+	Function byte
+	Id       uint64
+	Status   byte
+	Data     []byte
+}
+
+// Splits the message into datagrams, the message longer than UdpMaxMessage is an error
+func UdpMarshal(function byte, id uint64, status byte, data []byte) (datagrams [][]byte, err error) {
+	count := (len(data) + UdpChunkSize - 1) / UdpChunkSize
+	if count == 0 {
+		count = 1
+	}
+	if count > UdpMaxFragments {
+		err = errors.New(ERR_XCHG_ROUTER_UDP_TOO_LARGE)
+		return
+	}
+	datagrams = make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		begin := i * UdpChunkSize
+		end := begin + UdpChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		datagram := make([]byte, UdpHeaderSize+end-begin)
+		datagram[0] = function
+		binary.LittleEndian.PutUint64(datagram[1:], id)
+		datagram[9] = status
+		datagram[10] = byte(i)
+		datagram[11] = byte(count)
+		copy(datagram[UdpHeaderSize:], data[begin:end])
+		datagrams = append(datagrams, datagram)
+	}
+	return
+}
+
+// Collects fragments of messages
+type UdpAssembler struct {
+	mtx      sync.Mutex
+	messages map[string]*udpPartialMessage
+	sources  map[string]int
+	bytes    int
+}
+
+type udpPartialMessage struct {
+	source    string
+	fragments [][]byte
+	received  int
+	bytes     int
+	beginDT   time.Time
+}
+
+func NewUdpAssembler() *UdpAssembler {
+	var c UdpAssembler
+	c.messages = make(map[string]*udpPartialMessage)
+	c.sources = make(map[string]int)
+	return &c
+}
+
+// Returns the message if the datagram completes it
+func (c *UdpAssembler) Add(source string, datagram []byte) (message *UdpMessage) {
+	if len(datagram) < UdpHeaderSize {
+		return
+	}
+	index := int(datagram[10])
+	count := int(datagram[11])
+	if count == 0 || index >= count {
+		return
+	}
+
+	message = &UdpMessage{}
+	message.Function = datagram[0]
+	message.Id = binary.LittleEndian.Uint64(datagram[1:])
+	message.Status = datagram[9]
+
+	if count == 1 {
+		message.Data = datagram[UdpHeaderSize:]
+		return
+	}
+
+	key := source + "/" + string(datagram[0:9])
+	fragment := datagram[UdpHeaderSize:]
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	partialMessage, ok := c.messages[key]
+	if ok && len(partialMessage.fragments) != count {
+		c.remove(key, partialMessage)
+		ok = false
+	}
+	if !ok {
+		if len(c.messages) >= udpMaxPartialMessages || c.sources[source] >= udpMaxPartialPerSource {
+			message = nil
+			return
+		}
+		partialMessage = &udpPartialMessage{}
+		partialMessage.source = source
+		partialMessage.fragments = make([][]byte, count)
+		partialMessage.beginDT = time.Now()
+		c.messages[key] = partialMessage
+		c.sources[source]++
+	}
+	if partialMessage.fragments[index] == nil {
+		if c.bytes+len(fragment) > udpMaxAssemblyBytes {
+			message = nil
+			return
+		}
+		partialMessage.fragments[index] = fragment
+		partialMessage.received++
+		partialMessage.bytes += len(fragment)
+		c.bytes += len(fragment)
+	}
+	if partialMessage.received < count {
+		message = nil
+		return
+	}
+	c.remove(key, partialMessage)
+	message.Data = make([]byte, 0, partialMessage.bytes)
+	for _, fragment := range partialMessage.fragments {
+		message.Data = append(message.Data, fragment...)
+	}
+	return
+}
+
+// Removes incomplete messages
+func (c *UdpAssembler) Purge() {
+	c.mtx.Lock()
+	for key, partialMessage := range c.messages {
+		if time.Since(partialMessage.beginDT) > udpAssemblyTimeout {
+			c.remove(key, partialMessage)
+		}
+	}
+	c.mtx.Unlock()
+}
+
+func (c *UdpAssembler) remove(key string, partialMessage *udpPartialMessage) {
+	delete(c.messages, key)
+	c.bytes -= partialMessage.bytes
+	c.sources[partialMessage.source]--
+	if c.sources[partialMessage.source] <= 0 {
+		delete(c.sources, partialMessage.source)
+	}
+}
@@ -0,0 +1,316 @@
+package router
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UDP API of the router - the functions of the HTTP API in datagrams (see UdpMarshal).
+// Response: the same function and id, status 0 - success, 1 - error.
+//
+// Source addresses of datagrams can be spoofed: the router answers only the verified endpoints.
+// An endpoint is verified by the handshake (UdpFunctionCookie): the router sends the cookie
+// (HMAC of the endpoint) in the datagram of the size of the request, the endpoint sends it back.
+// Other datagrams of unknown endpoints are dropped. Not more than udpMaxEndpoints are verified.
+//
+// A successful read ("r") subscribes the endpoint to the address before the frames are read:
+// new frames of the address are pushed to the endpoint (function "f").
+// A frame longer than UdpMaxMessage is not pushed: the push has status 1 (the frame is read by other transports).
+// The subscription expires if the endpoint sends nothing during udpEndpointTimeout.
+//
+// Requests are processed by udpWorkers, not more than udpQueueSize wait (the excess is dropped).
+type UdpServer struct {
+	mtx          sync.Mutex
+	conn         *net.UDPConn
+	server       *Router
+	assembler    *UdpAssembler
+	endpoints    map[string]*udpEndpoint
+	subscribers  map[string]map[string]*udpEndpoint
+	cookieSecret []byte
+	queue        chan udpWork
+	stopping     bool
+}
+
+type udpEndpoint struct {
+	key       string
+	addr      *net.UDPAddr
+	state     *ConnectionState
+	addresses map[string]struct{}
+	lastDT    time.Time
+}
+
+type udpWork struct {
+	endpoint *udpEndpoint
+	message  *UdpMessage
+}
+
+const (
+	udpEndpointTimeout = 30 * time.Second
+	udpReadBufferSize  = 4 * 1024 * 1024
+	udpMaxEndpoints    = 16 * 1024
+	udpCookiePeriod    = 60 // seconds
+	udpWorkers         = 16
+	udpQueueSize       = 1024
+)
+
+func NewUdpServer() *UdpServer {
+	var c UdpServer
+	c.assembler = NewUdpAssembler()
+	c.endpoints = make(map[string]*udpEndpoint)
+	c.subscribers = make(map[string]map[string]*udpEndpoint)
+	c.cookieSecret = make([]byte, 32)
+	rand.Read(c.cookieSecret)
+	return &c
+}
+
+func (c *UdpServer) Start(server *Router, port int) (err error) {
+	c.server = server
+	c.conn, err = net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return
+	}
+	c.conn.SetReadBuffer(udpReadBufferSize)
+	c.conn.SetWriteBuffer(udpReadBufferSize)
+	server.AddPutHandler(c.push)
+	c.queue = make(chan udpWork, udpQueueSize)
+	for i := 0; i < udpWorkers; i++ {
+		go c.thWork()
+	}
+	go c.thReceive()
+	return
+}
+
+func (c *UdpServer) Stop() error {
+	c.mtx.Lock()
+	c.stopping = true
+	conn := c.conn
+	c.mtx.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+func (c *UdpServer) thReceive() {
+	defer close(c.queue)
+	buffer := make([]byte, UdpHeaderSize+UdpChunkSize+1024)
+	lastPurgeDT := time.Now()
+	for {
+		c.mtx.Lock()
+		stopping := c.stopping
+		c.mtx.Unlock()
+		if stopping {
+			break
+		}
+
+		if time.Since(lastPurgeDT) > time.Second {
+			c.purgeEndpoints()
+			c.assembler.Purge()
+			lastPurgeDT = time.Now()
+		}
+
+		c.conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := c.conn.ReadFromUDP(buffer)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			break
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buffer[:n])
+		endpoint := c.touchEndpoint(addr)
+		if endpoint == nil {
+			c.processHandshake(addr, datagram)
+			continue
+		}
+		message := c.assembler.Add(endpoint.key, datagram)
+		if message != nil {
+			c.server.DeclareUdpRequest()
+			select {
+			case c.queue <- udpWork{endpoint: endpoint, message: message}:
+			default:
+			}
+		}
+	}
+}
+
+func (c *UdpServer) thWork() {
+	for work := range c.queue {
+		c.processMessage(work.endpoint, work.message)
+	}
+}
+
+// The datagram of an unknown endpoint: only the handshake (one datagram) is answered
+func (c *UdpServer) processHandshake(addr *net.UDPAddr, datagram []byte) {
+	if len(datagram) != UdpHeaderSize+UdpCookieSize || datagram[0] != UdpFunctionCookie || datagram[11] != 1 {
+		return
+	}
+	key := udpEndpointKey(addr)
+	cookie := datagram[UdpHeaderSize:]
+	if !c.checkCookie(key, cookie) {
+		// The response is not larger than the request
+		c.send(addr, UdpFunctionCookie, binary.LittleEndian.Uint64(datagram[1:]), 0, c.cookie(key, time.Now().Unix()/udpCookiePeriod))
+		return
+	}
+	if c.addEndpoint(addr, key) {
+		c.send(addr, UdpFunctionCookie, binary.LittleEndian.Uint64(datagram[1:]), 0, nil)
+	}
+}
+
+func (c *UdpServer) cookie(key string, period int64) []byte {
+	periodBS := make([]byte, 8)
+	binary.LittleEndian.PutUint64(periodBS, uint64(period))
+	mac := hmac.New(sha256.New, c.cookieSecret)
+	mac.Write([]byte(key))
+	mac.Write(periodBS)
+	return mac.Sum(nil)[:UdpCookieSize]
+}
+
+// The cookie of the current or the previous period
+func (c *UdpServer) checkCookie(key string, cookie []byte) bool {
+	period := time.Now().Unix() / udpCookiePeriod
+	return hmac.Equal(cookie, c.cookie(key, period)) || hmac.Equal(cookie, c.cookie(key, period-1))
+}
+
+func (c *UdpServer) processMessage(endpoint *udpEndpoint, message *UdpMessage) {
+	var result []byte
+	var err error
+	switch message.Function {
+	case UdpFunctionNonce:
+		result = c.server.GetNonce()
+	case UdpFunctionFrame:
+		result = c.server.ProcessFrame(message.Data)
+	case UdpFunctionWrite:
+		c.server.PutFrames(message.Data)
+	case UdpFunctionObserve:
+		result = []byte(endpoint.key)
+	case UdpFunctionCookie:
+		// The endpoint is verified already
+		if !c.checkCookie(endpoint.key, message.Data) {
+			result = c.cookie(endpoint.key, time.Now().Unix()/udpCookiePeriod)
+		}
+	case UdpFunctionRead:
+		var address string
+		address, err = c.server.AuthorizeRead(endpoint.state, message.Data)
+		if err == nil {
+			c.subscribe(endpoint, address)
+			// The signed block is checked only once
+			result, _, err = c.server.GetMessages(endpoint.state, message.Data[:46])
+		}
+	default:
+		return
+	}
+
+	status := byte(0)
+	if err != nil {
+		status = 1
+		result = []byte(err.Error())
+	}
+	if err = c.send(endpoint.addr, message.Function, message.Id, status, result); err != nil {
+		c.send(endpoint.addr, message.Function, message.Id, 1, []byte(err.Error()))
+	}
+}
+
+func (c *UdpServer) send(addr *net.UDPAddr, function byte, id uint64, status byte, data []byte) (err error) {
+	datagrams, err := UdpMarshal(function, id, status, data)
+	if err != nil {
+		return
+	}
+	for _, datagram := range datagrams {
+		c.conn.WriteToUDP(datagram, addr)
+	}
+	return
+}
+
+// Sends the new frame to the endpoints subscribed to the address
+func (c *UdpServer) push(address string, id uint64, frame []byte) {
+	c.mtx.Lock()
+	endpoints := make([]*udpEndpoint, 0, len(c.subscribers[address]))
+	for _, endpoint := range c.subscribers[address] {
+		endpoints = append(endpoints, endpoint)
+	}
+	c.mtx.Unlock()
+	for _, endpoint := range endpoints {
+		if err := c.send(endpoint.addr, UdpFunctionPush, id, 0, frame); err != nil {
+			c.send(endpoint.addr, UdpFunctionPush, id, 1, []byte(err.Error()))
+			continue
+		}
+		c.server.DeclareUdpFrameOut()
+	}
+}
+
+// The verified endpoint or nil
+func (c *UdpServer) touchEndpoint(addr *net.UDPAddr) (endpoint *udpEndpoint) {
+	key := udpEndpointKey(addr)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	endpoint, ok := c.endpoints[key]
+	if ok {
+		endpoint.lastDT = time.Now()
+	}
+	return
+}
+
+func (c *UdpServer) addEndpoint(addr *net.UDPAddr, key string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, ok := c.endpoints[key]; ok {
+		return true
+	}
+	if len(c.endpoints) >= udpMaxEndpoints {
+		return false
+	}
+	endpoint := &udpEndpoint{}
+	endpoint.key = key
+	endpoint.addr = addr
+	endpoint.state = NewConnectionState()
+	endpoint.addresses = make(map[string]struct{})
+	endpoint.lastDT = time.Now()
+	c.endpoints[key] = endpoint
+	return true
+}
+
+// The read of the address is authorized
+func (c *UdpServer) subscribe(endpoint *udpEndpoint, address string) {
+	c.mtx.Lock()
+	endpoint.addresses[address] = struct{}{}
+	subscribers, ok := c.subscribers[address]
+	if !ok {
+		subscribers = make(map[string]*udpEndpoint)
+		c.subscribers[address] = subscribers
+	}
+	subscribers[endpoint.key] = endpoint
+	c.mtx.Unlock()
+}
+
+func (c *UdpServer) purgeEndpoints() {
+	c.mtx.Lock()
+	for key, endpoint := range c.endpoints {
+		if time.Since(endpoint.lastDT) < udpEndpointTimeout {
+			continue
+		}
+		delete(c.endpoints, key)
+		for address := range endpoint.addresses {
+			delete(c.subscribers[address], key)
+			if len(c.subscribers[address]) == 0 {
+				delete(c.subscribers, address)
+			}
+		}
+	}
+	count := len(c.endpoints)
+	c.mtx.Unlock()
+	c.server.DeclareUdpEndpoints(count)
+}
+
+func udpEndpointKey(addr *net.UDPAddr) string {
+	return net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
+}
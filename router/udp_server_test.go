@@ -0,0 +1,144 @@
+package router
+
+import (
+	"bytes"
+	"encoding/base32"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startTestUdpServer(t testing.TB, r *Router) (server *UdpServer, conn *net.UDPConn) {
+	server = NewUdpServer()
+	if err := server.Start(r, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Stop() })
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: server.conn.LocalAddr().(*net.UDPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return
+}
+
+// Sends the request (one datagram) and returns the response datagram, nil - no response
+func testUdpCall(t testing.TB, conn *net.UDPConn, function byte, data []byte, timeout time.Duration) []byte {
+	datagrams, err := UdpMarshal(function, 1, 0, data)
+	if err != nil || len(datagrams) != 1 {
+		t.Fatal("wrong request", err)
+	}
+	if _, err = conn.Write(datagrams[0]); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, UdpHeaderSize+UdpChunkSize)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return nil
+	}
+	return buffer[:n]
+}
+
+func TestUdpHandshake(t *testing.T) {
+	_, conn := startTestUdpServer(t, NewRouter())
+
+	if response := testUdpCall(t, conn, UdpFunctionNonce, nil, 300*time.Millisecond); response != nil {
+		t.Fatal("unknown endpoint is answered")
+	}
+
+	request := make([]byte, UdpCookieSize)
+	response := testUdpCall(t, conn, UdpFunctionCookie, request, time.Second)
+	if response == nil || len(response) != UdpHeaderSize+UdpCookieSize || response[9] != 0 {
+		t.Fatal("wrong cookie response", response)
+	}
+	cookie := response[UdpHeaderSize:]
+
+	wrongCookie := bytes.Repeat([]byte{1}, UdpCookieSize)
+	response = testUdpCall(t, conn, UdpFunctionCookie, wrongCookie, time.Second)
+	if response == nil || !bytes.Equal(response[UdpHeaderSize:], cookie) {
+		t.Fatal("wrong cookie is accepted")
+	}
+	if response = testUdpCall(t, conn, UdpFunctionNonce, nil, 300*time.Millisecond); response != nil {
+		t.Fatal("endpoint is verified by the wrong cookie")
+	}
+
+	response = testUdpCall(t, conn, UdpFunctionCookie, cookie, time.Second)
+	if response == nil || len(response) != UdpHeaderSize || response[9] != 0 {
+		t.Fatal("cookie is not accepted", response)
+	}
+	response = testUdpCall(t, conn, UdpFunctionNonce, nil, time.Second)
+	if response == nil || response[9] != 0 || len(response) <= UdpHeaderSize {
+		t.Fatal("verified endpoint is not answered", response)
+	}
+}
+
+func TestUdpPushTooLarge(t *testing.T) {
+	r := NewRouter()
+	server, conn := startTestUdpServer(t, r)
+	addressBS := testAddressBS(t, testPrivateKey(t))
+	address := "#" + strings.ToLower(base32.StdEncoding.EncodeToString(addressBS))
+
+	localAddr := conn.LocalAddr().(*net.UDPAddr)
+	server.addEndpoint(localAddr, udpEndpointKey(localAddr))
+	server.subscribe(server.touchEndpoint(localAddr), address)
+
+	frame := testFrame(addressBS, 1)
+	frame = append(frame, make([]byte, UdpMaxMessage)...)
+	r.Put(frame)
+
+	buffer := make([]byte, UdpHeaderSize+UdpChunkSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buffer[0] != UdpFunctionPush || buffer[9] != 1 || string(buffer[UdpHeaderSize:n]) != ERR_XCHG_ROUTER_UDP_TOO_LARGE {
+		t.Fatal("wrong push", buffer[:n])
+	}
+}
+
+func TestUdpMarshalTooLarge(t *testing.T) {
+	datagrams, err := UdpMarshal(UdpFunctionPush, 1, 0, make([]byte, UdpMaxMessage))
+	if err != nil || len(datagrams) != UdpMaxFragments {
+		t.Fatal(len(datagrams), err)
+	}
+	if _, err = UdpMarshal(UdpFunctionPush, 1, 0, make([]byte, UdpMaxMessage+1)); err == nil || err.Error() != ERR_XCHG_ROUTER_UDP_TOO_LARGE {
+		t.Fatal("message is not rejected", err)
+	}
+}
+
+func TestUdpAssemblerLimits(t *testing.T) {
+	assembler := NewUdpAssembler()
+	firstFragment := func(id uint64) []byte {
+		datagrams, _ := UdpMarshal(UdpFunctionWrite, id, 0, make([]byte, UdpChunkSize*2))
+		return datagrams[0]
+	}
+
+	for id := uint64(1); id <= udpMaxPartialPerSource+1; id++ {
+		assembler.Add("a", firstFragment(id))
+	}
+	if len(assembler.messages) != udpMaxPartialPerSource || assembler.sources["a"] != udpMaxPartialPerSource {
+		t.Fatal("source limit", len(assembler.messages), assembler.sources["a"])
+	}
+	if assembler.bytes != udpMaxPartialPerSource*UdpChunkSize {
+		t.Fatal("wrong bytes", assembler.bytes)
+	}
+
+	datagrams, _ := UdpMarshal(UdpFunctionWrite, 1, 0, make([]byte, UdpChunkSize*2))
+	message := assembler.Add("a", datagrams[1])
+	if message == nil || len(message.Data) != UdpChunkSize*2 {
+		t.Fatal("message is not assembled")
+	}
+	if assembler.sources["a"] != udpMaxPartialPerSource-1 || assembler.bytes != (udpMaxPartialPerSource-1)*UdpChunkSize {
+		t.Fatal("assembled message is not removed")
+	}
+
+	for i := 0; i < udpMaxPartialMessages; i++ {
+		assembler.Add(string(rune('b'+i)), firstFragment(1))
+	}
+	if len(assembler.messages) != udpMaxPartialMessages {
+		t.Fatal("messages limit", len(assembler.messages))
+	}
+}
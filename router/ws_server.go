@@ -0,0 +1,166 @@
+package router
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket API (/api/ws) - the functions of the HTTP API over one connection,
+// raw binary frames instead of multipart/base64.
+//
+// Request:  [function 1][requestId 8][data]
+// Response: [function 1][requestId 8][status 1][data]
+//
+// Status: 0 - success, 1 - error (data is the error text).
+// Requests are processed concurrently (up to wsMaxRequests per connection,
+// the excess is answered with an error), "r" is a long polling request.
+const (
+	WsHeaderSize         = 9
+	WsResponseHeaderSize = 10
+
+	WsStatusSuccess = byte(0)
+	WsStatusError   = byte(1)
+
+	wsIdleTimeout = 60 * time.Second
+	wsMaxRequests = 64
+)
+
+// Requests are authorized by signatures of the peers, not by cookies,
+// so any origin is accepted unless the allowed origins are set
+func (c *HttpServer) SetWsAllowedOrigins(origins []string) {
+	c.mtx.Lock()
+	c.wsAllowedOrigins = append([]string{}, origins...)
+	c.mtx.Unlock()
+}
+
+// Requests without the Origin header are not from browsers
+func (c *HttpServer) checkWsOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(c.wsAllowedOrigins) == 0 {
+		return true
+	}
+	for _, allowedOrigin := range c.wsAllowedOrigins {
+		if strings.EqualFold(allowedOrigin, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+type wsConnection struct {
+	mtx        sync.Mutex
+	conn       *websocket.Conn
+	httpServer *HttpServer
+	state      *ConnectionState
+	ctx        context.Context
+	requests   chan struct{}
+}
+
+func (c *HttpServer) processWS(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  64 * 1024,
+		WriteBufferSize: 64 * 1024,
+		CheckOrigin:     c.checkWsOrigin,
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wsConn wsConnection
+	wsConn.conn = conn
+	wsConn.httpServer = c
+	wsConn.state = NewConnectionState()
+	wsConn.requests = make(chan struct{}, wsMaxRequests)
+	wsConn.ctx = ctx
+
+	c.server.DeclareWsConnection(1)
+	wsConn.thReceive()
+	c.server.DeclareWsConnection(-1)
+	conn.Close()
+}
+
+func (c *wsConnection) thReceive() {
+	c.conn.SetReadLimit(INPUT_BUFFER_SIZE)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+		messageType, message, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType != websocket.BinaryMessage || len(message) < WsHeaderSize {
+			continue
+		}
+		c.httpServer.server.DeclareWsRequest()
+		select {
+		case c.requests <- struct{}{}:
+			go func() {
+				c.processRequest(message)
+				<-c.requests
+			}()
+		default:
+			c.sendResponse(message, WsStatusError, []byte(ERR_XCHG_ROUTER_WS_TOO_MANY_REQUESTS))
+		}
+	}
+}
+
+func (c *wsConnection) processRequest(message []byte) {
+	function := message[0]
+	data := message[WsHeaderSize:]
+
+	var result []byte
+	var err error
+	switch function {
+	case 'n':
+		result = c.httpServer.server.GetNonce()
+	case 'c':
+		result = c.httpServer.server.ProcessFrame(data)
+	case 'w':
+		c.httpServer.server.PutFrames(data)
+	case 'r':
+		result, err = c.httpServer.getMessagesLongPolling(c.ctx, c.state, data)
+		if err == nil && c.ctx.Err() != nil {
+			return
+		}
+	default:
+		err = errors.New(ERR_XCHG_ROUTER_WS_WRONG_FUNCTION)
+	}
+
+	status := WsStatusSuccess
+	if err != nil {
+		status = WsStatusError
+		result = []byte(err.Error())
+	}
+	c.sendResponse(message, status, result)
+}
+
+func (c *wsConnection) sendResponse(message []byte, status byte, result []byte) {
+	response := make([]byte, WsResponseHeaderSize+len(result))
+	copy(response, message[:WsHeaderSize])
+	response[WsHeaderSize] = status
+	copy(response[WsResponseHeaderSize:], result)
+
+	c.mtx.Lock()
+	c.conn.WriteMessage(websocket.BinaryMessage, response)
+	c.mtx.Unlock()
+}
+
+// Request id of the message
+func WsRequestId(message []byte) uint64 {
+	return binary.LittleEndian.Uint64(message[1:])
+}
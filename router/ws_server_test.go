@@ -0,0 +1,83 @@
+package router
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func testWsDial(t *testing.T, server *httptest.Server, origin string) (conn *websocket.Conn, err error) {
+	header := http.Header{}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	conn, _, err = websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/ws", header)
+	return
+}
+
+// An unknown function is answered with the error and the id of the request
+func TestWsWrongFunction(t *testing.T) {
+	httpServer := newTestHttpServer(NewRouter())
+	server := httptest.NewServer(httpServer)
+	defer server.Close()
+
+	conn, err := testWsDial(t, server, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	request := make([]byte, WsHeaderSize)
+	request[0] = 'x'
+	binary.LittleEndian.PutUint64(request[1:], 42)
+	if err = conn.WriteMessage(websocket.BinaryMessage, request); err != nil {
+		t.Fatal(err)
+	}
+	_, response, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response) < WsResponseHeaderSize || WsRequestId(response) != 42 || response[WsHeaderSize] != WsStatusError {
+		t.Fatal("wrong response", response)
+	}
+	if string(response[WsResponseHeaderSize:]) != ERR_XCHG_ROUTER_WS_WRONG_FUNCTION {
+		t.Fatal("wrong error", string(response[WsResponseHeaderSize:]))
+	}
+}
+
+func TestWsAllowedOrigins(t *testing.T) {
+	httpServer := newTestHttpServer(NewRouter())
+	server := httptest.NewServer(httpServer)
+	defer server.Close()
+
+	// Any origin by default
+	conn, err := testWsDial(t, server, "http://other.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	httpServer.SetWsAllowedOrigins([]string{"https://app.example"})
+	tests := []struct {
+		origin   string
+		accepted bool
+	}{
+		{"https://app.example", true},
+		{"HTTPS://APP.EXAMPLE", true},
+		{"", true},
+		{"http://other.example", false},
+	}
+	for _, test := range tests {
+		conn, err = testWsDial(t, server, test.origin)
+		if (err == nil) != test.accepted {
+			t.Errorf("origin %q: %v, expected accepted %v", test.origin, err, test.accepted)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
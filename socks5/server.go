@@ -0,0 +1,243 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipoluianov/xchg/tunnel"
+	"github.com/ipoluianov/xchg/xchg"
+)
+
+// SOCKS5 server (RFC 1928) for xchg addresses
+// CONNECT to <address>.xchg:port or <custom address>.xchg:port is forwarded through xchg
+// to the tunnel server of the address, which connects to localhost:port on its side.
+
+const (
+	Suffix = ".xchg"
+
+	socksVersion = 0x05
+
+	methodNoAuth       = 0x00
+	methodNoAcceptable = 0xFF
+
+	commandConnect = 0x01
+
+	addressTypeIPv4   = 0x01
+	addressTypeDomain = 0x03
+	addressTypeIPv6   = 0x04
+
+	replySucceeded           = 0x00
+	replyGeneralFailure      = 0x01
+	replyNotAllowed          = 0x02
+	replyHostUnreachable     = 0x04
+	replyCommandNotSupported = 0x07
+	replyAddressNotSupported = 0x08
+
+	handshakeTimeout = 10 * time.Second
+
+	ERR_SOCKS5_WRONG_VERSION = "{ERR_SOCKS5_WRONG_VERSION}"
+	ERR_SOCKS5_NO_METHOD     = "{ERR_SOCKS5_NO_METHOD}"
+)
+
+type Config struct {
+	Listen string `json:"listen"`
+
+	// Auth data for the native address, default - DefaultAuthData
+	AuthData        map[string]string `json:"auth_data"`
+	DefaultAuthData string            `json:"default_auth_data"`
+}
+
+type Server struct {
+	mtx      sync.Mutex
+	peer     *xchg.Peer
+	config   Config
+	listener net.Listener
+	logger   xchg.Logger
+}
+
+func NewServer(peer *xchg.Peer, config Config, logger xchg.Logger) *Server {
+	var c Server
+	c.peer = peer
+	c.config = config
+	c.logger = logger
+	return &c
+}
+
+func (c *Server) Start() (err error) {
+	listener, err := net.Listen("tcp", c.config.Listen)
+	if err != nil {
+		return
+	}
+	c.mtx.Lock()
+	c.listener = listener
+	c.mtx.Unlock()
+	go c.thAccept(listener)
+	return
+}
+
+func (c *Server) Stop() {
+	c.mtx.Lock()
+	listener := c.listener
+	c.listener = nil
+	c.mtx.Unlock()
+	if listener != nil {
+		listener.Close()
+	}
+}
+
+func (c *Server) thAccept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go c.serve(conn)
+	}
+}
+
+func (c *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	err := c.negotiate(conn)
+	if err != nil {
+		c.logger.Println("socks5", conn.RemoteAddr(), "error:", err)
+		return
+	}
+
+	host, port, reply := c.readRequest(conn)
+	if reply != replySucceeded {
+		writeReply(conn, reply)
+		return
+	}
+
+	address, err := c.resolve(host)
+	if err != nil {
+		c.logger.Println("socks5 resolve", host, "error:", err)
+		writeReply(conn, replyHostUnreachable)
+		return
+	}
+
+	authData, ok := c.config.AuthData[address]
+	if !ok {
+		authData = c.config.DefaultAuthData
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	remoteConn, err := xchg.DialService(ctx, c.peer, address, authData, tunnel.PortService(port))
+	cancel()
+	if err != nil {
+		c.logger.Println("socks5 dial", address, port, "error:", err)
+		writeReply(conn, replyHostUnreachable)
+		return
+	}
+	defer remoteConn.Close()
+
+	err = writeReply(conn, replySucceeded)
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.logger.Println("socks5", conn.RemoteAddr(), "to", address, port)
+	tunnel.Pipe(conn, remoteConn)
+}
+
+// Only "no authentication" is supported - the server is for local clients
+func (c *Server) negotiate(conn net.Conn) (err error) {
+	header := make([]byte, 2)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return
+	}
+	if header[0] != socksVersion {
+		return errors.New(ERR_SOCKS5_WRONG_VERSION)
+	}
+	methods := make([]byte, int(header[1]))
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return
+	}
+	for _, method := range methods {
+		if method == methodNoAuth {
+			_, err = conn.Write([]byte{socksVersion, methodNoAuth})
+			return
+		}
+	}
+	conn.Write([]byte{socksVersion, methodNoAcceptable})
+	return errors.New(ERR_SOCKS5_NO_METHOD)
+}
+
+// [ver 1] [cmd 1] [rsv 1] [atyp 1] [addr] [port 2]
+func (c *Server) readRequest(conn net.Conn) (host string, port int, reply byte) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", 0, replyGeneralFailure
+	}
+	if header[0] != socksVersion {
+		return "", 0, replyGeneralFailure
+	}
+	if header[1] != commandConnect {
+		return "", 0, replyCommandNotSupported
+	}
+
+	switch header[3] {
+	case addressTypeDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return "", 0, replyGeneralFailure
+		}
+		name := make([]byte, int(size[0]))
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", 0, replyGeneralFailure
+		}
+		host = string(name)
+	case addressTypeIPv4, addressTypeIPv6:
+		// Only xchg names are routed
+		return "", 0, replyAddressNotSupported
+	default:
+		return "", 0, replyAddressNotSupported
+	}
+
+	portBS := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBS); err != nil {
+		return "", 0, replyGeneralFailure
+	}
+	port = int(binary.BigEndian.Uint16(portBS))
+
+	if !strings.HasSuffix(strings.ToLower(host), Suffix) {
+		return "", 0, replyNotAllowed
+	}
+	reply = replySucceeded
+	return
+}
+
+// <native address>.xchg or <custom address>.xchg
+func (c *Server) resolve(host string) (address string, err error) {
+	name := strings.ToLower(strings.TrimSuffix(strings.ToLower(host), Suffix))
+	if len(name) == xchg.AddressSize && isBase32(name) {
+		return "#" + name, nil
+	}
+	return c.peer.ResolveAddress(name)
+}
+
+func isBase32(s string) bool {
+	for _, ch := range strings.ToUpper(s) {
+		if !strings.ContainsRune(xchg.Base32Alphabet, ch) {
+			return false
+		}
+	}
+	return true
+}
+
+// The bound address is not known - 0.0.0.0:0
+func writeReply(conn net.Conn, reply byte) (err error) {
+	_, err = conn.Write([]byte{socksVersion, reply, 0x00, addressTypeIPv4, 0, 0, 0, 0, 0, 0})
+	return
+}
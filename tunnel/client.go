@@ -0,0 +1,80 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/ipoluianov/xchg/xchg"
+)
+
+// Listens local TCP ports and forwards connections through xchg
+type Client struct {
+	mtx       sync.Mutex
+	peer      *xchg.Peer
+	config    ClientConfig
+	listeners []net.Listener
+	logger    xchg.Logger
+}
+
+func NewClient(peer *xchg.Peer, config ClientConfig, logger xchg.Logger) *Client {
+	var c Client
+	c.peer = peer
+	c.config = config
+	c.logger = logger
+	return &c
+}
+
+func (c *Client) Start() (err error) {
+	listeners := make([]net.Listener, 0, len(c.config.Forwards))
+	for _, forward := range c.config.Forwards {
+		var listener net.Listener
+		listener, err = net.Listen("tcp", forward.Listen)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return
+		}
+		listeners = append(listeners, listener)
+		go c.thAccept(listener, forward)
+	}
+	c.mtx.Lock()
+	c.listeners = listeners
+	c.mtx.Unlock()
+	return
+}
+
+func (c *Client) Stop() {
+	c.mtx.Lock()
+	listeners := c.listeners
+	c.listeners = nil
+	c.mtx.Unlock()
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
+
+func (c *Client) thAccept(listener net.Listener, forward ForwardConfig) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go c.serve(conn, forward)
+	}
+}
+
+func (c *Client) serve(conn net.Conn, forward ForwardConfig) {
+	defer conn.Close()
+
+	remoteConn, err := xchg.DialService(context.Background(), c.peer, forward.Address, forward.AuthData, forward.Service)
+	if err != nil {
+		c.logger.Println("forward", forward.Listen, "dial", forward.Address, "error:", err)
+		return
+	}
+	defer remoteConn.Close()
+
+	c.logger.Println("forward", conn.RemoteAddr(), "to", forward.Address, forward.Service)
+	Pipe(conn, remoteConn)
+}
@@ -0,0 +1,69 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// Server side: connections to the service Name are forwarded to Target (host:port)
+type TunnelConfig struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+
+	// Allowlists. Empty - any authorized client.
+	AllowedAuthData  []string `json:"allowed_auth_data"`
+	AllowedAddresses []string `json:"allowed_addresses"`
+}
+
+type ServerConfig struct {
+	Tunnels []TunnelConfig `json:"tunnels"`
+
+	// Local ports available by the service tcp:<port> (SOCKS5 clients)
+	AllowedPorts         []int    `json:"allowed_ports"`
+	PortsAllowedAuthData []string `json:"ports_allowed_auth_data"`
+
+	// A tunnel without allowlists (or ports without PortsAllowedAuthData) is available to any client of the network.
+	// The server refuses to start with such tunnels and ports unless it is set.
+	AllowAnyClient bool `json:"allow_any_client"`
+}
+
+// Names of the tunnels available to any client
+func (c *ServerConfig) OpenTunnels() (names []string) {
+	for _, t := range c.Tunnels {
+		if len(t.AllowedAuthData) == 0 && len(t.AllowedAddresses) == 0 {
+			names = append(names, t.Name)
+		}
+	}
+	return
+}
+
+// Ports available to any client
+func (c *ServerConfig) OpenPorts() bool {
+	return len(c.AllowedPorts) > 0 && len(c.PortsAllowedAuthData) == 0
+}
+
+// Client side: TCP connections to Listen (host:port) are forwarded to the service of the xchg address
+type ForwardConfig struct {
+	Listen   string `json:"listen"`
+	Address  string `json:"address"`
+	AuthData string `json:"auth_data"`
+	Service  string `json:"service"`
+}
+
+type ClientConfig struct {
+	Forwards []ForwardConfig `json:"forwards"`
+}
+
+type Config struct {
+	Server ServerConfig `json:"server"`
+	Client ClientConfig `json:"client"`
+}
+
+func LoadConfig(fileName string) (config Config, err error) {
+	bs, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(bs, &config)
+	return
+}
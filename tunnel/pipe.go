@@ -0,0 +1,32 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	ERR_TUNNEL_UNKNOWN_SERVICE = "{ERR_TUNNEL_UNKNOWN_SERVICE}"
+	ERR_TUNNEL_NO_AUTH         = "{ERR_TUNNEL_NO_AUTH}"
+
+	// Service of a local port: tcp:<port>
+	PortServicePrefix = "tcp:"
+)
+
+// Service for the connection to localhost:port of the server
+func PortService(port int) string {
+	return PortServicePrefix + strconv.Itoa(port)
+}
+
+// Copies data in both directions until one of the sides is closed
+func Pipe(conn1 net.Conn, conn2 net.Conn) {
+	done := make(chan struct{}, 2)
+	copyData := func(dst net.Conn, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go copyData(conn1, conn2)
+	go copyData(conn2, conn1)
+	<-done
+}
@@ -0,0 +1,169 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipoluianov/xchg/xchg"
+)
+
+const (
+	dialTargetTimeout = 5 * time.Second
+)
+
+// Accepts xchg connections and forwards them to the targets of the tunnels
+type Server struct {
+	mtx      sync.Mutex
+	peer     *xchg.Peer
+	config   ServerConfig
+	listener net.Listener
+	logger   xchg.Logger
+}
+
+func NewServer(peer *xchg.Peer, config ServerConfig, logger xchg.Logger) *Server {
+	var c Server
+	c.peer = peer
+	c.config = config
+	c.logger = logger
+	return &c
+}
+
+// Sets the server as the processor of the peer (authorization) and starts accepting connections.
+// Tunnels without allowlists and ports without PortsAllowedAuthData are refused unless AllowAnyClient is set.
+func (c *Server) Start() (err error) {
+	openTunnels := c.config.OpenTunnels()
+	if c.config.OpenPorts() {
+		openTunnels = append(openTunnels, "ports")
+	}
+	if len(openTunnels) > 0 {
+		if !c.config.AllowAnyClient {
+			err = errors.New(ERR_TUNNEL_NO_AUTH + ":" + strings.Join(openTunnels, ","))
+			return
+		}
+		c.logger.Println("WARNING: tunnels (ports) available to ANY client of the network:", strings.Join(openTunnels, ","))
+	}
+
+	c.peer.SetProcessor(c)
+	c.mtx.Lock()
+	c.listener = c.peer.Listen()
+	listener := c.listener
+	c.mtx.Unlock()
+	go c.thAccept(listener)
+	return
+}
+
+func (c *Server) Stop() {
+	c.mtx.Lock()
+	listener := c.listener
+	c.listener = nil
+	c.mtx.Unlock()
+	if listener != nil {
+		listener.Close()
+	}
+}
+
+// A client is authorized if any tunnel (or the ports) allows its auth data
+func (c *Server) ServerProcessorAuth(authData []byte) (err error) {
+	for _, tunnel := range c.config.Tunnels {
+		if len(tunnel.AllowedAuthData) == 0 || contains(tunnel.AllowedAuthData, string(authData)) {
+			return nil
+		}
+	}
+	if len(c.config.AllowedPorts) > 0 && c.portsAllowed(authData) {
+		return nil
+	}
+	return errors.New(xchg.ERR_XCHG_ACCESS_DENIED)
+}
+
+func (c *Server) ServerProcessorCall(authData []byte, function string, parameter []byte) (response []byte, err error) {
+	err = errors.New(xchg.ERR_XCHG_NOT_IMPLEMENTED)
+	return
+}
+
+func (c *Server) thAccept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go c.serve(conn.(*xchg.Conn))
+	}
+}
+
+func (c *Server) serve(conn *xchg.Conn) {
+	defer conn.Close()
+
+	tunnel, err := c.findTunnel(conn)
+	if err != nil {
+		c.logger.Println("tunnel", conn.Service(), "from", conn.RemoteAddr(), "error:", err)
+		return
+	}
+
+	targetConn, err := net.DialTimeout("tcp", tunnel.Target, dialTargetTimeout)
+	if err != nil {
+		c.logger.Println("tunnel", tunnel.Name, "dial", tunnel.Target, "error:", err)
+		return
+	}
+	defer targetConn.Close()
+
+	c.logger.Println("tunnel", tunnel.Name, "from", conn.RemoteAddr(), "to", tunnel.Target)
+	Pipe(conn, targetConn)
+}
+
+func (c *Server) findTunnel(conn *xchg.Conn) (tunnel TunnelConfig, err error) {
+	for _, t := range c.config.Tunnels {
+		if t.Name != conn.Service() {
+			continue
+		}
+		if len(t.AllowedAuthData) > 0 && !contains(t.AllowedAuthData, string(conn.AuthData())) {
+			err = errors.New(xchg.ERR_XCHG_ACCESS_DENIED)
+			return
+		}
+		if len(t.AllowedAddresses) > 0 && !contains(t.AllowedAddresses, conn.RemoteAddr().String()) {
+			err = errors.New(xchg.ERR_XCHG_ACCESS_DENIED)
+			return
+		}
+		tunnel = t
+		return
+	}
+	if strings.HasPrefix(conn.Service(), PortServicePrefix) {
+		port, errPort := strconv.Atoi(strings.TrimPrefix(conn.Service(), PortServicePrefix))
+		if errPort == nil && containsPort(c.config.AllowedPorts, port) {
+			if !c.portsAllowed(conn.AuthData()) {
+				err = errors.New(xchg.ERR_XCHG_ACCESS_DENIED)
+				return
+			}
+			tunnel.Name = conn.Service()
+			tunnel.Target = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+			return
+		}
+	}
+	err = errors.New(ERR_TUNNEL_UNKNOWN_SERVICE)
+	return
+}
+
+func (c *Server) portsAllowed(authData []byte) bool {
+	return len(c.config.PortsAllowedAuthData) == 0 || contains(c.config.PortsAllowedAuthData, string(authData))
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
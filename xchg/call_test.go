@@ -0,0 +1,197 @@
+package xchg_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipoluianov/xchg/xchg"
+	"github.com/ipoluianov/xchg/xchgtest"
+)
+
+type echoProcessor struct{}
+
+func (c *echoProcessor) ServerProcessorAuth(authData []byte) (err error) {
+	return nil
+}
+
+func (c *echoProcessor) ServerProcessorCall(authData []byte, function string, parameter []byte) (response []byte, err error) {
+	if function == "sleep" {
+		time.Sleep(2 * time.Second)
+	}
+	return parameter, nil
+}
+
+// The peer of the simulated network (not started)
+func newNetworkPeer(t testing.TB, network *xchgtest.Network, privateKey *rsa.PrivateKey) *xchg.Peer {
+	peer, err := network.NewPeer(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return peer
+}
+
+func TestCallLargePayload(t *testing.T) {
+	if testing.Short() {
+		t.Skip("multi-megabyte payloads")
+	}
+
+	network := xchgtest.NewNetwork(2, 1)
+	defer network.Stop()
+
+	serverKey, _ := xchg.GenerateRSAKey()
+	server := newNetworkPeer(t, network, serverKey)
+	server.SetProcessor(&echoProcessor{})
+	server.Start(false)
+	client := newNetworkPeer(t, network, nil)
+	client.Start(false)
+	serverAddress := xchg.AddressForPublicKey(&serverKey.PublicKey)
+
+	for _, size := range []int{4 * 1024 * 1024, 16 * 1024 * 1024} {
+		t.Run(fmt.Sprint(size/(1024*1024), "MB"), func(t *testing.T) {
+			data := make([]byte, size)
+			rand.New(rand.NewSource(int64(size))).Read(data)
+			result, err := client.Call(serverAddress, "", "echo", data, 120*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(result, data) {
+				t.Fatalf("wrong result: %d bytes", len(result))
+			}
+		})
+	}
+}
+
+func TestCallContextError(t *testing.T) {
+	network := xchgtest.NewNetwork(1, 1)
+	defer network.Stop()
+
+	serverKey, _ := xchg.GenerateRSAKey()
+	server := newNetworkPeer(t, network, serverKey)
+	server.SetProcessor(&echoProcessor{})
+	server.Start(false)
+	client := newNetworkPeer(t, network, nil)
+	client.Start(false)
+	serverAddress := xchg.AddressForPublicKey(&serverKey.PublicKey)
+
+	if _, err := client.Call(serverAddress, "", "echo", nil, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	_, err := client.CallContext(ctx, serverAddress, "", "sleep", nil)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(fmt.Sprint(err), xchg.ERR_XCHG_PEER_CONN_TR_TIMEOUT) {
+		t.Fatal("deadline:", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(300*time.Millisecond, cancel)
+	_, err = client.CallContext(ctx, serverAddress, "", "sleep", nil)
+	if !errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("cancel:", err)
+	}
+
+	// The auth is limited by the deadline of the call
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	absentKey, _ := xchg.GenerateRSAKey()
+	_, err = client.CallContext(ctx, xchg.AddressForPublicKey(&absentKey.PublicKey), "", "echo", nil)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("auth:", err)
+	}
+}
+
+// A lost middle block of the call and of the response: only the range of the block is requested (0x12, 0x13) and resent
+func TestCallNackResendsMissingRange(t *testing.T) {
+	network := xchgtest.NewNetwork(1, 1)
+	defer network.Stop()
+
+	config := xchg.DefaultPeerConfig()
+	serverKey, _ := xchg.GenerateRSAKey()
+	server := newNetworkPeer(t, network, serverKey)
+	server.SetProcessor(&echoProcessor{})
+	server.Start(false)
+	client := newNetworkPeer(t, network, nil)
+	client.Start(false)
+	serverAddress := xchg.AddressForPublicKey(&serverKey.PublicKey)
+	if _, err := client.Call(serverAddress, "", "echo", nil, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	const minSize = 16 * 1024
+	lostOffsets := map[byte]uint32{
+		xchg.FrameTypeCall:     uint32(2 * config.CallBlockSize),
+		xchg.FrameTypeResponse: uint32(2 * config.ResponseBlockSize),
+	}
+	var mtx sync.Mutex
+	sent := make(map[byte]map[uint32]int)
+	nacks := make(map[byte][][2]uint32)
+	network.SetFilter(func(frame []byte) bool {
+		tr, err := xchg.Parse(frame)
+		if err != nil {
+			return false
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		switch tr.FrameType {
+		case xchg.FrameTypeCallNack, xchg.FrameTypeResponseNack:
+			nacks[tr.FrameType] = append(nacks[tr.FrameType], xchg.ParseRanges(tr.Data)...)
+		case xchg.FrameTypeCall, xchg.FrameTypeResponse:
+			if tr.TotalSize < minSize {
+				return false
+			}
+			if sent[tr.FrameType] == nil {
+				sent[tr.FrameType] = make(map[uint32]int)
+			}
+			sent[tr.FrameType][tr.Offset]++
+			// The first copy of the block is lost
+			return tr.Offset == lostOffsets[tr.FrameType] && sent[tr.FrameType][tr.Offset] == 1
+		}
+		return false
+	})
+
+	data := make([]byte, 4*minSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	result, err := client.Call(serverAddress, "", "echo", data, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, data) {
+		t.Fatal("wrong result")
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	tests := []struct {
+		name      string
+		frameType byte
+		nackType  byte
+		blockSize int
+	}{
+		{"call", xchg.FrameTypeCall, xchg.FrameTypeCallNack, config.CallBlockSize},
+		{"response", xchg.FrameTypeResponse, xchg.FrameTypeResponseNack, config.ResponseBlockSize},
+	}
+	for _, test := range tests {
+		lostOffset := lostOffsets[test.frameType]
+		if len(sent[test.frameType]) < 4 {
+			t.Fatalf("%s: %d blocks", test.name, len(sent[test.frameType]))
+		}
+		for offset, count := range sent[test.frameType] {
+			if offset == lostOffset && count != 2 || offset != lostOffset && count != 1 {
+				t.Errorf("%s: the block %d is sent %d times", test.name, offset, count)
+			}
+		}
+		ranges := nacks[test.nackType]
+		if len(ranges) != 1 || ranges[0] != [2]uint32{lostOffset, uint32(test.blockSize)} {
+			t.Errorf("%s: wrong ranges of NACK %v", test.name, ranges)
+		}
+	}
+}
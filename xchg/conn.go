@@ -0,0 +1,317 @@
+package xchg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Address of a connection over xchg
+type Addr struct {
+	Address string
+	Service string
+}
+
+func (c *Addr) Network() string {
+	return "xchg"
+}
+
+func (c *Addr) String() string {
+	return c.Address
+}
+
+// Ordered reliable byte stream over a stream call (net.Conn)
+type Conn struct {
+	mtx        sync.Mutex
+	localAddr  *Addr
+	remoteAddr *Addr
+	writer     io.Writer
+	closer     func() error
+	authData   []byte
+
+	readCh  chan []byte
+	readErr error
+	readBuf []byte
+
+	writeCh      chan []byte
+	writeResult  chan error
+	writePending bool
+
+	readDeadline  *connDeadline
+	writeDeadline *connDeadline
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+const connReadBufferSize = 64 * 1024
+
+// Connects to the listener of the remote peer
+func Dial(peer *Peer, remoteAddress string, authData string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), streamCallTimeout)
+	defer cancel()
+	return DialService(ctx, peer, remoteAddress, authData, "")
+}
+
+// Connects to the listener of the remote peer. The service is available for the server in Conn.Service().
+// ctx is used only for connecting.
+func DialService(ctx context.Context, peer *Peer, remoteAddress string, authData string, service string) (conn *Conn, err error) {
+	if len(service) > 255 {
+		err = errors.New(ERR_XCHG_CONN_WRONG_SERVICE)
+		return
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	remotePeer, network := peer.getRemotePeer(remoteAddress, authData)
+	// The connection does not depend on ctx after connecting
+	stream, err := remotePeer.openStream(ctx, context.Background(), network, "/xchg-dial", []byte(service), pipeReader)
+	if err != nil {
+		pipeWriter.Close()
+		return
+	}
+
+	closer := func() error {
+		// Graceful end of the input, then the stream is closed
+		pipeWriter.Close()
+		select {
+		case <-stream.writeDone:
+		case <-time.After(streamCallTimeout):
+		}
+		return stream.Close()
+	}
+
+	conn = newConn(&Addr{Address: peer.LocalAddress()}, &Addr{Address: remoteAddress, Service: service}, stream, pipeWriter, closer)
+	return
+}
+
+func newConn(localAddr *Addr, remoteAddr *Addr, reader io.Reader, writer io.Writer, closer func() error) *Conn {
+	var c Conn
+	c.localAddr = localAddr
+	c.remoteAddr = remoteAddr
+	c.writer = writer
+	c.closer = closer
+	c.readCh = make(chan []byte)
+	c.writeCh = make(chan []byte)
+	c.writeResult = make(chan error, 1)
+	c.readDeadline = newConnDeadline()
+	c.writeDeadline = newConnDeadline()
+	c.closed = make(chan struct{})
+	go c.thRead(reader)
+	go c.thWrite()
+	return &c
+}
+
+// Name of the service requested by the client
+func (c *Conn) Service() string {
+	return c.remoteAddr.Service
+}
+
+// Auth data of the client (server side only)
+func (c *Conn) AuthData() []byte {
+	return c.authData
+}
+
+func (c *Conn) thRead(reader io.Reader) {
+	for {
+		buffer := make([]byte, connReadBufferSize)
+		n, err := reader.Read(buffer)
+		if n > 0 {
+			select {
+			case c.readCh <- buffer[:n]:
+			case <-c.closed:
+				return
+			}
+		}
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				// The remote side has closed the connection
+				err = io.EOF
+			}
+			// Visible to Read after the channel is closed
+			c.readErr = err
+			close(c.readCh)
+			return
+		}
+	}
+}
+
+func (c *Conn) thWrite() {
+	for {
+		select {
+		case data := <-c.writeCh:
+			_, err := c.writer.Write(data)
+			c.writeResult <- err
+			if err != nil {
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// Read is not safe for concurrent use
+func (c *Conn) Read(b []byte) (n int, err error) {
+	if len(c.readBuf) == 0 {
+		select {
+		case <-c.closed:
+			return 0, net.ErrClosed
+		default:
+		}
+		select {
+		case data, ok := <-c.readCh:
+			if !ok {
+				return 0, c.readErr
+			}
+			c.readBuf = data
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+	}
+	n = copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return
+}
+
+func (c *Conn) Write(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.writePending {
+		// The previous write has exceeded the deadline
+		err = c.waitWriteResult()
+		if err != nil {
+			return
+		}
+	}
+
+	data := make([]byte, len(b))
+	copy(data, b)
+	select {
+	case c.writeCh <- data:
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+	c.writePending = true
+	err = c.waitWriteResult()
+	if err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+func (c *Conn) waitWriteResult() (err error) {
+	select {
+	case err = <-c.writeResult:
+		c.writePending = false
+		return
+	case <-c.writeDeadline.wait():
+		return os.ErrDeadlineExceeded
+	case <-c.closed:
+		return net.ErrClosed
+	}
+}
+
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.closeErr = c.closer()
+	})
+	return c.closeErr
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// Channel that is closed when the deadline is exceeded
+type connDeadline struct {
+	mtx     sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func newConnDeadline() *connDeadline {
+	var c connDeadline
+	c.expired = make(chan struct{})
+	return &c
+}
+
+func (c *connDeadline) set(t time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.timer != nil && !c.timer.Stop() {
+		// The timer has fired (or is firing) - wait for the channel
+		<-c.expired
+	}
+	c.timer = nil
+
+	closed := false
+	select {
+	case <-c.expired:
+		closed = true
+	default:
+	}
+
+	if t.IsZero() {
+		if closed {
+			c.expired = make(chan struct{})
+		}
+		return
+	}
+
+	duration := time.Until(t)
+	if duration <= 0 {
+		if !closed {
+			close(c.expired)
+		}
+		return
+	}
+
+	if closed {
+		c.expired = make(chan struct{})
+	}
+	expired := c.expired
+	c.timer = time.AfterFunc(duration, func() {
+		close(expired)
+	})
+}
+
+func (c *connDeadline) wait() chan struct{} {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.expired
+}
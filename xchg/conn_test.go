@@ -0,0 +1,76 @@
+package xchg_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ipoluianov/xchg/xchg"
+	"github.com/ipoluianov/xchg/xchgtest"
+)
+
+func serveEcho(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(conn, conn)
+			conn.Close()
+		}()
+	}
+}
+
+func TestListenAuth(t *testing.T) {
+	network := xchgtest.NewNetwork(1, 1)
+	defer network.Stop()
+
+	serverKey, _ := xchg.GenerateRSAKey()
+	server := newNetworkPeer(t, network, serverKey)
+	server.Start(false)
+	serverAddress := xchg.AddressForPublicKey(&serverKey.PublicKey)
+
+	// No processor and no auth function - no sessions
+	listener := server.Listen()
+	go serveEcho(listener)
+	client := newNetworkPeer(t, network, nil)
+	client.Start(false)
+	// A refused auth is not answered
+	refusedDial := func(authData string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_, err := xchg.DialService(ctx, client, serverAddress, authData, "")
+		return err
+	}
+	if err := refusedDial("secret"); err == nil {
+		t.Fatal("connected without authorization")
+	}
+
+	server.ListenWithAuth(func(authData []byte) error {
+		if string(authData) != "secret" {
+			return errors.New(xchg.ERR_XCHG_ACCESS_DENIED)
+		}
+		return nil
+	})
+
+	if err := refusedDial("wrong"); err == nil {
+		t.Fatal("connected with wrong auth data")
+	}
+
+	conn, err := xchg.Dial(client, serverAddress, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	go conn.Write(data)
+	result := make([]byte, len(data))
+	if _, err = io.ReadFull(conn, result); err != nil || !bytes.Equal(result, data) {
+		t.Fatal("echo:", err)
+	}
+}
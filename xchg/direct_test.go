@@ -0,0 +1,56 @@
+package xchg_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ipoluianov/xchg/xchg"
+	"github.com/ipoluianov/xchg/xchgtest"
+)
+
+// Hole punching over loopback: the calls go directly while the client can not reach the routers,
+// then via routers after the direct path is lost
+func TestDirectPath(t *testing.T) {
+	network := xchgtest.NewNetwork(1, 1)
+	defer network.Stop()
+
+	serverKey, _ := xchg.GenerateRSAKey()
+	server := newNetworkPeer(t, network, serverKey)
+	serverUdp := xchg.NewUdpTransport(0, xchg.DefaultPeerConfig())
+	server.SetTransports(xchgtest.NewTransport(network), serverUdp)
+	server.SetProcessor(&echoProcessor{})
+	server.Start(false)
+	serverAddress := xchg.AddressForPublicKey(&serverKey.PublicKey)
+
+	client := newNetworkPeer(t, network, nil)
+	client.SetTransports(xchgtest.NewTransport(network), xchg.NewUdpTransport(0, xchg.DefaultPeerConfig()))
+	client.Start(false)
+
+	if _, err := client.Call(serverAddress, "", "echo", nil, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	network.Partition(client.LocalAddress())
+	direct := false
+	for i := 0; i < 10 && !direct; i++ {
+		result, err := client.Call(serverAddress, "", "echo", []byte("direct"), time.Second)
+		direct = err == nil && string(result) == "direct"
+		if !direct {
+			time.Sleep(500 * time.Millisecond)
+		}
+	}
+	if !direct {
+		t.Fatal("no direct path")
+	}
+
+	serverUdp.Stop()
+	network.Heal(client.LocalAddress())
+	fallback := false
+	for i := 0; i < 3 && !fallback; i++ {
+		result, err := client.Call(serverAddress, "", "echo", []byte("routers"), 3*time.Second)
+		fallback = err == nil && string(result) == "routers"
+	}
+	if !fallback {
+		t.Fatal("no fallback to routers")
+	}
+}
@@ -0,0 +1,116 @@
+package xchg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+const listenerBacklog = 16
+
+// Accepts connections made by Dial (net.Listener)
+type Listener struct {
+	mtx       sync.Mutex
+	peer      *Peer
+	addr      *Addr
+	conns     chan *Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// Authorization of the connections, protected by the mutex of the peer
+	auth func(authData []byte) error
+}
+
+// Returns the listener of the peer. Clients are authorized by the ServerProcessor,
+// without the processor no client is authorized (see ListenWithAuth).
+func (c *Peer) Listen() net.Listener {
+	return c.ListenWithAuth(nil)
+}
+
+// Returns the listener of the peer, auth authorizes the connections by the auth data of the client.
+// Without a ServerProcessor auth authorizes the sessions as well.
+func (c *Peer) ListenWithAuth(auth func(authData []byte) error) net.Listener {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.listener == nil {
+		var l Listener
+		l.peer = c
+		l.addr = &Addr{Address: c.localAddress}
+		l.conns = make(chan *Conn, listenerBacklog)
+		l.closed = make(chan struct{})
+		c.listener = &l
+	}
+	if auth != nil {
+		c.listener.auth = auth
+	}
+	return c.listener
+}
+
+func (c *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-c.conns:
+		return conn, nil
+	case <-c.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (c *Listener) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.peer.mtx.Lock()
+		if c.peer.listener == c {
+			c.peer.listener = nil
+		}
+		c.peer.mtx.Unlock()
+	})
+	return nil
+}
+
+func (c *Listener) Addr() net.Addr {
+	return c.addr
+}
+
+// Handler of the "/xchg-dial" stream
+func (c *Peer) serveConn(ctx context.Context, remoteAddress string, authData []byte, service string, input io.Reader, output io.Writer) (err error) {
+	c.mtx.Lock()
+	listener := c.listener
+	var auth func(authData []byte) error
+	if listener != nil {
+		auth = listener.auth
+	}
+	c.mtx.Unlock()
+	if listener == nil {
+		err = errors.New(ERR_XCHG_CONN_NO_LISTENER)
+		return
+	}
+	if auth != nil {
+		if err = auth(authData); err != nil {
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	closer := func() error {
+		cancel()
+		return nil
+	}
+	conn := newConn(&Addr{Address: c.localAddress, Service: service}, &Addr{Address: remoteAddress, Service: service}, input, output, closer)
+	conn.authData = authData
+
+	select {
+	case listener.conns <- conn:
+	case <-listener.closed:
+		err = errors.New(ERR_XCHG_CONN_NO_LISTENER)
+		return
+	case <-ctx.Done():
+		return
+	}
+
+	// The stream ends when the connection is closed by any side
+	<-ctx.Done()
+	return
+}
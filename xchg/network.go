@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -26,6 +27,18 @@ type Network struct {
 	Timestamp     int64    `json:"timestamp"`
 	InitialPoints []string `json:"initial_points"`
 	Ranges        []*rng   `json:"ranges"`
+
+	// Validity period (unix time, 0 - not limited)
+	NotBefore int64 `json:"not_before,omitempty"`
+	NotAfter  int64 `json:"not_after,omitempty"`
+
+	// Keys of the next containers and the count of their signatures (rotation).
+	// Empty - the keys are not changed.
+	SigningKeys      []string `json:"signing_keys,omitempty"`
+	SigningThreshold int      `json:"signing_threshold,omitempty"`
+
+	// The signed container of the network
+	container []byte
 }
 
 type host struct {
@@ -135,6 +148,16 @@ func (c *Network) init() {
 	c.InitialPoints = make([]string, 0)
 }
 
+func (c *Network) CheckValidity(now time.Time) error {
+	if c.NotBefore != 0 && now.Unix() < c.NotBefore {
+		return errors.New(ERR_XCHG_NETWORK_NOT_YET_VALID)
+	}
+	if c.NotAfter != 0 && now.Unix() > c.NotAfter {
+		return errors.New(ERR_XCHG_NETWORK_EXPIRED)
+	}
+	return nil
+}
+
 func (c *Network) AddHostToRange(prefix string, address string) {
 	prefix = strings.ToLower(prefix)
 
@@ -210,23 +233,26 @@ func (c *Network) GetNodesAddressesByAddress(address string) []string {
 		return rnd[i] < rnd[j]
 	})
 
-	// local router
-	addresses = append(addresses, c.GetLocalNodes()...)
-
 	return addresses
 }
 
+// The local nodes of the default configuration.
+//
+// Deprecated: the local nodes are configured by PeerConfig.LocalNodes.
 func (c *Network) GetLocalNodes() []string {
-	addresses := make([]string, 0)
-
-	addresses = append(addresses, "localhost:42001")
-	addresses = append(addresses, "localhost:42002")
-
-	return addresses
+	return append([]string{}, DefaultPeerConfig().LocalNodes...)
 }
 
+// The node is a local node of the default configuration.
+//
+// Deprecated: the local nodes are configured by PeerConfig.LocalNodes.
 func (c *Network) IsLocalNode(nodeAddress string) bool {
-	return strings.Contains(nodeAddress, "localhost")
+	for _, localNode := range DefaultPeerConfig().LocalNodes {
+		if strings.EqualFold(localNode, nodeAddress) {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *Network) FlatListRandom() []string {
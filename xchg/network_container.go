@@ -15,7 +15,10 @@ import (
 	"io/fs"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
+
+	"golang.org/x/crypto/scrypt"
 )
 
 const (
@@ -24,73 +27,117 @@ const (
 	NetworkContainerPublicKey           = "MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA8V7FEvpzVo4sLhE3rIEmKwbLmNZkweZLucv/vxIbj3y8jpJiEGT3kQA9JvGscdsS85gca34WCfKdMJBKErUm28/UAWnDZeVUmQyxwGXs2jO/OLQukwJT76Umsu/KIfr7zKxkzfm7fTsJ8q1ZYuHgndi4OTblKqy/tSynyEYFnlbpEvmIAS2ZJblarxaG5VJo3YA5ZdO5FTcuaSkZ+9v4uMvcwFK9qIigJCS+xJa+ubgN9cv2RuHuQB7+Qw9bGbCjk9cSGnbV0ttwoVMZxFkT72lAXdp5/NLWcRpKnnjEvkWKjo21ROeH6hk4qfa30Q/Q+hLbPxhLlXX2r9sNEEZkWQIDAQAB"
 	NetworkContainerFileNetwork         = "network.json"
 	NetworkContainerFileSignature       = "signature.base64"
+
+	// Additional signatures: signature-2.base64, signature-3.base64 ...
+	networkContainerFileSignatureN = "signature-%d.base64"
+
+	// Encrypted private keys: "scrypt:" + base64([salt 16] [AES-GCM]),
+	// the legacy keys are base64(AES-GCM) with the key sha256(password)
+	networkContainerKeyPrefix = "scrypt:"
+	networkContainerSaltSize  = 16
+	networkContainerScryptN   = 1 << 15
+	networkContainerScryptR   = 8
+	networkContainerScryptP   = 1
 )
 
 func NetworkContainerLoadStaticDefault() (network *Network, err error) {
-	var zipFileBS []byte
-	zipFileBS, err = base64.StdEncoding.DecodeString(NetworkContainerDefault)
-	network, err = NetworkContainerLoad(zipFileBS, NetworkContainerPublicKey)
+	network, err = NetworkContainerLoad(networkContainerStaticDefaultBytes(), NetworkContainerPublicKey)
 	network.Source = "STATIC"
 	return network, err
 }
 
+func networkContainerStaticDefaultBytes() []byte {
+	zipFileBS, _ := base64.StdEncoding.DecodeString(NetworkContainerDefault)
+	return zipFileBS
+}
+
 func NetworkContainerLoadFromInternet() (network *Network, err error) {
+	return NetworkContainerLoadFromInternetWithTimeout(1 * time.Second)
+}
+
+// timeout - of the request to every initial point
+func NetworkContainerLoadFromInternetWithTimeout(timeout time.Duration) (network *Network, err error) {
 	// Load local static network
 	network, err = NetworkContainerLoadStaticDefault()
 	if err != nil {
 		return
 	}
+	trust, err := NewNetworkTrust([]string{NetworkContainerPublicKey}, 1, "")
+	if err != nil {
+		return
+	}
+	latestNetwork, err := NetworkContainerLoadFromInitialPoints(network, trust, timeout)
+	if err == nil && latestNetwork.Timestamp > network.Timestamp {
+		network = latestNetwork
+	}
+	return
+}
 
+// Downloads the containers from the initial points of the network.
+// Returns the latest of the containers accepted by the trust.
+func NetworkContainerLoadFromInitialPoints(network *Network, trust *NetworkTrust, timeout time.Duration) (latestNetwork *Network, err error) {
 	var httpClient *http.Client
 	tr := &http.Transport{}
 	httpClient = &http.Client{Transport: tr}
-	httpClient.Timeout = 1 * time.Second
-
-	networks := make([]*Network, 0)
+	httpClient.Timeout = timeout
 
+	err = errors.New(ERR_XCHG_NETWORK_NOT_FOUND)
 	for _, initialPoint := range network.InitialPoints {
-		var response *http.Response
-		response, err = httpClient.Get(initialPoint + "?" + fmt.Sprint(time.Now().Unix()))
-		if err != nil {
+		response, errGet := httpClient.Get(initialPoint + "?" + fmt.Sprint(time.Now().Unix()))
+		if errGet != nil {
 			//fmt.Println("network", initialPoint, "err=", err)
 			continue
 		}
 
-		var content []byte
-		content, err = ioutil.ReadAll(response.Body)
-		if err != nil {
-			response.Body.Close()
+		content, errRead := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if errRead != nil {
+			continue
+		}
+		networkBS, errDecode := base64.StdEncoding.DecodeString(string(content))
+		if errDecode != nil {
 			continue
 		}
-		var networkBS []byte
-		networkBS, err = base64.StdEncoding.DecodeString(string(content))
-		response.Body.Close()
 
-		var n *Network
-		n, err = NetworkContainerLoadDefault(networkBS)
-		if err != nil {
+		n, errLoad := trust.Load(networkBS)
+		if errLoad != nil {
+			err = errLoad
 			continue
 		}
 		n.Source = initialPoint
-		networks = append(networks, n)
+		if latestNetwork == nil || n.Timestamp > latestNetwork.Timestamp {
+			latestNetwork = n
+		}
 	}
 
 	httpClient.CloseIdleConnections()
 
-	// No fresh networks - use default static network
-	if len(networks) < 1 {
-		return
+	if latestNetwork != nil {
+		err = nil
 	}
+	return
+}
 
-	// Get latest network
-	// logger.Println("loaded networks:")
-	for _, n := range networks {
-		//fmt.Println(n.Timestamp, n.Name, n.Source)
-		if n.Timestamp > network.Timestamp {
-			network = n
+// Signed container (zip) - accepted by the trust, JSON - the network as is (trusted local file)
+func NetworkContainerLoadFile(fileName string, trust *NetworkTrust) (network *Network, err error) {
+	var bs []byte
+	bs, err = ioutil.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+	if bytes.HasPrefix(bs, []byte("PK")) {
+		if trust == nil {
+			err = errors.New(ERR_XCHG_NETWORK_NO_PUBLIC_KEY)
+			return
 		}
+		network, err = trust.Load(bs)
+	} else {
+		network, err = NewNetworkFromBytes(bs)
 	}
-
+	if err != nil {
+		return
+	}
+	network.Source = fileName
 	return
 }
 
@@ -98,78 +145,139 @@ func NetworkContainerLoadDefault(zipFileBS []byte) (network *Network, err error)
 	return NetworkContainerLoad(zipFileBS, NetworkContainerPublicKey)
 }
 
+// Container signed with the key (one of the signatures).
+// The validity period is not checked (NetworkTrust).
 func NetworkContainerLoad(zipFileBS []byte, publicKeyBase64 string) (network *Network, err error) {
-	var publicKeyBS []byte
-	publicKeyBS, err = base64.StdEncoding.DecodeString(publicKeyBase64)
+	var publicKey *rsa.PublicKey
+	publicKey, err = NetworkContainerParsePublicKey(publicKeyBase64)
 	if err != nil {
 		return
 	}
 
-	var publicKeyAny any
-	publicKeyAny, err = x509.ParsePKIXPublicKey(publicKeyBS)
+	networkBS, signatures, err := networkContainerRead(zipFileBS)
+	if err != nil {
+		return
+	}
 
-	var publicKey *rsa.PublicKey
-	var ok bool
-	publicKey, ok = publicKeyAny.(*rsa.PublicKey)
-	if !ok {
-		err = errors.New("wrong public key")
+	err = networkContainerVerify(publicKey, networkBS, signatures)
+	if err != nil {
+		return
 	}
 
-	buf := bytes.NewReader(zipFileBS)
-	var zipFile *zip.Reader
-	zipFile, err = zip.NewReader(buf, buf.Size())
+	network, err = NewNetworkFromBytes(networkBS)
+	return
+}
+
+// Network of the container without the verification of the signature
+func NetworkContainerLoadUnverified(zipFileBS []byte) (network *Network, err error) {
+	networkBS, _, err := networkContainerRead(zipFileBS)
 	if err != nil {
 		return
 	}
-	var networkBS []byte
-	{
-		var file fs.File
-		file, err = zipFile.Open(NetworkContainerFileNetwork)
+	network, err = NewNetworkFromBytes(networkBS)
+	return
+}
+
+// Any of the signatures is made by the key
+func networkContainerVerify(publicKey *rsa.PublicKey, networkBS []byte, signatures [][]byte) (err error) {
+	err = errors.New(ERR_XCHG_NETWORK_WRONG_SIGNATURE)
+	hash := sha256.Sum256(networkBS)
+	for _, signature := range signatures {
+		err = rsa.VerifyPSS(publicKey, crypto.SHA256, hash[:], signature, &rsa.PSSOptions{
+			SaltLength: 32,
+		})
 		if err == nil {
-			networkBS, err = ioutil.ReadAll(file)
-			if err != nil {
-				_ = file.Close()
-				return
-			}
-			_ = file.Close()
-		} else {
 			return
 		}
 	}
-	var signatureBase64BS []byte
-	{
-		var file fs.File
-		file, err = zipFile.Open(NetworkContainerFileSignature)
+	return
+}
+
+// Index of the signature made by the key and not used by other keys, -1 if none
+func networkContainerFindSignature(publicKey *rsa.PublicKey, networkBS []byte, signatures [][]byte, used []bool) int {
+	hash := sha256.Sum256(networkBS)
+	for i, signature := range signatures {
+		if used[i] {
+			continue
+		}
+		err := rsa.VerifyPSS(publicKey, crypto.SHA256, hash[:], signature, &rsa.PSSOptions{
+			SaltLength: 32,
+		})
 		if err == nil {
-			signatureBase64BS, err = ioutil.ReadAll(file)
-			if err != nil {
-				_ = file.Close()
-				return
-			}
-			_ = file.Close()
-		} else {
+			return i
+		}
+	}
+	return -1
+}
+
+func networkContainerRead(zipFileBS []byte) (networkBS []byte, signatures [][]byte, err error) {
+	buf := bytes.NewReader(zipFileBS)
+	var zipFile *zip.Reader
+	zipFile, err = zip.NewReader(buf, buf.Size())
+	if err != nil {
+		return
+	}
+	networkBS, err = networkContainerReadFile(zipFile, NetworkContainerFileNetwork)
+	if err != nil {
+		return
+	}
+
+	fileName := NetworkContainerFileSignature
+	for i := 2; ; i++ {
+		var signatureBase64BS []byte
+		signatureBase64BS, err = networkContainerReadFile(zipFile, fileName)
+		if err != nil {
+			break
+		}
+		var signature []byte
+		signature, err = base64.StdEncoding.DecodeString(string(signatureBase64BS))
+		if err != nil {
 			return
 		}
+		signatures = append(signatures, signature)
+		fileName = fmt.Sprintf(networkContainerFileSignatureN, i)
+	}
+	err = nil
+	if len(signatures) == 0 {
+		err = errors.New(ERR_XCHG_NETWORK_WRONG_SIGNATURE)
 	}
+	return
+}
 
-	var signature []byte
-	signature, err = base64.StdEncoding.DecodeString(string(signatureBase64BS))
+func networkContainerReadFile(zipFile *zip.Reader, fileName string) (content []byte, err error) {
+	var file fs.File
+	file, err = zipFile.Open(fileName)
 	if err != nil {
 		return
 	}
+	content, err = ioutil.ReadAll(file)
+	_ = file.Close()
+	return
+}
 
-	hash := sha256.Sum256(networkBS)
-	err = rsa.VerifyPSS(publicKey, crypto.SHA256, hash[:], signature, &rsa.PSSOptions{
-		SaltLength: 32,
-	})
+func NetworkContainerParsePublicKey(publicKeyBase64 string) (publicKey *rsa.PublicKey, err error) {
+	var publicKeyBS []byte
+	publicKeyBS, err = base64.StdEncoding.DecodeString(publicKeyBase64)
 	if err != nil {
 		return
 	}
 
-	network, err = NewNetworkFromBytes(networkBS)
+	var publicKeyAny any
+	publicKeyAny, err = x509.ParsePKIXPublicKey(publicKeyBS)
+	if err != nil {
+		return
+	}
+
+	var ok bool
+	publicKey, ok = publicKeyAny.(*rsa.PublicKey)
+	if !ok {
+		err = errors.New("wrong public key")
+	}
 	return
 }
 
+// The private key is encrypted with the key derived from the password by scrypt (random salt).
+// Keys of the legacy format (sha256 of the password) are still accepted by NetworkContainerMake.
 func NetworkContainerCreateKey(privateKeyPassword string) (encryptedPrivateKeyBase64 string, publicKeyBase64 string, err error) {
 	var privateKey *rsa.PrivateKey
 	privateKey, err = GenerateRSAKey()
@@ -189,15 +297,22 @@ func NetworkContainerCreateKey(privateKeyPassword string) (encryptedPrivateKeyBa
 		return
 	}
 
-	passwordHash := sha256.Sum256([]byte(privateKeyPassword))
-	aesKey := passwordHash[:]
+	salt := make([]byte, networkContainerSaltSize)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return
+	}
+	aesKey, err := networkContainerPasswordKey(privateKeyPassword, salt)
+	if err != nil {
+		return
+	}
 	var encryptedPrivateKeyBS []byte
 	encryptedPrivateKeyBS, err = EncryptAESGCM(privateKeyBS, aesKey)
 	if err != nil {
 		return
 	}
 
-	encryptedPrivateKeyBase64 = base64.StdEncoding.EncodeToString(encryptedPrivateKeyBS)
+	encryptedPrivateKeyBase64 = networkContainerKeyPrefix + base64.StdEncoding.EncodeToString(append(salt, encryptedPrivateKeyBS...))
 	publicKeyBase64 = base64.StdEncoding.EncodeToString(publicKeyBS)
 
 	return
@@ -209,14 +324,74 @@ func NetworkContainerMake(network *Network, encryptedPrivateKeyBase64 string, pr
 		return
 	}
 
-	var encryptedPrivateKeyBS []byte
-	encryptedPrivateKeyBS, err = base64.StdEncoding.DecodeString(encryptedPrivateKeyBase64)
+	privateKey, err := networkContainerPrivateKey(encryptedPrivateKeyBase64, privateKeyPassword)
+	if err != nil {
+		return
+	}
+
+	networkBS := network.toBytes()
+	signature, err := networkContainerSign(privateKey, networkBS)
+	if err != nil {
+		return
+	}
+	resultZipFile, err = networkContainerWrite(networkBS, [][]byte{signature})
+	return
+}
+
+// One more signature of the container (threshold of keys)
+func NetworkContainerAddSignature(zipFileBS []byte, encryptedPrivateKeyBase64 string, privateKeyPassword string) (resultZipFile []byte, err error) {
+	networkBS, signatures, err := networkContainerRead(zipFileBS)
+	if err != nil {
+		return
+	}
+
+	privateKey, err := networkContainerPrivateKey(encryptedPrivateKeyBase64, privateKeyPassword)
+	if err != nil {
+		return
+	}
+	if networkContainerVerify(&privateKey.PublicKey, networkBS, signatures) == nil {
+		err = errors.New(ERR_XCHG_NETWORK_ALREADY_SIGNED)
+		return
+	}
+
+	signature, err := networkContainerSign(privateKey, networkBS)
 	if err != nil {
 		return
 	}
+	resultZipFile, err = networkContainerWrite(networkBS, append(signatures, signature))
+	return
+}
+
+func networkContainerPasswordKey(password string, salt []byte) (aesKey []byte, err error) {
+	return scrypt.Key([]byte(password), salt, networkContainerScryptN, networkContainerScryptR, networkContainerScryptP, 32)
+}
+
+func networkContainerPrivateKey(encryptedPrivateKeyBase64 string, privateKeyPassword string) (privateKey *rsa.PrivateKey, err error) {
+	var encryptedPrivateKeyBS []byte
+	var aesKey []byte
+	if strings.HasPrefix(encryptedPrivateKeyBase64, networkContainerKeyPrefix) {
+		encryptedPrivateKeyBS, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(encryptedPrivateKeyBase64, networkContainerKeyPrefix))
+		if err != nil {
+			return
+		}
+		if len(encryptedPrivateKeyBS) < networkContainerSaltSize {
+			err = errors.New("wrong private key")
+			return
+		}
+		aesKey, err = networkContainerPasswordKey(privateKeyPassword, encryptedPrivateKeyBS[:networkContainerSaltSize])
+		if err != nil {
+			return
+		}
+		encryptedPrivateKeyBS = encryptedPrivateKeyBS[networkContainerSaltSize:]
+	} else {
+		encryptedPrivateKeyBS, err = base64.StdEncoding.DecodeString(encryptedPrivateKeyBase64)
+		if err != nil {
+			return
+		}
+		passwordHash := sha256.Sum256([]byte(privateKeyPassword))
+		aesKey = passwordHash[:]
+	}
 
-	passwordHash := sha256.Sum256([]byte(privateKeyPassword))
-	aesKey := passwordHash[:]
 	var privateKeyBS []byte
 	privateKeyBS, err = DecryptAESGCM(encryptedPrivateKeyBS, aesKey)
 	if err != nil {
@@ -229,67 +404,50 @@ func NetworkContainerMake(network *Network, encryptedPrivateKeyBase64 string, pr
 		return
 	}
 
-	var privateKey *rsa.PrivateKey
 	var ok bool
 	privateKey, ok = privateKeyAny.(*rsa.PrivateKey)
-	if !ok {
+	if !ok || privateKey == nil {
 		err = errors.New("wrong private key")
 		return
 	}
+	return
+}
 
-	if privateKey == nil {
-		err = errors.New("privateKey == nil")
-		return
-	}
-
-	networkBS := network.toBytes()
+func networkContainerSign(privateKey *rsa.PrivateKey, networkBS []byte) (signature []byte, err error) {
 	hash := sha256.Sum256(networkBS)
-	signature, err := rsa.SignPSS(rand.Reader, privateKey, crypto.SHA256, hash[:], &rsa.PSSOptions{
+	signature, err = rsa.SignPSS(rand.Reader, privateKey, crypto.SHA256, hash[:], &rsa.PSSOptions{
 		SaltLength: 32,
 	})
-	if err != nil {
-		return
-	}
-
-	signatureBase64 := base64.StdEncoding.EncodeToString(signature)
+	return
+}
 
+func networkContainerWrite(networkBS []byte, signatures [][]byte) (resultZipFile []byte, err error) {
 	buf := new(bytes.Buffer)
 	zipWriter := zip.NewWriter(buf)
-	{
-		var zipFile io.Writer
 
-		header := &zip.FileHeader{
-			Name:     NetworkContainerFileNetwork,
-			Method:   zip.Deflate,
-			Modified: time.Now(),
-		}
-		zipFile, err = zipWriter.CreateHeader(header)
-		if err == nil {
-			_, err = zipFile.Write(networkBS)
-			if err != nil {
-				zipWriter.Close()
-				return
-			}
-		} else {
-			zipWriter.Close()
-			return
+	files := []string{NetworkContainerFileNetwork}
+	contents := [][]byte{networkBS}
+	for i, signature := range signatures {
+		fileName := NetworkContainerFileSignature
+		if i > 0 {
+			fileName = fmt.Sprintf(networkContainerFileSignatureN, i+1)
 		}
+		files = append(files, fileName)
+		contents = append(contents, []byte(base64.StdEncoding.EncodeToString(signature)))
 	}
-	{
+
+	for i, fileName := range files {
 		var zipFile io.Writer
 		header := &zip.FileHeader{
-			Name:     NetworkContainerFileSignature,
+			Name:     fileName,
 			Method:   zip.Deflate,
 			Modified: time.Now(),
 		}
 		zipFile, err = zipWriter.CreateHeader(header)
 		if err == nil {
-			_, err = zipFile.Write([]byte(signatureBase64))
-			if err != nil {
-				zipWriter.Close()
-				return
-			}
-		} else {
+			_, err = zipFile.Write(contents[i])
+		}
+		if err != nil {
 			zipWriter.Close()
 			return
 		}
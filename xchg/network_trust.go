@@ -0,0 +1,238 @@
+package xchg
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// Acceptance of network containers:
+// signatures of threshold trusted keys, the validity period (NotBefore/NotAfter)
+// and the high-water mark - the timestamp of the latest accepted network.
+// An accepted network with SigningKeys replaces the trusted keys for the next containers.
+// The state is saved to the file (if set): older containers are refused after restart.
+// Keys are counted by the public key: the same key listed twice is one signer.
+type NetworkTrust struct {
+	mtx           sync.Mutex
+	initialKeys   []string
+	publicKeys    []string
+	threshold     int
+	stateFile     string
+	highWaterMark int64
+	container     []byte
+}
+
+type networkTrustState struct {
+	HighWaterMark int64    `json:"high_water_mark"`
+	PublicKeys    []string `json:"public_keys"`
+	Threshold     int      `json:"threshold"`
+	Container     []byte   `json:"container"`
+	// The keys the state was started with (configured)
+	InitialPublicKeys []string `json:"initial_public_keys"`
+}
+
+// The keys of the saved state (rotated) replace the keys if the state was started with the same keys.
+// Other keys are an error: the state file must be removed to trust the new keys.
+func NewNetworkTrust(publicKeys []string, threshold int, stateFile string) (*NetworkTrust, error) {
+	var c NetworkTrust
+	c.initialKeys = append([]string{}, publicKeys...)
+	c.publicKeys = append([]string{}, publicKeys...)
+	c.threshold = threshold
+	c.stateFile = stateFile
+
+	if stateFile != "" {
+		bs, err := os.ReadFile(stateFile)
+		if err == nil {
+			var state networkTrustState
+			err = json.Unmarshal(bs, &state)
+			if err != nil {
+				return nil, err
+			}
+			if len(state.InitialPublicKeys) > 0 && !networkSameKeys(state.InitialPublicKeys, publicKeys) {
+				return nil, errors.New(ERR_XCHG_NETWORK_STATE_KEYS_MISMATCH)
+			}
+			c.highWaterMark = state.HighWaterMark
+			c.container = state.Container
+			if len(state.PublicKeys) > 0 {
+				c.publicKeys = state.PublicKeys
+				c.threshold = state.Threshold
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	keys, err := NetworkDistinctPublicKeys(c.publicKeys)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 && (c.threshold < 1 || c.threshold > len(keys)) {
+		return nil, errors.New(ERR_XCHG_NETWORK_WRONG_THRESHOLD)
+	}
+	return &c, nil
+}
+
+// Parsed keys without repetitions (the same DER)
+func NetworkDistinctPublicKeys(publicKeys []string) (keys []*rsa.PublicKey, err error) {
+	keys = make([]*rsa.PublicKey, 0, len(publicKeys))
+	found := make(map[string]struct{})
+	for _, publicKeyBase64 := range publicKeys {
+		var publicKey *rsa.PublicKey
+		publicKey, err = NetworkContainerParsePublicKey(publicKeyBase64)
+		if err != nil {
+			return
+		}
+		der := string(RSAPublicKeyToDer(publicKey))
+		if _, ok := found[der]; ok {
+			continue
+		}
+		found[der] = struct{}{}
+		keys = append(keys, publicKey)
+	}
+	return
+}
+
+func networkSameKeys(publicKeys1 []string, publicKeys2 []string) bool {
+	keys1, err1 := NetworkDistinctPublicKeys(publicKeys1)
+	keys2, err2 := NetworkDistinctPublicKeys(publicKeys2)
+	if err1 != nil || err2 != nil || len(keys1) != len(keys2) {
+		return false
+	}
+	found := make(map[string]struct{})
+	for _, key := range keys1 {
+		found[string(RSAPublicKeyToDer(key))] = struct{}{}
+	}
+	for _, key := range keys2 {
+		if _, ok := found[string(RSAPublicKeyToDer(key))]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Verifies the container, the network is not accepted yet
+func (c *NetworkTrust) Load(zipFileBS []byte) (network *Network, err error) {
+	networkBS, signatures, err := networkContainerRead(zipFileBS)
+	if err != nil {
+		return
+	}
+
+	c.mtx.Lock()
+	publicKeys := c.publicKeys
+	threshold := c.threshold
+	highWaterMark := c.highWaterMark
+	c.mtx.Unlock()
+
+	if len(publicKeys) == 0 {
+		err = errors.New(ERR_XCHG_NETWORK_NO_PUBLIC_KEY)
+		return
+	}
+
+	keys, err := NetworkDistinctPublicKeys(publicKeys)
+	if err != nil {
+		return
+	}
+	// Every signature is counted once
+	used := make([]bool, len(signatures))
+	signed := 0
+	for _, publicKey := range keys {
+		if i := networkContainerFindSignature(publicKey, networkBS, signatures, used); i >= 0 {
+			used[i] = true
+			signed++
+		}
+	}
+	if signed < threshold {
+		err = errors.New(ERR_XCHG_NETWORK_NOT_ENOUGH_SIGNATURES)
+		return
+	}
+
+	network, err = NewNetworkFromBytes(networkBS)
+	if err != nil {
+		return
+	}
+	err = network.CheckValidity(time.Now())
+	if err != nil {
+		return
+	}
+	if network.Timestamp < highWaterMark {
+		err = errors.New(ERR_XCHG_NETWORK_ROLLBACK)
+		return
+	}
+	if len(network.SigningKeys) > 0 {
+		signingKeys, errKeys := NetworkDistinctPublicKeys(network.SigningKeys)
+		if errKeys != nil || network.SigningThreshold < 1 || network.SigningThreshold > len(signingKeys) {
+			err = errors.New(ERR_XCHG_NETWORK_WRONG_THRESHOLD)
+			return
+		}
+	}
+	network.container = zipFileBS
+	return
+}
+
+// The network is in use: the high-water mark and the keys are updated and saved
+func (c *NetworkTrust) Accept(network *Network) (err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if network.container == nil {
+		return
+	}
+	if network.Timestamp < c.highWaterMark {
+		return errors.New(ERR_XCHG_NETWORK_ROLLBACK)
+	}
+	c.highWaterMark = network.Timestamp
+	c.container = network.container
+	if len(network.SigningKeys) > 0 {
+		c.publicKeys = append([]string{}, network.SigningKeys...)
+		c.threshold = network.SigningThreshold
+	}
+
+	if c.stateFile == "" {
+		return
+	}
+	var state networkTrustState
+	state.HighWaterMark = c.highWaterMark
+	state.PublicKeys = c.publicKeys
+	state.Threshold = c.threshold
+	state.Container = c.container
+	state.InitialPublicKeys = c.initialKeys
+	bs, err := json.MarshalIndent(state, "", " ")
+	if err != nil {
+		return
+	}
+	// Replaced at once - the state is not lost if the process is killed
+	tmpFile := c.stateFile + ".tmp"
+	err = os.WriteFile(tmpFile, bs, 0600)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmpFile, c.stateFile)
+	return
+}
+
+// The latest accepted network (saved state), nil if none.
+// The signatures were verified when the network was accepted.
+func (c *NetworkTrust) Network() (network *Network) {
+	c.mtx.Lock()
+	container := c.container
+	c.mtx.Unlock()
+	if container == nil {
+		return
+	}
+	network, err := NetworkContainerLoadUnverified(container)
+	if err != nil {
+		return nil
+	}
+	network.container = container
+	network.Source = "STATE"
+	return
+}
+
+func (c *NetworkTrust) HighWaterMark() int64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.highWaterMark
+}
@@ -0,0 +1,83 @@
+package xchg_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/ipoluianov/xchg/xchg"
+)
+
+func TestNetworkTrustDistinctKeys(t *testing.T) {
+	keyA, publicKeyA, err := xchg.NetworkContainerCreateKey("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyB, publicKeyB, err := xchg.NetworkContainerCreateKey("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = xchg.NewNetworkTrust([]string{publicKeyA, publicKeyA}, 2, ""); err == nil {
+		t.Fatal("the same key is counted twice")
+	}
+
+	network := xchg.NewNetwork()
+	network.Timestamp = 100
+	network.AddHostToRange("0", "127.0.0.1:8084")
+	container, err := xchg.NetworkContainerMake(network, keyA, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trust, err := xchg.NewNetworkTrust([]string{publicKeyA, publicKeyB}, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = trust.Load(container); err == nil {
+		t.Fatal("one signature of two is accepted")
+	}
+	container, err = xchg.NetworkContainerAddSignature(container, keyB, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = trust.Load(container); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNetworkTrustStateKeys(t *testing.T) {
+	keyA, publicKeyA, err := xchg.NetworkContainerCreateKey("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, publicKeyB, err := xchg.NetworkContainerCreateKey("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateFile := filepath.Join(t.TempDir(), "network_state.json")
+
+	network := xchg.NewNetwork()
+	network.Timestamp = 100
+	network.AddHostToRange("0", "127.0.0.1:8084")
+	container, err := xchg.NetworkContainerMake(network, keyA, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trust, err := xchg.NewNetworkTrust([]string{publicKeyA}, 1, stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network, err = trust.Load(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = trust.Accept(network); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = xchg.NewNetworkTrust([]string{publicKeyA}, 1, stateFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = xchg.NewNetworkTrust([]string{publicKeyB}, 1, stateFile); err == nil || err.Error() != xchg.ERR_XCHG_NETWORK_STATE_KEYS_MISMATCH {
+		t.Fatal("the state of other keys is used:", err)
+	}
+}
@@ -0,0 +1,54 @@
+package xchg_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ipoluianov/xchg/xchg"
+	"github.com/ipoluianov/xchg/xchgtest"
+)
+
+func TestNotifyAll(t *testing.T) {
+	network := xchgtest.NewNetwork(1, 1)
+	defer network.Stop()
+
+	serverKey, _ := xchg.GenerateRSAKey()
+	server := newNetworkPeer(t, network, serverKey)
+	server.SetProcessor(&echoProcessor{})
+	server.Start(false)
+	serverAddress := xchg.AddressForPublicKey(&serverKey.PublicKey)
+
+	received := make(chan string, 10)
+	subscriber := newNetworkPeer(t, network, nil)
+	subscriber.Start(false)
+	err := subscriber.Subscribe(serverAddress, "topic", func(remoteAddress string, topic string, data []byte) {
+		received <- string(data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := newNetworkPeer(t, network, nil)
+	other.Start(false)
+	if _, err = other.Call(serverAddress, "", "echo", nil, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// The session of the other client is not subscribed
+	count, err := server.NotifyAll("topic", []byte("data"))
+	if err != nil || count != 1 {
+		t.Fatalf("count: %d, %v", count, err)
+	}
+	select {
+	case data := <-received:
+		if data != "data" {
+			t.Fatal("wrong data:", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification")
+	}
+
+	if _, err = server.NotifyAll("topic", make([]byte, xchg.MaxNotificationSize+1)); err == nil {
+		t.Fatal("too large notification is sent")
+	}
+}
@@ -1,30 +1,17 @@
 package xchg
 
 import (
-	"bytes"
+	"context"
 	"crypto/rsa"
 	"encoding/base32"
-	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"io"
-	"io/ioutil"
-	"mime/multipart"
-	"net"
-	"net/http"
-	"net/http/cookiejar"
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/ipoluianov/xchg/router"
 )
 
-type PeerTransport interface {
-	Start(peerProcessor PeerProcessor, localAddressBS []byte) error
-	Stop() error
-}
-
 type Logger interface {
 	Println(v ...interface{})
 }
@@ -36,44 +23,43 @@ type Peer struct {
 	started      bool
 	stopping     bool
 	network      *Network
-
-	httpClient     *http.Client
-	httpClientLong *http.Client
-
-	longPollingDelay time.Duration
+	networkFixed bool
+	networkTrust *NetworkTrust
 
 	localAddressBS []byte
 
 	logger         Logger
 	routerStatRead map[string]int
 
-	//peerTransports []PeerTransport
+	transports []PeerTransport
 
 	gettingFromInternet   map[string]bool
 	lastReceivedMessageId map[string]uint64
+	authorizedRouters     map[string]bool
+
+	routingData *RoutingData
 
 	// Client
 	remotePeers map[string]*RemotePeer
 
 	// Server
 	incomingTransactions  map[string]*Transaction
+	outgoingResponses     map[string]*Transaction
+	runningCalls          map[string]context.CancelFunc
+	streams               map[uint64]*serverStream
+	nextStreamId          uint64
 	sessionsById          map[uint64]*Session
+	directPaths           map[string]*directPath
+	directPunches         int
 	authNonces            *Nonces
 	nextSessionId         uint64
 	processor             ServerProcessor
+	listener              *Listener
 	lastPurgeSessionsTime time.Time
 
-	httpServer1 *router.HttpServer
-	httpServer2 *router.HttpServer
-
-	router1 *router.Router
-	router2 *router.Router
-
-	udpConn *net.UDPConn
-}
-
-type PeerProcessor interface {
-	processFrame(conn net.PacketConn, sourceAddress *net.UDPAddr, routerHost string, frame []byte) (responseFrames []*Transaction)
+	config       PeerConfig
+	localRouters []*localRouter
+	localNodes   []string
 }
 
 type ServerProcessor interface {
@@ -81,17 +67,36 @@ type ServerProcessor interface {
 	ServerProcessorCall(authData []byte, function string, parameter []byte) (response []byte, err error)
 }
 
+// Optional streaming handler. input - data sent by the client (io.EOF at the end),
+// output - data for the client. The end of the stream is the return of the handler.
+type ServerProcessorStream interface {
+	ServerProcessorStream(ctx context.Context, authData []byte, function string, parameter []byte, input io.Reader, output io.Writer) (err error)
+}
+
+// Optional variant of ServerProcessorCall. The context is cancelled
+// when the client cancels the call or its deadline is exceeded.
+type ServerProcessorContext interface {
+	ServerProcessorCallContext(ctx context.Context, authData []byte, function string, parameter []byte) (response []byte, err error)
+}
+
 const (
 	UDP_PORT          = 8484
 	INPUT_BUFFER_SIZE = 1024 * 1024
 )
 
 type Session struct {
-	id           uint64
-	aesKey       []byte
-	authData     []byte
-	lastAccessDT time.Time
-	snakeCounter *SnakeCounter
+	id            uint64
+	aesKey        []byte
+	authData      []byte
+	remoteAddress string
+	lastAccessDT  time.Time
+	snakeCounter  *SnakeCounter
+
+	subscriptions       map[string]struct{}
+	notificationCounter uint64
+
+	// The last /xchg-direct of the session
+	directDT time.Time
 }
 
 const (
@@ -99,21 +104,51 @@ const (
 	PEER_UDP_END_PORT   = 42500
 )
 
+// The auth data of the remote peers may come from clients (gateway)
+const (
+	maxRemotePeers = 1024
+	remotePeerTTL  = 5 * time.Minute
+)
+
+// The default configuration is valid: the error is a panic
 func NewPeer(privateKey *rsa.PrivateKey, logger Logger) *Peer {
+	peer, err := NewPeerWithConfig(privateKey, logger, DefaultPeerConfig())
+	if err != nil {
+		panic(err)
+	}
+	return peer
+}
+
+// The configuration is validated
+func NewPeerWithConfig(privateKey *rsa.PrivateKey, logger Logger, config PeerConfig) (peer *Peer, err error) {
+	err = config.Validate()
+	if err != nil {
+		return
+	}
+
 	var c Peer
+	c.config = config.clone()
 	c.logger = logger
 	c.remotePeers = make(map[string]*RemotePeer)
 	c.incomingTransactions = make(map[string]*Transaction)
-	c.authNonces = NewNonces(100)
+	c.outgoingResponses = make(map[string]*Transaction)
+	c.runningCalls = make(map[string]context.CancelFunc)
+	c.streams = make(map[uint64]*serverStream)
+	c.nextStreamId = 1
+	c.authNonces = NewNonces(c.config.NoncePoolSize)
 	c.sessionsById = make(map[uint64]*Session)
+	c.directPaths = make(map[string]*directPath)
 	c.nextSessionId = 1
-	c.network = NewNetworkLocalhost()
+	err = c.initNetwork()
+	if err != nil {
+		return
+	}
 	c.lastReceivedMessageId = make(map[string]uint64)
+	c.authorizedRouters = make(map[string]bool)
 
 	c.routerStatRead = make(map[string]int)
 
 	c.gettingFromInternet = make(map[string]bool)
-	c.longPollingDelay = 12 * time.Second
 
 	c.privateKey = privateKey
 	if c.privateKey == nil {
@@ -121,24 +156,13 @@ func NewPeer(privateKey *rsa.PrivateKey, logger Logger) *Peer {
 	}
 	c.localAddress = AddressForPublicKey(&c.privateKey.PublicKey)
 
-	{
-		tr := &http.Transport{}
-		jar, _ := cookiejar.New(nil)
-		c.httpClient = &http.Client{Transport: tr, Jar: jar}
-		c.httpClient.Timeout = 2 * time.Second
+	c.transports = []PeerTransport{NewHttpTransport(c.config), NewWsTransport(c.config), NewTcpTransport(c.config)}
+	if c.config.UdpTransport {
+		c.transports = append(c.transports, NewUdpTransport(0, c.config))
 	}
 
-	{
-		tr := &http.Transport{}
-		jar, _ := cookiejar.New(nil)
-		c.httpClientLong = &http.Client{Transport: tr, Jar: jar}
-		c.httpClientLong.Timeout = c.longPollingDelay
-	}
-
-	// Create peer transports
-	//c.peerTransports = make([]PeerTransport, 0)
-
-	return &c
+	peer = &c
+	return
 }
 
 func (c *Peer) Start(enableLocalRouter bool) (err error) {
@@ -155,39 +179,128 @@ func (c *Peer) Start(enableLocalRouter bool) (err error) {
 
 	c.updateHttpPeers()
 
-	if enableLocalRouter {
+	err = c.startTransports()
+	if err != nil {
+		return
+	}
 
-		c.router1 = router.NewRouter()
-		c.router1.Start()
+	if udpTransport := c.getUdpTransport(); udpTransport != nil {
+		udpTransport.setDirectProcessor(c)
+	}
 
-		c.router2 = router.NewRouter()
-		c.router2.Start()
+	c.startLocalRouters(enableLocalRouter)
+
+	go c.thWork()
+	//go c.thUDP()
+	return
+}
 
-		c.httpServer1 = router.NewHttpServer()
-		c.httpServer1.Start(c.router1, 42001)
+// The network of the file or the saved state (the newer one)
+func (c *Peer) initNetwork() (err error) {
+	publicKeys := []string{NetworkContainerPublicKey}
+	threshold := 1
+	if c.config.NetworkFile != "" {
+		publicKeys = c.config.NetworkPublicKeys
+		threshold = c.config.NetworkKeyThreshold
+	}
+	c.networkTrust, err = NewNetworkTrust(publicKeys, threshold, c.config.NetworkStateFile)
+	if err != nil {
+		return
+	}
 
-		c.httpServer2 = router.NewHttpServer()
-		c.httpServer2.Start(c.router1, 42002)
+	c.network = NewNetworkLocalhost()
+	savedNetwork := c.networkTrust.Network()
+	if savedNetwork != nil {
+		if err = savedNetwork.CheckValidity(time.Now()); err != nil {
+			c.logger.Println("Peer::initNetwork", "saved network:", err, "- not used")
+			savedNetwork = nil
+			err = nil
+		} else {
+			c.network = savedNetwork
+		}
+	}
+	if c.config.NetworkFile == "" {
+		return
 	}
 
-	go c.thWork()
-	//go c.thUDP()
+	network, err := NetworkContainerLoadFile(c.config.NetworkFile, c.networkTrust)
+	if err != nil {
+		if savedNetwork == nil {
+			return
+		}
+		c.logger.Println("Peer::initNetwork", "network file:", err, "- the saved network is used")
+		err = nil
+		return
+	}
+	if savedNetwork == nil || network.Timestamp >= savedNetwork.Timestamp {
+		c.network = network
+		err = c.networkTrust.Accept(network)
+	}
 	return
 }
 
 func (c *Peer) updateHttpPeers() {
 	c.logger.Println("Peer::updateHttpPeers")
 
-	network, _ := NetworkContainerLoadFromInternet()
-	c.logger.Println("Network container", network.Name)
-
 	c.mtx.Lock()
-	if network != nil {
-		if network.Timestamp > c.network.Timestamp {
-			c.network = network
-			c.logger.Println("Peer::updateHttpPeers", "new network detected", network.Name)
+	networkFixed := c.networkFixed
+	currentNetwork := c.network
+	c.mtx.Unlock()
+	if networkFixed {
+		return
+	}
+
+	// The expired (not yet valid) network is not used, only its initial points
+	if err := currentNetwork.CheckValidity(time.Now()); err != nil {
+		c.logger.Println("Peer::updateHttpPeers", "network", currentNetwork.Name, err, "- not used")
+		localNetwork := NewNetworkLocalhost()
+		localNetwork.InitialPoints = currentNetwork.InitialPoints
+		c.mtx.Lock()
+		c.network = localNetwork
+		c.mtx.Unlock()
+		currentNetwork = localNetwork
+	}
+
+	if !c.config.NetworkUpdate {
+		return
+	}
+
+	// Private network without keys - no containers are accepted
+	if c.config.NetworkFile != "" && len(c.config.NetworkPublicKeys) == 0 {
+		return
+	}
+
+	candidates := make([]*Network, 0)
+	initialPointsNetwork := currentNetwork
+	if c.config.NetworkFile == "" {
+		staticNetwork, err := NetworkContainerLoadStaticDefault()
+		if err == nil && len(initialPointsNetwork.InitialPoints) == 0 {
+			initialPointsNetwork = staticNetwork
+		}
+		if staticNetwork, err = c.networkTrust.Load(networkContainerStaticDefaultBytes()); err == nil {
+			candidates = append(candidates, staticNetwork)
+		}
+	}
+	if network, err := NetworkContainerLoadFromInitialPoints(initialPointsNetwork, c.networkTrust, c.config.NetworkLoadTimeout); err == nil {
+		candidates = append(candidates, network)
+	}
+
+	var network *Network
+	for _, n := range candidates {
+		if n.Timestamp > currentNetwork.Timestamp && (network == nil || n.Timestamp > network.Timestamp) {
+			network = n
 		}
 	}
+	if network == nil {
+		return
+	}
+	if err := c.networkTrust.Accept(network); err != nil {
+		c.logger.Println("Peer::updateHttpPeers", "network state:", err)
+	}
+
+	c.mtx.Lock()
+	c.network = network
+	c.logger.Println("Peer::updateHttpPeers", "new network detected", network.Name)
 	c.mtx.Unlock()
 }
 
@@ -205,24 +318,17 @@ func (c *Peer) Stop() (err error) {
 	started := c.started
 	c.mtx.Unlock()
 
-	if c.router1 != nil {
-		c.router1.Stop()
-		c.router1 = nil
-	}
+	c.stopLocalRouters()
 
-	if c.router2 != nil {
-		c.router2.Stop()
-		c.router2 = nil
-	}
+	c.stopTransports()
 
-	if c.httpServer1 != nil {
-		c.httpServer1.Stop()
-		c.httpServer1 = nil
-	}
-
-	if c.httpServer2 != nil {
-		c.httpServer2.Stop()
-		c.httpServer2 = nil
+	// Subscriptions of the remote peers end with the peer
+	c.mtx.Lock()
+	remotePeers := c.remotePeers
+	c.remotePeers = make(map[string]*RemotePeer)
+	c.mtx.Unlock()
+	for _, remotePeer := range remotePeers {
+		remotePeer.Stop()
 	}
 
 	dtBegin := time.Now()
@@ -247,35 +353,10 @@ func (c *Peer) Stop() (err error) {
 	return
 }
 
-/*
-	func (c *Peer) thUDP() {
-		c.logger.Println("UDR started")
-		addr, _ := net.ResolveUDPAddr("udp", ":8585")
-		var err error
-		c.udpConn, err = net.ListenUDP("udp", addr)
-		if err != nil {
-			c.logger.Println("ERROR:", err)
-			return
-		}
-
-		for !c.stopping {
-			buffer := make([]byte, 4000)
-			c.logger.Println("UDR reading ...", addr)
-			bytesRead, remoteAddr, err := c.udpConn.ReadFromUDP(buffer)
-			if err != nil {
-				c.logger.Println("ReadFromUDP error:", err)
-				break
-			}
-			incoming := string(buffer[0:bytesRead])
-			c.processFrame("UDP", buffer[0:bytesRead])
-			c.logger.Println("RECEIVED UDP", incoming, "from", remoteAddr.String())
-		}
+func (c *Peer) LocalAddress() string {
+	return c.localAddress
+}
 
-		if c.udpConn != nil {
-			c.udpConn.Close()
-		}
-	}
-*/
 func (c *Peer) Network() *Network {
 	return c.network
 }
@@ -284,12 +365,22 @@ func (c *Peer) SetProcessor(processor ServerProcessor) {
 	c.processor = processor
 }
 
+// The network is not loaded from the internet after it is set
+func (c *Peer) SetNetwork(network *Network) {
+	c.mtx.Lock()
+	c.network = network
+	c.networkFixed = true
+	c.mtx.Unlock()
+}
+
 func (c *Peer) thWork() {
 	c.started = true
 	lastNetworkUpdateDT := time.Now()
 	lastPurgeSessionsDT := time.Now()
 	lastStatDT := time.Now()
-	lastDeclareUDPPointDT := time.Now()
+	lastDeclareRoutingDataDT := time.Now()
+	lastCheckTransactionsDT := time.Now()
+	lastResubscribeDT := time.Now()
 	for {
 		// Stopping
 		c.mtx.Lock()
@@ -301,12 +392,26 @@ func (c *Peer) thWork() {
 
 		go c.getFramesFromInternet()
 
+		if time.Since(lastCheckTransactionsDT) > 100*time.Millisecond {
+			c.checkTransactions()
+			c.checkStreams()
+			c.checkRemoteStreams()
+			lastCheckTransactionsDT = time.Now()
+		}
+
 		if time.Since(lastPurgeSessionsDT) > 5*time.Second {
 			c.purgeSessions()
+			c.purgeDirectPaths()
+			c.purgeRemotePeers()
 			lastPurgeSessionsDT = time.Now()
 		}
 
-		if time.Since(lastNetworkUpdateDT) > 30*time.Second {
+		if time.Since(lastResubscribeDT) > resubscribePeriod {
+			c.resubscribe()
+			lastResubscribeDT = time.Now()
+		}
+
+		if time.Since(lastNetworkUpdateDT) > c.config.NetworkUpdatePeriod {
 			c.updateHttpPeers()
 			lastNetworkUpdateDT = time.Now()
 		}
@@ -316,9 +421,9 @@ func (c *Peer) thWork() {
 			lastStatDT = time.Now()
 		}
 
-		if time.Since(lastDeclareUDPPointDT) > 10*time.Second {
-			//c.declareUDPPoint()
-			lastDeclareUDPPointDT = time.Now()
+		if time.Since(lastDeclareRoutingDataDT) > 60*time.Second {
+			go c.declareRoutingData()
+			lastDeclareRoutingDataDT = time.Now()
 		}
 
 		time.Sleep(10 * time.Millisecond)
@@ -337,34 +442,6 @@ func (c *Peer) fixStat() {
 	c.mtx.Unlock()
 }
 
-/*
-	func (c *Peer) declareUDPPoint() {
-		c.logger.Println("-------DECLARE UDP------")
-		c.mtx.Lock()
-		network := c.network
-		c.mtx.Unlock()
-
-		if network == nil {
-			return
-		}
-
-		if c.udpConn == nil {
-			c.logger.Println("c.udpConn == nil")
-			return
-		}
-
-		routers := network.GetNodesAddressesByAddress(c.localAddress)
-		for _, router := range routers {
-			//signalAddress := "x03.gazer.cloud:8484"
-			remote, _ := net.ResolveUDPAddr("udp", router)
-			bytesWritten, err := c.udpConn.WriteTo([]byte(c.localAddress), remote)
-			if err != nil {
-				c.logger.Println("UDP send error:", err)
-			}
-			c.logger.Println(bytesWritten, " bytes written")
-		}
-	}
-*/
 func (c *Peer) getFramesFromRouter(router string) {
 	/////////////////////////////////////////////
 	c.mtx.Lock()
@@ -389,18 +466,8 @@ func (c *Peer) getFramesFromRouter(router string) {
 
 	// Get message
 	{
-		c.mtx.Lock()
-		fromMessageId := c.lastReceivedMessageId[router]
-		c.mtx.Unlock()
-		getMessageRequest := make([]byte, 16+30)
-		binary.LittleEndian.PutUint64(getMessageRequest[0:], fromMessageId)
-		binary.LittleEndian.PutUint64(getMessageRequest[8:], 1024*1024)
-		copy(getMessageRequest[16:], c.localAddressBS)
-
-		// fmt.Println("GETTING from", router)
-		res, err := c.httpCall(c.httpClientLong, router, "r", getMessageRequest)
+		res, err := c.readFromRouter(router)
 		if err != nil {
-			//fmt.Println("HTTP Error: ", err)
 			return
 		}
 		if len(res) >= 8 {
@@ -445,6 +512,57 @@ func (c *Peer) getFramesFromRouter(router string) {
 
 }
 
+// Reads frames via the preferred transport, the others are the fallback.
+// The authorization to read the address is per transport connection.
+func (c *Peer) readFromRouter(router string) (res []byte, err error) {
+	c.mtx.Lock()
+	fromMessageId := c.lastReceivedMessageId[router]
+	c.mtx.Unlock()
+
+	err = errors.New(ERR_XCHG_PEER_NO_TRANSPORT)
+	for _, transport := range c.transportsForRouter(router) {
+		authKey := router + "/" + transport.Id()
+		c.mtx.Lock()
+		authorized := c.authorizedRouters[authKey]
+		c.mtx.Unlock()
+
+		getMessageRequest := make([]byte, 16+30)
+		binary.LittleEndian.PutUint64(getMessageRequest[0:], fromMessageId)
+		binary.LittleEndian.PutUint64(getMessageRequest[8:], 1024*1024)
+		copy(getMessageRequest[16:], c.localAddressBS)
+
+		// Proof of ownership of the address - once per connection
+		if !authorized {
+			var authBlock []byte
+			authBlock, err = c.routerAuthBlock(transport, router)
+			if err != nil {
+				continue
+			}
+			getMessageRequest = append(getMessageRequest, authBlock...)
+		}
+
+		res, err = transport.Call(router, "r", getMessageRequest)
+		c.mtx.Lock()
+		c.authorizedRouters[authKey] = err == nil
+		c.mtx.Unlock()
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// The nonce is taken via the transport of the read
+func (c *Peer) routerAuthBlock(transport PeerTransport, router string) (authBlock []byte, err error) {
+	var nonce []byte
+	nonce, err = transport.Call(router, "n", nil)
+	if err != nil {
+		return
+	}
+	authBlock, err = makeSignedBlock(c.privateKey, nonce, nil)
+	return
+}
+
 func (c *Peer) getFramesFromInternet() {
 	c.mtx.Lock()
 	network := c.network
@@ -454,77 +572,175 @@ func (c *Peer) getFramesFromInternet() {
 		return
 	}
 
-	routers := network.GetNodesAddressesByAddress(c.localAddress)
+	routers := c.routersForAddress(network, c.localAddress)
 	for _, router := range routers {
 		c.getFramesFromRouter(router)
 	}
 }
 
 func (c *Peer) send(frame []byte, onlyToLocalRouter bool) {
+	if !onlyToLocalRouter && c.sendDirect(frame) {
+		return
+	}
 	addr := "#" + strings.ToLower(base32.StdEncoding.EncodeToString(frame[70:70+30]))
-	addrs := c.network.GetNodesAddressesByAddress(addr)
+	c.mtx.Lock()
+	network := c.network
+	c.mtx.Unlock()
+	addrs := c.routersForAddress(network, addr)
 	if onlyToLocalRouter {
-		addrs = c.network.GetLocalNodes()
+		addrs = c.LocalNodes()
 	}
 	//countHosts := len(addrs)/2 + 1
 	countHosts := len(addrs)
 	for i := 0; i < countHosts; i++ {
 		routerHost := addrs[i]
-		go c.httpCall(c.httpClient, routerHost, "w", frame)
+		go c.routerCall(routerHost, "w", frame)
 	}
 }
 
-func (c *Peer) httpCall(httpClient *http.Client, routerHost string, function string, frame []byte) (result []byte, err error) {
-	if len(routerHost) == 0 {
-		return
-	}
-
-	var body bytes.Buffer
-	writer := multipart.NewWriter(&body)
-	{
-		fw, _ := writer.CreateFormField("d")
-		frame64 := base64.StdEncoding.EncodeToString(frame)
-		fw.Write([]byte(frame64))
-	}
-	writer.Close()
+func (c *Peer) Call(remoteAddress string, authData string, function string, data []byte, timeout time.Duration) (result []byte, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.CallContext(ctx, remoteAddress, authData, function, data)
+}
 
-	addr := "http://" + routerHost
+// Call that returns as soon as the context is cancelled or its deadline is exceeded
+func (c *Peer) CallContext(ctx context.Context, remoteAddress string, authData string, function string, data []byte) (result []byte, err error) {
+	remotePeer, network := c.getRemotePeer(remoteAddress, authData)
+	result, err = remotePeer.CallContext(ctx, network, function, data)
+	return
+}
 
-	response, err := c.Post(httpClient, addr+"/api/"+function, writer.FormDataContentType(), &body, "https://"+addr)
+// Subscribes to notifications of the topic from the remote peer.
+// The session of the first call to the address is used (empty auth data if there were no calls).
+// The subscription is kept (and repeated) even if the subscribe call fails.
+func (c *Peer) Subscribe(remoteAddress string, topic string, handler NotificationHandler) (err error) {
+	c.mtx.Lock()
+	remotePeer := c.findRemotePeer(remoteAddress)
+	c.mtx.Unlock()
+	if remotePeer == nil {
+		remotePeer, _ = c.getRemotePeer(remoteAddress, "")
+	}
+	err = remotePeer.Subscribe(c.Network(), topic, handler)
+	return
+}
 
-	if err != nil {
-		return
-	} else {
-		var content []byte
-		content, err = ioutil.ReadAll(response.Body)
-		if err != nil {
-			response.Body.Close()
-			return
+func (c *Peer) Unsubscribe(remoteAddress string, topic string) (err error) {
+	c.mtx.Lock()
+	network := c.network
+	remotePeers := make([]*RemotePeer, 0)
+	for _, remotePeer := range c.remotePeers {
+		if remotePeer.RemoteAddress() == remoteAddress && remotePeer.hasSubscriptions() {
+			remotePeers = append(remotePeers, remotePeer)
 		}
-		result, err = base64.StdEncoding.DecodeString(string(content))
-		response.Body.Close()
+	}
+	c.mtx.Unlock()
+	for _, remotePeer := range remotePeers {
+		err = remotePeer.Unsubscribe(network, topic)
 	}
 	return
 }
 
-func (c *Peer) Post(httpClient *http.Client, url, contentType string, body io.Reader, host string) (resp *http.Response, err error) {
-	req, err := http.NewRequest("POST", url, body)
-	if err != nil {
-		return nil, err
+func (c *Peer) resubscribe() {
+	c.mtx.Lock()
+	remotePeers := make([]*RemotePeer, 0)
+	for _, remotePeer := range c.remotePeers {
+		remotePeers = append(remotePeers, remotePeer)
+	}
+	network := c.network
+	c.mtx.Unlock()
+
+	for _, remotePeer := range remotePeers {
+		if remotePeer.hasSubscriptions() {
+			go remotePeer.resubscribe(network)
+		}
 	}
-	req.Header.Set("Content-Type", contentType)
-	return httpClient.Do(req)
 }
 
-func (c *Peer) Call(remoteAddress string, authData string, function string, data []byte, timeout time.Duration) (result []byte, err error) {
+// Streaming call. Data of input (may be nil) is uploaded to the handler,
+// the returned reader is the output of the handler and must be closed.
+func (c *Peer) CallStream(ctx context.Context, remoteAddress string, authData string, function string, parameter []byte, input io.Reader) (output io.ReadCloser, err error) {
+	remotePeer, network := c.getRemotePeer(remoteAddress, authData)
+	output, err = remotePeer.CallStream(ctx, network, function, parameter, input)
+	return
+}
+
+// One remote peer (session) per address and auth data, not more than maxRemotePeers
+func (c *Peer) getRemotePeer(remoteAddress string, authData string) (remotePeer *RemotePeer, network *Network) {
+	var evicted *RemotePeer
 	c.mtx.Lock()
-	remotePeer, remotePeerOk := c.remotePeers[remoteAddress]
+	key := remoteAddress + "/" + authData
+	remotePeer, remotePeerOk := c.remotePeers[key]
 	if !remotePeerOk || remotePeer == nil {
 		remotePeer = NewRemotePeer(remoteAddress, authData, c.privateKey)
-		c.remotePeers[remoteAddress] = remotePeer
+		remotePeer.configure(c.config)
+		remotePeer.AddTransport(newRoutersTransport(c))
+		if udpTransport := c.findUdpTransport(); udpTransport != nil {
+			remotePeer.AddTransport(newDirectTransport(udpTransport))
+		}
+		if len(c.remotePeers) >= maxRemotePeers {
+			evicted = c.evictRemotePeer()
+		}
+		c.remotePeers[key] = remotePeer
 	}
-	network := c.network
+	remotePeer.lastUsedDT = time.Now()
+	network = c.network
 	c.mtx.Unlock()
-	result, err = remotePeer.Call(network, function, data, timeout)
+
+	// Not under the lock of the peer
+	if evicted != nil {
+		evicted.Stop()
+	}
 	return
 }
+
+// Removes the least recently used idle remote peer or, if all are busy,
+// the least recently used one (its calls fail). Must be called under the lock,
+// the removed remote peer must be stopped after the unlock.
+func (c *Peer) evictRemotePeer() (evicted *RemotePeer) {
+	var oldestKey, oldestIdleKey string
+	var oldest, oldestIdle *RemotePeer
+	for key, remotePeer := range c.remotePeers {
+		if oldest == nil || remotePeer.lastUsedDT.Before(oldest.lastUsedDT) {
+			oldestKey = key
+			oldest = remotePeer
+		}
+		if (oldestIdle == nil || remotePeer.lastUsedDT.Before(oldestIdle.lastUsedDT)) && remotePeer.idle() {
+			oldestIdleKey = key
+			oldestIdle = remotePeer
+		}
+	}
+	if oldestIdle != nil {
+		oldestKey = oldestIdleKey
+		oldest = oldestIdle
+	}
+	if oldest != nil {
+		delete(c.remotePeers, oldestKey)
+	}
+	return oldest
+}
+
+func (c *Peer) purgeRemotePeers() {
+	expired := make([]*RemotePeer, 0)
+	c.mtx.Lock()
+	for key, remotePeer := range c.remotePeers {
+		if time.Since(remotePeer.lastUsedDT) > remotePeerTTL && remotePeer.idle() {
+			delete(c.remotePeers, key)
+			expired = append(expired, remotePeer)
+		}
+	}
+	c.mtx.Unlock()
+
+	for _, remotePeer := range expired {
+		remotePeer.Stop()
+	}
+}
+
+func (c *Peer) findRemotePeer(remoteAddress string) *RemotePeer {
+	for _, remotePeer := range c.remotePeers {
+		if remotePeer.RemoteAddress() == remoteAddress {
+			return remotePeer
+		}
+	}
+	return nil
+}
@@ -0,0 +1,399 @@
+package xchg
+
+import (
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipoluianov/xchg/router"
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration of the peer, passed to NewPeerWithConfig.
+// Files (PeerConfigLoad) and environment variables (XCHG_<KEY>) use the yaml keys,
+// durations are strings: "12s", "500ms".
+type PeerConfig struct {
+	// Embedded routers started by Start(true), host:port.
+	// Every router listens on the port (HTTP, WebSocket, UDP and TCP on port + router.TcpPortOffset),
+	// the host is the name used to reach it (localhost if empty). No routers - empty list.
+	LocalRouters []string `yaml:"local_routers"`
+
+	// Other routers of this host (for example the embedded routers of another process).
+	// Frames of every address are sent to and read from the local nodes and the embedded routers.
+	LocalNodes []string `yaml:"local_nodes"`
+
+	// Reading of frames from routers (long polling)
+	LongPollingDelay time.Duration `yaml:"long_polling_delay"`
+	// Other requests to routers (all transports)
+	RouterCallTimeout time.Duration `yaml:"router_call_timeout"`
+	// TCP and UDP: the read request is repeated with the period (the routers push the frames),
+	// less than the idle timeout of TCP connections of the routers (60s)
+	RouterRegisterPeriod time.Duration `yaml:"router_register_period"`
+	// Router API over UDP and direct paths between peers (optional, disabled by default)
+	UdpTransport bool `yaml:"udp_transport"`
+	// Broadcasts of the address to the local subnets (direct paths without routers), requires UdpTransport
+	LanDiscovery bool `yaml:"lan_discovery"`
+
+	// Network of a private deployment: signed container (zip) or network JSON (trusted as is).
+	// Empty - the default network.
+	NetworkFile string `yaml:"network_file"`
+	// Trusted keys of the containers of the private network (base64 PKIX)
+	// and the count of the distinct keys that must sign a container.
+	// The keys rotated by the accepted containers (the state file) are used instead
+	// while these keys are the same; other keys require a new state file.
+	// Empty - containers are not accepted (the key of the default network is not used).
+	NetworkPublicKeys   []string `yaml:"network_public_keys"`
+	NetworkKeyThreshold int      `yaml:"network_key_threshold"`
+	// The high-water mark, the rotated keys and the latest accepted container.
+	// Empty - the state is not saved.
+	NetworkStateFile string `yaml:"network_state_file"`
+	// Containers are downloaded from the initial points of the network.
+	// false - no internet requests (offline mode).
+	NetworkUpdate bool `yaml:"network_update"`
+
+	// Download of the network from the initial points and its period
+	NetworkLoadTimeout  time.Duration `yaml:"network_load_timeout"`
+	NetworkUpdatePeriod time.Duration `yaml:"network_update_period"`
+
+	// Server: inactive sessions and incomplete incoming calls are removed
+	SessionTTL     time.Duration `yaml:"session_ttl"`
+	TransactionTTL time.Duration `yaml:"transaction_ttl"`
+
+	// Client: authorization before the first call
+	AuthTimeout time.Duration `yaml:"auth_timeout"`
+
+	// Data of one frame of calls (client) and responses (server)
+	CallBlockSize     int `yaml:"call_block_size"`
+	ResponseBlockSize int `yaml:"response_block_size"`
+
+	// Nonces of authorization waiting for the answer
+	NoncePoolSize int `yaml:"nonce_pool_size"`
+
+	// Server: open streams of one session
+	MaxStreamsPerSession int `yaml:"max_streams_per_session"`
+}
+
+const (
+	peerConfigEnvPrefix  = "XCHG_"
+	peerConfigMaxBlock   = INPUT_BUFFER_SIZE - TransactionHeaderSize
+	peerConfigMaxNonces  = 1000000
+	peerConfigMinTimeout = time.Millisecond
+)
+
+// Embedded routers on localhost:42001 and localhost:42002.
+// The same hosts are the local nodes for the peers without embedded routers.
+func DefaultPeerConfig() (config PeerConfig) {
+	config.LocalRouters = []string{"localhost:42001", "localhost:42002"}
+	config.LocalNodes = []string{"localhost:42001", "localhost:42002"}
+	config.LongPollingDelay = 12 * time.Second
+	config.RouterCallTimeout = 2 * time.Second
+	config.RouterRegisterPeriod = 10 * time.Second
+	config.NetworkKeyThreshold = 1
+	config.NetworkUpdate = true
+	config.NetworkLoadTimeout = 1 * time.Second
+	config.NetworkUpdatePeriod = 30 * time.Second
+	config.SessionTTL = 60 * time.Second
+	config.TransactionTTL = 10 * time.Second
+	config.AuthTimeout = 1000 * time.Millisecond
+	config.CallBlockSize = 1024
+	config.ResponseBlockSize = 4 * 1024
+	config.NoncePoolSize = 100
+	config.MaxStreamsPerSession = 16
+	return
+}
+
+// The default configuration, the values of the file (YAML or JSON), the environment variables.
+// The result is validated.
+func PeerConfigLoad(fileName string) (config PeerConfig, err error) {
+	config = DefaultPeerConfig()
+	if fileName != "" {
+		var bs []byte
+		bs, err = os.ReadFile(fileName)
+		if err != nil {
+			return
+		}
+		// JSON is YAML
+		err = yaml.Unmarshal(bs, &config)
+		if err != nil {
+			err = errors.New(ERR_XCHG_PEER_CONFIG_WRONG_FORMAT + ":" + err.Error())
+			return
+		}
+	}
+	err = config.LoadFromEnv()
+	if err != nil {
+		return
+	}
+	err = config.Validate()
+	return
+}
+
+// Overrides the values with the environment variables XCHG_<KEY>:
+// XCHG_LONG_POLLING_DELAY=5s, XCHG_LOCAL_ROUTERS=localhost:43001,localhost:43002
+func (c *PeerConfig) LoadFromEnv() (err error) {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		envName := peerConfigEnvPrefix + strings.ToUpper(key)
+		value, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		field := v.Field(i)
+		switch field.Interface().(type) {
+		case time.Duration:
+			var duration time.Duration
+			duration, err = time.ParseDuration(value)
+			field.SetInt(int64(duration))
+		case int:
+			var n int
+			n, err = strconv.Atoi(value)
+			field.SetInt(int64(n))
+		case bool:
+			var b bool
+			b, err = strconv.ParseBool(value)
+			field.SetBool(b)
+		case string:
+			field.SetString(value)
+		case []string:
+			list := make([]string, 0)
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+		}
+		if err != nil {
+			err = errors.New(ERR_XCHG_PEER_CONFIG_WRONG_VALUE + ":" + envName)
+			return
+		}
+	}
+	return
+}
+
+func (c *PeerConfig) Validate() (err error) {
+	wrongValue := func(key string) error {
+		return errors.New(ERR_XCHG_PEER_CONFIG_WRONG_VALUE + ":" + key)
+	}
+
+	for _, routerAddress := range c.LocalRouters {
+		if _, _, err = parseLocalRouter(routerAddress); err != nil {
+			return wrongValue("local_routers")
+		}
+	}
+	for _, routerHost := range c.LocalNodes {
+		if _, _, err = net.SplitHostPort(routerHost); err != nil {
+			return wrongValue("local_nodes")
+		}
+	}
+
+	if len(c.NetworkPublicKeys) > 0 && c.NetworkFile == "" {
+		return wrongValue("network_public_keys")
+	}
+	keys, err := NetworkDistinctPublicKeys(c.NetworkPublicKeys)
+	if err != nil {
+		return wrongValue("network_public_keys")
+	}
+	if c.NetworkKeyThreshold < 1 || (len(keys) > 0 && c.NetworkKeyThreshold > len(keys)) {
+		return wrongValue("network_key_threshold")
+	}
+
+	durations := []struct {
+		key   string
+		value time.Duration
+	}{
+		{"long_polling_delay", c.LongPollingDelay},
+		{"router_call_timeout", c.RouterCallTimeout},
+		{"router_register_period", c.RouterRegisterPeriod},
+		{"network_load_timeout", c.NetworkLoadTimeout},
+		{"network_update_period", c.NetworkUpdatePeriod},
+		{"session_ttl", c.SessionTTL},
+		{"transaction_ttl", c.TransactionTTL},
+		{"auth_timeout", c.AuthTimeout},
+	}
+	for _, d := range durations {
+		if d.value < peerConfigMinTimeout {
+			return wrongValue(d.key)
+		}
+	}
+	// TCP: the connection of the read must not be closed by the router as idle
+	if c.RouterRegisterPeriod >= router.TcpIdleTimeout {
+		return wrongValue("router_register_period")
+	}
+
+	if c.CallBlockSize < 1 || c.CallBlockSize > peerConfigMaxBlock {
+		return wrongValue("call_block_size")
+	}
+	if c.ResponseBlockSize < 1 || c.ResponseBlockSize > peerConfigMaxBlock {
+		return wrongValue("response_block_size")
+	}
+	if c.NoncePoolSize < 1 || c.NoncePoolSize > peerConfigMaxNonces {
+		return wrongValue("nonce_pool_size")
+	}
+	if c.MaxStreamsPerSession < 1 {
+		return wrongValue("max_streams_per_session")
+	}
+	return
+}
+
+func (c PeerConfig) clone() PeerConfig {
+	c.LocalRouters = append([]string{}, c.LocalRouters...)
+	c.LocalNodes = append([]string{}, c.LocalNodes...)
+	c.NetworkPublicKeys = append([]string{}, c.NetworkPublicKeys...)
+	return c
+}
+
+type localRouter struct {
+	host       string
+	router     *router.Router
+	httpServer *router.HttpServer
+	udpServer  *router.UdpServer
+	tcpServer  *router.TcpServer
+}
+
+func (c *Peer) Config() PeerConfig {
+	return c.config.clone()
+}
+
+// Hosts of the local nodes and the running embedded routers
+func (c *Peer) LocalNodes() []string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return append([]string{}, c.localNodes...)
+}
+
+func (c *Peer) startLocalRouters(enableLocalRouter bool) {
+	config := c.config
+
+	localNodes := make([]string, 0)
+	localRouters := make([]*localRouter, 0)
+	if enableLocalRouter {
+		for _, routerAddress := range config.LocalRouters {
+			r, err := c.startLocalRouter(routerAddress)
+			if err != nil {
+				c.logger.Println("Peer::Start", "local router", routerAddress, "error:", err)
+				continue
+			}
+			localRouters = append(localRouters, r)
+			localNodes = appendHost(localNodes, r.host)
+		}
+	}
+	for _, routerHost := range config.LocalNodes {
+		localNodes = appendHost(localNodes, routerHost)
+	}
+
+	c.mtx.Lock()
+	c.localRouters = localRouters
+	c.localNodes = localNodes
+	c.mtx.Unlock()
+}
+
+// host:port -> the host to reach the router and the port to listen
+func parseLocalRouter(routerAddress string) (host string, port int, err error) {
+	host, portString, err := net.SplitHostPort(routerAddress)
+	if err != nil {
+		return
+	}
+	port, err = strconv.Atoi(portString)
+	if err != nil || port <= 0 || port+router.TcpPortOffset > 65535 {
+		err = errors.New(ERR_XCHG_PEER_WRONG_LOCAL_ROUTER)
+		return
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	host = net.JoinHostPort(host, portString)
+	return
+}
+
+func (c *Peer) startLocalRouter(routerAddress string) (r *localRouter, err error) {
+	host, port, err := parseLocalRouter(routerAddress)
+	if err != nil {
+		return
+	}
+
+	r = &localRouter{}
+	r.host = host
+	r.router = router.NewRouter()
+	r.router.Start()
+
+	r.httpServer = router.NewHttpServer()
+	err = r.httpServer.Start(r.router, port)
+	if err != nil {
+		r.router.Stop()
+		r = nil
+		return
+	}
+
+	// UDP and TCP API are optional
+	r.udpServer = router.NewUdpServer()
+	if errUdp := r.udpServer.Start(r.router, port); errUdp != nil {
+		c.logger.Println("Peer::Start", "UDP server error:", errUdp)
+		r.udpServer = nil
+	}
+
+	r.tcpServer = router.NewTcpServer()
+	if errTcp := r.tcpServer.Start(r.router, port+router.TcpPortOffset); errTcp != nil {
+		c.logger.Println("Peer::Start", "TCP server error:", errTcp)
+		r.tcpServer = nil
+	}
+
+	return
+}
+
+func (c *Peer) stopLocalRouters() {
+	c.mtx.Lock()
+	localRouters := c.localRouters
+	c.localRouters = nil
+	c.localNodes = nil
+	c.mtx.Unlock()
+
+	for _, r := range localRouters {
+		r.httpServer.Stop()
+		if r.udpServer != nil {
+			r.udpServer.Stop()
+		}
+		if r.tcpServer != nil {
+			r.tcpServer.Stop()
+		}
+		r.router.Stop()
+	}
+}
+
+// Routers of the address in the network and the local nodes
+func (c *Peer) routersForAddress(network *Network, address string) (routers []string) {
+	routers = network.GetNodesAddressesByAddress(address)
+	c.mtx.Lock()
+	localNodes := c.localNodes
+	c.mtx.Unlock()
+	for _, routerHost := range localNodes {
+		routers = appendHost(routers, routerHost)
+	}
+	return
+}
+
+func (c *Peer) isLocalNode(routerHost string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, localNode := range c.localNodes {
+		if strings.EqualFold(localNode, routerHost) {
+			return true
+		}
+	}
+	return false
+}
+
+func appendHost(hosts []string, host string) []string {
+	for _, h := range hosts {
+		if strings.EqualFold(h, host) {
+			return hosts
+		}
+	}
+	return append(hosts, host)
+}
@@ -0,0 +1,23 @@
+package xchg_test
+
+import (
+	"testing"
+
+	"github.com/ipoluianov/xchg/router"
+	"github.com/ipoluianov/xchg/xchg"
+)
+
+// The TCP connection of the read is not closed by the router between the reads
+func TestPeerConfigRegisterPeriod(t *testing.T) {
+	config := xchg.DefaultPeerConfig()
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	config.RouterRegisterPeriod = router.TcpIdleTimeout
+	if err := config.Validate(); err == nil || err.Error() != xchg.ERR_XCHG_PEER_CONFIG_WRONG_VALUE+":router_register_period" {
+		t.Fatal("the period of the idle timeout is accepted:", err)
+	}
+	if _, err := xchg.NewPeerWithConfig(nil, xchg.NewDefaultLogger(), config); err == nil {
+		t.Fatal("the peer is created")
+	}
+}
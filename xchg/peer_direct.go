@@ -0,0 +1,360 @@
+package xchg
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipoluianov/xchg/router"
+)
+
+// Direct path between peers - UDP hole punching.
+//
+// The client asks the server (/xchg-direct, encrypted session call) with its candidates
+// (the endpoints observed by routers and the local addresses) and gets the candidates
+// of the server. Both sides send punch datagrams to the candidates of each other.
+// A punch is [timestamp 8][random 8] encrypted with the key of the session.
+// The endpoint of the first valid punch (or ack) is the direct path.
+//
+// The candidates are chosen by the other side: only IP addresses are accepted,
+// not more than directMaxPublicCandidates of them are public (the rest are LAN and loopback),
+// the server punches once per directCallPeriod for a session and not more than directMaxPunches at once.
+//
+// The server sends frames to the client directly while the frames of the client come directly.
+const (
+	directPunchPeriod   = 100 * time.Millisecond
+	directPunchDuration = 3 * time.Second
+	directPunchMaxAge   = 30 * time.Second
+	directPathTimeout   = 60 * time.Second
+	directRetryPeriod   = 60 * time.Second
+	directCallTimeout   = 2 * time.Second
+	directCallPeriod    = 10 * time.Second
+
+	directMaxPublicCandidates = 2
+	directMaxPunches          = 16
+)
+
+// Direct path of the server to the client.
+// The endpoint is the verified (by punches) endpoint the frames of the client come from.
+type directPath struct {
+	verified map[string]struct{}
+	endpoint *net.UDPAddr
+	active   bool
+	lastDT   time.Time
+}
+
+func isDirectFunction(function string) bool {
+	return function == "/xchg-direct"
+}
+
+func (c *Peer) getUdpTransport() *UdpTransport {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.findUdpTransport()
+}
+
+func (c *Peer) findUdpTransport() *UdpTransport {
+	for _, transport := range c.transports {
+		if udpTransport, ok := transport.(*UdpTransport); ok {
+			return udpTransport
+		}
+	}
+	return nil
+}
+
+// [candidates] -> [candidates], the server starts punching to the client
+func (c *Peer) processDirectCall(session *Session, parameter []byte) (response []byte, err error) {
+	udpTransport := c.getUdpTransport()
+	if udpTransport == nil {
+		err = errors.New(ERR_XCHG_DIRECT_NOT_AVAILABLE)
+		return
+	}
+	clientCandidates := parseCandidates(parameter)
+
+	c.mtx.Lock()
+	if time.Since(session.directDT) < directCallPeriod || c.directPunches >= directMaxPunches {
+		c.mtx.Unlock()
+		err = errors.New(ERR_XCHG_DIRECT_LIMIT)
+		return
+	}
+	session.directDT = time.Now()
+	c.directPunches++
+	remoteAddress := session.remoteAddress
+	aesKey := session.aesKey
+	c.mtx.Unlock()
+
+	response = marshalCandidates(udpTransport.Candidates())
+
+	go func() {
+		punch(udpTransport, clientCandidates, router.UdpFunctionPunchToClient, session.id, aesKey, func() bool {
+			c.mtx.Lock()
+			defer c.mtx.Unlock()
+			_, pathOk := c.directPaths[remoteAddress]
+			_, sessionOk := c.sessionsById[session.id]
+			return pathOk || !sessionOk
+		})
+		c.mtx.Lock()
+		c.directPunches--
+		c.mtx.Unlock()
+	}()
+	return
+}
+
+func (c *Peer) processDirectMessage(addr *net.UDPAddr, message *router.UdpMessage) {
+	switch message.Function {
+	case router.UdpFunctionPunchToServer, router.UdpFunctionPunchToClientAck:
+		c.processPunchToServer(addr, message)
+	case router.UdpFunctionPunchToClient, router.UdpFunctionPunchToServerAck:
+		c.processPunchToClient(addr, message)
+	case router.UdpFunctionDirectFrame:
+		c.processDirectFrame(addr, message.Data)
+	case router.UdpFunctionLanFrame:
+		c.processLanFrame(addr, message.Data)
+	}
+}
+
+// 0x20 - the endpoint of the request is the direct path to the requester,
+// 0x21 - the endpoint of the response is the direct path to the remote peer
+func (c *Peer) processLanFrame(addr *net.UDPAddr, frame []byte) {
+	if len(frame) < TransactionHeaderSize {
+		return
+	}
+	switch frame[8] {
+	case 0x20:
+		responseFrames := c.processFrame20(frame)
+		if len(responseFrames) == 0 {
+			return
+		}
+		udpTransport := c.getUdpTransport()
+		if udpTransport == nil {
+			return
+		}
+		// The endpoint of the requester is verified later by its punches
+		for _, f := range responseFrames {
+			udpTransport.sendDirect(addr, router.UdpFunctionLanFrame, 0, f.Marshal())
+		}
+	case 0x21:
+		c.processFrame21(udpEndpointKey(addr), addr, frame)
+	}
+}
+
+func (c *Peer) processPunchToServer(addr *net.UDPAddr, message *router.UdpMessage) {
+	c.mtx.Lock()
+	session, ok := c.sessionsById[message.Id]
+	c.mtx.Unlock()
+	if !ok || !checkPunch(message.Data, session.aesKey) {
+		return
+	}
+
+	c.addDirectEndpoint(session.remoteAddress, addr)
+
+	if message.Function == router.UdpFunctionPunchToServer {
+		if udpTransport := c.getUdpTransport(); udpTransport != nil {
+			udpTransport.sendDirect(addr, router.UdpFunctionPunchToServerAck, message.Id, makePunch(session.aesKey))
+		}
+	}
+}
+
+func (c *Peer) processPunchToClient(addr *net.UDPAddr, message *router.UdpMessage) {
+	c.mtx.Lock()
+	remotePeers := make([]*RemotePeer, 0, 1)
+	for _, remotePeer := range c.remotePeers {
+		remotePeers = append(remotePeers, remotePeer)
+	}
+	c.mtx.Unlock()
+
+	for _, remotePeer := range remotePeers {
+		sessionId, aesKey := remotePeer.session()
+		if sessionId != message.Id || !checkPunch(message.Data, aesKey) {
+			continue
+		}
+		remotePeer.SetRemoteUDPAddress(addr)
+		if direct := remotePeer.getDirectTransport(); direct != nil {
+			direct.setVerified(addr)
+		}
+		if message.Function == router.UdpFunctionPunchToClient {
+			if udpTransport := c.getUdpTransport(); udpTransport != nil {
+				udpTransport.sendDirect(addr, router.UdpFunctionPunchToClientAck, message.Id, makePunch(aesKey))
+			}
+		}
+		return
+	}
+}
+
+// The endpoint is verified - the frames of the address may come from it
+func (c *Peer) addDirectEndpoint(address string, addr *net.UDPAddr) {
+	c.mtx.Lock()
+	path, ok := c.directPaths[address]
+	if !ok {
+		path = &directPath{}
+		path.verified = make(map[string]struct{})
+		c.directPaths[address] = path
+	}
+	path.verified[udpEndpointKey(addr)] = struct{}{}
+	path.lastDT = time.Now()
+	c.mtx.Unlock()
+}
+
+func (c *Peer) processDirectFrame(addr *net.UDPAddr, frame []byte) {
+	if len(frame) < TransactionHeaderSize {
+		return
+	}
+	srcAddress := "#" + strings.ToLower(base32.StdEncoding.EncodeToString(frame[40:70]))
+	c.mtx.Lock()
+	if path, ok := c.directPaths[srcAddress]; ok {
+		if _, verified := path.verified[udpEndpointKey(addr)]; verified {
+			path.endpoint = addr
+			path.active = true
+			path.lastDT = time.Now()
+		}
+	}
+	c.mtx.Unlock()
+
+	responses := c.processFrame("", frame)
+	for _, f := range responses {
+		c.send(f.Marshal(), f.FromLocalNode)
+	}
+}
+
+// The client has switched to routers
+func (c *Peer) deactivateDirectPath(frame []byte) {
+	if len(frame) < TransactionHeaderSize {
+		return
+	}
+	srcAddress := "#" + strings.ToLower(base32.StdEncoding.EncodeToString(frame[40:70]))
+	c.mtx.Lock()
+	if path, ok := c.directPaths[srcAddress]; ok {
+		path.active = false
+	}
+	c.mtx.Unlock()
+}
+
+// Sends the frame directly if the path to the destination is active
+func (c *Peer) sendDirect(frame []byte) bool {
+	destAddress := "#" + strings.ToLower(base32.StdEncoding.EncodeToString(frame[70:100]))
+	c.mtx.Lock()
+	var endpoint *net.UDPAddr
+	if path, ok := c.directPaths[destAddress]; ok && path.active && path.endpoint != nil {
+		endpoint = path.endpoint
+	}
+	c.mtx.Unlock()
+	if endpoint == nil {
+		return false
+	}
+	udpTransport := c.getUdpTransport()
+	if udpTransport == nil {
+		return false
+	}
+	return udpTransport.sendDirectFrame(endpoint, frame) == nil
+}
+
+func (c *Peer) purgeDirectPaths() {
+	c.mtx.Lock()
+	for address, path := range c.directPaths {
+		if time.Since(path.lastDT) > directPathTimeout {
+			delete(c.directPaths, address)
+		}
+	}
+	c.mtx.Unlock()
+}
+
+// Sends punches to the candidates until done or directPunchDuration
+func punch(udpTransport *UdpTransport, candidates []string, function byte, sessionId uint64, aesKey []byte, done func() bool) {
+	addrs := punchAddresses(candidates)
+	if len(addrs) == 0 {
+		return
+	}
+
+	beginDT := time.Now()
+	for time.Since(beginDT) < directPunchDuration && !done() {
+		for _, addr := range addrs {
+			udpTransport.sendDirect(addr, function, sessionId, makePunch(aesKey))
+		}
+		time.Sleep(directPunchPeriod)
+	}
+}
+
+// IP:port candidates (no names), directMaxPublicCandidates of them may be public
+func punchAddresses(candidates []string) (addrs []*net.UDPAddr) {
+	addrs = make([]*net.UDPAddr, 0, len(candidates))
+	publicCount := 0
+	for _, candidate := range candidates {
+		host, portString, err := net.SplitHostPort(candidate)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		port, err := strconv.Atoi(portString)
+		if ip == nil || err != nil || port <= 0 || port > 65535 {
+			continue
+		}
+		if ip.IsUnspecified() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+			continue
+		}
+		if !ip.IsLoopback() && !ip.IsPrivate() {
+			if publicCount >= directMaxPublicCandidates {
+				continue
+			}
+			publicCount++
+		}
+		addrs = append(addrs, &net.UDPAddr{IP: ip, Port: port})
+	}
+	return
+}
+
+func makePunch(aesKey []byte) []byte {
+	payload := make([]byte, 16)
+	binary.LittleEndian.PutUint64(payload, uint64(time.Now().UnixMilli()))
+	rand.Read(payload[8:])
+	encrypted, err := EncryptAESGCM(payload, aesKey)
+	if err != nil {
+		return nil
+	}
+	return encrypted
+}
+
+func checkPunch(data []byte, aesKey []byte) bool {
+	if len(aesKey) != 32 {
+		return false
+	}
+	payload, err := DecryptAESGCM(data, aesKey)
+	if err != nil || len(payload) != 16 {
+		return false
+	}
+	punchDT := time.UnixMilli(int64(binary.LittleEndian.Uint64(payload)))
+	age := time.Since(punchDT)
+	return age < directPunchMaxAge && age > -directPunchMaxAge
+}
+
+// [len 1][ip:port] ...
+func marshalCandidates(candidates []string) []byte {
+	result := make([]byte, 0)
+	for _, candidate := range candidates {
+		if len(candidate) > 255 {
+			continue
+		}
+		result = append(result, byte(len(candidate)))
+		result = append(result, candidate...)
+	}
+	return result
+}
+
+func parseCandidates(data []byte) (candidates []string) {
+	candidates = make([]string, 0)
+	offset := 0
+	for offset < len(data) && len(candidates) < udpMaxCandidates {
+		candidateLen := int(data[offset])
+		offset++
+		if offset+candidateLen > len(data) {
+			break
+		}
+		candidates = append(candidates, string(data[offset:offset+candidateLen]))
+		offset += candidateLen
+	}
+	return
+}
@@ -0,0 +1,164 @@
+package xchg
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const (
+	FrameTypeNotify = byte(0x17)
+
+	// A notification is sent in one frame without acknowledgement
+	MaxNotificationSize = 64 * 1024
+
+	// The client repeats subscriptions to keep the session alive
+	resubscribePeriod = 20 * time.Second
+)
+
+type sessionIdContextKey struct{}
+
+// Returns the session of the client that made the call.
+// Available in ServerProcessorCallContext and ServerProcessorStream.
+func SessionIdFromContext(ctx context.Context) (sessionId uint64, ok bool) {
+	sessionId, ok = ctx.Value(sessionIdContextKey{}).(uint64)
+	return
+}
+
+func isSubscriptionFunction(function string) bool {
+	return function == "/xchg-subscribe" || function == "/xchg-unsubscribe"
+}
+
+// [topicLen 1] [topic] [topicLen 1] [topic] ...
+func (c *Peer) processSubscriptionCall(session *Session, function string, parameter []byte) (response []byte, err error) {
+	topics, err := parseTopics(parameter)
+	if err != nil {
+		return
+	}
+	c.mtx.Lock()
+	if session.subscriptions == nil {
+		session.subscriptions = make(map[string]struct{})
+	}
+	for _, topic := range topics {
+		if function == "/xchg-subscribe" {
+			session.subscriptions[topic] = struct{}{}
+		} else {
+			delete(session.subscriptions, topic)
+		}
+	}
+	c.mtx.Unlock()
+	response = make([]byte, 0)
+	return
+}
+
+// Sends the notification to the client of the session if it is subscribed to the topic
+func (c *Peer) Notify(sessionId uint64, topic string, data []byte) (err error) {
+	c.mtx.Lock()
+	session, ok := c.sessionsById[sessionId]
+	c.mtx.Unlock()
+	if !ok {
+		err = errors.New(ERR_XCHG_SRV_CONN_WRONG_SESSION)
+		return
+	}
+	_, err = c.notifySession(session, topic, data)
+	return
+}
+
+// Sends the notification to all clients subscribed to the topic
+// Returns the count of notified sessions. An error of a session does not stop the delivery,
+// the first error is returned.
+func (c *Peer) NotifyAll(topic string, data []byte) (count int, err error) {
+	err = checkNotification(topic, data)
+	if err != nil {
+		return
+	}
+
+	c.mtx.Lock()
+	sessions := make([]*Session, 0, len(c.sessionsById))
+	for _, session := range c.sessionsById {
+		sessions = append(sessions, session)
+	}
+	c.mtx.Unlock()
+
+	for _, session := range sessions {
+		sent, errSession := c.notifySession(session, topic, data)
+		if errSession != nil && err == nil {
+			err = errSession
+		}
+		if sent {
+			count++
+		}
+	}
+	return
+}
+
+func checkNotification(topic string, data []byte) (err error) {
+	if len(topic) > 255 {
+		err = errors.New(ERR_XCHG_NOTIFY_WRONG_TOPIC_LEN)
+		return
+	}
+	if len(data) > MaxNotificationSize {
+		err = errors.New(ERR_XCHG_NOTIFY_TOO_LARGE)
+		return
+	}
+	return
+}
+
+// The counter of the session is advanced only for the sent notifications
+func (c *Peer) notifySession(session *Session, topic string, data []byte) (sent bool, err error) {
+	err = checkNotification(topic, data)
+	if err != nil {
+		return
+	}
+
+	c.mtx.Lock()
+	_, subscribed := session.subscriptions[topic]
+	if !subscribed {
+		c.mtx.Unlock()
+		return
+	}
+	session.notificationCounter++
+	counter := session.notificationCounter
+	c.mtx.Unlock()
+
+	payload := make([]byte, 8+1+len(topic)+len(data))
+	binary.LittleEndian.PutUint64(payload, counter)
+	payload[8] = byte(len(topic))
+	copy(payload[9:], topic)
+	copy(payload[9+len(topic):], data)
+	payload = PackBytes(payload)
+	payload, err = EncryptAESGCM(payload, session.aesKey)
+	if err != nil {
+		return
+	}
+
+	tr := NewTransaction(FrameTypeNotify, c.localAddress, session.remoteAddress, counter, session.id, 0, len(payload), payload)
+	c.send(tr.Marshal(), false)
+	sent = true
+	return
+}
+
+func parseTopics(data []byte) (topics []string, err error) {
+	topics = make([]string, 0)
+	offset := 0
+	for offset < len(data) {
+		topicLen := int(data[offset])
+		if offset+1+topicLen > len(data) {
+			err = errors.New(ERR_XCHG_NOTIFY_WRONG_TOPIC_LEN)
+			return
+		}
+		topics = append(topics, string(data[offset+1:offset+1+topicLen]))
+		offset += 1 + topicLen
+	}
+	return
+}
+
+func marshalTopics(topics []string) (data []byte) {
+	data = make([]byte, 0)
+	for _, topic := range topics {
+		data = append(data, byte(len(topic)))
+		data = append(data, topic...)
+	}
+	return
+}
@@ -1,13 +1,16 @@
 package xchg
 
 import (
+	"context"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/base32"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"net"
 	"strings"
 	"time"
 )
@@ -21,6 +24,9 @@ func (c *Peer) processFrame(routerHost string, frame []byte) (responseFrames []*
 
 	// Call Request
 	if frameType == 0x10 {
+		if routerHost != "" {
+			c.deactivateDirectPath(frame)
+		}
 		responseFrames = c.processFrame10(routerHost, frame)
 		return
 	}
@@ -31,6 +37,42 @@ func (c *Peer) processFrame(routerHost string, frame []byte) (responseFrames []*
 		return
 	}
 
+	// Call NACK - the server asks for missing blocks of the call
+	if frameType == 0x12 {
+		c.processFrame11(routerHost, frame)
+		return
+	}
+
+	// Response NACK - the client asks for missing blocks of the response
+	if frameType == 0x13 {
+		responseFrames = c.processFrame13(routerHost, frame)
+		return
+	}
+
+	// Cancel of a call
+	if frameType == 0x14 {
+		c.processFrame14(routerHost, frame)
+		return
+	}
+
+	// Notification from a server peer
+	if frameType == 0x17 {
+		c.processFrame11(routerHost, frame)
+		return
+	}
+
+	// Stream data and acknowledgements from the client
+	if frameType == 0x15 || frameType == 0x18 {
+		c.processStreamFrame(frame)
+		return
+	}
+
+	// Stream data and acknowledgements from the server
+	if frameType == 0x16 || frameType == 0x19 {
+		c.processFrame11(routerHost, frame)
+		return
+	}
+
 	// ARP request
 	if frameType == 0x20 {
 		responseFrames = c.processFrame20(frame)
@@ -39,7 +81,7 @@ func (c *Peer) processFrame(routerHost string, frame []byte) (responseFrames []*
 
 	// ARP response
 	if frameType == 0x21 {
-		c.processFrame21(routerHost, frame)
+		c.processFrame21(routerHost, nil, frame)
 		return
 	}
 
@@ -51,37 +93,35 @@ func (c *Peer) processFrame(routerHost string, frame []byte) (responseFrames []*
 // ----------------------------------------
 
 func (c *Peer) processFrame10(routerHost string, frame []byte) (responseFrames []*Transaction) {
-	var processor ServerProcessor
-
-	responseFrames = make([]*Transaction, 0)
-
 	transaction, err := Parse(frame)
 	if err != nil {
 		return
 	}
 
-	if c.network != nil {
-		if c.network.IsLocalNode(routerHost) {
-			transaction.FromLocalNode = true
-		}
+	if c.isLocalNode(routerHost) {
+		transaction.FromLocalNode = true
 	}
 
 	c.mtx.Lock()
-	processor = c.processor
+	acceptsCalls := c.processor != nil || c.listener != nil
 	var incomingTransaction *Transaction
 
-	for trCode, tr := range c.incomingTransactions {
-		now := time.Now()
-		if now.Sub(tr.BeginDT) > 10*time.Second {
-			delete(c.incomingTransactions, trCode)
-		}
-	}
-
 	var ok bool
-	incomingTransactionCode := fmt.Sprint(transaction.SrcAddress, "-", transaction.TransactionId)
+	incomingTransactionCode := transactionCode(transaction)
+	if _, ok = c.outgoingResponses[incomingTransactionCode]; ok {
+		// Already processed - the response can be requested by NACK
+		c.mtx.Unlock()
+		return
+	}
+	if _, ok = c.runningCalls[incomingTransactionCode]; ok {
+		// Is being processed
+		c.mtx.Unlock()
+		return
+	}
 	if incomingTransaction, ok = c.incomingTransactions[incomingTransactionCode]; !ok {
-		incomingTransaction = NewTransaction(transaction.FrameType, AddressForPublicKey(&c.privateKey.PublicKey), string(transaction.SrcAddress[:]), transaction.TransactionId, transaction.SessionId, 0, int(transaction.TotalSize), make([]byte, 0))
+		incomingTransaction = NewTransaction(transaction.FrameType, AddressForPublicKey(&c.privateKey.PublicKey), transaction.SrcAddressString(), transaction.TransactionId, transaction.SessionId, 0, int(transaction.TotalSize), make([]byte, 0))
 		incomingTransaction.BeginDT = time.Now()
+		incomingTransaction.Appendix = transaction.Appendix
 		c.incomingTransactions[incomingTransactionCode] = incomingTransaction
 	}
 
@@ -96,54 +136,201 @@ func (c *Peer) processFrame10(routerHost string, frame []byte) (responseFrames [
 	}
 
 	delete(c.incomingTransactions, incomingTransactionCode)
+
+	if !acceptsCalls {
+		c.mtx.Unlock()
+		return
+	}
+
+	ctx, cancel := c.callContext(incomingTransaction)
+	c.runningCalls[incomingTransactionCode] = cancel
 	c.mtx.Unlock()
 
-	srcAddress := "#" + base32.StdEncoding.EncodeToString(transaction.SrcAddress[:])
+	go c.executeCall(ctx, incomingTransactionCode, incomingTransaction)
+	return
+}
+
+// The context of a call is cancelled by the 0x14 frame or by the deadline of the client
+func (c *Peer) callContext(incomingTransaction *Transaction) (ctx context.Context, cancel context.CancelFunc) {
+	timeoutMs := binary.LittleEndian.Uint64(incomingTransaction.Appendix[0:])
+	if timeoutMs > 0 {
+		return context.WithDeadline(context.Background(), incomingTransaction.BeginDT.Add(time.Duration(timeoutMs)*time.Millisecond))
+	}
+	return context.WithCancel(context.Background())
+}
 
-	if processor != nil {
-		resp, dontSendResponse := c.onEdgeReceivedCall(incomingTransaction.SessionId, incomingTransaction.Data)
-		if !dontSendResponse {
-			trResponse := NewTransaction(0x11, AddressForPublicKey(&c.privateKey.PublicKey), srcAddress, incomingTransaction.TransactionId, incomingTransaction.SessionId, 0, len(resp), resp)
-
-			offset := 0
-			blockSize := 4 * 1024
-			for offset < len(trResponse.Data) {
-				currentBlockSize := blockSize
-				restDataLen := len(trResponse.Data) - offset
-				if restDataLen < currentBlockSize {
-					currentBlockSize = restDataLen
-				}
-
-				blockTransaction := NewTransaction(0x11, AddressForPublicKey(&c.privateKey.PublicKey), srcAddress, trResponse.TransactionId, trResponse.SessionId, offset, len(resp), trResponse.Data[offset:offset+currentBlockSize])
-				blockTransaction.Offset = uint32(offset)
-				blockTransaction.TotalSize = uint32(len(trResponse.Data))
-				blockTransaction.FromLocalNode = incomingTransaction.FromLocalNode
-				responseFrames = append(responseFrames, blockTransaction)
-				offset += currentBlockSize
-			}
+func (c *Peer) executeCall(ctx context.Context, code string, incomingTransaction *Transaction) {
+	defer func() {
+		c.mtx.Lock()
+		if cancel, ok := c.runningCalls[code]; ok {
+			cancel()
+			delete(c.runningCalls, code)
 		}
+		c.mtx.Unlock()
+	}()
+
+	resp, dontSendResponse := c.onEdgeReceivedCall(ctx, incomingTransaction.SessionId, incomingTransaction.Data)
+	if dontSendResponse || ctx.Err() != nil {
+		return
+	}
+
+	srcAddress := incomingTransaction.DestAddressString()
+	trResponse := NewTransaction(0x11, c.localAddress, srcAddress, incomingTransaction.TransactionId, incomingTransaction.SessionId, 0, len(resp), resp)
+
+	responseFrames := make([]*Transaction, 0)
+	offset := 0
+	blockSize := c.config.ResponseBlockSize
+	for offset < len(trResponse.Data) {
+		currentBlockSize := blockSize
+		restDataLen := len(trResponse.Data) - offset
+		if restDataLen < currentBlockSize {
+			currentBlockSize = restDataLen
+		}
+
+		blockTransaction := NewTransaction(0x11, c.localAddress, srcAddress, trResponse.TransactionId, trResponse.SessionId, offset, len(resp), trResponse.Data[offset:offset+currentBlockSize])
+		blockTransaction.Offset = uint32(offset)
+		blockTransaction.TotalSize = uint32(len(trResponse.Data))
+		blockTransaction.FromLocalNode = incomingTransaction.FromLocalNode
+		responseFrames = append(responseFrames, blockTransaction)
+		offset += currentBlockSize
+	}
+
+	// Keep the blocks for retransmission
+	trResponse.BeginDT = time.Now()
+	trResponse.LastReceivedDT = trResponse.BeginDT
+	trResponse.OutgoingFrames = responseFrames
+	c.mtx.Lock()
+	c.outgoingResponses[code] = trResponse
+	c.mtx.Unlock()
+
+	for _, f := range responseFrames {
+		c.send(f.Marshal(), f.FromLocalNode)
+	}
+}
+
+// Response NACK - resends the requested blocks of the response
+func (c *Peer) processFrame13(routerHost string, frame []byte) (responseFrames []*Transaction) {
+	transaction, err := Parse(frame)
+	if err != nil {
+		return
+	}
+
+	code := transactionCode(transaction)
+	ranges := ParseRanges(transaction.Data)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if trResponse, ok := c.outgoingResponses[code]; ok {
+		// The response is kept while the client asks for its blocks
+		trResponse.LastReceivedDT = time.Now()
+		responseFrames = trResponse.OutgoingFramesInRanges(ranges)
+		return
+	}
+
+	// The call is not received completely - ask for the missing blocks
+	if incomingTransaction, ok := c.incomingTransactions[code]; ok {
+		responseFrames = append(responseFrames, c.makeCallNack(incomingTransaction))
 	}
 	return
 }
 
+// Cancel - the client does not wait for the response anymore
+func (c *Peer) processFrame14(routerHost string, frame []byte) {
+	transaction, err := Parse(frame)
+	if err != nil {
+		return
+	}
+
+	c.mtx.Lock()
+	session, ok := c.sessionsById[transaction.SessionId]
+	c.mtx.Unlock()
+	if !ok {
+		return
+	}
+
+	transactionIdBS, err := DecryptAESGCM(transaction.Data, session.aesKey)
+	if err != nil || len(transactionIdBS) != 8 || binary.LittleEndian.Uint64(transactionIdBS) != transaction.TransactionId {
+		return
+	}
+
+	code := transactionCode(transaction)
+	tombstone := NewTransaction(FrameTypeResponse, c.localAddress, transaction.SrcAddressString(), transaction.TransactionId, transaction.SessionId, 0, 0, nil)
+	tombstone.BeginDT = time.Now()
+	tombstone.LastReceivedDT = tombstone.BeginDT
+
+	c.mtx.Lock()
+	delete(c.incomingTransactions, code)
+	c.outgoingResponses[code] = tombstone
+	if cancel, ok := c.runningCalls[code]; ok {
+		cancel()
+	}
+	c.mtx.Unlock()
+}
+
+func (c *Peer) makeCallNack(incomingTransaction *Transaction) *Transaction {
+	ranges := incomingTransaction.MissingRanges(incomingTransaction.TotalSize)
+	nack := NewTransaction(FrameTypeCallNack, c.localAddress, incomingTransaction.DestAddressString(), incomingTransaction.TransactionId, incomingTransaction.SessionId, 0, int(incomingTransaction.TotalSize), MarshalRanges(ranges))
+	nack.FromLocalNode = incomingTransaction.FromLocalNode
+	incomingTransaction.LastNackDT = time.Now()
+	incomingTransaction.NackCount++
+	return nack
+}
+
+// Asks for missing blocks of stalled incoming calls and removes old transactions
+func (c *Peer) checkTransactions() {
+	nacks := make([]*Transaction, 0)
+	now := time.Now()
+
+	c.mtx.Lock()
+	for code, tr := range c.incomingTransactions {
+		// A large call may be being received longer than the TTL
+		if now.Sub(tr.LastReceivedDT) > c.config.TransactionTTL {
+			delete(c.incomingTransactions, code)
+			continue
+		}
+		if tr.Complete || tr.NackCount >= MaxNackCount {
+			continue
+		}
+		if now.Sub(tr.LastReceivedDT) > NackDelay && now.Sub(tr.LastNackDT) > NackDelay {
+			nacks = append(nacks, c.makeCallNack(tr))
+		}
+	}
+	for code, tr := range c.outgoingResponses {
+		if now.Sub(tr.LastReceivedDT) > c.config.TransactionTTL {
+			delete(c.outgoingResponses, code)
+		}
+	}
+	c.mtx.Unlock()
+
+	for _, nack := range nacks {
+		c.send(nack.Marshal(), nack.FromLocalNode)
+	}
+}
+
+func transactionCode(transaction *Transaction) string {
+	return fmt.Sprint(transaction.SrcAddress, "-", transaction.TransactionId)
+}
+
 func (c *Peer) processFrame11(routerHost string, frame []byte) {
 	tr, err := Parse(frame)
 	if err != nil {
 		return
 	}
 
-	var remotePeer *RemotePeer
+	// There can be several sessions to the address (different auth data)
+	srcAddress := "#" + strings.ToLower(base32.StdEncoding.EncodeToString(tr.SrcAddress[:]))
+	remotePeers := make([]*RemotePeer, 0, 1)
 	c.mtx.Lock()
 	for _, peer := range c.remotePeers {
-		srcAddress := "#" + strings.ToLower(base32.StdEncoding.EncodeToString(tr.SrcAddress[:]))
 		if peer.RemoteAddress() == srcAddress {
-			remotePeer = peer
-			break
+			remotePeers = append(remotePeers, peer)
 		}
 	}
+	network := c.network
 	c.mtx.Unlock()
-	if remotePeer != nil {
-		remotePeer.processFrame(routerHost, frame)
+	for _, remotePeer := range remotePeers {
+		remotePeer.processFrame(network, routerHost, frame)
 	}
 }
 
@@ -161,7 +348,10 @@ func (c *Peer) processFrame20(frame []byte) (responseFrames []*Transaction) {
 		return
 	}
 
-	fmt.Println("20 received", transaction)
+	// [nonce 16] [address]
+	if len(transaction.Data) != 16+len(localAddress) {
+		return
+	}
 
 	nonce := transaction.Data[:16]
 	nonceHash := sha256.Sum256(nonce)
@@ -194,7 +384,8 @@ func (c *Peer) processFrame20(frame []byte) (responseFrames []*Transaction) {
 	//_, _ = conn.WriteTo(response.Marshal(), sourceAddress)
 }
 
-func (c *Peer) processFrame21(routerHost string, frame []byte) {
+// lanAddr - the UDP endpoint of the LAN response, nil - via routers
+func (c *Peer) processFrame21(routerHost string, lanAddr *net.UDPAddr, frame []byte) {
 	transaction, err := Parse(frame)
 	if err != nil {
 		return
@@ -217,8 +408,7 @@ func (c *Peer) processFrame21(routerHost string, frame []byte) {
 
 	for _, peer := range c.remotePeers {
 		if peer.RemoteAddress() == receivedAddress {
-			peer.setConnectionPoint(routerHost, receivedPublicKey, transaction.Data[0:16], transaction.Data[16:16+256])
-			break
+			peer.setConnectionPoint(routerHost, lanAddr, receivedPublicKey, transaction.Data[0:16], transaction.Data[16:16+256])
 		}
 	}
 
@@ -0,0 +1,162 @@
+package xchg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A large call is kept while its blocks are coming
+func TestCheckTransactionsTTL(t *testing.T) {
+	config := DefaultPeerConfig()
+	config.LocalRouters = nil
+	config.LocalNodes = nil
+	config.TransactionTTL = time.Second
+	peer, err := NewPeerWithConfig(nil, NewDefaultLogger(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name           string
+		beginDT        time.Time
+		lastReceivedDT time.Time
+		kept           bool
+	}{
+		{"new", now, now, true},
+		{"long upload", now.Add(-time.Minute), now, true},
+		{"stalled", now.Add(-time.Minute), now.Add(-2 * time.Second), false},
+	}
+
+	for _, test := range tests {
+		tr := NewTransaction(FrameTypeCall, "", "", 1, 0, 0, 1024*1024, nil)
+		tr.BeginDT = test.beginDT
+		tr.LastReceivedDT = test.lastReceivedDT
+		tr.NackCount = MaxNackCount
+		peer.incomingTransactions[test.name] = tr
+
+		response := NewTransaction(FrameTypeResponse, "", "", 1, 0, 0, 0, nil)
+		response.BeginDT = test.beginDT
+		response.LastReceivedDT = test.lastReceivedDT
+		peer.outgoingResponses[test.name] = response
+	}
+
+	peer.checkTransactions()
+
+	for _, test := range tests {
+		if _, ok := peer.incomingTransactions[test.name]; ok != test.kept {
+			t.Errorf("%s: incoming transaction kept %v, expected %v", test.name, ok, test.kept)
+		}
+		if _, ok := peer.outgoingResponses[test.name]; ok != test.kept {
+			t.Errorf("%s: response kept %v, expected %v", test.name, ok, test.kept)
+		}
+	}
+}
+
+// The remote peers are bounded even if all of them are busy
+func TestRemotePeersEviction(t *testing.T) {
+	config := DefaultPeerConfig()
+	config.LocalRouters = nil
+	config.LocalNodes = nil
+	peer, err := NewPeerWithConfig(nil, NewDefaultLogger(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	var busyOldest, idle *RemotePeer
+	for i := 0; i < maxRemotePeers; i++ {
+		remotePeer, _ := peer.getRemotePeer("#address", fmt.Sprint(i))
+		remotePeer.lastUsedDT = now.Add(time.Duration(i) * time.Second)
+		remotePeer.authProcessing = true
+		if i == 0 {
+			busyOldest = remotePeer
+		}
+		if i == 10 {
+			idle = remotePeer
+			remotePeer.authProcessing = false
+		}
+	}
+
+	// The least recently used idle remote peer first
+	remotePeer, _ := peer.getRemotePeer("#address", "new")
+	remotePeer.lastUsedDT = now.Add(time.Hour)
+	remotePeer.authProcessing = true
+	if len(peer.remotePeers) != maxRemotePeers || !stopped(idle) || stopped(busyOldest) {
+		t.Fatal("the idle remote peer is not evicted", len(peer.remotePeers))
+	}
+
+	// Then the least recently used one
+	peer.getRemotePeer("#address", "new 2")
+	if len(peer.remotePeers) != maxRemotePeers || !stopped(busyOldest) {
+		t.Fatal("the busy remote peer is not evicted", len(peer.remotePeers))
+	}
+}
+
+func stopped(remotePeer *RemotePeer) bool {
+	select {
+	case <-remotePeer.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// Transport of the tests: fails the functions of failFunctions, counts the calls
+type testRouterTransport struct {
+	id            string
+	failFunctions string
+	calls         []string
+}
+
+func (c *testRouterTransport) Id() string { return c.id }
+
+func (c *testRouterTransport) Start(peerProcessor PeerProcessor, localAddressBS []byte) error {
+	return nil
+}
+
+func (c *testRouterTransport) Stop() error { return nil }
+
+func (c *testRouterTransport) Supports(routerHost string) bool { return true }
+
+func (c *testRouterTransport) Call(routerHost string, function string, frame []byte) (result []byte, err error) {
+	c.calls = append(c.calls, function)
+	if strings.Contains(c.failFunctions, function) {
+		err = errors.New(ERR_XCHG_PEER_CONN_LOSS)
+		return
+	}
+	result = make([]byte, 8)
+	if function == "n" {
+		result = make([]byte, 16)
+	}
+	return
+}
+
+// The auth block of one transport fails - the read goes via the next transport
+func TestReadFromRouterAuthFallback(t *testing.T) {
+	config := DefaultPeerConfig()
+	config.LocalRouters = nil
+	config.LocalNodes = nil
+	peer, err := NewPeerWithConfig(nil, NewDefaultLogger(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.localAddressBS = AddressBSForPublicKey(&peer.privateKey.PublicKey)
+	failing := &testRouterTransport{id: "failing", failFunctions: "n"}
+	working := &testRouterTransport{id: "working"}
+	peer.SetTransports(working, failing) // The last is preferred
+
+	if _, err = peer.readFromRouter("router:8084"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(failing.calls, ",") != "n" || strings.Join(working.calls, ",") != "n,r" {
+		t.Fatal("wrong calls", failing.calls, working.calls)
+	}
+
+	if _, err = peer.routerCall("", "n", nil); err == nil || err.Error() != ERR_XCHG_PEER_NO_ROUTER_HOST {
+		t.Fatal("call without the host", err)
+	}
+}
@@ -1,6 +1,7 @@
 package xchg
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -14,7 +15,7 @@ const (
 	INTERNAL_ERROR = "#internal_error#"
 )
 
-func (c *Peer) onEdgeReceivedCall(sessionId uint64, data []byte) (response []byte, dontSendResponse bool) {
+func (c *Peer) onEdgeReceivedCall(ctx context.Context, sessionId uint64, data []byte) (response []byte, dontSendResponse bool) {
 
 	var err error
 	// Find the session
@@ -77,9 +78,10 @@ func (c *Peer) onEdgeReceivedCall(sessionId uint64, data []byte) (response []byt
 	var processor ServerProcessor
 	c.mtx.Lock()
 	processor = c.processor
+	listener := c.listener
 	c.mtx.Unlock()
 
-	if processor == nil {
+	if processor == nil && listener == nil {
 		response = prepareResponseError(errors.New(ERR_XCHG_SRV_CONN_NOT_IMPL))
 		return
 	}
@@ -107,7 +109,20 @@ func (c *Peer) onEdgeReceivedCall(sessionId uint64, data []byte) (response []byt
 		if session != nil {
 			authData = session.authData
 		}
-		resp, err = c.processor.ServerProcessorCall(authData, function, functionParameter)
+		ctx = context.WithValue(ctx, sessionIdContextKey{}, sessionId)
+		if isDirectFunction(function) {
+			resp, err = c.processDirectCall(session, functionParameter)
+		} else if isSubscriptionFunction(function) {
+			resp, err = c.processSubscriptionCall(session, function, functionParameter)
+		} else if isStreamFunction(function) {
+			resp, err = c.processStreamCall(ctx, session, function, functionParameter)
+		} else if processor == nil {
+			err = errors.New(ERR_XCHG_SRV_CONN_NOT_IMPL)
+		} else if processorContext, ok := processor.(ServerProcessorContext); ok {
+			resp, err = processorContext.ServerProcessorCallContext(ctx, authData, function, functionParameter)
+		} else {
+			resp, err = processor.ServerProcessorCall(authData, function, functionParameter)
+		}
 	}
 
 	if err != nil {
@@ -167,7 +182,22 @@ func (c *Peer) processAuth(functionParameter []byte) (response []byte, err error
 	}
 
 	authData := parameter[16:]
-	err = c.processor.ServerProcessorAuth(authData)
+	// The processor authorizes the client, without the processor - the auth of the listener.
+	// Nothing - no sessions.
+	c.mtx.Lock()
+	processor := c.processor
+	var listenerAuth func(authData []byte) error
+	if c.listener != nil {
+		listenerAuth = c.listener.auth
+	}
+	c.mtx.Unlock()
+	if processor != nil {
+		err = processor.ServerProcessorAuth(authData)
+	} else if listenerAuth != nil {
+		err = listenerAuth(authData)
+	} else {
+		err = errors.New(ERR_XCHG_ACCESS_DENIED)
+	}
 	if err != nil {
 		return
 	}
@@ -182,6 +212,7 @@ func (c *Peer) processAuth(functionParameter []byte) (response []byte, err error
 	session.aesKey = make([]byte, 32)
 	session.snakeCounter = NewSnakeCounter(100, 0)
 	session.authData = authData
+	session.remoteAddress = AddressForPublicKey(remotePublicKey)
 	rand.Read(session.aesKey)
 	c.sessionsById[sessionId] = session
 	response = make([]byte, 8+32)
@@ -202,7 +233,7 @@ func (c *Peer) purgeSessions() {
 	c.mtx.Lock()
 	if now.Sub(c.lastPurgeSessionsTime).Seconds() > 60 {
 		for sessionId, session := range c.sessionsById {
-			if now.Sub(session.lastAccessDT).Seconds() > 60 {
+			if now.Sub(session.lastAccessDT) > c.config.SessionTTL {
 				delete(c.sessionsById, sessionId)
 				log.Println("Session removed", sessionId)
 			}
@@ -0,0 +1,233 @@
+package xchg
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	FrameTypeStreamInput     = byte(0x15) // client to server
+	FrameTypeStreamOutput    = byte(0x16) // server to client
+	FrameTypeStreamOutputAck = byte(0x18) // client to server
+	FrameTypeStreamInputAck  = byte(0x19) // server to client
+
+	streamCallTimeout = 10 * time.Second
+
+	streamFlagInput = 0x01
+)
+
+// A stream belongs to the session: the frames are encrypted with the session key,
+// the session is kept alive by the frames of the stream
+type serverStream struct {
+	id            uint64
+	sessionId     uint64
+	aesKey        []byte
+	remoteAddress string
+	channel       *streamChannel
+	cancel        context.CancelFunc
+}
+
+func isStreamFunction(function string) bool {
+	return function == "/xchg-stream-open" || function == "/xchg-stream-close"
+}
+
+func (c *Peer) processStreamCall(ctx context.Context, session *Session, function string, parameter []byte) (response []byte, err error) {
+	switch function {
+	case "/xchg-stream-open":
+		return c.processStreamOpen(session, parameter)
+	case "/xchg-stream-close":
+		return c.processStreamClose(session, parameter)
+	}
+	err = errors.New(ERR_XCHG_STREAM_WRONG_FRAME)
+	return
+}
+
+// [flags 1] [functionLen 1] [function] [parameter]
+func (c *Peer) processStreamOpen(session *Session, parameter []byte) (response []byte, err error) {
+	if len(parameter) < 2 || len(parameter) < 2+int(parameter[1]) {
+		err = errors.New(ERR_XCHG_STREAM_WRONG_FRAME)
+		return
+	}
+	flags := parameter[0]
+	function := string(parameter[2 : 2+int(parameter[1])])
+	functionParameter := parameter[2+int(parameter[1]):]
+
+	var handler func(ctx context.Context, input io.Reader, output io.Writer) error
+	if function == "/xchg-dial" {
+		handler = func(ctx context.Context, input io.Reader, output io.Writer) error {
+			return c.serveConn(ctx, session.remoteAddress, session.authData, string(functionParameter), input, output)
+		}
+	} else {
+		c.mtx.Lock()
+		processor, ok := c.processor.(ServerProcessorStream)
+		c.mtx.Unlock()
+		if !ok {
+			err = errors.New(ERR_XCHG_STREAM_NOT_IMPL)
+			return
+		}
+		handler = func(ctx context.Context, input io.Reader, output io.Writer) error {
+			return processor.ServerProcessorStream(ctx, session.authData, function, functionParameter, input, output)
+		}
+	}
+
+	stream := &serverStream{}
+	stream.sessionId = session.id
+	stream.aesKey = session.aesKey
+	stream.remoteAddress = session.remoteAddress
+
+	// The output is sent after the first acknowledgement of the client
+	stream.channel = newStreamChannel(c.config.ResponseBlockSize, FrameTypeStreamOutput, FrameTypeStreamInputAck, func(frameType byte, position uint64, payload []byte) {
+		c.sendStreamFrame(stream, frameType, position, payload)
+	}, false)
+	var streamCtx context.Context
+	streamCtx, stream.cancel = context.WithCancel(context.WithValue(context.Background(), sessionIdContextKey{}, session.id))
+
+	c.mtx.Lock()
+	count := 0
+	for _, s := range c.streams {
+		if s.sessionId == session.id {
+			count++
+		}
+	}
+	if count >= c.config.MaxStreamsPerSession {
+		c.mtx.Unlock()
+		stream.cancel()
+		err = errors.New(ERR_XCHG_STREAM_LIMIT)
+		return
+	}
+	stream.id = c.nextStreamId
+	c.nextStreamId++
+	c.streams[stream.id] = stream
+	c.mtx.Unlock()
+
+	if flags&streamFlagInput == 0 {
+		stream.channel.closeRead()
+	}
+
+	go func() {
+		input := &streamReader{ctx: streamCtx, channel: stream.channel}
+		output := &streamWriter{ctx: streamCtx, channel: stream.channel}
+		errStream := handler(streamCtx, input, output)
+		stream.channel.closeWrite(errStream)
+		stream.channel.closeRead()
+	}()
+
+	response = make([]byte, 8)
+	binary.LittleEndian.PutUint64(response, stream.id)
+	return
+}
+
+// [streamId 8]
+func (c *Peer) processStreamClose(session *Session, parameter []byte) (response []byte, err error) {
+	if len(parameter) < 8 {
+		err = errors.New(ERR_XCHG_STREAM_WRONG_FRAME)
+		return
+	}
+	streamId := binary.LittleEndian.Uint64(parameter[0:])
+	c.mtx.Lock()
+	stream, ok := c.streams[streamId]
+	if ok && stream.sessionId == session.id {
+		delete(c.streams, streamId)
+	}
+	c.mtx.Unlock()
+	if !ok || stream.sessionId != session.id {
+		err = errors.New(ERR_XCHG_STREAM_UNKNOWN)
+		return
+	}
+	c.stopStream(stream, errors.New(ERR_XCHG_STREAM_CLOSED))
+	response = make([]byte, 0)
+	return
+}
+
+func (c *Peer) stopStream(stream *serverStream, err error) {
+	stream.cancel()
+	stream.channel.abort(err)
+}
+
+func (c *Peer) sendStreamFrame(stream *serverStream, frameType byte, position uint64, payload []byte) {
+	data, err := encryptStreamFrame(frameType, stream.id, payload, stream.aesKey)
+	if err != nil {
+		return
+	}
+	tr := NewTransaction(frameType, c.localAddress, stream.remoteAddress, stream.id, stream.sessionId, int(uint32(position)), 0, data)
+	c.send(tr.Marshal(), false)
+}
+
+// Input data and acknowledgements of the output from the client
+func (c *Peer) processStreamFrame(frame []byte) {
+	tr, err := Parse(frame)
+	if err != nil {
+		return
+	}
+
+	c.mtx.Lock()
+	stream, ok := c.streams[tr.TransactionId]
+	c.mtx.Unlock()
+	if !ok || stream.sessionId != tr.SessionId {
+		return
+	}
+
+	payload, err := decryptStreamFrame(tr, stream.aesKey)
+	if err != nil {
+		return
+	}
+
+	c.mtx.Lock()
+	if session, ok := c.sessionsById[stream.sessionId]; ok {
+		session.lastAccessDT = time.Now()
+	}
+	c.mtx.Unlock()
+
+	if tr.FrameType == FrameTypeStreamInput {
+		stream.channel.processData(payload)
+	} else {
+		stream.channel.processAck(payload)
+	}
+}
+
+// Streams of removed sessions and streams without frames from the client are removed
+func (c *Peer) checkStreams() {
+	now := time.Now()
+	removed := make([]*serverStream, 0)
+	streams := make([]*serverStream, 0)
+	c.mtx.Lock()
+	for streamId, stream := range c.streams {
+		if _, ok := c.sessionsById[stream.sessionId]; !ok {
+			delete(c.streams, streamId)
+			removed = append(removed, stream)
+			continue
+		}
+		streams = append(streams, stream)
+	}
+	c.mtx.Unlock()
+
+	for _, stream := range streams {
+		if stream.channel.check(now) {
+			c.mtx.Lock()
+			delete(c.streams, stream.id)
+			c.mtx.Unlock()
+			removed = append(removed, stream)
+		}
+	}
+
+	for _, stream := range removed {
+		c.stopStream(stream, errors.New(ERR_XCHG_STREAM_TIMEOUT))
+	}
+}
+
+// Streams opened by the peer as a client
+func (c *Peer) checkRemoteStreams() {
+	c.mtx.Lock()
+	remotePeers := make([]*RemotePeer, 0, len(c.remotePeers))
+	for _, remotePeer := range c.remotePeers {
+		remotePeers = append(remotePeers, remotePeer)
+	}
+	c.mtx.Unlock()
+
+	for _, remotePeer := range remotePeers {
+		remotePeer.checkStreams()
+	}
+}
@@ -1,32 +1,23 @@
 package xchg
 
 import (
-	"bytes"
+	"context"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
-	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"mime/multipart"
 	"net"
-	"net/http"
-	"net/http/cookiejar"
 	"sync"
 	"time"
 )
 
-type RemotePeerTransport interface {
-	Id() string
-	Check(frame20 *Transaction, network *Network, remotePublicKeyExists bool) error
-	DeclareError(sentViaTransportMap map[string]struct{})
-	Send(network *Network, tr *Transaction) error
-	SetRemoteUDPAddress(udpAddress *net.UDPAddr)
-}
+const (
+	sendBlocksWindow  = 8
+	checkResponseTick = 50 * time.Millisecond
+)
 
 type RemotePeer struct {
 	mtx           sync.Mutex
@@ -39,7 +30,10 @@ type RemotePeer struct {
 
 	nonces *Nonces
 
-	httpClient *http.Client
+	authTimeout   time.Duration
+	callBlockSize int
+
+	transports []RemotePeerTransport
 
 	findingConnection    bool
 	authProcessing       bool
@@ -48,6 +42,19 @@ type RemotePeer struct {
 	sessionNonceCounter  uint64
 	outgoingTransactions map[uint64]*Transaction
 	nextTransactionId    uint64
+
+	// Streams opened by the client
+	streams map[uint64]*remoteStream
+
+	// Notifications
+	subscriptions       map[string][]NotificationHandler
+	notifications       chan notification
+	notificationCounter *SnakeCounter
+
+	stopped chan struct{}
+
+	// Guarded by the mutex of the peer
+	lastUsedDT time.Time
 }
 
 func NewRemotePeer(remoteAddress string, authData string, privateKey *rsa.PrivateKey) *RemotePeer {
@@ -56,30 +63,79 @@ func NewRemotePeer(remoteAddress string, authData string, privateKey *rsa.Privat
 	c.remoteAddress = remoteAddress
 	c.authData = authData
 	c.outgoingTransactions = make(map[uint64]*Transaction)
-	c.nextTransactionId = 1
+	// Random start - transaction ids of remote peers with the same address must not intersect
+	var transactionIdBS [8]byte
+	rand.Read(transactionIdBS[:])
+	c.nextTransactionId = binary.LittleEndian.Uint64(transactionIdBS[:]) >> 1
 	//c.network = network
-	c.nonces = NewNonces(100)
+	c.notificationCounter = NewSnakeCounter(100, 0)
+	c.stopped = make(chan struct{})
+	c.configure(DefaultPeerConfig())
+	return &c
+}
 
-	tr := &http.Transport{}
-	jar, _ := cookiejar.New(nil)
-	c.httpClient = &http.Client{Transport: tr, Jar: jar}
-	c.httpClient.Timeout = 1 * time.Second
+// Tunables of the peer, before the first call
+func (c *RemotePeer) configure(config PeerConfig) {
+	c.nonces = NewNonces(config.NoncePoolSize)
+	c.authTimeout = config.AuthTimeout
+	c.callBlockSize = config.CallBlockSize
+}
 
-	//c.remotePeerTransports = make([]RemotePeerTransport, 2)
-	//c.remotePeerTransports[0] = NewRemotePeerHttp()
-	return &c
+// Ends the delivery of notifications
+func (c *RemotePeer) Stop() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	select {
+	case <-c.stopped:
+	default:
+		close(c.stopped)
+	}
+}
+
+// No calls, streams and subscriptions - the remote peer can be removed
+func (c *RemotePeer) idle() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.outgoingTransactions) == 0 && len(c.streams) == 0 && len(c.subscriptions) == 0 && !c.authProcessing && !c.findingConnection
 }
 
 func (c *RemotePeer) RemoteAddress() string {
 	return c.remoteAddress
 }
 
-func (c *RemotePeer) processFrame(routerHost string, frame []byte) {
+func (c *RemotePeer) processFrame(network *Network, routerHost string, frame []byte) {
 	frameType := frame[8]
 
 	switch frameType {
 	case FrameTypeResponse:
 		c.processFrame11(routerHost, frame)
+	case FrameTypeCallNack:
+		c.processFrame12(network, frame)
+	case FrameTypeNotify:
+		c.processFrame17(frame)
+	case FrameTypeStreamOutput, FrameTypeStreamInputAck:
+		c.processStreamFrame(frame)
+	}
+}
+
+// Call NACK - resends the requested blocks of the call
+func (c *RemotePeer) processFrame12(network *Network, frame []byte) {
+	transaction, err := Parse(frame)
+	if err != nil {
+		return
+	}
+
+	ranges := ParseRanges(transaction.Data)
+
+	var frames []*Transaction
+	c.mtx.Lock()
+	if t, ok := c.outgoingTransactions[transaction.TransactionId]; ok {
+		frames = t.OutgoingFramesInRanges(ranges)
+	}
+	c.mtx.Unlock()
+
+	for _, f := range frames {
+		go c.Send(network, f)
 	}
 }
 
@@ -92,18 +148,19 @@ func (c *RemotePeer) processFrame11(routerHost string, frame []byte) {
 
 	c.mtx.Lock()
 	if t, ok := c.outgoingTransactions[transaction.TransactionId]; ok {
-		if transaction.Err == nil && transaction.TotalSize < 1024*1024 {
+		if transaction.Err == nil && transaction.TotalSize <= MaxTransactionSize {
 			t.AppendReceivedData(transaction)
 		} else {
 			t.Result = transaction.Data
 			t.Err = transaction.Err
-			t.Complete = true
+			t.SetComplete()
 		}
 	}
 	c.mtx.Unlock()
 }
 
-func (c *RemotePeer) setConnectionPoint(routerHost string, publicKey *rsa.PublicKey, nonce []byte, signature []byte) {
+// udpAddress - the endpoint of the LAN response (nil - via routers), it is set before the public key
+func (c *RemotePeer) setConnectionPoint(routerHost string, udpAddress *net.UDPAddr, publicKey *rsa.PublicKey, nonce []byte, signature []byte) {
 	if !c.nonces.Check(nonce) {
 		return
 	}
@@ -116,15 +173,31 @@ func (c *RemotePeer) setConnectionPoint(routerHost string, publicKey *rsa.Public
 		return
 	}
 
+	if udpAddress != nil {
+		c.SetRemoteUDPAddress(udpAddress)
+	}
+
 	c.mtx.Lock()
 	c.remotePublicKey = publicKey
 	c.mtx.Unlock()
-	fmt.Println("Received Address for", c.remoteAddress, "from", routerHost)
+	//fmt.Println("Received Address for", c.remoteAddress, "from", routerHost)
 }
 
 func (c *RemotePeer) Call(network *Network, function string, data []byte, timeout time.Duration) (result []byte, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.CallContext(ctx, network, function, data)
+}
+
+func (c *RemotePeer) CallContext(ctx context.Context, network *Network, function string, data []byte) (result []byte, err error) {
+	result, _, _, err = c.call(ctx, network, function, data)
+	return
+}
+
+// Returns the session of the call as well
+func (c *RemotePeer) call(ctx context.Context, network *Network, function string, data []byte) (result []byte, sessionId uint64, aesKey []byte, err error) {
 	c.mtx.Lock()
-	sessionId := c.sessionId
+	sessionId = c.sessionId
 	c.mtx.Unlock()
 
 	// Check transport leyer
@@ -138,7 +211,14 @@ func (c *RemotePeer) Call(network *Network, function string, data []byte, timeou
 	c.Check(transaction, network, c.remotePublicKey != nil)
 
 	if sessionId == 0 {
-		err = c.auth(network, 1000*time.Millisecond)
+		// The deadline of the call limits the auth, AuthTimeout - only without the deadline
+		authCtx, authCancel := context.WithCancel(ctx)
+		if _, ok := ctx.Deadline(); !ok {
+			authCancel()
+			authCtx, authCancel = context.WithTimeout(ctx, c.authTimeout)
+		}
+		err = c.auth(authCtx, network)
+		authCancel()
 		if err != nil {
 			return
 		}
@@ -146,16 +226,16 @@ func (c *RemotePeer) Call(network *Network, function string, data []byte, timeou
 
 	c.mtx.Lock()
 	sessionId = c.sessionId
-	aesKey := make([]byte, len(c.aesKey))
+	aesKey = make([]byte, len(c.aesKey))
 	copy(aesKey, c.aesKey)
 	c.mtx.Unlock()
 
-	result, err = c.regularCall(network, function, data, aesKey, timeout)
+	result, err = c.regularCall(ctx, network, function, data, aesKey)
 
 	return
 }
 
-func (c *RemotePeer) auth(network *Network, timeout time.Duration) (err error) {
+func (c *RemotePeer) auth(ctx context.Context, network *Network) (err error) {
 	c.mtx.Lock()
 	if c.authProcessing {
 		c.mtx.Unlock()
@@ -171,10 +251,18 @@ func (c *RemotePeer) auth(network *Network, timeout time.Duration) (err error) {
 		c.mtx.Unlock()
 	}()
 
+	// The ARP response brings the public key (and the direct path in LAN)
+	remotePublicKey := c.waitRemotePublicKey(ctx)
+	if remotePublicKey == nil {
+		err = fmt.Errorf("%s:%w", ERR_XCHG_CL_CONN_AUTH_NO_REMOTE_PUBLIC_KEY, ctx.Err())
+		//c.requestRemotePublicKey(conn)
+		return
+	}
+
 	var nonce []byte
-	nonce, err = c.regularCall(network, "/xchg-get-nonce", nil, nil, timeout)
+	nonce, err = c.regularCall(ctx, network, "/xchg-get-nonce", nil, nil)
 	if err != nil {
-		err = errors.New(ERR_XCHG_CL_CONN_AUTH_GET_NONCE + ":" + err.Error())
+		err = fmt.Errorf("%s:%w", ERR_XCHG_CL_CONN_AUTH_GET_NONCE, err)
 		return
 	}
 	if len(nonce) != 16 {
@@ -184,7 +272,6 @@ func (c *RemotePeer) auth(network *Network, timeout time.Duration) (err error) {
 
 	c.mtx.Lock()
 	localPrivateKey := c.privateKey
-	remotePublicKey := c.remotePublicKey
 	authData := make([]byte, len(c.authData))
 	copy(authData, []byte(c.authData))
 	c.mtx.Unlock()
@@ -194,12 +281,6 @@ func (c *RemotePeer) auth(network *Network, timeout time.Duration) (err error) {
 		return
 	}
 
-	if remotePublicKey == nil {
-		err = errors.New(ERR_XCHG_CL_CONN_AUTH_NO_REMOTE_PUBLIC_KEY)
-		//c.requestRemotePublicKey(conn)
-		return
-	}
-
 	localPublicKeyBS := RSAPublicKeyToDer(&localPrivateKey.PublicKey)
 
 	authFrameSecret := make([]byte, 16+len(authData))
@@ -218,9 +299,9 @@ func (c *RemotePeer) auth(network *Network, timeout time.Duration) (err error) {
 	copy(authFrame[4+len(localPublicKeyBS):], encryptedAuthFrame)
 
 	var result []byte
-	result, err = c.regularCall(network, "/xchg-auth", authFrame, nil, timeout)
+	result, err = c.regularCall(ctx, network, "/xchg-auth", authFrame, nil)
 	if err != nil {
-		err = errors.New(ERR_XCHG_CL_CONN_AUTH_AUTH + ":" + err.Error())
+		err = fmt.Errorf("%s:%w", ERR_XCHG_CL_CONN_AUTH_AUTH, err)
 		return
 	}
 
@@ -239,12 +320,39 @@ func (c *RemotePeer) auth(network *Network, timeout time.Duration) (err error) {
 	c.sessionId = binary.LittleEndian.Uint64(result)
 	c.aesKey = make([]byte, 32)
 	copy(c.aesKey, result[8:])
+	c.notificationCounter = NewSnakeCounter(100, 0)
+	resubscribe := len(c.subscriptions) > 0
 	c.mtx.Unlock()
 
+	if resubscribe {
+		// Subscriptions belong to the session
+		go c.resubscribe(network)
+	}
+
+	go c.connectDirect(network)
+
 	return
 }
 
-func (c *RemotePeer) regularCall(network *Network, function string, data []byte, aesKey []byte, timeout time.Duration) (result []byte, err error) {
+func (c *RemotePeer) waitRemotePublicKey(ctx context.Context) (remotePublicKey *rsa.PublicKey) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		c.mtx.Lock()
+		remotePublicKey = c.remotePublicKey
+		c.mtx.Unlock()
+		if remotePublicKey != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *RemotePeer) regularCall(ctx context.Context, network *Network, function string, data []byte, aesKey []byte) (result []byte, err error) {
 	if len(function) > 255 {
 		err = errors.New(ERR_XCHG_CL_CONN_CALL_WRONG_FUNCTION_LEN)
 		return
@@ -292,7 +400,7 @@ func (c *RemotePeer) regularCall(network *Network, function string, data []byte,
 		copy(frame[1+len(function):], data)
 	}
 
-	result, err = c.executeTransaction(network, sessionId, frame, timeout, aesKey)
+	result, err = c.executeTransaction(ctx, network, sessionId, frame, aesKey)
 
 	if NeedToChangeNode(err) {
 		c.Reset()
@@ -300,7 +408,7 @@ func (c *RemotePeer) regularCall(network *Network, function string, data []byte,
 	}
 
 	if err != nil {
-		err = errors.New(ERR_XCHG_CL_CONN_CALL_ERR + ":" + err.Error())
+		err = fmt.Errorf("%s:%w", ERR_XCHG_CL_CONN_CALL_ERR, err)
 		return
 	}
 
@@ -359,7 +467,7 @@ func (c *RemotePeer) reset() {
 	c.aesKey = nil
 }
 
-func (c *RemotePeer) executeTransaction(network *Network, sessionId uint64, data []byte, timeout time.Duration, aesKeyOriginal []byte) (result []byte, err error) {
+func (c *RemotePeer) executeTransaction(ctx context.Context, network *Network, sessionId uint64, data []byte, aesKeyOriginal []byte) (result []byte, err error) {
 	// Get transaction ID
 	var transactionId uint64
 	c.mtx.Lock()
@@ -368,68 +476,48 @@ func (c *RemotePeer) executeTransaction(network *Network, sessionId uint64, data
 
 	// Create transaction
 	t := NewTransaction(FrameTypeCall, AddressForPublicKey(&c.privateKey.PublicKey), c.remoteAddress, transactionId, sessionId, 0, len(data), data)
+	done := t.Done()
 	c.outgoingTransactions[transactionId] = t
 	c.mtx.Unlock()
 
 	// Send transaction
-	sentCount := 0
-	sendCounter := 0
-	offset := 0
-	blockSize := 1024
-	for offset < len(data) {
-		sendCounter++
-		currentBlockSize := blockSize
-		restDataLen := len(data) - offset
-		if restDataLen < currentBlockSize {
-			currentBlockSize = restDataLen
-		}
-
-		blockTransaction := NewTransaction(FrameTypeCall, AddressForPublicKey(&c.privateKey.PublicKey), c.remoteAddress, transactionId, sessionId, offset, len(data), data[offset:offset+currentBlockSize])
-
-		err = c.Send(network, blockTransaction)
-		if err == nil {
-			sentCount++
-			break
-		}
-
-		if err != nil {
-			c.mtx.Lock()
-			delete(c.outgoingTransactions, t.TransactionId)
-			c.mtx.Unlock()
-			return
+	sentDT := time.Now()
+	sentVia, err := c.sendBlocks(ctx, network, t, data)
+	if err != nil {
+		c.mtx.Lock()
+		delete(c.outgoingTransactions, t.TransactionId)
+		c.mtx.Unlock()
+		if ctx.Err() != nil {
+			c.sendCancel(network, t, aesKeyOriginal)
+			err = contextError(ctx)
 		}
-		offset += currentBlockSize
-		//fmt.Println("executeTransaction send ", currentBlockSize, c.internalId)
-	}
-
-	if sendCounter != sentCount {
-		return nil, errors.New("no route")
+		return
 	}
 
 	// Wait for response
-	waitingDurationInMilliseconds := timeout.Milliseconds()
-	waitingTick := int64(10)
-	waitingIterationCount := waitingDurationInMilliseconds / waitingTick
-	for i := int64(0); i < waitingIterationCount; i++ {
-		if t.Complete {
+	ticker := time.NewTicker(checkResponseTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
 			// Transaction complete
 			c.mtx.Lock()
 			delete(c.outgoingTransactions, t.TransactionId)
+			result = t.Result
+			err = t.Err
 			c.mtx.Unlock()
 
 			// Error recevied
-			if t.Err != nil {
+			if err != nil {
 				result = nil
-				err = t.Err
-				return
 			}
-
-			// Success
-			result = t.Result
-			err = nil
 			return
+		case <-ticker.C:
+			c.checkResponse(network, t, sentDT)
+			continue
+		case <-ctx.Done():
 		}
-		time.Sleep(time.Duration(waitingTick) * time.Millisecond)
+		break
 	}
 
 	// Clear transactions map
@@ -437,7 +525,12 @@ func (c *RemotePeer) executeTransaction(network *Network, sessionId uint64, data
 	delete(c.outgoingTransactions, t.TransactionId)
 	c.mtx.Unlock()
 
-	fmt.Println("exec transaction timeout")
+	// The server can abandon the call
+	c.sendCancel(network, t, aesKeyOriginal)
+
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, contextError(ctx)
+	}
 
 	c.mtx.Lock()
 
@@ -458,80 +551,190 @@ func (c *RemotePeer) executeTransaction(network *Network, sessionId uint64, data
 
 	c.mtx.Unlock()
 
-	return nil, errors.New(ERR_XCHG_PEER_CONN_TR_TIMEOUT)
-}
+	c.declareError(sentVia)
 
-func (c *RemotePeer) httpCall(routerHost string, function string, frame []byte) (result []byte, err error) {
-	// Waiting for router host
+	return nil, contextError(ctx)
+}
 
-	if len(routerHost) == 0 {
+// Best-effort cancel frame. The transaction id is encrypted with the session key.
+func (c *RemotePeer) sendCancel(network *Network, t *Transaction, aesKey []byte) {
+	if t.SessionId == 0 || len(aesKey) != 32 {
 		return
 	}
-
-	if len(frame) < 128 {
+	transactionIdBS := make([]byte, 8)
+	binary.LittleEndian.PutUint64(transactionIdBS, t.TransactionId)
+	encryptedTransactionId, err := EncryptAESGCM(transactionIdBS, aesKey)
+	if err != nil {
 		return
 	}
+	cancelFrame := NewTransaction(FrameTypeCancel, AddressForPublicKey(&c.privateKey.PublicKey), c.remoteAddress, t.TransactionId, t.SessionId, 0, 0, encryptedTransactionId)
+	go c.Send(network, cancelFrame)
+}
+
+// The error of the context is wrapped: errors.Is(err, context.DeadlineExceeded) or context.Canceled
+func contextError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s:%w", ERR_XCHG_PEER_CONN_TR_TIMEOUT, ctx.Err())
+	}
+	return fmt.Errorf("%s:%w", ERR_XCHG_PEER_CONN_TR_CANCELLED, ctx.Err())
+}
 
-	var body bytes.Buffer
-	writer := multipart.NewWriter(&body)
-	{
-		fw, _ := writer.CreateFormField("d")
-		frame64 := base64.StdEncoding.EncodeToString(frame)
-		fw.Write([]byte(frame64))
+// Sends all blocks of the request.
+// Not more than sendBlocksWindow blocks are being sent at the same time.
+// The blocks are kept in the transaction for retransmission.
+func (c *RemotePeer) sendBlocks(ctx context.Context, network *Network, t *Transaction, data []byte) (sentVia map[string]struct{}, err error) {
+	srcAddress := AddressForPublicKey(&c.privateKey.PublicKey)
+
+	// Appendix[0:8] - the timeout of the call in milliseconds, 0 - no deadline
+	var appendix [28]byte
+	if deadline, ok := ctx.Deadline(); ok {
+		timeoutMs := time.Until(deadline).Milliseconds()
+		if timeoutMs < 1 {
+			timeoutMs = 1
+		}
+		binary.LittleEndian.PutUint64(appendix[0:], uint64(timeoutMs))
 	}
-	writer.Close()
 
-	addr := "http://" + routerHost
+	blocks := make([]*Transaction, 0, len(data)/c.callBlockSize+1)
+	offset := 0
+	for {
+		currentBlockSize := c.callBlockSize
+		restDataLen := len(data) - offset
+		if restDataLen < currentBlockSize {
+			currentBlockSize = restDataLen
+		}
+		block := NewTransaction(FrameTypeCall, srcAddress, c.remoteAddress, t.TransactionId, t.SessionId, offset, len(data), data[offset:offset+currentBlockSize])
+		block.Appendix = appendix
+		blocks = append(blocks, block)
+		offset += currentBlockSize
+		if offset >= len(data) {
+			break
+		}
+	}
 
-	response, err := c.Post(addr+"/api/"+function, writer.FormDataContentType(), &body, addr)
+	c.mtx.Lock()
+	t.OutgoingFrames = blocks
+	c.mtx.Unlock()
 
-	if err != nil {
-		//fmt.Println("HTTP error:", err)
+	sentVia = make(map[string]struct{})
+	var wg sync.WaitGroup
+	var errMtx sync.Mutex
+	window := make(chan struct{}, sendBlocksWindow)
+
+	for _, block := range blocks {
+		errMtx.Lock()
+		if err == nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		failed := err != nil
+		errMtx.Unlock()
+		if failed {
+			break
+		}
+
+		window <- struct{}{}
+		wg.Add(1)
+		go func(blockTransaction *Transaction) {
+			defer wg.Done()
+			transportId, sendErr := c.send(network, blockTransaction)
+			errMtx.Lock()
+			if sendErr != nil {
+				if err == nil {
+					err = errors.New(ERR_XCHG_CL_CONN_CALL_NO_ROUTE_TO_PEER + ":block " + fmt.Sprint(blockTransaction.Offset) + ":" + sendErr.Error())
+				}
+			} else {
+				sentVia[transportId] = struct{}{}
+			}
+			errMtx.Unlock()
+			<-window
+		}(block)
+	}
+
+	wg.Wait()
+	return
+}
+
+// Asks the server for missing blocks of a stalled response
+func (c *RemotePeer) checkResponse(network *Network, t *Transaction, sentDT time.Time) {
+	now := time.Now()
+
+	c.mtx.Lock()
+	if t.Complete || now.Sub(t.LastNackDT) < NackDelay {
+		c.mtx.Unlock()
 		return
+	}
+
+	var ranges [][2]uint32
+	if len(t.ReceivedFrames) > 0 {
+		if now.Sub(t.LastReceivedDT) < NackDelay || t.NackCount >= MaxNackCount {
+			c.mtx.Unlock()
+			return
+		}
+		ranges = t.MissingRanges(t.ReceivedFrames[0].TotalSize)
+		t.NackCount++
 	} else {
-		var content []byte
-		content, err = ioutil.ReadAll(response.Body)
-		if err != nil {
-			response.Body.Close()
+		// Nothing received - ask for the whole response
+		if now.Sub(sentDT) < NackDelayNoData || now.Sub(t.LastNackDT) < NackDelayNoData {
+			c.mtx.Unlock()
 			return
 		}
-		result, err = base64.StdEncoding.DecodeString(string(content))
-		response.Body.Close()
 	}
-	return
+	t.LastNackDT = now
+	nack := NewTransaction(FrameTypeResponseNack, AddressForPublicKey(&c.privateKey.PublicKey), c.remoteAddress, t.TransactionId, t.SessionId, 0, 0, MarshalRanges(ranges))
+	c.mtx.Unlock()
+
+	go c.Send(network, nack)
 }
 
-func (c *RemotePeer) Post(url, contentType string, body io.Reader, host string) (resp *http.Response, err error) {
-	req, err := http.NewRequest("POST", url, body)
-	if err != nil {
-		return nil, err
+// Registers the path to the remote peer. The transports added later are preferred.
+func (c *RemotePeer) AddTransport(transport RemotePeerTransport) {
+	c.mtx.Lock()
+	c.transports = append(c.transports, transport)
+	c.mtx.Unlock()
+}
+
+func (c *RemotePeer) getTransports() (transports []RemotePeerTransport) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	transports = make([]RemotePeerTransport, 0, len(c.transports))
+	for i := len(c.transports) - 1; i >= 0; i-- {
+		transports = append(transports, c.transports[i])
 	}
-	req.Header.Set("Content-Type", contentType)
-	return c.httpClient.Do(req)
+	return
 }
 
+// Sends the frame via the first transport that accepts it
 func (c *RemotePeer) Send(network *Network, tr *Transaction) (err error) {
-	addrs := network.GetNodesAddressesByAddress(tr.DestAddressString())
-	bs := tr.Marshal()
-	for _, a := range addrs {
-		go c.httpCall(a, "w", bs)
+	_, err = c.send(network, tr)
+	return
+}
+
+func (c *RemotePeer) send(network *Network, tr *Transaction) (transportId string, err error) {
+	err = errors.New(ERR_XCHG_CL_CONN_CALL_NO_ROUTE_TO_PEER)
+	for _, transport := range c.getTransports() {
+		err = transport.Send(network, tr)
+		if err == nil {
+			transportId = transport.Id()
+			return
+		}
 	}
 	return
 }
 
-func (c *RemotePeer) Check(frame20 *Transaction, network *Network, remotePublicKeyExists bool) error {
-	if remotePublicKeyExists {
-		return nil
+func (c *RemotePeer) Check(frame20 *Transaction, network *Network, remotePublicKeyExists bool) {
+	for _, transport := range c.getTransports() {
+		transport.Check(frame20, network, remotePublicKeyExists)
 	}
-	go c.checkInternetConnectionPoint(frame20, network)
-	return nil
 }
 
-func (c *RemotePeer) checkInternetConnectionPoint(frame20 *Transaction, network *Network) (err error) {
-	addrs := network.GetNodesAddressesByAddress(frame20.DestAddressString())
-	for _, a := range addrs {
-		go c.httpCall(a, "w", frame20.Marshal())
+func (c *RemotePeer) SetRemoteUDPAddress(udpAddress *net.UDPAddr) {
+	for _, transport := range c.getTransports() {
+		transport.SetRemoteUDPAddress(udpAddress)
 	}
+}
 
-	return
+func (c *RemotePeer) declareError(sentVia map[string]struct{}) {
+	for _, transport := range c.getTransports() {
+		transport.DeclareError(sentVia)
+	}
 }
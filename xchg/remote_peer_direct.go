@@ -0,0 +1,172 @@
+package xchg
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ipoluianov/xchg/router"
+)
+
+// Direct UDP path from the client to the remote peer (see peer_direct.go).
+// Without the path (or after a timeout of a call sent via it) the frames go via routers.
+type directTransport struct {
+	mtx           sync.Mutex
+	udpTransport  *UdpTransport
+	endpoint      *net.UDPAddr
+	verified      bool
+	lastAttemptDT time.Time
+	lastLanDT     time.Time
+}
+
+func newDirectTransport(udpTransport *UdpTransport) *directTransport {
+	var c directTransport
+	c.udpTransport = udpTransport
+	return &c
+}
+
+func (c *directTransport) Id() string {
+	return "direct"
+}
+
+func (c *directTransport) Check(frame20 *Transaction, network *Network, remotePublicKeyExists bool) error {
+	c.discoverLan(frame20, remotePublicKeyExists)
+	return nil
+}
+
+func (c *directTransport) DeclareError(sentViaTransportMap map[string]struct{}) {
+	if _, ok := sentViaTransportMap[c.Id()]; !ok {
+		return
+	}
+	c.mtx.Lock()
+	c.endpoint = nil
+	c.verified = false
+	c.lastAttemptDT = time.Now()
+	c.mtx.Unlock()
+}
+
+func (c *directTransport) Send(network *Network, tr *Transaction) (err error) {
+	c.mtx.Lock()
+	endpoint := c.endpoint
+	c.mtx.Unlock()
+	if endpoint == nil {
+		err = errors.New(ERR_XCHG_DIRECT_NO_PATH)
+		return
+	}
+	err = c.udpTransport.sendDirectFrame(endpoint, tr.Marshal())
+	return
+}
+
+func (c *directTransport) SetRemoteUDPAddress(udpAddress *net.UDPAddr) {
+	c.mtx.Lock()
+	if c.endpoint == nil {
+		c.endpoint = udpAddress
+	}
+	c.mtx.Unlock()
+}
+
+func (c *directTransport) hasEndpoint() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.endpoint != nil
+}
+
+func (c *directTransport) getEndpoint() *net.UDPAddr {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.endpoint
+}
+
+// The server has the punch of the session from the endpoint
+func (c *directTransport) setVerified(udpAddress *net.UDPAddr) {
+	c.mtx.Lock()
+	if c.endpoint != nil && udpEndpointKey(c.endpoint) == udpEndpointKey(udpAddress) {
+		c.verified = true
+	}
+	c.mtx.Unlock()
+}
+
+func (c *directTransport) isVerified() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.verified
+}
+
+// Not more than one attempt per directRetryPeriod
+func (c *directTransport) beginAttempt() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.endpoint != nil || time.Since(c.lastAttemptDT) < directRetryPeriod {
+		return false
+	}
+	c.lastAttemptDT = time.Now()
+	return true
+}
+
+// The direct path is not known - broadcast the 0x20 frame.
+// Not more often than once a second before the public key is received, then every 30 seconds.
+func (c *directTransport) discoverLan(frame20 *Transaction, remotePublicKeyExists bool) {
+	period := time.Second
+	if remotePublicKeyExists {
+		period = 30 * time.Second
+	}
+	c.mtx.Lock()
+	if c.endpoint != nil || time.Since(c.lastLanDT) < period {
+		c.mtx.Unlock()
+		return
+	}
+	c.lastLanDT = time.Now()
+	c.mtx.Unlock()
+	c.udpTransport.broadcastLan(frame20.Marshal())
+}
+
+func (c *RemotePeer) session() (sessionId uint64, aesKey []byte) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	sessionId = c.sessionId
+	aesKey = make([]byte, len(c.aesKey))
+	copy(aesKey, c.aesKey)
+	return
+}
+
+func (c *RemotePeer) getDirectTransport() *directTransport {
+	for _, transport := range c.getTransports() {
+		if direct, ok := transport.(*directTransport); ok {
+			return direct
+		}
+	}
+	return nil
+}
+
+// Exchanges the candidates with the server and punches the NAT.
+// The known endpoint (LAN discovery) is proved to the server by the punches of the session.
+func (c *RemotePeer) connectDirect(network *Network) {
+	direct := c.getDirectTransport()
+	if direct == nil {
+		return
+	}
+	if endpoint := direct.getEndpoint(); endpoint != nil {
+		sessionId, aesKey := c.session()
+		punch(direct.udpTransport, []string{udpEndpointKey(endpoint)}, router.UdpFunctionPunchToServer, sessionId, aesKey, direct.isVerified)
+		return
+	}
+	if !direct.beginAttempt() {
+		return
+	}
+	candidates := direct.udpTransport.Candidates()
+	if len(candidates) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), directCallTimeout)
+	defer cancel()
+	response, err := c.CallContext(ctx, network, "/xchg-direct", marshalCandidates(candidates))
+	if err != nil {
+		return
+	}
+
+	sessionId, aesKey := c.session()
+	punch(direct.udpTransport, parseCandidates(response), router.UdpFunctionPunchToServer, sessionId, aesKey, direct.hasEndpoint)
+}
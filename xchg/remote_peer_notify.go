@@ -0,0 +1,136 @@
+package xchg
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+)
+
+const (
+	subscribeTimeout      = 5 * time.Second
+	notificationQueueSize = 1000
+)
+
+// Handler of notifications from a server peer
+// Handlers of a remote peer are called sequentially in the order of receiving
+type NotificationHandler func(remoteAddress string, topic string, data []byte)
+
+type notification struct {
+	topic string
+	data  []byte
+}
+
+func (c *RemotePeer) Subscribe(network *Network, topic string, handler NotificationHandler) (err error) {
+	c.mtx.Lock()
+	if c.subscriptions == nil {
+		c.subscriptions = make(map[string][]NotificationHandler)
+		c.notifications = make(chan notification, notificationQueueSize)
+		go c.thNotifications()
+	}
+	c.subscriptions[topic] = append(c.subscriptions[topic], handler)
+	c.mtx.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), subscribeTimeout)
+	defer cancel()
+	_, err = c.CallContext(ctx, network, "/xchg-subscribe", marshalTopics([]string{topic}))
+	return
+}
+
+func (c *RemotePeer) Unsubscribe(network *Network, topic string) (err error) {
+	c.mtx.Lock()
+	delete(c.subscriptions, topic)
+	c.mtx.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), subscribeTimeout)
+	defer cancel()
+	_, err = c.CallContext(ctx, network, "/xchg-unsubscribe", marshalTopics([]string{topic}))
+	return
+}
+
+func (c *RemotePeer) hasSubscriptions() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.subscriptions) > 0
+}
+
+// Repeats all subscriptions - after a new session or to keep the session alive
+func (c *RemotePeer) resubscribe(network *Network) {
+	c.mtx.Lock()
+	topics := make([]string, 0, len(c.subscriptions))
+	for topic := range c.subscriptions {
+		topics = append(topics, topic)
+	}
+	c.mtx.Unlock()
+
+	if len(topics) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), subscribeTimeout)
+	defer cancel()
+	c.CallContext(ctx, network, "/xchg-subscribe", marshalTopics(topics))
+}
+
+func (c *RemotePeer) processFrame17(frame []byte) {
+	tr, err := Parse(frame)
+	if err != nil {
+		return
+	}
+
+	c.mtx.Lock()
+	sessionId := c.sessionId
+	aesKey := c.aesKey
+	notificationCounter := c.notificationCounter
+	notifications := c.notifications
+	c.mtx.Unlock()
+
+	if notifications == nil || sessionId == 0 || tr.SessionId != sessionId || len(aesKey) != 32 {
+		return
+	}
+
+	payload, err := DecryptAESGCM(tr.Data, aesKey)
+	if err != nil {
+		return
+	}
+	payload, err = UnpackBytes(payload)
+	if err != nil {
+		return
+	}
+	if len(payload) < 9 || len(payload) < 9+int(payload[8]) {
+		return
+	}
+
+	counter := binary.LittleEndian.Uint64(payload)
+	if notificationCounter.TestAndDeclare(int(counter)) != nil {
+		// Replay
+		return
+	}
+
+	var n notification
+	n.topic = string(payload[9 : 9+int(payload[8])])
+	n.data = payload[9+int(payload[8]):]
+
+	select {
+	case notifications <- n:
+	default:
+		// The queue is full - the notification is lost
+	}
+}
+
+// Ends when the remote peer is stopped
+func (c *RemotePeer) thNotifications() {
+	for {
+		var n notification
+		select {
+		case n = <-c.notifications:
+		case <-c.stopped:
+			return
+		}
+		c.mtx.Lock()
+		handlers := c.subscriptions[n.topic]
+		c.mtx.Unlock()
+		for _, handler := range handlers {
+			handler(c.remoteAddress, n.topic, n.data)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package xchg
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const streamInputBufferSize = 64 * 1024
+
+// Client side of a stream
+// Implements io.ReadCloser for the output of the remote handler
+type remoteStream struct {
+	mtx        sync.Mutex
+	remotePeer *RemotePeer
+	network    *Network
+	id         uint64
+	sessionId  uint64
+	aesKey     []byte
+	channel    *streamChannel
+	ctx        context.Context
+	cancel     context.CancelFunc
+	closed     bool
+	writeDone  chan struct{}
+}
+
+// Opens a stream to the function of the remote peer.
+// Data of input (if not nil) is sent to the handler, the output of the handler is returned as io.ReadCloser.
+// The stream is cancelled when ctx is done.
+func (c *RemotePeer) CallStream(ctx context.Context, network *Network, function string, parameter []byte, input io.Reader) (output io.ReadCloser, err error) {
+	stream, err := c.openStream(ctx, ctx, network, function, parameter, input)
+	if err != nil {
+		return
+	}
+	output = stream
+	return
+}
+
+// openCtx - for the open call, streamCtx - for the whole stream
+func (c *RemotePeer) openStream(openCtx context.Context, streamCtx context.Context, network *Network, function string, parameter []byte, input io.Reader) (stream *remoteStream, err error) {
+	if len(function) > 255 {
+		err = errors.New(ERR_XCHG_CL_CONN_CALL_WRONG_FUNCTION_LEN)
+		return
+	}
+
+	openFrame := make([]byte, 2+len(function)+len(parameter))
+	if input != nil {
+		openFrame[0] = streamFlagInput
+	}
+	openFrame[1] = byte(len(function))
+	copy(openFrame[2:], function)
+	copy(openFrame[2+len(function):], parameter)
+
+	openCtx, openCancel := context.WithTimeout(openCtx, streamCallTimeout)
+	result, sessionId, aesKey, err := c.call(openCtx, network, "/xchg-stream-open", openFrame)
+	openCancel()
+	if err != nil {
+		return
+	}
+	if len(result) != 8 || len(aesKey) != 32 {
+		err = errors.New(ERR_XCHG_STREAM_WRONG_FRAME)
+		return
+	}
+
+	var s remoteStream
+	s.remotePeer = c
+	s.network = network
+	s.id = binary.LittleEndian.Uint64(result)
+	s.sessionId = sessionId
+	s.aesKey = aesKey
+	s.ctx, s.cancel = context.WithCancel(streamCtx)
+	s.writeDone = make(chan struct{})
+	// The server is ready to receive the input
+	s.channel = newStreamChannel(c.callBlockSize, FrameTypeStreamInput, FrameTypeStreamOutputAck, func(frameType byte, position uint64, payload []byte) {
+		c.sendStreamFrame(&s, frameType, position, payload)
+	}, true)
+
+	c.mtx.Lock()
+	if c.streams == nil {
+		c.streams = make(map[uint64]*remoteStream)
+	}
+	c.streams[s.id] = &s
+	c.mtx.Unlock()
+
+	// The first acknowledgement starts the output of the server
+	s.channel.mtx.Lock()
+	frames := s.channel.ack(nil)
+	s.channel.mtx.Unlock()
+	s.channel.flush(frames)
+
+	go func() {
+		<-s.ctx.Done()
+		s.channel.abort(s.ctx.Err())
+	}()
+
+	if input != nil {
+		go s.thWrite(input)
+	} else {
+		close(s.writeDone)
+	}
+	stream = &s
+	return
+}
+
+func (c *RemotePeer) sendStreamFrame(stream *remoteStream, frameType byte, position uint64, payload []byte) {
+	data, err := encryptStreamFrame(frameType, stream.id, payload, stream.aesKey)
+	if err != nil {
+		return
+	}
+	tr := NewTransaction(frameType, AddressForPublicKey(&c.privateKey.PublicKey), c.remoteAddress, stream.id, stream.sessionId, int(uint32(position)), 0, data)
+	c.Send(stream.network, tr)
+}
+
+// Output data and acknowledgements of the input from the server
+func (c *RemotePeer) processStreamFrame(frame []byte) {
+	tr, err := Parse(frame)
+	if err != nil {
+		return
+	}
+
+	c.mtx.Lock()
+	stream, ok := c.streams[tr.TransactionId]
+	c.mtx.Unlock()
+	if !ok || stream.sessionId != tr.SessionId {
+		return
+	}
+
+	payload, err := decryptStreamFrame(tr, stream.aesKey)
+	if err != nil {
+		return
+	}
+
+	if tr.FrameType == FrameTypeStreamOutput {
+		stream.channel.processData(payload)
+	} else {
+		stream.channel.processAck(payload)
+	}
+}
+
+// Streams without frames from the server are aborted
+func (c *RemotePeer) checkStreams() {
+	now := time.Now()
+	c.mtx.Lock()
+	streams := make([]*remoteStream, 0, len(c.streams))
+	for _, stream := range c.streams {
+		streams = append(streams, stream)
+	}
+	c.mtx.Unlock()
+
+	for _, stream := range streams {
+		if stream.channel.check(now) {
+			c.removeStream(stream)
+			stream.channel.abort(errors.New(ERR_XCHG_STREAM_TIMEOUT))
+		}
+	}
+}
+
+func (c *RemotePeer) removeStream(stream *remoteStream) {
+	c.mtx.Lock()
+	if c.streams[stream.id] == stream {
+		delete(c.streams, stream.id)
+	}
+	c.mtx.Unlock()
+}
+
+func (c *remoteStream) Read(p []byte) (n int, err error) {
+	return c.channel.read(c.ctx, p)
+}
+
+func (c *remoteStream) Close() (err error) {
+	c.mtx.Lock()
+	if c.closed {
+		c.mtx.Unlock()
+		return
+	}
+	c.closed = true
+	c.mtx.Unlock()
+
+	frame := make([]byte, 8)
+	binary.LittleEndian.PutUint64(frame, c.id)
+	ctx, cancel := context.WithTimeout(context.Background(), streamCallTimeout)
+	_, err = c.remotePeer.CallContext(ctx, c.network, "/xchg-stream-close", frame)
+	cancel()
+	c.remotePeer.removeStream(c)
+	c.channel.abort(errors.New(ERR_XCHG_STREAM_CLOSED))
+	c.cancel()
+	if isStreamError(err) {
+		// The stream is already removed by the server
+		err = nil
+	}
+	return
+}
+
+func (c *remoteStream) thWrite(input io.Reader) {
+	defer close(c.writeDone)
+	buffer := make([]byte, streamInputBufferSize)
+	for {
+		n, errRead := input.Read(buffer)
+		if n > 0 {
+			if _, err := c.channel.write(c.ctx, buffer[:n]); err != nil {
+				c.setWriteError(err)
+				return
+			}
+		}
+		if errRead != nil {
+			if errRead == io.EOF {
+				errRead = nil
+			}
+			c.channel.closeWrite(errRead)
+			c.setWriteError(c.channel.waitWritten(c.ctx))
+			return
+		}
+	}
+}
+
+// The error of the input is returned by Read
+func (c *remoteStream) setWriteError(err error) {
+	if err == nil || strings.Contains(err.Error(), ERR_XCHG_STREAM_CLOSED) {
+		// The handler does not read the input anymore
+		return
+	}
+	c.channel.abort(err)
+}
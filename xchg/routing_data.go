@@ -0,0 +1,266 @@
+package xchg
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/ipoluianov/xchg/router"
+)
+
+// Signed metadata of a peer published via routers (frames 0x04 / 0x06)
+type RoutingData struct {
+	DisplayName   string   `json:"display_name"`
+	Endpoints     []string `json:"endpoints"`
+	CustomAddress string   `json:"custom_address"`
+
+	// Signature of the custom address by the owner of custom addresses (SignCustomAddress)
+	CustomAddressSign []byte `json:"custom_address_sign,omitempty"`
+
+	// Filled on receiving
+	Address   string         `json:"-"`
+	PublicKey *rsa.PublicKey `json:"-"`
+}
+
+func (c *Peer) routerFrame(routerHost string, frameType byte, data []byte) (response []byte, err error) {
+	frame := make([]byte, router.FrameHeaderSize+len(data))
+	frame[0] = frameType
+	copy(frame[router.FrameHeaderSize:], data)
+
+	var result []byte
+	result, err = c.routerCall(routerHost, "c", frame)
+	if err != nil {
+		return
+	}
+	if len(result) < router.FrameHeaderSize || result[0] != frameType+1 {
+		err = errors.New(ERR_XCHG_ROUTER_CONN_WRONG_FRAME_TYPE)
+		return
+	}
+	if result[1] != router.FrameCodeSuccess {
+		err = errors.New(string(result[router.FrameHeaderSize:]))
+		return
+	}
+	response = result[router.FrameHeaderSize:]
+	return
+}
+
+func (c *Peer) RouterPing(routerHost string) (err error) {
+	_, err = c.routerFrame(routerHost, router.FramePingRequest, nil)
+	return
+}
+
+func (c *Peer) RouterGetNonce(routerHost string) (nonce []byte, err error) {
+	nonce, err = c.routerFrame(routerHost, router.FrameNonceRequest, nil)
+	if err == nil && len(nonce) != 16 {
+		err = errors.New(ERR_XCHG_CL_CONN_AUTH_WRONG_NONCE_LEN)
+	}
+	return
+}
+
+func (c *Peer) RouterDeclareRoutingData(routerHost string, routingData *RoutingData) (err error) {
+	var data []byte
+	data, err = json.Marshal(routingData)
+	if err != nil {
+		return
+	}
+	var nonce []byte
+	nonce, err = c.RouterGetNonce(routerHost)
+	if err != nil {
+		return
+	}
+	var signedBlock []byte
+	signedBlock, err = makeSignedBlock(c.privateKey, nonce, data)
+	if err != nil {
+		return
+	}
+	_, err = c.routerFrame(routerHost, router.FrameDeclareData, signedBlock)
+	return
+}
+
+func (c *Peer) RouterGetRoutingData(routerHost string, address string) (routingData *RoutingData, err error) {
+	address = strings.ToLower(address)
+	if !strings.HasPrefix(address, "#") {
+		address = "#" + address
+	}
+
+	var response []byte
+	response, err = c.routerFrame(routerHost, router.FrameGetData, []byte(address))
+	if err != nil {
+		return
+	}
+	if len(response) < len(address)+1 || string(response[:len(address)]) != address || response[len(address)] != '=' {
+		err = errors.New(ERR_XCHG_ROUTER_WRONG_ADDRESS_DATA)
+		return
+	}
+
+	var publicKeyBS []byte
+	var data []byte
+	publicKeyBS, data, err = verifySignedBlock(response[len(address)+1:])
+	if err != nil {
+		return
+	}
+	if AddressForPublicKeyBS(publicKeyBS) != address {
+		err = errors.New(ERR_XCHG_ROUTER_WRONG_ADDRESS_DATA)
+		return
+	}
+
+	routingData = &RoutingData{}
+	err = json.Unmarshal(data, routingData)
+	if err != nil {
+		routingData = nil
+		return
+	}
+	routingData.Address = address
+	routingData.PublicKey, err = RSAPublicKeyFromDer(publicKeyBS)
+	if err != nil {
+		routingData = nil
+	}
+	return
+}
+
+func (c *Peer) RouterResolveAddress(routerHost string, address string) (nativeAddress string, err error) {
+	var response []byte
+	response, err = c.routerFrame(routerHost, router.FrameResolveAddress, []byte(address))
+	if err != nil {
+		return
+	}
+	prefix := address + "="
+	if !strings.HasPrefix(string(response), prefix) {
+		err = errors.New(ERR_XCHG_ROUTER_UNKNOWN_ADDRESS)
+		return
+	}
+	nativeAddress = string(response[len(prefix):])
+	return
+}
+
+// Sets the data published by the peer. It is declared on the routers of
+// the native address and of the custom address.
+func (c *Peer) SetRoutingData(routingData *RoutingData) {
+	c.mtx.Lock()
+	c.routingData = routingData
+	c.mtx.Unlock()
+	go c.declareRoutingData()
+}
+
+func (c *Peer) declareRoutingData() {
+	c.mtx.Lock()
+	routingData := c.routingData
+	network := c.network
+	c.mtx.Unlock()
+
+	if routingData == nil || network == nil {
+		return
+	}
+
+	routers := c.routersForAddress(network, c.localAddress)
+	if len(routingData.CustomAddress) > 0 {
+		routers = append(routers, c.routersForAddress(network, routingData.CustomAddress)...)
+	}
+
+	declared := make(map[string]bool)
+	for _, routerHost := range routers {
+		if declared[routerHost] {
+			continue
+		}
+		declared[routerHost] = true
+		err := c.RouterDeclareRoutingData(routerHost, routingData)
+		if err != nil {
+			c.logger.Println("Peer::declareRoutingData", routerHost, err)
+		}
+	}
+}
+
+// Gets the routing data of the address from any of its routers
+func (c *Peer) GetRoutingData(address string) (routingData *RoutingData, err error) {
+	c.mtx.Lock()
+	network := c.network
+	c.mtx.Unlock()
+
+	err = errors.New(ERR_XCHG_ROUTER_NO_ADDRESS_DATA)
+	for _, routerHost := range c.routersForAddress(network, address) {
+		routingData, err = c.RouterGetRoutingData(routerHost, address)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// Resolves a custom address to the native one
+func (c *Peer) ResolveAddress(address string) (nativeAddress string, err error) {
+	if strings.HasPrefix(address, "#") {
+		nativeAddress = strings.ToLower(address)
+		return
+	}
+
+	c.mtx.Lock()
+	network := c.network
+	c.mtx.Unlock()
+
+	err = errors.New(ERR_XCHG_ROUTER_UNKNOWN_ADDRESS)
+	for _, routerHost := range c.routersForAddress(network, address) {
+		nativeAddress, err = c.RouterResolveAddress(routerHost, address)
+		if err != nil {
+			continue
+		}
+		// The owner of the native address must confirm the custom address
+		var routingData *RoutingData
+		routingData, err = c.GetRoutingData(nativeAddress)
+		if err == nil && strings.EqualFold(routingData.CustomAddress, address) {
+			return
+		}
+		nativeAddress = ""
+		err = errors.New(ERR_XCHG_ROUTER_UNKNOWN_ADDRESS)
+	}
+	return
+}
+
+// Permission for the native address to use the custom address.
+// The routers accept the custom address if the key is in their custom address keys.
+func SignCustomAddress(privateKey *rsa.PrivateKey, customAddress string, nativeAddress string) (sign []byte, err error) {
+	sign, err = rsa.SignPSS(rand.Reader, privateKey, crypto.SHA256, router.CustomAddressHash(customAddress, nativeAddress), &rsa.PSSOptions{
+		SaltLength: 32,
+	})
+	return
+}
+
+// Checks PoW and signature of a signed block received from a router.
+// The nonce is not checked - it belongs to the router.
+func verifySignedBlock(block []byte) (publicKeyBS []byte, data []byte, err error) {
+	if len(block) < router.SignedBlockHeaderSize {
+		err = errors.New(ERR_XCHG_ROUTER_SIGNED_BLOCK_SIZE)
+		return
+	}
+	publicKeyLen := int(binary.LittleEndian.Uint32(block[280:]))
+	if len(block) < router.SignedBlockHeaderSize+publicKeyLen {
+		err = errors.New(ERR_XCHG_ROUTER_SIGNED_BLOCK_SIZE)
+		return
+	}
+	publicKeyBS = block[284 : 284+publicKeyLen]
+	data = block[284+publicKeyLen:]
+
+	powHash := sha256.Sum256(block[0:24])
+	if !router.CheckHash(powHash[:], block[4]) {
+		err = errors.New(ERR_XCHG_ROUTER_WRONG_POW)
+		return
+	}
+
+	var publicKey *rsa.PublicKey
+	publicKey, err = RSAPublicKeyFromDer(publicKeyBS)
+	if err != nil {
+		return
+	}
+	signedContent := make([]byte, 24+len(data))
+	copy(signedContent[0:], block[0:24])
+	copy(signedContent[24:], data)
+	hash := sha256.Sum256(signedContent)
+	err = rsa.VerifyPSS(publicKey, crypto.SHA256, hash[:], block[24:280], &rsa.PSSOptions{
+		SaltLength: 32,
+	})
+	return
+}
@@ -0,0 +1,554 @@
+package xchg
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// Data of a direction that is sent and not read yet
+	streamWindow = 1024 * 1024
+
+	streamRetransmitDelay = 500 * time.Millisecond
+	streamAckDelay        = 50 * time.Millisecond
+	streamKeepAlivePeriod = 10 * time.Second
+	streamTTL             = 60 * time.Second
+
+	// Data frame
+	streamFlagEOS   = 0x01
+	streamFlagError = 0x02
+	// Ack frame
+	streamFlagEOSReceived = 0x01
+	streamFlagClosed      = 0x02
+)
+
+// One side of a stream: sends the output by frames within the credit of the other side
+// and receives the input from the other side.
+// Positions are counted from the beginning of the stream, the end is marked by the EOS flag.
+type streamChannel struct {
+	mtx     sync.Mutex
+	changed chan struct{}
+
+	blockSize     int
+	dataFrameType byte
+	ackFrameType  byte
+	send          func(frameType byte, position uint64, payload []byte)
+
+	// Aborted locally
+	err error
+
+	// Output
+	out            []byte // the data from outAcked
+	outAcked       uint64
+	outNext        uint64
+	outSent        uint64
+	outLimit       uint64 // the credit of the receiver
+	outStarted     bool   // the receiver is ready
+	outEOS         bool
+	outErr         error
+	outEOSSent     bool
+	outEOSAcked    bool
+	outClosed      bool // the receiver does not read anymore
+	lastProgressDT time.Time
+	lastProbeDT    time.Time
+
+	// Input
+	in             []byte // received in order and not read
+	inEnd          uint64
+	inBlocks       map[uint64][]byte // received out of order
+	inBlocksSize   int
+	inEOS          bool
+	inEOSPosition  uint64
+	inErr          error
+	inClosed       bool // the input is not read anymore
+	ackedEnd       uint64
+	ackedLimit     uint64
+	lastReceivedDT time.Time
+	lastAckDT      time.Time
+}
+
+type streamFrame struct {
+	frameType byte
+	position  uint64
+	payload   []byte
+}
+
+// started - the other side is ready to receive the full window
+func newStreamChannel(blockSize int, dataFrameType byte, ackFrameType byte, send func(frameType byte, position uint64, payload []byte), started bool) *streamChannel {
+	var c streamChannel
+	c.changed = make(chan struct{})
+	c.blockSize = blockSize
+	c.dataFrameType = dataFrameType
+	c.ackFrameType = ackFrameType
+	c.send = send
+	c.inBlocks = make(map[uint64][]byte)
+	c.ackedLimit = streamWindow
+	if started {
+		c.outStarted = true
+		c.outLimit = streamWindow
+	}
+	c.lastReceivedDT = time.Now()
+	c.lastAckDT = time.Now()
+	return &c
+}
+
+func (c *streamChannel) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Not more than sendBlocksWindow frames are being sent at the same time
+func (c *streamChannel) flush(frames []streamFrame) {
+	if len(frames) == 1 {
+		c.send(frames[0].frameType, frames[0].position, frames[0].payload)
+		return
+	}
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, sendBlocksWindow)
+	for _, f := range frames {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(f streamFrame) {
+			c.send(f.frameType, f.position, f.payload)
+			<-semaphore
+			wg.Done()
+		}(f)
+	}
+	wg.Wait()
+}
+
+func (c *streamChannel) outstanding() bool {
+	return c.outNext > c.outAcked || (c.outEOSSent && !c.outEOSAcked)
+}
+
+// New blocks within the credit and the EOS after the last block
+func (c *streamChannel) pump(frames []streamFrame) []streamFrame {
+	if !c.outStarted || c.outClosed || c.err != nil {
+		return frames
+	}
+	if !c.outstanding() {
+		c.lastProgressDT = time.Now()
+	}
+	outEnd := c.outAcked + uint64(len(c.out))
+	for c.outNext < outEnd && c.outNext < c.outLimit {
+		end := c.outNext + uint64(c.blockSize)
+		if end > outEnd {
+			end = outEnd
+		}
+		if end > c.outLimit {
+			end = c.outLimit
+		}
+		frames = append(frames, c.dataFrame(c.outNext, 0, c.out[c.outNext-c.outAcked:end-c.outAcked]))
+		c.outNext = end
+	}
+	if c.outNext > c.outSent {
+		c.outSent = c.outNext
+	}
+	if c.outEOS && !c.outEOSSent && c.outNext == outEnd {
+		var flags byte = streamFlagEOS
+		var data []byte
+		if c.outErr != nil {
+			flags |= streamFlagError
+			data = []byte(c.outErr.Error())
+		}
+		frames = append(frames, c.dataFrame(outEnd, flags, data))
+		c.outEOSSent = true
+	}
+	return frames
+}
+
+// [position 8] [flags 1] [data or error text]
+func (c *streamChannel) dataFrame(position uint64, flags byte, data []byte) streamFrame {
+	payload := make([]byte, 9+len(data))
+	binary.LittleEndian.PutUint64(payload[0:], position)
+	payload[8] = flags
+	copy(payload[9:], data)
+	return streamFrame{c.dataFrameType, position, payload}
+}
+
+// [received 8] [limit 8] [flags 1]
+func (c *streamChannel) ack(frames []streamFrame) []streamFrame {
+	limit := c.inLimit()
+	var flags byte
+	if c.inEOS && c.inEnd == c.inEOSPosition {
+		flags |= streamFlagEOSReceived
+	}
+	if c.inClosed {
+		flags |= streamFlagClosed
+	}
+	payload := make([]byte, 17)
+	binary.LittleEndian.PutUint64(payload[0:], c.inEnd)
+	binary.LittleEndian.PutUint64(payload[8:], limit)
+	payload[16] = flags
+	c.ackedEnd = c.inEnd
+	c.ackedLimit = limit
+	c.lastAckDT = time.Now()
+	return append(frames, streamFrame{c.ackFrameType, c.inEnd, payload})
+}
+
+// The sender can send the data before the limit
+func (c *streamChannel) inLimit() uint64 {
+	return c.inEnd - uint64(len(c.in)) + streamWindow
+}
+
+// Blocks while the output is full
+func (c *streamChannel) write(ctx context.Context, p []byte) (n int, err error) {
+	for {
+		c.mtx.Lock()
+		if c.err != nil {
+			err = c.err
+		} else if c.outClosed || c.outEOS {
+			err = errors.New(ERR_XCHG_STREAM_CLOSED)
+		}
+		if err != nil {
+			c.mtx.Unlock()
+			return
+		}
+		var frames []streamFrame
+		space := streamWindow - len(c.out)
+		if space > len(p)-n {
+			space = len(p) - n
+		}
+		if space > 0 {
+			c.out = append(c.out, p[n:n+space]...)
+			n += space
+			frames = c.pump(frames)
+		}
+		changed := c.changed
+		c.mtx.Unlock()
+
+		c.flush(frames)
+		if n == len(p) {
+			return
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+	}
+}
+
+// End of the output, err is delivered to the reader of the other side
+func (c *streamChannel) closeWrite(err error) {
+	c.mtx.Lock()
+	if c.outEOS {
+		c.mtx.Unlock()
+		return
+	}
+	c.outEOS = true
+	c.outErr = err
+	frames := c.pump(nil)
+	c.notify()
+	c.mtx.Unlock()
+	c.flush(frames)
+}
+
+// Waits until the other side has received all the output (or does not read it)
+func (c *streamChannel) waitWritten(ctx context.Context) (err error) {
+	for {
+		c.mtx.Lock()
+		done := c.outEOSAcked || c.outClosed
+		err = c.err
+		changed := c.changed
+		c.mtx.Unlock()
+		if done || err != nil {
+			return
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *streamChannel) read(ctx context.Context, p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return
+	}
+	for {
+		c.mtx.Lock()
+		if len(c.in) > 0 {
+			n = copy(p, c.in)
+			c.in = c.in[n:]
+			var frames []streamFrame
+			if c.inLimit()-c.ackedLimit >= streamWindow/4 {
+				// The window is open enough to tell the sender
+				frames = c.ack(frames)
+			}
+			c.mtx.Unlock()
+			c.flush(frames)
+			return
+		}
+		if c.inEOS && c.inEnd == c.inEOSPosition {
+			err = c.inErr
+			c.mtx.Unlock()
+			if err == nil {
+				err = io.EOF
+			}
+			return
+		}
+		if c.err != nil || c.inClosed {
+			err = c.err
+			c.mtx.Unlock()
+			if err == nil {
+				err = errors.New(ERR_XCHG_STREAM_CLOSED)
+			}
+			return
+		}
+		changed := c.changed
+		c.mtx.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// The input is not read anymore, the sender stops
+func (c *streamChannel) closeRead() {
+	c.mtx.Lock()
+	if c.inClosed {
+		c.mtx.Unlock()
+		return
+	}
+	c.inClosed = true
+	c.in = nil
+	c.inBlocks = make(map[uint64][]byte)
+	c.inBlocksSize = 0
+	frames := c.ack(nil)
+	c.notify()
+	c.mtx.Unlock()
+	c.flush(frames)
+}
+
+// Local end of the stream, nothing is sent
+func (c *streamChannel) abort(err error) {
+	c.mtx.Lock()
+	if c.err == nil {
+		c.err = err
+		c.notify()
+	}
+	c.mtx.Unlock()
+}
+
+func (c *streamChannel) processData(payload []byte) {
+	if len(payload) < 9 {
+		return
+	}
+	position := binary.LittleEndian.Uint64(payload[0:])
+	flags := payload[8]
+	data := payload[9:]
+
+	c.mtx.Lock()
+	c.lastReceivedDT = time.Now()
+
+	// A probe, a gap, a duplicate or the EOS is acknowledged at once
+	ackNow := len(data) == 0
+	progress := false
+	if flags&streamFlagEOS != 0 {
+		if !c.inEOS && position >= c.inEnd {
+			c.inEOS = true
+			c.inEOSPosition = position
+			if flags&streamFlagError != 0 {
+				c.inErr = errors.New(string(data))
+			}
+			progress = true
+		}
+		data = nil
+		ackNow = true
+	}
+	if len(data) > 0 && !c.inClosed {
+		if c.receiveBlock(position, data) {
+			progress = true
+		} else {
+			ackNow = true
+		}
+	}
+	if c.inClosed {
+		ackNow = true
+	}
+
+	var frames []streamFrame
+	if ackNow || c.inEnd-c.ackedEnd >= streamWindow/4 {
+		frames = c.ack(frames)
+	}
+	if progress {
+		c.notify()
+	}
+	c.mtx.Unlock()
+	c.flush(frames)
+}
+
+// Returns true if the data continues the input
+func (c *streamChannel) receiveBlock(position uint64, data []byte) bool {
+	limit := c.inLimit()
+	if c.inEOS && limit > c.inEOSPosition {
+		limit = c.inEOSPosition
+	}
+	if position >= limit {
+		return false
+	}
+	end := position + uint64(len(data))
+	if end > limit {
+		data = data[:limit-position]
+		end = limit
+	}
+	if end <= c.inEnd {
+		return false
+	}
+
+	if position > c.inEnd {
+		// Out of order - kept within the window
+		if _, ok := c.inBlocks[position]; !ok && c.inBlocksSize+len(data) <= streamWindow {
+			c.inBlocks[position] = append([]byte{}, data...)
+			c.inBlocksSize += len(data)
+		}
+		return false
+	}
+
+	c.in = append(c.in, data[c.inEnd-position:]...)
+	c.inEnd = end
+
+	// The blocks received before
+	for progress := true; progress; {
+		progress = false
+		for blockPosition, block := range c.inBlocks {
+			if blockPosition > c.inEnd {
+				continue
+			}
+			delete(c.inBlocks, blockPosition)
+			c.inBlocksSize -= len(block)
+			blockEnd := blockPosition + uint64(len(block))
+			if blockEnd > c.inEnd {
+				c.in = append(c.in, block[c.inEnd-blockPosition:]...)
+				c.inEnd = blockEnd
+			}
+			progress = true
+		}
+	}
+	return true
+}
+
+func (c *streamChannel) processAck(payload []byte) {
+	if len(payload) < 17 {
+		return
+	}
+	received := binary.LittleEndian.Uint64(payload[0:])
+	limit := binary.LittleEndian.Uint64(payload[8:])
+	flags := payload[16]
+
+	c.mtx.Lock()
+	now := time.Now()
+	c.lastReceivedDT = now
+	c.outStarted = true
+	if received > c.outAcked && received <= c.outSent {
+		c.out = c.out[received-c.outAcked:]
+		c.outAcked = received
+		if c.outNext < received {
+			c.outNext = received
+		}
+		c.lastProgressDT = now
+	}
+	if limit > c.outLimit {
+		c.outLimit = limit
+	}
+	if flags&streamFlagEOSReceived != 0 && c.outEOSSent && received == c.outAcked && len(c.out) == 0 {
+		c.outEOSAcked = true
+	}
+	if flags&streamFlagClosed != 0 {
+		c.outClosed = true
+		c.out = nil
+	}
+	frames := c.pump(nil)
+	c.notify()
+	c.mtx.Unlock()
+	c.flush(frames)
+}
+
+// Retransmission, probes and acknowledgements by time.
+// Returns true if nothing has been received from the other side during streamTTL.
+func (c *streamChannel) check(now time.Time) (expired bool) {
+	c.mtx.Lock()
+	if now.Sub(c.lastReceivedDT) > streamTTL {
+		c.mtx.Unlock()
+		return true
+	}
+
+	var frames []streamFrame
+	if c.err == nil {
+		pending := len(c.out) > 0 || (c.outEOS && !c.outEOSAcked)
+		if c.outStarted && !c.outClosed && c.outstanding() && now.Sub(c.lastProgressDT) > streamRetransmitDelay {
+			// Go-back-N from the first not acknowledged block
+			c.outNext = c.outAcked
+			c.outEOSSent = false
+			frames = c.pump(frames)
+		} else if !c.outClosed && !c.outstanding() && pending && now.Sub(c.lastProbeDT) > streamRetransmitDelay {
+			// The credit is exhausted or the receiver is not ready - the probe is acknowledged with the actual credit
+			frames = append(frames, c.dataFrame(c.outNext, 0, nil))
+			c.lastProbeDT = now
+		}
+
+		if (c.inEnd != c.ackedEnd || c.inLimit() != c.ackedLimit) && now.Sub(c.lastAckDT) > streamAckDelay {
+			frames = c.ack(frames)
+		} else if now.Sub(c.lastAckDT) > streamKeepAlivePeriod {
+			frames = c.ack(frames)
+		}
+	}
+	c.mtx.Unlock()
+
+	if len(frames) > 0 {
+		go c.flush(frames)
+	}
+	return
+}
+
+// AES-GCM(session key, [frameType 1] [streamId 8] [payload])
+func encryptStreamFrame(frameType byte, streamId uint64, payload []byte, aesKey []byte) (data []byte, err error) {
+	data = make([]byte, 9+len(payload))
+	data[0] = frameType
+	binary.LittleEndian.PutUint64(data[1:], streamId)
+	copy(data[9:], payload)
+	return EncryptAESGCM(data, aesKey)
+}
+
+func decryptStreamFrame(tr *Transaction, aesKey []byte) (payload []byte, err error) {
+	data, err := DecryptAESGCM(tr.Data, aesKey)
+	if err != nil {
+		return
+	}
+	if len(data) < 9 || data[0] != tr.FrameType || binary.LittleEndian.Uint64(data[1:]) != tr.TransactionId {
+		err = errors.New(ERR_XCHG_STREAM_WRONG_FRAME)
+		return
+	}
+	payload = data[9:]
+	return
+}
+
+// The input of a stream for the handler
+type streamReader struct {
+	ctx     context.Context
+	channel *streamChannel
+}
+
+func (c *streamReader) Read(p []byte) (n int, err error) {
+	return c.channel.read(c.ctx, p)
+}
+
+// The output of a stream for the handler
+type streamWriter struct {
+	ctx     context.Context
+	channel *streamChannel
+}
+
+func (c *streamWriter) Write(p []byte) (n int, err error) {
+	return c.channel.write(c.ctx, p)
+}
@@ -0,0 +1,127 @@
+package xchg_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipoluianov/xchg/xchg"
+	"github.com/ipoluianov/xchg/xchgtest"
+)
+
+type streamProcessor struct {
+	echoProcessor
+}
+
+func (c *streamProcessor) ServerProcessorStream(ctx context.Context, authData []byte, function string, parameter []byte, input io.Reader, output io.Writer) (err error) {
+	switch function {
+	case "echo":
+		_, err = io.Copy(output, input)
+	case "download":
+		data := make([]byte, binary.LittleEndian.Uint64(parameter))
+		rand.New(rand.NewSource(1)).Read(data)
+		_, err = output.Write(data)
+	case "wait":
+		<-ctx.Done()
+	case "fail":
+		err = errors.New("handler error")
+	}
+	return
+}
+
+func streamNetwork(t *testing.T, loss float64) (network *xchgtest.Network, client *xchg.Peer, serverAddress string) {
+	network = xchgtest.NewNetwork(2, 1)
+	network.SetLoss(loss)
+	t.Cleanup(network.Stop)
+
+	serverKey, _ := xchg.GenerateRSAKey()
+	server := newNetworkPeer(t, network, serverKey)
+	server.SetProcessor(&streamProcessor{})
+	server.Start(false)
+	client = newNetworkPeer(t, network, nil)
+	client.Start(false)
+	serverAddress = xchg.AddressForPublicKey(&serverKey.PublicKey)
+	return
+}
+
+func TestStream(t *testing.T) {
+	for _, loss := range []float64{0, 0.05} {
+		_, client, serverAddress := streamNetwork(t, loss)
+		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+		defer cancel()
+
+		size := make([]byte, 8)
+		binary.LittleEndian.PutUint64(size, 3*1024*1024+17)
+		expected := make([]byte, 3*1024*1024+17)
+		rand.New(rand.NewSource(1)).Read(expected)
+		output, err := client.CallStream(ctx, serverAddress, "", "download", size, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := io.ReadAll(output)
+		output.Close()
+		if err != nil || !bytes.Equal(result, expected) {
+			t.Fatalf("download, loss %v: %d bytes, %v", loss, len(result), err)
+		}
+
+		input := make([]byte, 2*1024*1024+5)
+		rand.New(rand.NewSource(2)).Read(input)
+		output, err = client.CallStream(ctx, serverAddress, "", "echo", nil, bytes.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err = io.ReadAll(output)
+		output.Close()
+		if err != nil || !bytes.Equal(result, input) {
+			t.Fatalf("echo, loss %v: %d bytes, %v", loss, len(result), err)
+		}
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	_, client, serverAddress := streamNetwork(t, 0)
+	output, err := client.CallStream(context.Background(), serverAddress, "", "fail", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+	_, err = io.ReadAll(output)
+	if err == nil || err.Error() != "handler error" {
+		t.Fatal("error of the handler:", err)
+	}
+}
+
+func TestStreamLimit(t *testing.T) {
+	_, client, serverAddress := streamNetwork(t, 0)
+	config := xchg.DefaultPeerConfig()
+
+	streams := make([]io.ReadCloser, 0)
+	for i := 0; i < config.MaxStreamsPerSession; i++ {
+		output, err := client.CallStream(context.Background(), serverAddress, "", "wait", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, output)
+	}
+
+	_, err := client.CallStream(context.Background(), serverAddress, "", "wait", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), xchg.ERR_XCHG_STREAM_LIMIT) {
+		t.Fatal("limit:", err)
+	}
+
+	streams[0].Close()
+	output, err := client.CallStream(context.Background(), serverAddress, "", "wait", nil, nil)
+	if err != nil {
+		t.Fatal("after close:", err)
+	}
+	output.Close()
+	for _, stream := range streams[1:] {
+		stream.Close()
+	}
+}
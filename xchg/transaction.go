@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"sort"
 	"strings"
 	"time"
 )
@@ -36,19 +37,37 @@ type Transaction struct {
 	FromLocalNode bool
 
 	// Execution Result
-	BeginDT        time.Time
-	ReceivedFrames []*Transaction
-	//ReceivedDataLen int
-	Complete bool
-	Result   []byte
-	Err      error
+	BeginDT         time.Time
+	ReceivedFrames  []*Transaction
+	ReceivedDataLen int
+	LastReceivedDT  time.Time
+	Complete        bool
+	Result          []byte
+	Err             error
+
+	// Blocks kept for retransmission
+	OutgoingFrames []*Transaction
+	LastNackDT     time.Time
+	NackCount      int
+
+	receivedOffsets map[uint32]struct{}
+	doneCh          chan struct{}
 }
 
 const (
 	TransactionHeaderSize = 128
-
-	FrameTypeCall     = byte(0x10)
-	FrameTypeResponse = byte(0x11)
+	MaxTransactionSize    = 64 * 1024 * 1024
+
+	FrameTypeCall         = byte(0x10)
+	FrameTypeResponse     = byte(0x11)
+	FrameTypeCallNack     = byte(0x12)
+	FrameTypeResponseNack = byte(0x13)
+	FrameTypeCancel       = byte(0x14)
+
+	NackDelay        = 300 * time.Millisecond
+	NackDelayNoData  = 1000 * time.Millisecond
+	MaxNackCount     = 10
+	MaxRangesPerNack = 256
 )
 
 func NewTransaction(frameType byte, srcAddress string, destAddress string, transactionId uint64, sessionId uint64, offset int, totalSize int, data []byte) *Transaction {
@@ -148,35 +167,130 @@ func (c *Transaction) String() string {
 	return res
 }
 
+// Blocks may come in any order, duplicated or overlapped.
+// The transaction is complete when the blocks cover the whole TotalSize.
 func (c *Transaction) AppendReceivedData(transaction *Transaction) {
-	if len(c.ReceivedFrames) < 1000 {
-		found := false
-		for _, trvTr := range c.ReceivedFrames {
-			if trvTr.Offset == transaction.Offset {
-				found = true
-			}
-		}
-		if !found {
-			c.ReceivedFrames = append(c.ReceivedFrames, transaction)
-		}
+	if transaction.TotalSize > MaxTransactionSize {
+		return
+	}
+	if uint64(transaction.Offset)+uint64(len(transaction.Data)) > uint64(transaction.TotalSize) {
+		return
+	}
+	if len(c.ReceivedFrames) > 0 && c.ReceivedFrames[0].TotalSize != transaction.TotalSize {
+		return
 	}
 
-	if transaction.FromLocalNode {
-		c.FromLocalNode = true
+	if c.receivedOffsets == nil {
+		c.receivedOffsets = make(map[uint32]struct{})
 	}
 
-	receivedDataLen := 0
-	for _, trvTr := range c.ReceivedFrames {
-		receivedDataLen += int(len(trvTr.Data))
+	if _, found := c.receivedOffsets[transaction.Offset]; !found {
+		c.receivedOffsets[transaction.Offset] = struct{}{}
+		c.ReceivedFrames = append(c.ReceivedFrames, transaction)
+		c.ReceivedDataLen += len(transaction.Data)
 	}
 
-	if receivedDataLen == int(transaction.TotalSize) {
+	if transaction.FromLocalNode {
+		c.FromLocalNode = true
+	}
+	c.LastReceivedDT = time.Now()
+
+	// Overlapped blocks are counted twice - the ranges are checked
+	if c.ReceivedDataLen >= int(transaction.TotalSize) && len(c.MissingRanges(transaction.TotalSize)) == 0 {
 		if len(c.Result) != int(transaction.TotalSize) {
 			c.Result = make([]byte, transaction.TotalSize)
 		}
 		for _, trvTr := range c.ReceivedFrames {
 			copy(c.Result[trvTr.Offset:], trvTr.Data)
 		}
-		c.Complete = true
+		c.SetComplete()
+	}
+}
+
+// Channel is closed when the transaction is complete
+func (c *Transaction) Done() <-chan struct{} {
+	if c.doneCh == nil {
+		c.doneCh = make(chan struct{})
+		if c.Complete {
+			close(c.doneCh)
+		}
+	}
+	return c.doneCh
+}
+
+func (c *Transaction) SetComplete() {
+	if c.Complete {
+		return
+	}
+	c.Complete = true
+	if c.doneCh != nil {
+		close(c.doneCh)
 	}
 }
+
+// Ranges [offset, size] of data that are not received yet
+func (c *Transaction) MissingRanges(totalSize uint32) (ranges [][2]uint32) {
+	ranges = make([][2]uint32, 0)
+
+	frames := make([]*Transaction, len(c.ReceivedFrames))
+	copy(frames, c.ReceivedFrames)
+	sort.Slice(frames, func(i, j int) bool {
+		return frames[i].Offset < frames[j].Offset
+	})
+
+	expectedOffset := uint32(0)
+	for _, f := range frames {
+		if f.Offset > expectedOffset {
+			ranges = append(ranges, [2]uint32{expectedOffset, f.Offset - expectedOffset})
+		}
+		end := f.Offset + uint32(len(f.Data))
+		if end > expectedOffset {
+			expectedOffset = end
+		}
+		if len(ranges) >= MaxRangesPerNack {
+			return
+		}
+	}
+	if expectedOffset < totalSize {
+		ranges = append(ranges, [2]uint32{expectedOffset, totalSize - expectedOffset})
+	}
+	return
+}
+
+// Outgoing blocks that intersect the ranges. Empty ranges - all blocks
+func (c *Transaction) OutgoingFramesInRanges(ranges [][2]uint32) (frames []*Transaction) {
+	if len(ranges) == 0 {
+		return c.OutgoingFrames
+	}
+	frames = make([]*Transaction, 0)
+	for _, f := range c.OutgoingFrames {
+		begin := uint64(f.Offset)
+		end := begin + uint64(len(f.Data))
+		for _, r := range ranges {
+			rangeBegin := uint64(r[0])
+			rangeEnd := rangeBegin + uint64(r[1])
+			if begin < rangeEnd && rangeBegin < end || (begin == end && begin == rangeBegin) {
+				frames = append(frames, f)
+				break
+			}
+		}
+	}
+	return
+}
+
+func MarshalRanges(ranges [][2]uint32) []byte {
+	result := make([]byte, 8*len(ranges))
+	for i, r := range ranges {
+		binary.LittleEndian.PutUint32(result[i*8:], r[0])
+		binary.LittleEndian.PutUint32(result[i*8+4:], r[1])
+	}
+	return result
+}
+
+func ParseRanges(data []byte) (ranges [][2]uint32) {
+	ranges = make([][2]uint32, 0, len(data)/8)
+	for offset := 0; offset+8 <= len(data); offset += 8 {
+		ranges = append(ranges, [2]uint32{binary.LittleEndian.Uint32(data[offset:]), binary.LittleEndian.Uint32(data[offset+4:])})
+	}
+	return
+}
@@ -0,0 +1,149 @@
+package xchg
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func makeBlock(data []byte, offset int, size int) *Transaction {
+	block := NewTransaction(FrameTypeCall, "", "", 1, 0, offset, len(data), data[offset:offset+size])
+	return block
+}
+
+// Blocks [offset, size] of the data
+func splitBlocks(data []byte, blockSize int) (blocks [][2]int) {
+	for offset := 0; offset < len(data); offset += blockSize {
+		size := blockSize
+		if offset+size > len(data) {
+			size = len(data) - offset
+		}
+		blocks = append(blocks, [2]int{offset, size})
+	}
+	return
+}
+
+func TestAppendReceivedData(t *testing.T) {
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(data)
+	blocks := splitBlocks(data, 1024)
+
+	reversed := make([][2]int, 0, len(blocks))
+	for i := len(blocks) - 1; i >= 0; i-- {
+		reversed = append(reversed, blocks[i])
+	}
+
+	shuffled := append([][2]int{}, blocks...)
+	rand.New(rand.NewSource(2)).Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	duplicated := make([][2]int, 0, len(blocks)*2)
+	for _, b := range blocks {
+		duplicated = append(duplicated, b, b)
+	}
+
+	tests := []struct {
+		name     string
+		blocks   [][2]int
+		complete bool
+	}{
+		{"in order", blocks, true},
+		{"reversed", reversed, true},
+		{"shuffled", shuffled, true},
+		{"duplicated", duplicated, true},
+		{"overlapped", [][2]int{{0, 6000}, {5000, 4000}, {8000, 2000}}, true},
+		{"overlapped with a gap", [][2]int{{0, 6000}, {5000, 3000}, {9000, 1000}}, false},
+		{"last block missing", blocks[:len(blocks)-1], false},
+		{"first block missing", blocks[1:], false},
+		{"duplicates of a part", [][2]int{{0, 1024}, {0, 1024}, {1024, 1024}, {1024, 1024}, {1024, 1024}, {1024, 1024}, {1024, 1024}, {1024, 1024}, {1024, 1024}, {1024, 1024}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr := NewTransaction(FrameTypeCall, "", "", 1, 0, 0, 0, nil)
+			for _, b := range test.blocks {
+				tr.AppendReceivedData(makeBlock(data, b[0], b[1]))
+			}
+			if tr.Complete != test.complete {
+				t.Fatalf("complete: %v, expected %v", tr.Complete, test.complete)
+			}
+			if test.complete && !bytes.Equal(tr.Result, data) {
+				t.Fatal("wrong result")
+			}
+			if !test.complete && len(tr.MissingRanges(uint32(len(data)))) == 0 {
+				t.Fatal("no missing ranges")
+			}
+		})
+	}
+}
+
+func TestAppendReceivedDataWrongBlocks(t *testing.T) {
+	data := make([]byte, 2048)
+
+	tests := []struct {
+		name  string
+		block *Transaction
+	}{
+		{"beyond the total size", NewTransaction(FrameTypeCall, "", "", 1, 0, 1024, 1500, data[:1024])},
+		{"too large", NewTransaction(FrameTypeCall, "", "", 1, 0, 0, MaxTransactionSize+1, data[:1024])},
+		{"other total size", NewTransaction(FrameTypeCall, "", "", 1, 0, 1024, 4096, data[:1024])},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr := NewTransaction(FrameTypeCall, "", "", 1, 0, 0, 0, nil)
+			tr.AppendReceivedData(makeBlock(data, 0, 1024))
+			tr.AppendReceivedData(test.block)
+			if tr.Complete || len(tr.ReceivedFrames) != 1 {
+				t.Fatalf("the block is accepted: complete %v, frames %d", tr.Complete, len(tr.ReceivedFrames))
+			}
+		})
+	}
+}
+
+func TestMissingRanges(t *testing.T) {
+	data := make([]byte, 4096)
+	tr := NewTransaction(FrameTypeCall, "", "", 1, 0, 0, 0, nil)
+	tr.AppendReceivedData(makeBlock(data, 1024, 1024))
+	tr.AppendReceivedData(makeBlock(data, 3072, 512))
+
+	ranges := tr.MissingRanges(4096)
+	expected := [][2]uint32{{0, 1024}, {2048, 1024}, {3584, 512}}
+	if len(ranges) != len(expected) {
+		t.Fatalf("ranges: %v, expected %v", ranges, expected)
+	}
+	for i := range ranges {
+		if ranges[i] != expected[i] {
+			t.Fatalf("ranges: %v, expected %v", ranges, expected)
+		}
+	}
+
+	parsed := ParseRanges(MarshalRanges(ranges))
+	for i := range ranges {
+		if parsed[i] != ranges[i] {
+			t.Fatalf("parsed ranges: %v, expected %v", parsed, ranges)
+		}
+	}
+}
+
+// Every other block is received: a NACK requests not more than MaxRangesPerNack ranges
+func TestMissingRangesLimit(t *testing.T) {
+	blockSize := 100
+	count := MaxRangesPerNack * 3
+	data := make([]byte, blockSize*count)
+	tr := NewTransaction(FrameTypeCall, "", "", 1, 0, 0, 0, nil)
+	for i := 1; i < count; i += 2 {
+		tr.AppendReceivedData(makeBlock(data, i*blockSize, blockSize))
+	}
+
+	ranges := tr.MissingRanges(uint32(len(data)))
+	if len(ranges) != MaxRangesPerNack {
+		t.Fatal("wrong count of ranges", len(ranges))
+	}
+	for i, r := range ranges {
+		if r != [2]uint32{uint32(2 * i * blockSize), uint32(blockSize)} {
+			t.Fatal("wrong range", i, r)
+		}
+	}
+}
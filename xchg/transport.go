@@ -0,0 +1,179 @@
+package xchg
+
+import (
+	"errors"
+	"net"
+)
+
+// Connection of the peer to routers.
+// Functions of Call (the router API):
+//
+//	"n" - nonce, "r" - read frames of the address, "w" - write a frame, "c" - router frame
+type PeerTransport interface {
+	Id() string
+	Start(peerProcessor PeerProcessor, localAddressBS []byte) error
+	Stop() error
+	// The transport can reach the router (host:port)
+	Supports(routerHost string) bool
+	Call(routerHost string, function string, frame []byte) (result []byte, err error)
+}
+
+// Response of a router to a request of a transport
+type routerResponse struct {
+	data []byte
+	err  error
+}
+
+// Frames received by a transport outside of the "r" function (pushed by the router)
+type PeerProcessor interface {
+	ProcessFrame(routerHost string, frame []byte)
+}
+
+// Path from the client to the remote peer
+type RemotePeerTransport interface {
+	Id() string
+	// ARP frame - the transport can look for the remote peer
+	Check(frame20 *Transaction, network *Network, remotePublicKeyExists bool) error
+	// A call sent via the transports has failed (timeout)
+	DeclareError(sentViaTransportMap map[string]struct{})
+	Send(network *Network, tr *Transaction) error
+	SetRemoteUDPAddress(udpAddress *net.UDPAddr)
+}
+
+// Registers the transport. Must be called before Start.
+// The transports added later are preferred, the HTTP transport is the fallback.
+func (c *Peer) AddTransport(transport PeerTransport) {
+	c.mtx.Lock()
+	c.transports = append(c.transports, transport)
+	c.mtx.Unlock()
+}
+
+// Replaces the transports (the default ones too), must be called before Start
+func (c *Peer) SetTransports(transports ...PeerTransport) {
+	c.mtx.Lock()
+	c.transports = append([]PeerTransport{}, transports...)
+	c.mtx.Unlock()
+}
+
+func (c *Peer) startTransports() (err error) {
+	c.mtx.Lock()
+	transports := append([]PeerTransport{}, c.transports...)
+	c.mtx.Unlock()
+	for _, transport := range transports {
+		err = transport.Start(c, c.localAddressBS)
+		if err != nil {
+			c.logger.Println("transport", transport.Id(), "start error:", err)
+			return
+		}
+	}
+	return
+}
+
+func (c *Peer) stopTransports() {
+	c.mtx.Lock()
+	transports := append([]PeerTransport{}, c.transports...)
+	c.mtx.Unlock()
+	for _, transport := range transports {
+		transport.Stop()
+	}
+}
+
+// Transports supporting the router, the preferred first
+func (c *Peer) transportsForRouter(routerHost string) (transports []PeerTransport) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	transports = make([]PeerTransport, 0, len(c.transports))
+	for i := len(c.transports) - 1; i >= 0; i-- {
+		if c.transports[i].Supports(routerHost) {
+			transports = append(transports, c.transports[i])
+		}
+	}
+	return
+}
+
+// Request to the router via the first transport that succeeds
+func (c *Peer) routerCall(routerHost string, function string, frame []byte) (result []byte, err error) {
+	if len(routerHost) == 0 {
+		err = errors.New(ERR_XCHG_PEER_NO_ROUTER_HOST)
+		return
+	}
+	transports := c.transportsForRouter(routerHost)
+	if len(transports) == 0 {
+		err = errors.New(ERR_XCHG_PEER_NO_TRANSPORT)
+		return
+	}
+	for _, transport := range transports {
+		result, err = transport.Call(routerHost, function, frame)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// Processes a frame received from a transport and sends the responses
+func (c *Peer) ProcessFrame(routerHost string, frame []byte) {
+	responses := c.processFrame(routerHost, frame)
+	for _, f := range responses {
+		c.send(f.Marshal(), f.FromLocalNode)
+	}
+}
+
+// Default path to the remote peer - via the routers of its address
+type routersTransport struct {
+	peer *Peer
+}
+
+func newRoutersTransport(peer *Peer) *routersTransport {
+	var c routersTransport
+	c.peer = peer
+	return &c
+}
+
+func (c *routersTransport) Id() string {
+	return "routers"
+}
+
+func (c *routersTransport) Check(frame20 *Transaction, network *Network, remotePublicKeyExists bool) error {
+	if remotePublicKeyExists {
+		return nil
+	}
+	frame := frame20.Marshal()
+	for _, routerHost := range c.peer.routersForAddress(network, frame20.DestAddressString()) {
+		go c.peer.routerCall(routerHost, "w", frame)
+	}
+	return nil
+}
+
+func (c *routersTransport) DeclareError(sentViaTransportMap map[string]struct{}) {
+}
+
+// Sends the frame to all routers of the destination address.
+// Returns an error if no router accepted the frame.
+func (c *routersTransport) Send(network *Network, tr *Transaction) (err error) {
+	addrs := c.peer.routersForAddress(network, tr.DestAddressString())
+	if len(addrs) == 0 {
+		err = errors.New(ERR_XCHG_CL_CONN_CALL_NO_ROUTE_TO_PEER)
+		return
+	}
+
+	bs := tr.Marshal()
+	results := make(chan error, len(addrs))
+	for _, a := range addrs {
+		go func(routerHost string) {
+			_, sendErr := c.peer.routerCall(routerHost, "w", bs)
+			results <- sendErr
+		}(a)
+	}
+
+	for i := 0; i < len(addrs); i++ {
+		err = <-results
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+func (c *routersTransport) SetRemoteUDPAddress(udpAddress *net.UDPAddr) {
+}
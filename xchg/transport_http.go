@@ -0,0 +1,103 @@
+package xchg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+)
+
+// Router API over HTTP: multipart POST, the frame is in the field "d" (base64).
+// Reading ("r") is a long polling request.
+type HttpTransport struct {
+	httpClient     *http.Client
+	httpClientLong *http.Client
+}
+
+// Timeouts: RouterCallTimeout, LongPollingDelay (read)
+func NewHttpTransport(config PeerConfig) *HttpTransport {
+	var c HttpTransport
+	{
+		tr := &http.Transport{}
+		jar, _ := cookiejar.New(nil)
+		c.httpClient = &http.Client{Transport: tr, Jar: jar}
+		c.httpClient.Timeout = config.RouterCallTimeout
+	}
+
+	{
+		tr := &http.Transport{}
+		jar, _ := cookiejar.New(nil)
+		c.httpClientLong = &http.Client{Transport: tr, Jar: jar}
+		c.httpClientLong.Timeout = config.LongPollingDelay
+	}
+	return &c
+}
+
+func (c *HttpTransport) Id() string {
+	return "http"
+}
+
+func (c *HttpTransport) Start(peerProcessor PeerProcessor, localAddressBS []byte) error {
+	return nil
+}
+
+func (c *HttpTransport) Stop() error {
+	c.httpClient.CloseIdleConnections()
+	c.httpClientLong.CloseIdleConnections()
+	return nil
+}
+
+func (c *HttpTransport) Supports(routerHost string) bool {
+	return true
+}
+
+func (c *HttpTransport) Call(routerHost string, function string, frame []byte) (result []byte, err error) {
+	httpClient := c.httpClient
+	if function == "r" {
+		httpClient = c.httpClientLong
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	{
+		fw, _ := writer.CreateFormField("d")
+		frame64 := base64.StdEncoding.EncodeToString(frame)
+		fw.Write([]byte(frame64))
+	}
+	writer.Close()
+
+	addr := "http://" + routerHost
+
+	response, err := c.post(httpClient, addr+"/api/"+function, writer.FormDataContentType(), &body)
+
+	if err != nil {
+		return
+	} else {
+		var content []byte
+		content, err = ioutil.ReadAll(response.Body)
+		if err != nil {
+			response.Body.Close()
+			return
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			err = errors.New(string(content))
+			return
+		}
+		result, err = base64.StdEncoding.DecodeString(string(content))
+	}
+	return
+}
+
+func (c *HttpTransport) post(httpClient *http.Client, url, contentType string, body io.Reader) (resp *http.Response, err error) {
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return httpClient.Do(req)
+}
@@ -0,0 +1,315 @@
+package xchg
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ipoluianov/xchg/router"
+)
+
+const (
+	tcpDialTimeout  = 2 * time.Second
+	tcpWriteTimeout = 2 * time.Second
+	tcpMaxReadSize  = 1024 * 1024
+
+	// The router without the TCP API is not asked again during the period
+	tcpRetryPeriod = 60 * time.Second
+)
+
+// Router API over one TCP connection per router (the port of the router + router.TcpPortOffset).
+// Requests are multiplexed by request id. The frames of the local address are pushed by routers:
+// the read ("r") subscribes the connection and then waits while the connection is alive.
+// The read is repeated every RouterRegisterPeriod (keeps the connection and returns missed frames).
+type TcpTransport struct {
+	mtx                sync.Mutex
+	callTimeout        time.Duration
+	registerPeriod     time.Duration
+	peerProcessor      PeerProcessor
+	connections        map[string]*tcpRouterConnection
+	unavailableRouters map[string]time.Time
+	stopping           bool
+}
+
+type tcpRouterConnection struct {
+	mtx           sync.Mutex
+	writeMtx      sync.Mutex
+	conn          net.Conn
+	requests      map[uint64]chan routerResponse
+	nextRequestId uint64
+	registeredDT  time.Time
+	lastMessageId uint64
+	closed        bool
+	closedCh      chan struct{}
+}
+
+// Timeouts: RouterCallTimeout, RouterRegisterPeriod
+func NewTcpTransport(config PeerConfig) *TcpTransport {
+	var c TcpTransport
+	c.callTimeout = config.RouterCallTimeout
+	c.registerPeriod = config.RouterRegisterPeriod
+	c.connections = make(map[string]*tcpRouterConnection)
+	c.unavailableRouters = make(map[string]time.Time)
+	return &c
+}
+
+func (c *TcpTransport) Id() string {
+	return "tcp"
+}
+
+func (c *TcpTransport) Start(peerProcessor PeerProcessor, localAddressBS []byte) error {
+	c.mtx.Lock()
+	c.peerProcessor = peerProcessor
+	c.stopping = false
+	c.mtx.Unlock()
+	return nil
+}
+
+func (c *TcpTransport) Stop() error {
+	c.mtx.Lock()
+	c.stopping = true
+	connections := c.connections
+	c.connections = make(map[string]*tcpRouterConnection)
+	c.mtx.Unlock()
+	for _, conn := range connections {
+		conn.close(errors.New(ERR_XCHG_PEER_TCP_CLOSED))
+	}
+	return nil
+}
+
+func (c *TcpTransport) Supports(routerHost string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.stopping {
+		return false
+	}
+	if dt, ok := c.unavailableRouters[routerHost]; ok {
+		if time.Since(dt) < tcpRetryPeriod {
+			return false
+		}
+		delete(c.unavailableRouters, routerHost)
+	}
+	return true
+}
+
+func (c *TcpTransport) Call(routerHost string, function string, frame []byte) (result []byte, err error) {
+	if len(function) != 1 {
+		err = errors.New(ERR_XCHG_PEER_TCP_WRONG_FUNCTION)
+		return
+	}
+	conn, err := c.connection(routerHost)
+	if err != nil {
+		return
+	}
+	if function[0] == router.TcpFunctionRead {
+		return conn.read(frame, c.callTimeout, c.registerPeriod)
+	}
+	result, err = conn.call(function[0], frame, c.callTimeout)
+	return
+}
+
+func (c *TcpTransport) connection(routerHost string) (conn *tcpRouterConnection, err error) {
+	c.mtx.Lock()
+	conn, ok := c.connections[routerHost]
+	c.mtx.Unlock()
+	if ok {
+		return
+	}
+
+	tcpHost, err := tcpRouterHost(routerHost)
+	if err != nil {
+		return
+	}
+	netConn, err := net.DialTimeout("tcp", tcpHost, tcpDialTimeout)
+	if err != nil {
+		c.mtx.Lock()
+		c.unavailableRouters[routerHost] = time.Now()
+		c.mtx.Unlock()
+		return
+	}
+
+	conn = &tcpRouterConnection{}
+	conn.conn = netConn
+	conn.requests = make(map[uint64]chan routerResponse)
+	conn.nextRequestId = 1
+	conn.closedCh = make(chan struct{})
+
+	c.mtx.Lock()
+	if existingConn, exists := c.connections[routerHost]; exists || c.stopping {
+		// Dialed concurrently or stopped
+		c.mtx.Unlock()
+		netConn.Close()
+		if !exists {
+			err = errors.New(ERR_XCHG_PEER_TCP_CLOSED)
+		}
+		conn = existingConn
+		return
+	}
+	c.connections[routerHost] = conn
+	c.mtx.Unlock()
+
+	go c.thReceive(routerHost, conn)
+	return
+}
+
+func (c *TcpTransport) thReceive(routerHost string, conn *tcpRouterConnection) {
+	for {
+		message, err := router.TcpReadMessage(conn.conn)
+		if err != nil {
+			c.mtx.Lock()
+			if c.connections[routerHost] == conn {
+				delete(c.connections, routerHost)
+			}
+			c.mtx.Unlock()
+			conn.close(errors.New(ERR_XCHG_PEER_TCP_CLOSED + ":" + err.Error()))
+			return
+		}
+
+		function := message[4]
+		id := binary.LittleEndian.Uint64(message[5:])
+		data := message[router.TcpHeaderSize:]
+
+		if function == router.TcpFunctionPush {
+			conn.mtx.Lock()
+			if id > conn.lastMessageId {
+				conn.lastMessageId = id
+			}
+			conn.mtx.Unlock()
+			c.mtx.Lock()
+			peerProcessor := c.peerProcessor
+			c.mtx.Unlock()
+			if peerProcessor != nil && len(data) >= TransactionHeaderSize {
+				peerProcessor.ProcessFrame(routerHost, data)
+			}
+			continue
+		}
+
+		var response routerResponse
+		if message[13] == 0 {
+			response.data = data
+		} else {
+			response.err = errors.New(string(data))
+		}
+		conn.complete(id, response)
+	}
+}
+
+// Subscribes the connection or waits while the frames are pushed
+func (c *tcpRouterConnection) read(request []byte, callTimeout time.Duration, registerPeriod time.Duration) (result []byte, err error) {
+	if len(request) < 16 {
+		err = errors.New(ERR_XCHG_PEER_TCP_WRONG_FUNCTION)
+		return
+	}
+
+	c.mtx.Lock()
+	registeredDT := c.registeredDT
+	c.mtx.Unlock()
+
+	if time.Since(registeredDT) < registerPeriod {
+		select {
+		case <-c.closedCh:
+			err = errors.New(ERR_XCHG_PEER_TCP_CLOSED)
+			return
+		case <-time.After(time.Until(registeredDT.Add(registerPeriod))):
+		}
+		c.mtx.Lock()
+		result = make([]byte, 8)
+		binary.LittleEndian.PutUint64(result, c.lastMessageId)
+		c.mtx.Unlock()
+		return
+	}
+
+	readRequest := make([]byte, len(request))
+	copy(readRequest, request)
+	binary.LittleEndian.PutUint64(readRequest[8:], tcpMaxReadSize)
+	result, err = c.call(router.TcpFunctionRead, readRequest, callTimeout)
+	if err == nil && len(result) >= 8 {
+		c.mtx.Lock()
+		c.registeredDT = time.Now()
+		lastMessageId := binary.LittleEndian.Uint64(result)
+		if lastMessageId > c.lastMessageId {
+			c.lastMessageId = lastMessageId
+		}
+		c.mtx.Unlock()
+	}
+	return
+}
+
+func (c *tcpRouterConnection) call(function byte, frame []byte, timeout time.Duration) (result []byte, err error) {
+	responseCh := make(chan routerResponse, 1)
+	c.mtx.Lock()
+	if c.closed {
+		c.mtx.Unlock()
+		err = errors.New(ERR_XCHG_PEER_TCP_CLOSED)
+		return
+	}
+	requestId := c.nextRequestId
+	c.nextRequestId++
+	c.requests[requestId] = responseCh
+	c.mtx.Unlock()
+
+	c.writeMtx.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	_, err = c.conn.Write(router.TcpMarshal(function, requestId, 0, frame))
+	c.writeMtx.Unlock()
+	if err != nil {
+		c.conn.Close()
+		c.complete(requestId, routerResponse{})
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case response := <-responseCh:
+		result = response.data
+		err = response.err
+	case <-timer.C:
+		c.complete(requestId, routerResponse{})
+		err = errors.New(ERR_XCHG_PEER_TCP_TIMEOUT)
+	}
+	return
+}
+
+func (c *tcpRouterConnection) complete(requestId uint64, response routerResponse) {
+	c.mtx.Lock()
+	responseCh, ok := c.requests[requestId]
+	delete(c.requests, requestId)
+	c.mtx.Unlock()
+	if ok {
+		responseCh <- response
+	}
+}
+
+// Fails all waiting requests
+func (c *tcpRouterConnection) close(err error) {
+	c.mtx.Lock()
+	if !c.closed {
+		close(c.closedCh)
+	}
+	c.closed = true
+	requests := c.requests
+	c.requests = make(map[uint64]chan routerResponse)
+	c.mtx.Unlock()
+	c.conn.Close()
+	for _, responseCh := range requests {
+		responseCh <- routerResponse{err: err}
+	}
+}
+
+// host:port of the HTTP API -> host:port of the TCP API
+func tcpRouterHost(routerHost string) (tcpHost string, err error) {
+	host, portString, err := net.SplitHostPort(routerHost)
+	if err != nil {
+		return
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return
+	}
+	tcpHost = net.JoinHostPort(host, strconv.Itoa(port+router.TcpPortOffset))
+	return
+}
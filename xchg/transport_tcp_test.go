@@ -0,0 +1,81 @@
+package xchg_test
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ipoluianov/xchg/router"
+	"github.com/ipoluianov/xchg/xchg"
+)
+
+// Port of an embedded router: the port and the port of its TCP API are free
+func freeRouterPort(t *testing.T) int {
+	for i := 0; i < 100; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+		if port+router.TcpPortOffset > 65535 {
+			continue
+		}
+		listener, err = net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port+router.TcpPortOffset))
+		if err != nil {
+			continue
+		}
+		listener.Close()
+		return port
+	}
+	t.Fatal("no free port")
+	return 0
+}
+
+// Calls via the TCP API of the embedded router: requests, reads and pushed frames
+func TestTcpTransport(t *testing.T) {
+	routerHost := "127.0.0.1:" + strconv.Itoa(freeRouterPort(t))
+
+	serverConfig := xchg.DefaultPeerConfig()
+	serverConfig.LocalRouters = []string{routerHost}
+	serverConfig.LocalNodes = nil
+	serverKey, _ := xchg.GenerateRSAKey()
+	server, err := xchg.NewPeerWithConfig(serverKey, xchg.NewDefaultLogger(), serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetNetwork(xchg.NewNetwork())
+	server.SetTransports(xchg.NewTcpTransport(serverConfig))
+	server.SetProcessor(&echoProcessor{})
+	if err = server.Start(true); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	clientConfig := xchg.DefaultPeerConfig()
+	clientConfig.LocalRouters = nil
+	clientConfig.LocalNodes = []string{routerHost}
+	client, err := xchg.NewPeerWithConfig(nil, xchg.NewDefaultLogger(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetNetwork(xchg.NewNetwork())
+	client.SetTransports(xchg.NewTcpTransport(clientConfig))
+	if err = client.Start(false); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+
+	serverAddress := xchg.AddressForPublicKey(&serverKey.PublicKey)
+	for i := 0; i < 5; i++ {
+		data := []byte("tcp " + strconv.Itoa(i))
+		result, err := client.Call(serverAddress, "", "echo", data, 10*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result) != string(data) {
+			t.Fatal("wrong result:", string(result))
+		}
+	}
+}
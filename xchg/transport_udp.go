@@ -0,0 +1,550 @@
+package xchg
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ipoluianov/xchg/router"
+)
+
+const (
+	udpProbeTimeout    = 1 * time.Second
+	udpKeepalivePeriod = 5 * time.Second
+	udpRetryPeriod     = 60 * time.Second
+	udpMaxReadSize     = 256 * 1024
+	udpBufferSize      = 4 * 1024 * 1024
+	udpMaxCandidates   = 16
+)
+
+// Router API over UDP. The frames of the local address are pushed by routers:
+// the read ("r") registers the endpoint and waits, pinging the router (frame 0x00)
+// to keep the registration and the NAT mapping. The registration is repeated
+// every RouterRegisterPeriod. Lost datagrams are recovered by NACK frames.
+// A router is used only after the handshake (the router answers verified endpoints only) and the ping.
+type UdpTransport struct {
+	mtx            sync.Mutex
+	port           int
+	callTimeout    time.Duration
+	registerPeriod time.Duration
+	conn           *net.UDPConn
+	peerProcessor  PeerProcessor
+	assembler      *router.UdpAssembler
+	requests       map[uint64]*udpRequest
+	nextRequestId  uint64
+	routers        map[string]*udpRouter
+	routerHosts    map[string]string
+	stopping       bool
+	stopCh         chan struct{}
+
+	// Datagrams of other peers (direct path)
+	directProcessor directProcessor
+
+	// Broadcasts of LAN discovery
+	lanDiscovery bool
+	lanConn      *net.UDPConn
+}
+
+// The response is accepted only from the endpoint of the request
+type udpRequest struct {
+	endpoint   string
+	responseCh chan routerResponse
+}
+
+type directProcessor interface {
+	processDirectMessage(addr *net.UDPAddr, message *router.UdpMessage)
+}
+
+type udpRouter struct {
+	host          string
+	addr          *net.UDPAddr
+	available     bool
+	probing       bool
+	probeDT       time.Time
+	registeredDT  time.Time
+	lastMessageId uint64
+}
+
+// port - the local UDP port, 0 - any.
+// Timeouts: RouterCallTimeout, RouterRegisterPeriod; LAN discovery: LanDiscovery.
+func NewUdpTransport(port int, config PeerConfig) *UdpTransport {
+	var c UdpTransport
+	c.port = port
+	c.callTimeout = config.RouterCallTimeout
+	c.registerPeriod = config.RouterRegisterPeriod
+	c.lanDiscovery = config.LanDiscovery
+	c.assembler = router.NewUdpAssembler()
+	c.requests = make(map[uint64]*udpRequest)
+	c.nextRequestId = 1
+	c.routers = make(map[string]*udpRouter)
+	c.routerHosts = make(map[string]string)
+	return &c
+}
+
+func (c *UdpTransport) Id() string {
+	return "udp"
+}
+
+func (c *UdpTransport) Start(peerProcessor PeerProcessor, localAddressBS []byte) (err error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: c.port})
+	if err != nil {
+		return
+	}
+	conn.SetReadBuffer(udpBufferSize)
+	conn.SetWriteBuffer(udpBufferSize)
+
+	c.mtx.Lock()
+	c.conn = conn
+	c.peerProcessor = peerProcessor
+	c.stopping = false
+	c.stopCh = make(chan struct{})
+	lanDiscovery := c.lanDiscovery
+	c.mtx.Unlock()
+
+	go c.thReceive(conn)
+	if lanDiscovery {
+		c.startLan()
+	}
+	return
+}
+
+func (c *UdpTransport) Stop() error {
+	c.mtx.Lock()
+	if c.stopping || c.conn == nil {
+		c.mtx.Unlock()
+		return nil
+	}
+	c.stopping = true
+	close(c.stopCh)
+	conn := c.conn
+	c.conn = nil
+	lanConn := c.lanConn
+	c.lanConn = nil
+	requests := c.requests
+	c.requests = make(map[uint64]*udpRequest)
+	c.routers = make(map[string]*udpRouter)
+	c.routerHosts = make(map[string]string)
+	c.mtx.Unlock()
+
+	for _, request := range requests {
+		request.responseCh <- routerResponse{err: errors.New(ERR_XCHG_PEER_UDP_CLOSED)}
+	}
+	if lanConn != nil {
+		lanConn.Close()
+	}
+	return conn.Close()
+}
+
+// Local UDP address of the transport
+func (c *UdpTransport) LocalAddr() (addr *net.UDPAddr) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.conn != nil {
+		addr, _ = c.conn.LocalAddr().(*net.UDPAddr)
+	}
+	return
+}
+
+func (c *UdpTransport) Supports(routerHost string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.stopping || c.conn == nil {
+		return false
+	}
+	r, ok := c.routers[routerHost]
+	if !ok {
+		r = &udpRouter{}
+		r.host = routerHost
+		c.routers[routerHost] = r
+	}
+	if !r.available && !r.probing && time.Since(r.probeDT) > udpRetryPeriod {
+		r.probing = true
+		go c.probe(r)
+	}
+	return r.available
+}
+
+func (c *UdpTransport) probe(r *udpRouter) {
+	addr, err := net.ResolveUDPAddr("udp", r.host)
+	if err == nil {
+		c.mtx.Lock()
+		r.addr = addr
+		c.routerHosts[udpEndpointKey(addr)] = r.host
+		c.mtx.Unlock()
+		err = c.handshake(addr)
+		if err == nil {
+			err = c.ping(addr, udpProbeTimeout)
+		}
+	}
+	c.mtx.Lock()
+	r.available = err == nil
+	r.probing = false
+	r.probeDT = time.Now()
+	c.mtx.Unlock()
+}
+
+// The router answers only the endpoints that returned its cookie
+func (c *UdpTransport) handshake(addr *net.UDPAddr) (err error) {
+	cookie, err := c.call(addr, router.UdpFunctionCookie, make([]byte, router.UdpCookieSize), udpProbeTimeout)
+	if err != nil {
+		return
+	}
+	if len(cookie) != router.UdpCookieSize {
+		err = errors.New(ERR_XCHG_PEER_UDP_WRONG_COOKIE)
+		return
+	}
+	_, err = c.call(addr, router.UdpFunctionCookie, cookie, udpProbeTimeout)
+	return
+}
+
+func (c *UdpTransport) ping(addr *net.UDPAddr, timeout time.Duration) (err error) {
+	frame := make([]byte, router.FrameHeaderSize)
+	frame[0] = router.FramePingRequest
+	result, err := c.call(addr, router.UdpFunctionFrame, frame, timeout)
+	if err == nil && (len(result) < router.FrameHeaderSize || result[0] != router.FramePingResponse) {
+		err = errors.New(ERR_XCHG_ROUTER_CONN_WRONG_FRAME_TYPE)
+	}
+	return
+}
+
+func (c *UdpTransport) Call(routerHost string, function string, frame []byte) (result []byte, err error) {
+	if len(function) != 1 {
+		err = errors.New(ERR_XCHG_PEER_UDP_WRONG_FUNCTION)
+		return
+	}
+	c.mtx.Lock()
+	r, ok := c.routers[routerHost]
+	available := ok && r.available
+	c.mtx.Unlock()
+	if !available {
+		err = errors.New(ERR_XCHG_PEER_UDP_NOT_AVAILABLE)
+		return
+	}
+
+	if function[0] == router.UdpFunctionRead {
+		return c.read(r, frame)
+	}
+
+	result, err = c.call(r.addr, function[0], frame, c.callTimeout)
+	if err != nil {
+		c.fail(r, err)
+	}
+	return
+}
+
+// Registers the endpoint or waits while the frames are pushed
+func (c *UdpTransport) read(r *udpRouter, request []byte) (result []byte, err error) {
+	if len(request) < 16 {
+		err = errors.New(ERR_XCHG_PEER_UDP_WRONG_FUNCTION)
+		return
+	}
+
+	c.mtx.Lock()
+	registeredDT := r.registeredDT
+	stopCh := c.stopCh
+	c.mtx.Unlock()
+
+	if time.Since(registeredDT) < c.registerPeriod {
+		deadline := registeredDT.Add(c.registerPeriod)
+		for time.Now().Before(deadline) {
+			wait := time.Until(deadline)
+			if wait > udpKeepalivePeriod {
+				wait = udpKeepalivePeriod
+			}
+			select {
+			case <-stopCh:
+				err = errors.New(ERR_XCHG_PEER_UDP_CLOSED)
+				return
+			case <-time.After(wait):
+			}
+			c.mtx.Lock()
+			available := r.available
+			c.mtx.Unlock()
+			if !available {
+				// A frame was not pushed - it is read by the other transports
+				break
+			}
+			if time.Now().Before(deadline) {
+				err = c.ping(r.addr, c.callTimeout)
+				if err != nil {
+					c.fail(r, err)
+					return
+				}
+			}
+		}
+		c.mtx.Lock()
+		result = make([]byte, 8)
+		binary.LittleEndian.PutUint64(result, r.lastMessageId)
+		c.mtx.Unlock()
+		return
+	}
+
+	readRequest := make([]byte, len(request))
+	copy(readRequest, request)
+	binary.LittleEndian.PutUint64(readRequest[8:], udpMaxReadSize)
+	result, err = c.call(r.addr, router.UdpFunctionRead, readRequest, c.callTimeout)
+	if err != nil {
+		c.fail(r, err)
+		return
+	}
+	if len(result) >= 8 {
+		c.mtx.Lock()
+		r.registeredDT = time.Now()
+		r.lastMessageId = binary.LittleEndian.Uint64(result)
+		c.mtx.Unlock()
+	}
+	return
+}
+
+// The router did not answer - the other transports are used until the next probe
+func (c *UdpTransport) fail(r *udpRouter, err error) {
+	var routerErr *udpRouterError
+	if errors.As(err, &routerErr) {
+		return
+	}
+	c.mtx.Lock()
+	r.available = false
+	r.registeredDT = time.Time{}
+	r.probeDT = time.Time{}
+	c.mtx.Unlock()
+}
+
+func (c *UdpTransport) call(addr *net.UDPAddr, function byte, data []byte, timeout time.Duration) (result []byte, err error) {
+	responseCh := make(chan routerResponse, 1)
+	c.mtx.Lock()
+	conn := c.conn
+	if conn == nil || addr == nil {
+		c.mtx.Unlock()
+		err = errors.New(ERR_XCHG_PEER_UDP_CLOSED)
+		return
+	}
+	requestId := c.nextRequestId
+	c.nextRequestId++
+	c.requests[requestId] = &udpRequest{endpoint: udpEndpointKey(addr), responseCh: responseCh}
+	c.mtx.Unlock()
+
+	datagrams, err := router.UdpMarshal(function, requestId, 0, data)
+	if err != nil {
+		c.removeRequest(requestId)
+		err = errors.New(ERR_XCHG_PEER_UDP_TOO_LARGE)
+		return
+	}
+	for _, datagram := range datagrams {
+		_, err = conn.WriteToUDP(datagram, addr)
+		if err != nil {
+			c.removeRequest(requestId)
+			return
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case response := <-responseCh:
+		result = response.data
+		err = response.err
+	case <-timer.C:
+		c.removeRequest(requestId)
+		err = errors.New(ERR_XCHG_PEER_UDP_TIMEOUT)
+	}
+	return
+}
+
+func (c *UdpTransport) removeRequest(requestId uint64) {
+	c.mtx.Lock()
+	delete(c.requests, requestId)
+	c.mtx.Unlock()
+}
+
+// Responses from other endpoints are dropped
+func (c *UdpTransport) complete(endpoint string, requestId uint64, response routerResponse) {
+	c.mtx.Lock()
+	request, ok := c.requests[requestId]
+	if ok && request.endpoint != endpoint {
+		ok = false
+	}
+	if ok {
+		delete(c.requests, requestId)
+	}
+	c.mtx.Unlock()
+	if ok {
+		request.responseCh <- response
+	}
+}
+
+func (c *UdpTransport) thReceive(conn *net.UDPConn) {
+	buffer := make([]byte, router.UdpHeaderSize+router.UdpChunkSize+1024)
+	lastPurgeDT := time.Now()
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if time.Since(lastPurgeDT) > time.Second {
+			c.assembler.Purge()
+			lastPurgeDT = time.Now()
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buffer[:n])
+		key := udpEndpointKey(addr)
+		message := c.assembler.Add(key, datagram)
+		if message == nil {
+			continue
+		}
+
+		if isDirectMessage(message.Function) {
+			c.mtx.Lock()
+			directProcessor := c.directProcessor
+			c.mtx.Unlock()
+			if directProcessor != nil {
+				directProcessor.processDirectMessage(addr, message)
+			}
+			continue
+		}
+
+		if message.Function != router.UdpFunctionPush {
+			var response routerResponse
+			if message.Status == 0 {
+				response.data = message.Data
+			} else {
+				response.err = &udpRouterError{message: string(message.Data)}
+			}
+			c.complete(key, message.Id, response)
+			continue
+		}
+
+		c.mtx.Lock()
+		routerHost, ok := c.routerHosts[key]
+		if ok {
+			r := c.routers[routerHost]
+			if r == nil || !r.available {
+				ok = false
+			} else if message.Status != 0 {
+				// The frame is too large for UDP: it is read again by the other transports
+				if message.Id-1 < r.lastMessageId {
+					r.lastMessageId = message.Id - 1
+				}
+				r.available = false
+				r.registeredDT = time.Time{}
+				r.probeDT = time.Now()
+				ok = false
+			} else if message.Id > r.lastMessageId {
+				r.lastMessageId = message.Id
+			}
+		}
+		peerProcessor := c.peerProcessor
+		c.mtx.Unlock()
+		if ok && len(message.Data) >= TransactionHeaderSize {
+			peerProcessor.ProcessFrame(routerHost, message.Data)
+		}
+	}
+}
+
+func (c *UdpTransport) setDirectProcessor(directProcessor directProcessor) {
+	c.mtx.Lock()
+	c.directProcessor = directProcessor
+	c.mtx.Unlock()
+}
+
+// Datagram to another peer, no response
+func (c *UdpTransport) sendDirect(addr *net.UDPAddr, function byte, id uint64, data []byte) (err error) {
+	c.mtx.Lock()
+	conn := c.conn
+	c.mtx.Unlock()
+	if conn == nil {
+		err = errors.New(ERR_XCHG_PEER_UDP_CLOSED)
+		return
+	}
+	datagrams, err := router.UdpMarshal(function, id, 0, data)
+	if err != nil {
+		err = errors.New(ERR_XCHG_PEER_UDP_TOO_LARGE)
+		return
+	}
+	for _, datagram := range datagrams {
+		_, err = conn.WriteToUDP(datagram, addr)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Frame to another peer, the id distinguishes the fragments of frames
+func (c *UdpTransport) sendDirectFrame(addr *net.UDPAddr, frame []byte) (err error) {
+	c.mtx.Lock()
+	c.nextRequestId++
+	id := c.nextRequestId
+	c.mtx.Unlock()
+	return c.sendDirect(addr, router.UdpFunctionDirectFrame, id, frame)
+}
+
+// Endpoints (ip:port) the other peers can try to reach the transport:
+// the addresses observed by the routers and the addresses of the local interfaces
+func (c *UdpTransport) Candidates() (candidates []string) {
+	localAddr := c.LocalAddr()
+	if localAddr == nil {
+		return
+	}
+
+	c.mtx.Lock()
+	routerAddrs := make([]*net.UDPAddr, 0, len(c.routers))
+	for _, r := range c.routers {
+		if r.available && r.addr != nil {
+			routerAddrs = append(routerAddrs, r.addr)
+		}
+	}
+	c.mtx.Unlock()
+
+	candidates = make([]string, 0)
+	found := make(map[string]struct{})
+	addCandidate := func(candidate string) {
+		if _, ok := found[candidate]; ok || len(candidates) >= udpMaxCandidates {
+			return
+		}
+		found[candidate] = struct{}{}
+		candidates = append(candidates, candidate)
+	}
+
+	for _, routerAddr := range routerAddrs {
+		observed, err := c.call(routerAddr, router.UdpFunctionObserve, nil, udpProbeTimeout)
+		if err == nil {
+			addCandidate(string(observed))
+		}
+	}
+
+	interfaceAddrs, _ := net.InterfaceAddrs()
+	for _, interfaceAddr := range interfaceAddrs {
+		ipNet, ok := interfaceAddr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		addCandidate(net.JoinHostPort(ipNet.IP.String(), strconv.Itoa(localAddr.Port)))
+	}
+	return
+}
+
+func isDirectMessage(function byte) bool {
+	switch function {
+	case router.UdpFunctionPunchToServer, router.UdpFunctionPunchToServerAck,
+		router.UdpFunctionPunchToClient, router.UdpFunctionPunchToClientAck,
+		router.UdpFunctionDirectFrame, router.UdpFunctionLanFrame:
+		return true
+	}
+	return false
+}
+
+// Error returned by the router (the router is reachable)
+type udpRouterError struct {
+	message string
+}
+
+func (c *udpRouterError) Error() string {
+	return c.message
+}
+
+func udpEndpointKey(addr *net.UDPAddr) string {
+	return net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
+}
@@ -0,0 +1,96 @@
+package xchg
+
+import (
+	"net"
+
+	"github.com/ipoluianov/xchg/router"
+)
+
+// LAN discovery: the 0x20 frame is broadcasted (function "l" of the UDP API)
+// to the discovery ports of the local subnets. The owner of the address answers
+// with the 0x21 frame from its UDP endpoint - the endpoint becomes the direct path.
+// A peer listens on the first free port of the range.
+const (
+	LanDiscoveryPort       = 42010
+	lanDiscoveryPortsCount = 8
+)
+
+func (c *UdpTransport) startLan() {
+	for i := 0; i < lanDiscoveryPortsCount; i++ {
+		lanConn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: LanDiscoveryPort + i})
+		if err != nil {
+			continue
+		}
+		c.mtx.Lock()
+		c.lanConn = lanConn
+		c.mtx.Unlock()
+		go c.thReceiveLan(lanConn)
+		return
+	}
+}
+
+func (c *UdpTransport) thReceiveLan(lanConn *net.UDPConn) {
+	buffer := make([]byte, router.UdpHeaderSize+router.UdpChunkSize+1024)
+	for {
+		n, addr, err := lanConn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buffer[:n])
+		message := c.assembler.Add("lan/"+udpEndpointKey(addr), datagram)
+		if message == nil || message.Function != router.UdpFunctionLanFrame {
+			continue
+		}
+		c.mtx.Lock()
+		directProcessor := c.directProcessor
+		c.mtx.Unlock()
+		if directProcessor != nil {
+			directProcessor.processDirectMessage(addr, message)
+		}
+	}
+}
+
+// Sends the frame to the discovery ports of the local subnets and of the host
+func (c *UdpTransport) broadcastLan(frame []byte) {
+	c.mtx.Lock()
+	lanDiscovery := c.lanDiscovery
+	c.mtx.Unlock()
+	if !lanDiscovery {
+		return
+	}
+	for _, ip := range lanBroadcastAddresses() {
+		for i := 0; i < lanDiscoveryPortsCount; i++ {
+			c.sendDirect(&net.UDPAddr{IP: ip, Port: LanDiscoveryPort + i}, router.UdpFunctionLanFrame, 0, frame)
+		}
+	}
+}
+
+func lanBroadcastAddresses() (addresses []net.IP) {
+	addresses = make([]net.IP, 0)
+	addresses = append(addresses, net.IPv4(127, 0, 0, 1))
+
+	interfaces, _ := net.Interfaces()
+	for _, ifc := range interfaces {
+		if ifc.Flags&net.FlagUp == 0 || ifc.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+		addrs, _ := ifc.Addrs()
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipNet.IP.To4()
+			if ip == nil || len(ipNet.Mask) != net.IPv4len {
+				continue
+			}
+			broadcast := make(net.IP, net.IPv4len)
+			for i := range ip {
+				broadcast[i] = ip[i] | ^ipNet.Mask[i]
+			}
+			addresses = append(addresses, broadcast)
+		}
+	}
+	return
+}
@@ -0,0 +1,67 @@
+package xchg_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ipoluianov/xchg/xchg"
+)
+
+// Calls via the UDP API of the embedded router: the handshake, requests, reads and pushed frames
+func TestUdpTransport(t *testing.T) {
+	routerHost := "127.0.0.1:" + strconv.Itoa(freeRouterPort(t))
+
+	serverConfig := xchg.DefaultPeerConfig()
+	serverConfig.LocalRouters = []string{routerHost}
+	serverConfig.LocalNodes = nil
+	serverKey, _ := xchg.GenerateRSAKey()
+	server, err := xchg.NewPeerWithConfig(serverKey, xchg.NewDefaultLogger(), serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetNetwork(xchg.NewNetwork())
+	serverTransport := xchg.NewUdpTransport(0, serverConfig)
+	server.SetTransports(serverTransport)
+	server.SetProcessor(&echoProcessor{})
+	if err = server.Start(true); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	clientConfig := xchg.DefaultPeerConfig()
+	clientConfig.LocalRouters = nil
+	clientConfig.LocalNodes = []string{routerHost}
+	client, err := xchg.NewPeerWithConfig(nil, xchg.NewDefaultLogger(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetNetwork(xchg.NewNetwork())
+	clientTransport := xchg.NewUdpTransport(0, clientConfig)
+	client.SetTransports(clientTransport)
+	if err = client.Start(false); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+
+	// The router is used after the handshake and the ping
+	deadline := time.Now().Add(10 * time.Second)
+	for !serverTransport.Supports(routerHost) || !clientTransport.Supports(routerHost) {
+		if time.Now().After(deadline) {
+			t.Fatal("no handshake")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	serverAddress := xchg.AddressForPublicKey(&serverKey.PublicKey)
+	for i := 0; i < 5; i++ {
+		data := []byte("udp " + strconv.Itoa(i))
+		result, err := client.Call(serverAddress, "", "echo", data, 10*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result) != string(data) {
+			t.Fatal("wrong result:", string(result))
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package xchg
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ipoluianov/xchg/router"
+)
+
+const (
+	wsDialTimeout  = 2 * time.Second
+	wsWriteTimeout = 2 * time.Second
+
+	// The router without the WebSocket API is not asked again during the period
+	wsRetryPeriod = 60 * time.Second
+)
+
+// Router API over one WebSocket connection per router (/api/ws).
+// Requests are multiplexed by request id.
+type WsTransport struct {
+	mtx                sync.Mutex
+	callTimeout        time.Duration
+	longPollingDelay   time.Duration
+	connections        map[string]*wsRouterConnection
+	unavailableRouters map[string]time.Time
+	stopping           bool
+}
+
+type wsRouterConnection struct {
+	mtx           sync.Mutex
+	writeMtx      sync.Mutex
+	conn          *websocket.Conn
+	requests      map[uint64]chan routerResponse
+	nextRequestId uint64
+	closed        bool
+}
+
+// Timeouts: RouterCallTimeout, LongPollingDelay (read)
+func NewWsTransport(config PeerConfig) *WsTransport {
+	var c WsTransport
+	c.callTimeout = config.RouterCallTimeout
+	c.longPollingDelay = config.LongPollingDelay
+	c.connections = make(map[string]*wsRouterConnection)
+	c.unavailableRouters = make(map[string]time.Time)
+	return &c
+}
+
+func (c *WsTransport) Id() string {
+	return "ws"
+}
+
+func (c *WsTransport) Start(peerProcessor PeerProcessor, localAddressBS []byte) error {
+	c.mtx.Lock()
+	c.stopping = false
+	c.mtx.Unlock()
+	return nil
+}
+
+func (c *WsTransport) Stop() error {
+	c.mtx.Lock()
+	c.stopping = true
+	connections := c.connections
+	c.connections = make(map[string]*wsRouterConnection)
+	c.mtx.Unlock()
+	for _, conn := range connections {
+		conn.close(errors.New(ERR_XCHG_PEER_WS_CLOSED))
+	}
+	return nil
+}
+
+func (c *WsTransport) Supports(routerHost string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.stopping {
+		return false
+	}
+	if dt, ok := c.unavailableRouters[routerHost]; ok {
+		if time.Since(dt) < wsRetryPeriod {
+			return false
+		}
+		delete(c.unavailableRouters, routerHost)
+	}
+	return true
+}
+
+func (c *WsTransport) Call(routerHost string, function string, frame []byte) (result []byte, err error) {
+	if len(function) != 1 {
+		err = errors.New(ERR_XCHG_PEER_WS_WRONG_FUNCTION)
+		return
+	}
+	conn, err := c.connection(routerHost)
+	if err != nil {
+		return
+	}
+	timeout := c.callTimeout
+	if function == "r" {
+		timeout = c.longPollingDelay
+	}
+	result, err = conn.call(function[0], frame, timeout)
+	return
+}
+
+func (c *WsTransport) connection(routerHost string) (conn *wsRouterConnection, err error) {
+	c.mtx.Lock()
+	conn, ok := c.connections[routerHost]
+	c.mtx.Unlock()
+	if ok {
+		return
+	}
+
+	dialer := websocket.Dialer{HandshakeTimeout: wsDialTimeout}
+	wsConn, _, err := dialer.Dial("ws://"+routerHost+"/api/ws", nil)
+	if err != nil {
+		c.mtx.Lock()
+		c.unavailableRouters[routerHost] = time.Now()
+		c.mtx.Unlock()
+		return
+	}
+
+	conn = &wsRouterConnection{}
+	conn.conn = wsConn
+	conn.requests = make(map[uint64]chan routerResponse)
+	conn.nextRequestId = 1
+
+	c.mtx.Lock()
+	if existingConn, exists := c.connections[routerHost]; exists || c.stopping {
+		// Dialed concurrently or stopped
+		c.mtx.Unlock()
+		wsConn.Close()
+		if !exists {
+			err = errors.New(ERR_XCHG_PEER_WS_CLOSED)
+		}
+		conn = existingConn
+		return
+	}
+	c.connections[routerHost] = conn
+	c.mtx.Unlock()
+
+	go c.thReceive(routerHost, conn)
+	return
+}
+
+func (c *WsTransport) thReceive(routerHost string, conn *wsRouterConnection) {
+	for {
+		messageType, message, err := conn.conn.ReadMessage()
+		if err != nil {
+			c.mtx.Lock()
+			if c.connections[routerHost] == conn {
+				delete(c.connections, routerHost)
+			}
+			c.mtx.Unlock()
+			conn.close(errors.New(ERR_XCHG_PEER_WS_CLOSED + ":" + err.Error()))
+			return
+		}
+		if messageType != websocket.BinaryMessage || len(message) < router.WsResponseHeaderSize {
+			continue
+		}
+		var response routerResponse
+		if message[router.WsHeaderSize] == router.WsStatusSuccess {
+			response.data = message[router.WsResponseHeaderSize:]
+		} else {
+			response.err = errors.New(string(message[router.WsResponseHeaderSize:]))
+		}
+		conn.complete(router.WsRequestId(message), response)
+	}
+}
+
+func (c *wsRouterConnection) call(function byte, frame []byte, timeout time.Duration) (result []byte, err error) {
+	responseCh := make(chan routerResponse, 1)
+	c.mtx.Lock()
+	if c.closed {
+		c.mtx.Unlock()
+		err = errors.New(ERR_XCHG_PEER_WS_CLOSED)
+		return
+	}
+	requestId := c.nextRequestId
+	c.nextRequestId++
+	c.requests[requestId] = responseCh
+	c.mtx.Unlock()
+
+	request := make([]byte, router.WsHeaderSize+len(frame))
+	request[0] = function
+	binary.LittleEndian.PutUint64(request[1:], requestId)
+	copy(request[router.WsHeaderSize:], frame)
+
+	c.writeMtx.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	err = c.conn.WriteMessage(websocket.BinaryMessage, request)
+	c.writeMtx.Unlock()
+	if err != nil {
+		c.conn.Close()
+		c.complete(requestId, routerResponse{})
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case response := <-responseCh:
+		result = response.data
+		err = response.err
+	case <-timer.C:
+		c.complete(requestId, routerResponse{})
+		err = errors.New(ERR_XCHG_PEER_WS_TIMEOUT)
+	}
+	return
+}
+
+func (c *wsRouterConnection) complete(requestId uint64, response routerResponse) {
+	c.mtx.Lock()
+	responseCh, ok := c.requests[requestId]
+	delete(c.requests, requestId)
+	c.mtx.Unlock()
+	if ok {
+		responseCh <- response
+	}
+}
+
+// Fails all waiting requests
+func (c *wsRouterConnection) close(err error) {
+	c.mtx.Lock()
+	c.closed = true
+	requests := c.requests
+	c.requests = make(map[uint64]chan routerResponse)
+	c.mtx.Unlock()
+	c.conn.Close()
+	for _, responseCh := range requests {
+		responseCh <- routerResponse{err: err}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base32"
+	"encoding/pem"
 	"errors"
 	"io"
 	"io/fs"
@@ -103,6 +104,37 @@ func GenerateRSAKey() (privateKey *rsa.PrivateKey, err error) {
 	return
 }
 
+func RSAPrivateKeyToPem(privateKey *rsa.PrivateKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+}
+
+func RSAPrivateKeyFromPem(privateKeyPem []byte) (privateKey *rsa.PrivateKey, err error) {
+	block, _ := pem.Decode(privateKeyPem)
+	if block == nil {
+		err = errors.New("wrong private key")
+		return
+	}
+	privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	return
+}
+
+// Loads the private key (PEM) from the file. If the file does not exist, a new key is generated and saved.
+func LoadOrCreateRSAKey(fileName string) (privateKey *rsa.PrivateKey, err error) {
+	privateKeyPem, err := ioutil.ReadFile(fileName)
+	if err == nil {
+		return RSAPrivateKeyFromPem(privateKeyPem)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	privateKey, err = GenerateRSAKey()
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(fileName, RSAPrivateKeyToPem(privateKey), 0600)
+	return
+}
+
 func DecryptAESGCM(encryptedMessage []byte, key []byte) (decryptedMessage []byte, err error) {
 	ch, err := aes.NewCipher(key)
 	if err != nil {
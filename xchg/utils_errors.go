@@ -12,6 +12,8 @@ const (
 	ERR_XCHG_CONN_WRONG_FRAME_SIZE = "{ERR_XCHG_CONN_WRONG_FRAME_SIZE}"
 	ERR_XCHG_CONN_NO_CONNECTION    = "{ERR_XCHG_CONN_NO_CONNECTION}"
 	ERR_XCHG_CONN_SENDING_ERROR    = "{ERR_XCHG_CONN_SENDING_ERROR}"
+	ERR_XCHG_CONN_WRONG_SERVICE    = "{ERR_XCHG_CONN_WRONG_SERVICE}"
+	ERR_XCHG_CONN_NO_LISTENER      = "{ERR_XCHG_CONN_NO_LISTENER}"
 
 	// Transaction
 	ERR_XCHG_TR_WRONG_FRAME = "{ERR_XCHG_TR_WRONG_FRAME}"
@@ -41,11 +43,43 @@ const (
 	ERR_XCHG_CL_CONN_AUTH_WRONG_AUTH_RESP_LEN  = "{ERR_XCHG_CL_CONN_AUTH_WRONG_AUTH_RESP_LEN}"
 
 	// Peer Connection
-	ERR_XCHG_PEER_CONN_LOSS               = "{ERR_XCHG_PEER_CONN_LOSS}"
-	ERR_XCHG_PEER_CONN_TR_TIMEOUT         = "{ERR_XCHG_PEER_CONN_TR_TIMEOUT}"
-	ERR_XCHG_PEER_CONN_REQ_SID_SIZE       = "{ERR_XCHG_PEER_CONN_REQ_SID_SIZE}"
-	ERR_XCHG_PEER_CONN_WRONG_PROT_VERSION = "{ERR_XCHG_PEER_CONN_WRONG_PROT_VERSION}"
-	ERR_XCHG_PEER_CONN_RCVD_ERR           = "{ERR_XCHG_PEER_CONN_RCVD_ERR}"
+	ERR_XCHG_PEER_CONN_LOSS                = "{ERR_XCHG_PEER_CONN_LOSS}"
+	ERR_XCHG_PEER_CONN_TR_TIMEOUT          = "{ERR_XCHG_PEER_CONN_TR_TIMEOUT}"
+	ERR_XCHG_PEER_CONN_TR_CANCELLED        = "{ERR_XCHG_PEER_CONN_TR_CANCELLED}"
+	ERR_XCHG_PEER_CONN_REQ_SID_SIZE        = "{ERR_XCHG_PEER_CONN_REQ_SID_SIZE}"
+	ERR_XCHG_PEER_CONN_WRONG_PROT_VERSION  = "{ERR_XCHG_PEER_CONN_WRONG_PROT_VERSION}"
+	ERR_XCHG_PEER_CONN_RCVD_ERR            = "{ERR_XCHG_PEER_CONN_RCVD_ERR}"
+	ERR_XCHG_PEER_NO_TRANSPORT             = "{ERR_XCHG_PEER_NO_TRANSPORT}"
+	ERR_XCHG_PEER_NO_ROUTER_HOST           = "{ERR_XCHG_PEER_NO_ROUTER_HOST}"
+	ERR_XCHG_PEER_WS_CLOSED                = "{ERR_XCHG_PEER_WS_CLOSED}"
+	ERR_XCHG_PEER_WS_TIMEOUT               = "{ERR_XCHG_PEER_WS_TIMEOUT}"
+	ERR_XCHG_PEER_WS_WRONG_FUNCTION        = "{ERR_XCHG_PEER_WS_WRONG_FUNCTION}"
+	ERR_XCHG_PEER_UDP_CLOSED               = "{ERR_XCHG_PEER_UDP_CLOSED}"
+	ERR_XCHG_PEER_UDP_TIMEOUT              = "{ERR_XCHG_PEER_UDP_TIMEOUT}"
+	ERR_XCHG_PEER_UDP_NOT_AVAILABLE        = "{ERR_XCHG_PEER_UDP_NOT_AVAILABLE}"
+	ERR_XCHG_PEER_UDP_WRONG_FUNCTION       = "{ERR_XCHG_PEER_UDP_WRONG_FUNCTION}"
+	ERR_XCHG_PEER_UDP_TOO_LARGE            = "{ERR_XCHG_PEER_UDP_TOO_LARGE}"
+	ERR_XCHG_PEER_UDP_WRONG_COOKIE         = "{ERR_XCHG_PEER_UDP_WRONG_COOKIE}"
+	ERR_XCHG_PEER_TCP_CLOSED               = "{ERR_XCHG_PEER_TCP_CLOSED}"
+	ERR_XCHG_PEER_TCP_TIMEOUT              = "{ERR_XCHG_PEER_TCP_TIMEOUT}"
+	ERR_XCHG_PEER_TCP_WRONG_FUNCTION       = "{ERR_XCHG_PEER_TCP_WRONG_FUNCTION}"
+	ERR_XCHG_PEER_WRONG_LOCAL_ROUTER       = "{ERR_XCHG_PEER_WRONG_LOCAL_ROUTER}"
+	ERR_XCHG_PEER_CONFIG_WRONG_VALUE       = "{ERR_XCHG_PEER_CONFIG_WRONG_VALUE}"
+	ERR_XCHG_PEER_CONFIG_WRONG_FORMAT      = "{ERR_XCHG_PEER_CONFIG_WRONG_FORMAT}"
+	ERR_XCHG_NETWORK_NO_PUBLIC_KEY         = "{ERR_XCHG_NETWORK_NO_PUBLIC_KEY}"
+	ERR_XCHG_NETWORK_NOT_FOUND             = "{ERR_XCHG_NETWORK_NOT_FOUND}"
+	ERR_XCHG_NETWORK_WRONG_SIGNATURE       = "{ERR_XCHG_NETWORK_WRONG_SIGNATURE}"
+	ERR_XCHG_NETWORK_NOT_ENOUGH_SIGNATURES = "{ERR_XCHG_NETWORK_NOT_ENOUGH_SIGNATURES}"
+	ERR_XCHG_NETWORK_ALREADY_SIGNED        = "{ERR_XCHG_NETWORK_ALREADY_SIGNED}"
+	ERR_XCHG_NETWORK_NOT_YET_VALID         = "{ERR_XCHG_NETWORK_NOT_YET_VALID}"
+	ERR_XCHG_NETWORK_EXPIRED               = "{ERR_XCHG_NETWORK_EXPIRED}"
+	ERR_XCHG_NETWORK_ROLLBACK              = "{ERR_XCHG_NETWORK_ROLLBACK}"
+	ERR_XCHG_NETWORK_WRONG_THRESHOLD       = "{ERR_XCHG_NETWORK_WRONG_THRESHOLD}"
+	ERR_XCHG_NETWORK_STATE_KEYS_MISMATCH   = "{ERR_XCHG_NETWORK_STATE_KEYS_MISMATCH}"
+
+	ERR_XCHG_DIRECT_NOT_AVAILABLE = "{ERR_XCHG_DIRECT_NOT_AVAILABLE}"
+	ERR_XCHG_DIRECT_NO_PATH       = "{ERR_XCHG_DIRECT_NO_PATH}"
+	ERR_XCHG_DIRECT_LIMIT         = "{ERR_XCHG_DIRECT_LIMIT}"
 
 	// Server Connection
 	ERR_XCHG_SRV_CONN_WRONG_SESSION       = "{ERR_XCHG_SRV_CONN_WRONG_SESSION}"
@@ -74,9 +108,27 @@ const (
 	ERR_XCHG_ROUTER_SERVER_IS_NOT_STARTED       = "{ERR_XCHG_ROUTER_SERVER_IS_NOT_STARTED}"
 	ERR_XCHG_ROUTER_ALREADY_STARTED             = "{ERR_XCHG_ROUTER_ALREADY_STARTED}"
 	ERR_XCHG_ROUTER_IS_NOT_STARTED              = "{ERR_XCHG_ROUTER_IS_NOT_STARTED}"
+	ERR_XCHG_ROUTER_READ_NOT_AUTHORIZED         = "{ERR_XCHG_ROUTER_READ_NOT_AUTHORIZED}"
+	ERR_XCHG_ROUTER_SIGNED_BLOCK_SIZE           = "{ERR_XCHG_ROUTER_SIGNED_BLOCK_SIZE}"
+	ERR_XCHG_ROUTER_WRONG_POW                   = "{ERR_XCHG_ROUTER_WRONG_POW}"
+	ERR_XCHG_ROUTER_WRONG_ADDRESS_DATA          = "{ERR_XCHG_ROUTER_WRONG_ADDRESS_DATA}"
+	ERR_XCHG_ROUTER_NO_ADDRESS_DATA             = "{ERR_XCHG_ROUTER_NO_ADDRESS_DATA}"
+	ERR_XCHG_ROUTER_UNKNOWN_ADDRESS             = "{ERR_XCHG_ROUTER_UNKNOWN_ADDRESS}"
 
 	// Other
 	ERR_XCHG_NOT_IMPLEMENTED = "{ERR_XCHG_NOT_IMPLEMENTED}"
+
+	// Streams
+	ERR_XCHG_STREAM_NOT_IMPL    = "{ERR_XCHG_STREAM_NOT_IMPL}"
+	ERR_XCHG_STREAM_UNKNOWN     = "{ERR_XCHG_STREAM_UNKNOWN}"
+	ERR_XCHG_STREAM_CLOSED      = "{ERR_XCHG_STREAM_CLOSED}"
+	ERR_XCHG_STREAM_WRONG_FRAME = "{ERR_XCHG_STREAM_WRONG_FRAME}"
+	ERR_XCHG_STREAM_LIMIT       = "{ERR_XCHG_STREAM_LIMIT}"
+	ERR_XCHG_STREAM_TIMEOUT     = "{ERR_XCHG_STREAM_TIMEOUT}"
+
+	// Notifications
+	ERR_XCHG_NOTIFY_WRONG_TOPIC_LEN = "{ERR_XCHG_NOTIFY_WRONG_TOPIC_LEN}"
+	ERR_XCHG_NOTIFY_TOO_LARGE       = "{ERR_XCHG_NOTIFY_TOO_LARGE}"
 )
 
 // Reason to make session
@@ -102,3 +154,11 @@ func NeedToChangeNode(err error) bool {
 	}
 	return false
 }
+
+// Error of the stream layer - no reason to repeat the call
+func isStreamError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return strings.Contains(err.Error(), "{ERR_XCHG_STREAM_")
+}
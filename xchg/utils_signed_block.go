@@ -0,0 +1,65 @@
+package xchg
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/ipoluianov/xchg/router"
+)
+
+// Signed block for a router (see router.CheckSignedBlock):
+// [nonce 0:16] [salt 16:24] [sign 24:280] [pkLen 280:284] [pk 284:284+pkLen] [data 284+pkLen:]
+func makeSignedBlock(privateKey *rsa.PrivateKey, nonce []byte, data []byte) (block []byte, err error) {
+	if privateKey == nil {
+		err = errors.New(ERR_XCHG_CL_CONN_CALL_NO_LOCAL_PRIVATE_KEY)
+		return
+	}
+	if len(nonce) != 16 {
+		err = errors.New(ERR_XCHG_CL_CONN_AUTH_WRONG_NONCE_LEN)
+		return
+	}
+
+	publicKeyBS := RSAPublicKeyToDer(&privateKey.PublicKey)
+	block = make([]byte, router.SignedBlockHeaderSize+len(publicKeyBS)+len(data))
+	copy(block[0:], nonce)
+
+	// PoW
+	complexity := nonce[4]
+	var salt uint64
+	rand.Read(block[16:24])
+	salt = binary.LittleEndian.Uint64(block[16:24])
+	for {
+		binary.LittleEndian.PutUint64(block[16:], salt)
+		powHash := sha256.Sum256(block[0:24])
+		if router.CheckHash(powHash[:], complexity) {
+			break
+		}
+		salt++
+	}
+
+	signedContent := make([]byte, 24+len(data))
+	copy(signedContent[0:], block[0:24])
+	copy(signedContent[24:], data)
+	hash := sha256.Sum256(signedContent)
+	var signature []byte
+	signature, err = rsa.SignPSS(rand.Reader, privateKey, crypto.SHA256, hash[:], &rsa.PSSOptions{
+		SaltLength: 32,
+	})
+	if err != nil {
+		return
+	}
+	if len(signature) != router.SignedBlockSignatureSize {
+		err = errors.New("wrong signature size")
+		return
+	}
+
+	copy(block[24:], signature)
+	binary.LittleEndian.PutUint32(block[280:], uint32(len(publicKeyBS)))
+	copy(block[284:], publicKeyBS)
+	copy(block[284+len(publicKeyBS):], data)
+	return
+}
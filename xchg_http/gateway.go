@@ -0,0 +1,185 @@
+package xchg_http
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipoluianov/xchg/xchg"
+)
+
+type GatewayConfig struct {
+	Listen string `json:"listen"`
+
+	// Target addresses allowed for calls, empty - any address
+	AllowedAddresses []string `json:"allowed_addresses"`
+
+	// Auth data injected for the address (overrides the auth data of the request)
+	AuthData map[string]string `json:"auth_data"`
+
+	// Bearer token required from clients of the gateway, empty - no token
+	AccessToken string `json:"access_token"`
+
+	// Default timeout of a call and the limit of the "timeout" parameter
+	TimeoutMs    int   `json:"timeout_ms"`
+	MaxTimeoutMs int   `json:"max_timeout_ms"`
+	MaxBodySize  int64 `json:"max_body_size"`
+}
+
+func DefaultGatewayConfig() GatewayConfig {
+	var c GatewayConfig
+	c.Listen = ":8080"
+	c.AuthData = make(map[string]string)
+	c.TimeoutMs = 5000
+	c.MaxTimeoutMs = 60000
+	c.MaxBodySize = 16 * 1024 * 1024
+	return c
+}
+
+func LoadGatewayConfig(fileName string) (config GatewayConfig, err error) {
+	config = DefaultGatewayConfig()
+	bs, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(bs, &config)
+	return
+}
+
+// REST to xchg gateway (http.Handler)
+//
+//	POST /call/{address}/{function}
+//	body - the parameter, response - the result of the call
+//	auth data - header X-Xchg-Auth or query parameter "auth", timeout - query parameter "timeout" (ms, up to max_timeout_ms)
+//
+// Errors: the status code is mapped from the error code, the code is in the header X-Xchg-Error
+type Gateway struct {
+	peer   *xchg.Peer
+	config GatewayConfig
+}
+
+func NewGateway(peer *xchg.Peer, config GatewayConfig) *Gateway {
+	var c Gateway
+	c.peer = peer
+	c.config = config
+	return &c
+}
+
+func (c *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.config.AccessToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+c.config.AccessToken)) != 1 {
+		c.writeError(w, http.StatusUnauthorized, errors.New(xchg.ERR_XCHG_ACCESS_DENIED))
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/call/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/call/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		c.writeError(w, http.StatusBadRequest, errors.New(ERR_XCHG_HTTP_WRONG_REQUEST))
+		return
+	}
+	address := "#" + strings.TrimPrefix(strings.ToLower(parts[0]), "#")
+	function := parts[1]
+
+	if len(c.config.AllowedAddresses) > 0 && !containsAddress(c.config.AllowedAddresses, address) {
+		c.writeError(w, http.StatusForbidden, errors.New(xchg.ERR_XCHG_ACCESS_DENIED))
+		return
+	}
+
+	authData := r.Header.Get("X-Xchg-Auth")
+	if authData == "" {
+		authData = r.URL.Query().Get("auth")
+	}
+	if injectedAuthData, ok := c.config.AuthData[address]; ok {
+		authData = injectedAuthData
+	}
+
+	timeout := time.Duration(c.config.TimeoutMs) * time.Millisecond
+	if timeoutMs, err := strconv.Atoi(r.URL.Query().Get("timeout")); err == nil && timeoutMs > 0 {
+		if timeoutMs > c.config.MaxTimeoutMs {
+			timeoutMs = c.config.MaxTimeoutMs
+		}
+		timeout = time.Duration(timeoutMs) * time.Millisecond
+	}
+
+	parameter, err := ioutil.ReadAll(io.LimitReader(r.Body, c.config.MaxBodySize+1))
+	if err != nil {
+		c.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if int64(len(parameter)) > c.config.MaxBodySize {
+		c.writeError(w, http.StatusRequestEntityTooLarge, errors.New(ERR_XCHG_HTTP_WRONG_REQUEST))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	result, err := c.peer.CallContext(ctx, address, authData, function, parameter)
+	if err != nil {
+		c.writeError(w, StatusCodeForError(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	w.Write(result)
+}
+
+func (c *Gateway) writeError(w http.ResponseWriter, statusCode int, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Xchg-Error", ErrorCode(err))
+	w.WriteHeader(statusCode)
+	w.Write([]byte(err.Error()))
+}
+
+var errorCodeRegexp = regexp.MustCompile(`\{(ERR_[A-Z0-9_]+)\}`)
+
+// The innermost (last) error code of the error: {ERR_XCHG_CL_CONN_CALL_ERR}:{ERR_XCHG_PEER_CONN_TR_TIMEOUT} - ERR_XCHG_PEER_CONN_TR_TIMEOUT
+func ErrorCode(err error) string {
+	codes := errorCodeRegexp.FindAllStringSubmatch(err.Error(), -1)
+	if len(codes) == 0 {
+		return ""
+	}
+	return codes[len(codes)-1][1]
+}
+
+func StatusCodeForError(err error) int {
+	errStr := err.Error()
+	switch {
+	case strings.Contains(errStr, xchg.ERR_XCHG_ACCESS_DENIED):
+		return http.StatusForbidden
+	case strings.Contains(errStr, xchg.ERR_XCHG_PEER_CONN_TR_TIMEOUT):
+		return http.StatusGatewayTimeout
+	case strings.Contains(errStr, xchg.ERR_XCHG_CL_CONN_CALL_NO_ROUTE_TO_PEER), strings.Contains(errStr, "{ERR_XCHG_ROUTER_"):
+		return http.StatusBadGateway
+	case strings.Contains(errStr, xchg.ERR_XCHG_CL_CONN_CALL_FROM_PEER):
+		// Error of the function
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+func containsAddress(addresses []string, address string) bool {
+	for _, a := range addresses {
+		if "#"+strings.TrimPrefix(strings.ToLower(a), "#") == address {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package xchg_http
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+)
+
+// Response of a call - the whole body in memory
+type bufferedResponseWriter struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func newBufferedResponseWriter() *bufferedResponseWriter {
+	var c bufferedResponseWriter
+	c.header = make(http.Header)
+	return &c
+}
+
+func (c *bufferedResponseWriter) Header() http.Header {
+	return c.header
+}
+
+func (c *bufferedResponseWriter) WriteHeader(statusCode int) {
+	if c.statusCode == 0 {
+		c.statusCode = statusCode
+	}
+}
+
+func (c *bufferedResponseWriter) Write(data []byte) (int, error) {
+	c.WriteHeader(http.StatusOK)
+	return c.body.Write(data)
+}
+
+func (c *bufferedResponseWriter) response(req *http.Request) *http.Response {
+	c.WriteHeader(http.StatusOK)
+	var resp http.Response
+	resp.ProtoMajor = 1
+	resp.ProtoMinor = 1
+	resp.StatusCode = c.statusCode
+	resp.Header = c.header
+	resp.ContentLength = int64(c.body.Len())
+	resp.Body = io.NopCloser(bytes.NewReader(c.body.Bytes()))
+	resp.Request = req
+	return &resp
+}
+
+// Response of a stream - the header is sent on the first write, the body is chunked
+type streamResponseWriter struct {
+	output        io.Writer
+	writer        *bufio.Writer
+	req           *http.Request
+	header        http.Header
+	headerSent    bool
+	chunked       bool
+	chunkedWriter io.WriteCloser
+	err           error
+}
+
+func newStreamResponseWriter(output io.Writer, req *http.Request) *streamResponseWriter {
+	var c streamResponseWriter
+	c.output = output
+	c.writer = bufio.NewWriter(output)
+	c.req = req
+	c.header = make(http.Header)
+	return &c
+}
+
+func (c *streamResponseWriter) Header() http.Header {
+	return c.header
+}
+
+func (c *streamResponseWriter) WriteHeader(statusCode int) {
+	if c.headerSent {
+		return
+	}
+	c.headerSent = true
+
+	_, hasContentLength := c.header["Content-Length"]
+	c.chunked = !hasContentLength && c.req.Method != http.MethodHead && statusCode != http.StatusNoContent && statusCode != http.StatusNotModified
+	if c.chunked {
+		c.header.Set("Transfer-Encoding", "chunked")
+	}
+
+	fmt.Fprintf(c.writer, "HTTP/1.1 %s %s\r\n", strconv.Itoa(statusCode), http.StatusText(statusCode))
+	c.header.Write(c.writer)
+	c.writer.WriteString("\r\n")
+	if c.chunked {
+		c.chunkedWriter = httputil.NewChunkedWriter(c.writer)
+	}
+}
+
+func (c *streamResponseWriter) Write(data []byte) (n int, err error) {
+	c.WriteHeader(http.StatusOK)
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.chunked {
+		n, err = c.chunkedWriter.Write(data)
+	} else {
+		n, err = c.writer.Write(data)
+	}
+	if err != nil {
+		c.err = err
+	}
+	return
+}
+
+// Sends buffered data to the client (http.Flusher)
+func (c *streamResponseWriter) Flush() {
+	c.WriteHeader(http.StatusOK)
+	if c.err == nil {
+		c.err = c.writer.Flush()
+	}
+}
+
+func (c *streamResponseWriter) finish() (err error) {
+	c.WriteHeader(http.StatusOK)
+	if c.err != nil {
+		return c.err
+	}
+	if c.chunked {
+		c.chunkedWriter.Close()
+		c.writer.WriteString("\r\n")
+	}
+	return c.writer.Flush()
+}
@@ -0,0 +1,149 @@
+package xchg_http
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ipoluianov/xchg/xchg"
+)
+
+const (
+	// Requests with larger (or unknown) bodies are sent as streams
+	maxCallRequestBodySize = 1024 * 1024
+	streamWriteBufferSize  = 256 * 1024
+)
+
+// http.RoundTripper for URLs xchg://#address/path or xchg://address/path
+//
+//	http.DefaultTransport.(*http.Transport).RegisterProtocol("xchg", xchg_http.NewRoundTripper(peer, "pass"))
+//	http.Get("xchg://#address/path")
+type RoundTripper struct {
+	peer     *xchg.Peer
+	authData string
+
+	// Responses are received as streams (not buffered) - for downloads and long responses
+	Streaming bool
+}
+
+func NewRoundTripper(peer *xchg.Peer, authData string) *RoundTripper {
+	var c RoundTripper
+	c.peer = peer
+	c.authData = authData
+	return &c
+}
+
+// Registers the scheme "xchg" in http.DefaultTransport
+func Register(peer *xchg.Peer, authData string) {
+	http.DefaultTransport.(*http.Transport).RegisterProtocol("xchg", NewRoundTripper(peer, authData))
+}
+
+// Returns the xchg address and the URL of the request for the server
+func ParseURL(u *url.URL) (address string, requestURL *url.URL, err error) {
+	requestURL = &url.URL{Scheme: "http", Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}
+	if u.Host != "" {
+		address = "#" + strings.TrimPrefix(strings.ToLower(u.Host), "#")
+	} else if u.Fragment != "" {
+		// xchg://#address/path - the address and the path are in the fragment
+		fragment := u.Fragment
+		path := "/"
+		if i := strings.Index(fragment, "/"); i >= 0 {
+			path = fragment[i:]
+			fragment = fragment[:i]
+		}
+		var pathURL *url.URL
+		pathURL, err = url.Parse(path)
+		if err != nil {
+			return
+		}
+		address = "#" + strings.ToLower(fragment)
+		requestURL.Path = pathURL.Path
+		requestURL.RawPath = pathURL.RawPath
+		requestURL.RawQuery = pathURL.RawQuery
+	}
+	if len(address) < 2 {
+		err = errors.New(ERR_XCHG_HTTP_WRONG_ADDRESS)
+		return
+	}
+	if requestURL.Path == "" {
+		requestURL.Path = "/"
+	}
+	requestURL.Host = strings.TrimPrefix(address, "#")
+	return
+}
+
+func (c *RoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	address, requestURL, err := ParseURL(req.URL)
+	if err != nil {
+		return
+	}
+
+	outReq := req.Clone(req.Context())
+	outReq.URL = requestURL
+	outReq.Host = requestURL.Host
+	outReq.RequestURI = ""
+
+	if c.Streaming || req.ContentLength > maxCallRequestBodySize || (req.Body != nil && req.Body != http.NoBody && req.ContentLength <= 0) {
+		return c.roundTripStream(address, req, outReq)
+	}
+	return c.roundTripCall(address, req, outReq)
+}
+
+func (c *RoundTripper) roundTripCall(address string, req *http.Request, outReq *http.Request) (resp *http.Response, err error) {
+	var buffer bytes.Buffer
+	err = outReq.Write(&buffer)
+	if err != nil {
+		return
+	}
+
+	result, err := c.peer.CallContext(req.Context(), address, c.authData, FunctionHttp, buffer.Bytes())
+	if err != nil {
+		return
+	}
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(result)), req)
+}
+
+func (c *RoundTripper) roundTripStream(address string, req *http.Request, outReq *http.Request) (resp *http.Response, err error) {
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		// Large blocks - every write to the pipe is a call
+		writer := bufio.NewWriterSize(pipeWriter, streamWriteBufferSize)
+		err := outReq.Write(writer)
+		if err == nil {
+			err = writer.Flush()
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+
+	stream, err := c.peer.CallStream(req.Context(), address, c.authData, FunctionHttp, nil, pipeReader)
+	if err != nil {
+		pipeReader.Close()
+		return
+	}
+
+	resp, err = http.ReadResponse(bufio.NewReader(stream), req)
+	if err != nil {
+		stream.Close()
+		pipeReader.Close()
+		return
+	}
+	resp.Body = &streamBody{ReadCloser: resp.Body, stream: stream, input: pipeReader}
+	return
+}
+
+// Closes the stream with the body of the response
+type streamBody struct {
+	io.ReadCloser
+	stream io.Closer
+	input  io.Closer
+}
+
+func (c *streamBody) Close() error {
+	c.ReadCloser.Close()
+	c.input.Close()
+	return c.stream.Close()
+}
@@ -0,0 +1,99 @@
+package xchg_http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/ipoluianov/xchg/xchg"
+)
+
+const (
+	// Function of a call or a stream with a serialized HTTP request
+	FunctionHttp = "http"
+
+	ERR_XCHG_HTTP_WRONG_REQUEST = "{ERR_XCHG_HTTP_WRONG_REQUEST}"
+	ERR_XCHG_HTTP_WRONG_ADDRESS = "{ERR_XCHG_HTTP_WRONG_ADDRESS}"
+)
+
+// Processor of a server peer that serves HTTP requests by the handler
+// Requests are received as calls (buffered) or streams (chunked response)
+type Server struct {
+	handler   http.Handler
+	accessKey string
+}
+
+// accessKey - the auth data of clients, empty - any client
+func NewServer(handler http.Handler, accessKey string) *Server {
+	var c Server
+	c.handler = handler
+	c.accessKey = accessKey
+	return &c
+}
+
+// Server that proxies requests to the upstream URL (http://127.0.0.1:8080)
+func NewUpstreamServer(upstreamURL string, accessKey string) (server *Server, err error) {
+	u, err := url.Parse(upstreamURL)
+	if err != nil {
+		return
+	}
+	server = NewServer(httputil.NewSingleHostReverseProxy(u), accessKey)
+	return
+}
+
+func (c *Server) ServerProcessorAuth(authData []byte) (err error) {
+	if c.accessKey == "" || string(authData) == c.accessKey {
+		return nil
+	}
+	return errors.New(xchg.ERR_XCHG_ACCESS_DENIED)
+}
+
+func (c *Server) ServerProcessorCall(authData []byte, function string, parameter []byte) (response []byte, err error) {
+	return c.ServerProcessorCallContext(context.Background(), authData, function, parameter)
+}
+
+func (c *Server) ServerProcessorCallContext(ctx context.Context, authData []byte, function string, parameter []byte) (response []byte, err error) {
+	if function != FunctionHttp {
+		err = errors.New(xchg.ERR_XCHG_NOT_IMPLEMENTED)
+		return
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(parameter)))
+	if err != nil {
+		err = errors.New(ERR_XCHG_HTTP_WRONG_REQUEST + ":" + err.Error())
+		return
+	}
+	req = req.WithContext(ctx)
+
+	w := newBufferedResponseWriter()
+	c.handler.ServeHTTP(w, req)
+
+	var buffer bytes.Buffer
+	err = w.response(req).Write(&buffer)
+	response = buffer.Bytes()
+	return
+}
+
+func (c *Server) ServerProcessorStream(ctx context.Context, authData []byte, function string, parameter []byte, input io.Reader, output io.Writer) (err error) {
+	if function != FunctionHttp {
+		err = errors.New(xchg.ERR_XCHG_NOT_IMPLEMENTED)
+		return
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(input))
+	if err != nil {
+		err = errors.New(ERR_XCHG_HTTP_WRONG_REQUEST + ":" + err.Error())
+		return
+	}
+	req = req.WithContext(ctx)
+
+	w := newStreamResponseWriter(output, req)
+	c.handler.ServeHTTP(w, req)
+	err = w.finish()
+	return
+}
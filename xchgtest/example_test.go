@@ -0,0 +1,92 @@
+package xchgtest_test
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/ipoluianov/xchg/xchg"
+	"github.com/ipoluianov/xchg/xchgtest"
+)
+
+type echoProcessor struct{}
+
+func (c *echoProcessor) ServerProcessorAuth(authData []byte) (err error) {
+	return nil
+}
+
+func (c *echoProcessor) ServerProcessorCall(authData []byte, function string, parameter []byte) (response []byte, err error) {
+	return parameter, nil
+}
+
+// The server and the client of the network, the server echoes the parameter
+func startPeers(network *xchgtest.Network) (client *xchg.Peer, server *xchg.Peer, serverAddress string) {
+	serverKey, _ := xchg.GenerateRSAKey()
+	server, err := network.NewPeer(serverKey)
+	if err != nil {
+		panic(err)
+	}
+	server.SetProcessor(&echoProcessor{})
+	server.Start(false)
+	client, err = network.NewPeer(nil)
+	if err != nil {
+		panic(err)
+	}
+	client.Start(false)
+	serverAddress = xchg.AddressForPublicKey(&serverKey.PublicKey)
+	return
+}
+
+func ExampleNetwork() {
+	network := xchgtest.NewNetwork(1, 1)
+	defer network.Stop()
+	client, _, serverAddress := startPeers(network)
+
+	result, err := client.Call(serverAddress, "", "echo", []byte("hello"), 10*time.Second)
+	fmt.Println(string(result), err)
+	// Output: hello <nil>
+}
+
+// Lost frames of the call and of the response are recovered by NACK frames
+func ExampleNetwork_SetLoss() {
+	network := xchgtest.NewNetwork(1, 1)
+	defer network.Stop()
+	client, _, serverAddress := startPeers(network)
+	network.SetLoss(0.1)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	result, err := client.Call(serverAddress, "", "echo", data, 30*time.Second)
+	fmt.Println(bytes.Equal(result, data), err)
+	// Output: true <nil>
+}
+
+func ExampleNetwork_Partition() {
+	network := xchgtest.NewNetwork(1, 1)
+	defer network.Stop()
+	client, server, serverAddress := startPeers(network)
+	client.Call(serverAddress, "", "echo", nil, 10*time.Second)
+
+	network.Partition(server.LocalAddress())
+	_, err := client.Call(serverAddress, "", "echo", nil, time.Second)
+	fmt.Println("partitioned:", err != nil)
+
+	network.Heal(server.LocalAddress())
+	_, err = client.Call(serverAddress, "", "echo", nil, 10*time.Second)
+	fmt.Println("healed:", err)
+	// Output:
+	// partitioned: true
+	// healed: <nil>
+}
+
+// Every address is served by all routers of the network
+func ExampleNetwork_StopRouter() {
+	network := xchgtest.NewNetwork(2, 1)
+	defer network.Stop()
+	client, _, serverAddress := startPeers(network)
+	client.Call(serverAddress, "", "echo", nil, 10*time.Second)
+
+	network.StopRouter(network.Routers()[0])
+	result, err := client.Call(serverAddress, "", "echo", []byte("failover"), 10*time.Second)
+	fmt.Println(string(result), err)
+	// Output: failover <nil>
+}
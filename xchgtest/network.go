@@ -0,0 +1,270 @@
+// Package xchgtest is a simulated xchg network in one process:
+// virtual routers, peers connected to them by the in-memory transport,
+// configurable latency, loss, reordering and partitions.
+//
+//	network := xchgtest.NewNetwork(2, 1)
+//	defer network.Stop()
+//	server, err := network.NewPeer(serverKey)
+//	server.SetProcessor(processor)
+//	server.Start(false)
+//	client, err := network.NewPeer(nil)
+//	client.Start(false)
+//	result, err := client.Call(xchg.AddressForPublicKey(&serverKey.PublicKey), "", "function", nil, time.Second)
+package xchgtest
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ipoluianov/xchg/router"
+	"github.com/ipoluianov/xchg/xchg"
+)
+
+type Network struct {
+	mtx      sync.Mutex
+	seed     int64
+	links    int
+	routers  map[string]*virtualRouter
+	hosts    []string
+	network  *xchg.Network
+	peers    []*xchg.Peer
+	latency  time.Duration
+	jitter   time.Duration
+	loss     float64
+	reorder  float64
+	filter   func(frame []byte) bool
+	blocked  map[string]map[string]struct{}
+	isolated map[string]struct{}
+}
+
+type virtualRouter struct {
+	router  *router.Router
+	running bool
+	putCh   chan struct{}
+}
+
+// Hosts of the routers: router-1:8084, router-2:8084 ...
+//
+// The simulation is only partly deterministic. The fate of frames (loss, reordering, jitter)
+// is seeded per link - the transport (in the order of NewTransport) and the router:
+// the fate of the n-th frame written by a transport to a router is repeatable.
+// The order of the frames of concurrent calls of one peer depends on the scheduling of the goroutines;
+// keys, nonces, session ids and the timing of the peers are not seeded.
+func NewNetwork(routersCount int, seed int64) *Network {
+	var c Network
+	c.seed = seed
+	c.routers = make(map[string]*virtualRouter)
+	c.hosts = make([]string, 0, routersCount)
+	c.blocked = make(map[string]map[string]struct{})
+	c.isolated = make(map[string]struct{})
+	c.network = xchg.NewNetwork()
+
+	for i := 1; i <= routersCount; i++ {
+		host := fmt.Sprintf("router-%d:8084", i)
+		vRouter := &virtualRouter{}
+		vRouter.router = router.NewRouter()
+		vRouter.router.Start()
+		vRouter.running = true
+		vRouter.putCh = make(chan struct{})
+		vRouter.router.AddPutHandler(func(address string, id uint64, frame []byte) {
+			c.mtx.Lock()
+			close(vRouter.putCh)
+			vRouter.putCh = make(chan struct{})
+			c.mtx.Unlock()
+		})
+		c.routers[host] = vRouter
+		c.hosts = append(c.hosts, host)
+		for r := 0; r < 16; r++ {
+			c.network.AddHostToRange(fmt.Sprintf("%X", r), host)
+		}
+	}
+	return &c
+}
+
+// The network of the routers (every address is served by all routers)
+func (c *Network) XchgNetwork() *xchg.Network {
+	return c.network
+}
+
+func (c *Network) Routers() []string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return append([]string{}, c.hosts...)
+}
+
+// Creates the peer connected to the routers of the network (not started).
+// The peer has no embedded routers and no local nodes.
+// privateKey - nil for a new key.
+func (c *Network) NewPeer(privateKey *rsa.PrivateKey) (peer *xchg.Peer, err error) {
+	config := xchg.DefaultPeerConfig()
+	config.LocalRouters = nil
+	config.LocalNodes = nil
+	peer, err = xchg.NewPeerWithConfig(privateKey, xchg.NewDefaultLogger(), config)
+	if err != nil {
+		return
+	}
+	peer.SetNetwork(c.network)
+	peer.SetTransports(NewTransport(c))
+	c.mtx.Lock()
+	c.peers = append(c.peers, peer)
+	c.mtx.Unlock()
+	return
+}
+
+// One-way delay of requests and responses: latency + random [0, jitter)
+func (c *Network) SetLatency(latency time.Duration, jitter time.Duration) {
+	c.mtx.Lock()
+	c.latency = latency
+	c.jitter = jitter
+	c.mtx.Unlock()
+}
+
+// Probability [0, 1] of the loss of a written frame
+func (c *Network) SetLoss(probability float64) {
+	c.mtx.Lock()
+	c.loss = probability
+	c.mtx.Unlock()
+}
+
+// Probability [0, 1] of the delayed store of a written frame (the next frames overtake it)
+func (c *Network) SetReordering(probability float64) {
+	c.mtx.Lock()
+	c.reorder = probability
+	c.mtx.Unlock()
+}
+
+// Every written frame is passed to the filter, the frames it returns true for are lost.
+// nil - no filter.
+func (c *Network) SetFilter(filter func(frame []byte) bool) {
+	c.mtx.Lock()
+	c.filter = filter
+	c.mtx.Unlock()
+}
+
+// The peer can not reach the routers (all routers if no hosts)
+func (c *Network) Partition(peerAddress string, routerHosts ...string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(routerHosts) == 0 {
+		c.isolated[peerAddress] = struct{}{}
+		return
+	}
+	blocked, ok := c.blocked[peerAddress]
+	if !ok {
+		blocked = make(map[string]struct{})
+		c.blocked[peerAddress] = blocked
+	}
+	for _, routerHost := range routerHosts {
+		blocked[routerHost] = struct{}{}
+	}
+}
+
+// Removes the partitions of the peer
+func (c *Network) Heal(peerAddress string) {
+	c.mtx.Lock()
+	delete(c.isolated, peerAddress)
+	delete(c.blocked, peerAddress)
+	c.mtx.Unlock()
+}
+
+// The router does not answer, the stored frames are kept
+func (c *Network) StopRouter(routerHost string) {
+	c.setRouterRunning(routerHost, false)
+}
+
+func (c *Network) StartRouter(routerHost string) {
+	c.setRouterRunning(routerHost, true)
+}
+
+func (c *Network) setRouterRunning(routerHost string, running bool) {
+	c.mtx.Lock()
+	if vRouter, ok := c.routers[routerHost]; ok {
+		vRouter.running = running
+	}
+	c.mtx.Unlock()
+}
+
+// Stops the peers and the routers
+func (c *Network) Stop() {
+	c.mtx.Lock()
+	peers := c.peers
+	c.peers = nil
+	routers := make([]*virtualRouter, 0, len(c.routers))
+	for _, vRouter := range c.routers {
+		routers = append(routers, vRouter)
+	}
+	c.mtx.Unlock()
+	for _, peer := range peers {
+		peer.Stop()
+	}
+	for _, vRouter := range routers {
+		vRouter.router.Stop()
+	}
+}
+
+func (c *Network) reachable(peerAddress string, routerHost string) (vRouter *virtualRouter, ok bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	vRouter, ok = c.routers[routerHost]
+	if !ok || !vRouter.running {
+		ok = false
+		return
+	}
+	if _, isolated := c.isolated[peerAddress]; isolated {
+		ok = false
+		return
+	}
+	if _, blocked := c.blocked[peerAddress][routerHost]; blocked {
+		ok = false
+	}
+	return
+}
+
+// The random source of the link of the transport (index) and the router
+func (c *Network) linkRand(index int, routerHost string) *rand.Rand {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d/%s", index, routerHost)
+	return rand.New(rand.NewSource(c.seed ^ int64(h.Sum64())))
+}
+
+func (c *Network) nextLink() (index int) {
+	c.mtx.Lock()
+	index = c.links
+	c.links++
+	c.mtx.Unlock()
+	return
+}
+
+// rnd - the random source of the link, used under the lock of the transport
+func (c *Network) delay(rnd *rand.Rand) time.Duration {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delay := c.latency
+	if c.jitter > 0 {
+		delay += time.Duration(rnd.Int63n(int64(c.jitter)))
+	}
+	return delay
+}
+
+// lost, delayed - the fate of a written frame
+func (c *Network) frameFate(rnd *rand.Rand, frame []byte) (lost bool, delayed bool) {
+	c.mtx.Lock()
+	lost = rnd.Float64() < c.loss
+	delayed = rnd.Float64() < c.reorder
+	filter := c.filter
+	c.mtx.Unlock()
+	if filter != nil && filter(frame) {
+		lost = true
+	}
+	return
+}
+
+func (c *Network) putCh(vRouter *virtualRouter) chan struct{} {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return vRouter.putCh
+}
@@ -0,0 +1,41 @@
+package xchgtest
+
+import "testing"
+
+// The fate of the n-th frame of a link depends on the seed only
+func TestLinkFateRepeatable(t *testing.T) {
+	fates := func(seed int64, otherFrames int) (result []bool) {
+		network := NewNetwork(2, seed)
+		defer network.Stop()
+		network.SetLoss(0.5)
+		first := NewTransport(network)
+		second := NewTransport(network)
+		for i := 0; i < 100; i++ {
+			// The frames of other links do not change the fate
+			for j := 0; j < otherFrames; j++ {
+				second.frameFate("router-1:8084", nil)
+			}
+			lost, _ := first.frameFate("router-1:8084", nil)
+			result = append(result, lost)
+			lost, _ = first.frameFate("router-2:8084", nil)
+			result = append(result, lost)
+		}
+		return
+	}
+
+	a := fates(1, 0)
+	b := fates(1, 3)
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatal("fate differs at", i)
+		}
+	}
+	c := fates(2, 0)
+	same := true
+	for i := range a {
+		same = same && a[i] == c[i]
+	}
+	if same {
+		t.Fatal("the seed is not used")
+	}
+}
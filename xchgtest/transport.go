@@ -0,0 +1,179 @@
+package xchgtest
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipoluianov/xchg/router"
+	"github.com/ipoluianov/xchg/xchg"
+)
+
+const (
+	ERR_XCHGTEST_UNREACHABLE    = "{ERR_XCHGTEST_UNREACHABLE}"
+	ERR_XCHGTEST_WRONG_FUNCTION = "{ERR_XCHGTEST_WRONG_FUNCTION}"
+)
+
+const (
+	// Read waits for frames up to the period (long polling)
+	readTimeout = 1 * time.Second
+
+	// The delay of the frame overtaken by the next frames
+	reorderDelay = 50 * time.Millisecond
+)
+
+// In-memory transport of a peer to the virtual routers of the network
+type Transport struct {
+	mtx          sync.Mutex
+	network      *Network
+	index        int
+	localAddress string
+	states       map[string]*router.ConnectionState
+	rnds         map[string]*rand.Rand
+}
+
+func NewTransport(network *Network) *Transport {
+	var c Transport
+	c.network = network
+	c.index = network.nextLink()
+	c.states = make(map[string]*router.ConnectionState)
+	c.rnds = make(map[string]*rand.Rand)
+	return &c
+}
+
+func (c *Transport) Id() string {
+	return "memory"
+}
+
+func (c *Transport) Start(peerProcessor xchg.PeerProcessor, localAddressBS []byte) error {
+	c.mtx.Lock()
+	c.localAddress = "#" + strings.ToLower(base32.StdEncoding.EncodeToString(localAddressBS))
+	c.mtx.Unlock()
+	return nil
+}
+
+func (c *Transport) Stop() error {
+	return nil
+}
+
+func (c *Transport) Supports(routerHost string) bool {
+	c.network.mtx.Lock()
+	defer c.network.mtx.Unlock()
+	_, ok := c.network.routers[routerHost]
+	return ok
+}
+
+func (c *Transport) Call(routerHost string, function string, frame []byte) (result []byte, err error) {
+	c.mtx.Lock()
+	localAddress := c.localAddress
+	state, ok := c.states[routerHost]
+	if !ok {
+		state = router.NewConnectionState()
+		c.states[routerHost] = state
+	}
+	c.mtx.Unlock()
+
+	time.Sleep(c.delay(routerHost))
+	vRouter, ok := c.network.reachable(localAddress, routerHost)
+	if !ok {
+		err = errors.New(ERR_XCHGTEST_UNREACHABLE)
+		return
+	}
+
+	switch function {
+	case "n":
+		result = vRouter.router.GetNonce()
+	case "c":
+		result = vRouter.router.ProcessFrame(frame)
+	case "w":
+		c.write(vRouter, routerHost, frame)
+	case "r":
+		result, err = c.read(vRouter, state, frame)
+	default:
+		err = errors.New(ERR_XCHGTEST_WRONG_FUNCTION)
+		return
+	}
+
+	time.Sleep(c.delay(routerHost))
+	if _, ok = c.network.reachable(localAddress, routerHost); !ok {
+		result = nil
+		err = errors.New(ERR_XCHGTEST_UNREACHABLE)
+	}
+	return
+}
+
+// Stores the frames [len 4][frame]... - some frames may be lost or delayed
+func (c *Transport) write(vRouter *virtualRouter, routerHost string, data []byte) {
+	offset := 0
+	for offset+xchg.TransactionHeaderSize <= len(data) {
+		frameLen := int(binary.LittleEndian.Uint32(data[offset:]))
+		if frameLen < xchg.TransactionHeaderSize || offset+frameLen > len(data) {
+			break
+		}
+		frame := make([]byte, frameLen)
+		copy(frame, data[offset:offset+frameLen])
+		offset += frameLen
+
+		lost, delayed := c.frameFate(routerHost, frame)
+		if lost {
+			continue
+		}
+		if delayed {
+			go func() {
+				time.Sleep(reorderDelay)
+				vRouter.router.Put(frame)
+			}()
+			continue
+		}
+		vRouter.router.Put(frame)
+	}
+}
+
+// Waits for frames of the address up to readTimeout
+func (c *Transport) read(vRouter *virtualRouter, state *router.ConnectionState, request []byte) (result []byte, err error) {
+	timer := time.NewTimer(readTimeout)
+	defer timer.Stop()
+	for {
+		putCh := c.network.putCh(vRouter)
+		var count int
+		result, count, err = vRouter.router.GetMessages(state, request)
+		if count > 0 || err != nil {
+			return
+		}
+		// The signed block is checked only once
+		if len(request) > 46 {
+			request = request[:46]
+		}
+		select {
+		case <-putCh:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// The random source of the link to the router, must be called under the lock
+func (c *Transport) rnd(routerHost string) *rand.Rand {
+	rnd, ok := c.rnds[routerHost]
+	if !ok {
+		rnd = c.network.linkRand(c.index, routerHost)
+		c.rnds[routerHost] = rnd
+	}
+	return rnd
+}
+
+func (c *Transport) delay(routerHost string) time.Duration {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.network.delay(c.rnd(routerHost))
+}
+
+func (c *Transport) frameFate(routerHost string, frame []byte) (lost bool, delayed bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.network.frameFate(c.rnd(routerHost), frame)
+}